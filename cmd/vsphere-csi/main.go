@@ -43,4 +43,12 @@ const usage = `    VSPHERE_CSI_CONFIG
         Specifies the path to the csi-vsphere.conf file
 
         The default value is "/etc/cloud/csi-vsphere.conf"
+
+    X_CSI_MODE
+        Specifies the services served by the plugin: "controller" serves only
+        the controller service, e.g. to provision volumes from a management
+        cluster without running the node plugin, and "node" serves only the
+        node service
+
+        The default value serves both services
 `
@@ -54,6 +54,8 @@ type Manager interface {
 	// nodes. If nodes are added or removed concurrently, they may or may not be
 	// reflected in the result of a call to this method.
 	GetAllNodes() ([]*vsphere.VirtualMachine, error)
+	// GetAllNodeNames returns the names of all registered nodes.
+	GetAllNodeNames() []string
 	// UnregisterNode unregisters a registered node given its name.
 	UnregisterNode(nodeName string) error
 }
@@ -237,6 +239,16 @@ func (m *nodeManager) GetAllNodes() ([]*vsphere.VirtualMachine, error) {
 	return vms, nil
 }
 
+// GetAllNodeNames returns the names of all registered nodes.
+func (m *nodeManager) GetAllNodeNames() []string {
+	var nodeNames []string
+	m.nodeNameToUUID.Range(func(nodeName, _ interface{}) bool {
+		nodeNames = append(nodeNames, nodeName.(string))
+		return true
+	})
+	return nodeNames
+}
+
 // UnregisterNode unregisters a registered node given its name.
 func (m *nodeManager) UnregisterNode(nodeName string) error {
 	nodeUUID, found := m.nodeNameToUUID.Load(nodeName)
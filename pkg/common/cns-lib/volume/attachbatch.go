@@ -0,0 +1,83 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"time"
+
+	"k8s.io/klog"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+// attachRequest is the attach of a volume, holding its disk UUID or error
+// once attached.
+type attachRequest struct {
+	volumeID string
+	diskUUID string
+	err      error
+	// issued, if set, receives nil once the CNS AttachVolume task of the
+	// request is issued, or the error of issuing it
+	issued chan error
+}
+
+// attachBatch collects the attaches to a virtual machine issued as a single
+// CNS AttachVolume task. done is closed once the task completed.
+type attachBatch struct {
+	vm       *cnsvsphere.VirtualMachine
+	requests []*attachRequest
+	done     chan struct{}
+}
+
+// SetAttachBatchWindow sets the time attaches to the same virtual machine are
+// batched for. 0 disables batching.
+func (m *volumeManager) SetAttachBatchWindow(window time.Duration) {
+	m.attachBatchWindow = window
+	klog.V(2).Infof("Volume manager attach batch window set to %v", window)
+}
+
+// batchAttachVolume adds the attach of the volume to the pending batch of the
+// virtual machine, starting a batch if there is none, and waits for the batch
+// to be attached.
+func (m *volumeManager) batchAttachVolume(vm *cnsvsphere.VirtualMachine, volumeID string) (string, error) {
+	key := vm.Reference().Value
+	request := &attachRequest{volumeID: volumeID}
+	m.attachBatchesLock.Lock()
+	batch, ok := m.attachBatches[key]
+	if !ok {
+		batch = &attachBatch{vm: vm, done: make(chan struct{})}
+		m.attachBatches[key] = batch
+		time.AfterFunc(m.attachBatchWindow, func() {
+			m.flushAttachBatch(key, batch)
+		})
+	}
+	batch.requests = append(batch.requests, request)
+	m.attachBatchesLock.Unlock()
+	<-batch.done
+	return request.diskUUID, request.err
+}
+
+// flushAttachBatch attaches the volumes of the batch of the virtual machine.
+// Attaches requested from now on start a new batch.
+func (m *volumeManager) flushAttachBatch(key string, batch *attachBatch) {
+	m.attachBatchesLock.Lock()
+	delete(m.attachBatches, key)
+	m.attachBatchesLock.Unlock()
+	defer close(batch.done)
+	klog.V(3).Infof("AttachVolume: Attaching batch of %d volumes to vm %q", len(batch.requests), batch.vm.String())
+	m.attachVolumes(batch.vm, batch.requests)
+}
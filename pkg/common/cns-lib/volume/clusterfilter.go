@@ -0,0 +1,109 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"sync/atomic"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	"github.com/vmware/govmomi/vim25/soap"
+	vimtypes "github.com/vmware/govmomi/vim25/types"
+	"k8s.io/klog"
+)
+
+// queryScopedToClusters runs the query with the filter. Queries scoped to
+// container clusters fall back to enumerating all volumes, filtered locally,
+// if the vCenter rejects the container cluster filter with an InvalidArgument
+// fault naming it. The fallback sticks for the lifetime of the manager.
+// Volumes of other clusters returned by vCenters ignoring the filter are
+// dropped as well.
+func (m *volumeManager) queryScopedToClusters(queryFilter cnstypes.CnsQueryFilter,
+	query func(cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error)) (*cnstypes.CnsQueryResult, error) {
+	clusterIDs := queryFilter.ContainerClusterIds
+	if len(clusterIDs) == 0 {
+		return query(queryFilter)
+	}
+	if atomic.LoadInt32(&m.clusterFilterUnsupported) == 0 {
+		res, err := query(queryFilter)
+		if err == nil || err == ErrPartialQueryResult {
+			if res != nil {
+				var dropped int
+				res.Volumes, dropped = filterVolumesByCluster(res.Volumes, clusterIDs, true)
+				if dropped > 0 {
+					klog.Warningf("CNS query scoped to clusters %v returned %d volumes of other clusters from vCenter %q, "+
+						"the container cluster filter is not honored", clusterIDs, dropped, m.virtualCenter.Config.Host)
+				}
+			}
+			return res, err
+		}
+		if !isClusterFilterUnsupported(err) {
+			return nil, err
+		}
+		atomic.StoreInt32(&m.clusterFilterUnsupported, 1)
+		klog.Warningf("vCenter %q does not support querying CNS volumes by container cluster, "+
+			"falling back to enumerating all volumes. Err: %v", m.virtualCenter.Config.Host, err)
+	}
+	queryFilter.ContainerClusterIds = nil
+	res, err := query(queryFilter)
+	if res != nil {
+		res.Volumes, _ = filterVolumesByCluster(res.Volumes, clusterIDs, false)
+	}
+	return res, err
+}
+
+// isClusterFilterUnsupported returns true if the error is the InvalidArgument
+// fault naming the container cluster query filter, returned by vCenters which
+// do not support it. Other faults, including InvalidArgument faults naming
+// other properties, are errors of the query itself.
+func isClusterFilterUnsupported(err error) bool {
+	var fault interface{}
+	switch {
+	case soap.IsSoapFault(err):
+		fault = soap.ToSoapFault(err).VimFault()
+	case soap.IsVimFault(err):
+		fault = soap.ToVimFault(err)
+	default:
+		return false
+	}
+	switch fault := fault.(type) {
+	case vimtypes.InvalidArgument:
+		return fault.InvalidProperty == "containerClusterIds"
+	case *vimtypes.InvalidArgument:
+		return fault.InvalidProperty == "containerClusterIds"
+	}
+	return false
+}
+
+// filterVolumesByCluster returns the volumes of the given container clusters,
+// along with the number of volumes dropped. Volumes whose cluster is not
+// reported are kept if keepUnreported is true, that is when vCenter already
+// scoped the query to the clusters, and dropped otherwise, since an unscoped
+// query returns the volumes of all the clusters.
+func filterVolumesByCluster(volumes []cnstypes.CnsVolume, clusterIDs []string, keepUnreported bool) ([]cnstypes.CnsVolume, int) {
+	clusters := make(map[string]bool, len(clusterIDs))
+	for _, clusterID := range clusterIDs {
+		clusters[clusterID] = true
+	}
+	filtered := volumes[:0]
+	for _, volume := range volumes {
+		clusterID := volume.Metadata.ContainerCluster.ClusterId
+		if (clusterID == "" && keepUnreported) || clusters[clusterID] {
+			filtered = append(filtered, volume)
+		}
+	}
+	return filtered, len(volumes) - len(filtered)
+}
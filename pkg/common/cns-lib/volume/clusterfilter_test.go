@@ -0,0 +1,123 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"errors"
+	"testing"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	"github.com/vmware/govmomi/vim25/soap"
+	vimtypes "github.com/vmware/govmomi/vim25/types"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+func newClusterVolume(volumeID string, clusterID string) cnstypes.CnsVolume {
+	volume := cnstypes.CnsVolume{VolumeId: cnstypes.CnsVolumeId{Id: volumeID}}
+	volume.Metadata.ContainerCluster.ClusterId = clusterID
+	return volume
+}
+
+func volumeIDs(volumes []cnstypes.CnsVolume) []string {
+	var ids []string
+	for _, volume := range volumes {
+		ids = append(ids, volume.VolumeId.Id)
+	}
+	return ids
+}
+
+func TestIsClusterFilterUnsupported(t *testing.T) {
+	tests := []struct {
+		err         error
+		unsupported bool
+	}{
+		{soap.WrapVimFault(&vimtypes.InvalidArgument{InvalidProperty: "containerClusterIds"}), true},
+		{soap.WrapVimFault(&vimtypes.InvalidArgument{InvalidProperty: "volumeIds"}), false},
+		{soap.WrapVimFault(&vimtypes.InvalidArgument{}), false},
+		{soap.WrapVimFault(&vimtypes.NotSupported{}), false},
+		{errors.New("connection refused"), false},
+	}
+	for i, test := range tests {
+		if unsupported := isClusterFilterUnsupported(test.err); unsupported != test.unsupported {
+			t.Errorf("Test %d: expected %v, got %v", i, test.unsupported, unsupported)
+		}
+	}
+}
+
+func TestFilterVolumesByCluster(t *testing.T) {
+	newVolumes := func() []cnstypes.CnsVolume {
+		return []cnstypes.CnsVolume{
+			newClusterVolume("vol-1", "cluster-1"),
+			newClusterVolume("vol-2", "cluster-2"),
+			newClusterVolume("vol-3", ""),
+		}
+	}
+	volumes, dropped := filterVolumesByCluster(newVolumes(), []string{"cluster-1"}, true)
+	if ids := volumeIDs(volumes); len(ids) != 2 || ids[0] != "vol-1" || ids[1] != "vol-3" || dropped != 1 {
+		t.Errorf("Expected vol-1 and vol-3 kept and 1 dropped, got %v and %d dropped", ids, dropped)
+	}
+	volumes, dropped = filterVolumesByCluster(newVolumes(), []string{"cluster-1"}, false)
+	if ids := volumeIDs(volumes); len(ids) != 1 || ids[0] != "vol-1" || dropped != 2 {
+		t.Errorf("Expected vol-1 kept and 2 dropped, got %v and %d dropped", ids, dropped)
+	}
+}
+
+func TestQueryScopedToClustersFallback(t *testing.T) {
+	m := &volumeManager{
+		virtualCenter: &cnsvsphere.VirtualCenter{Config: &cnsvsphere.VirtualCenterConfig{Host: "vc"}},
+	}
+	var filters []cnstypes.CnsQueryFilter
+	query := func(queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+		filters = append(filters, queryFilter)
+		if len(queryFilter.ContainerClusterIds) > 0 {
+			return nil, soap.WrapVimFault(&vimtypes.InvalidArgument{InvalidProperty: "containerClusterIds"})
+		}
+		return &cnstypes.CnsQueryResult{Volumes: []cnstypes.CnsVolume{
+			newClusterVolume("vol-1", "cluster-1"),
+			newClusterVolume("vol-2", "cluster-2"),
+			newClusterVolume("vol-3", ""),
+		}}, nil
+	}
+	queryFilter := cnstypes.CnsQueryFilter{ContainerClusterIds: []string{"cluster-1"}}
+	for i := 0; i < 2; i++ {
+		res, err := m.queryScopedToClusters(queryFilter, query)
+		if err != nil {
+			t.Fatalf("Query %d failed: %v", i, err)
+		}
+		if ids := volumeIDs(res.Volumes); len(ids) != 1 || ids[0] != "vol-1" {
+			t.Errorf("Query %d: expected only vol-1, got %v", i, ids)
+		}
+	}
+	// The scoped query is only issued once, the fallback sticks.
+	if len(filters) != 3 || len(filters[1].ContainerClusterIds) != 0 || len(filters[2].ContainerClusterIds) != 0 {
+		t.Errorf("Expected one scoped query followed by two unscoped ones, got %v", filters)
+	}
+
+	m = &volumeManager{
+		virtualCenter: &cnsvsphere.VirtualCenter{Config: &cnsvsphere.VirtualCenterConfig{Host: "vc"}},
+	}
+	queryErr := soap.WrapVimFault(&vimtypes.InvalidArgument{InvalidProperty: "volumeIds"})
+	if _, err := m.queryScopedToClusters(queryFilter, func(cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+		return nil, queryErr
+	}); err != queryErr {
+		t.Errorf("Expected the query error, got %v", err)
+	}
+	if m.clusterFilterUnsupported != 0 {
+		t.Errorf("Expected no fallback for an InvalidArgument fault naming another property")
+	}
+}
@@ -19,21 +19,49 @@ package volume
 import (
 	"context"
 	"errors"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/vmware/govmomi/cns"
 	cnstypes "github.com/vmware/govmomi/cns/types"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/methods"
 	"github.com/vmware/govmomi/vim25/soap"
 	vimtypes "github.com/vmware/govmomi/vim25/types"
 	"k8s.io/klog"
 
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
 )
 
+const (
+	// defaultCreateTimeout is the default timeout for CNS CreateVolume.
+	defaultCreateTimeout = 5 * time.Minute
+	// defaultDeleteTimeout is the default timeout for CNS DeleteVolume.
+	defaultDeleteTimeout = 5 * time.Minute
+	// defaultAttachTimeout is the default timeout for CNS AttachVolume and DetachVolume.
+	defaultAttachTimeout = 5 * time.Minute
+	// defaultQueryTimeout is the default timeout for CNS queries and metadata updates.
+	defaultQueryTimeout = 10 * time.Minute
+	// defaultHealthTimeout is the default timeout for vCenter health checks.
+	defaultHealthTimeout = 10 * time.Second
+	// defaultQueryPageSize is the number of volumes requested per page when
+	// completing partial query results whose cursor has no limit.
+	defaultQueryPageSize = 100
+)
+
+// ErrPartialQueryResult is returned with the volumes received so far when a CNS
+// query returned fewer volumes than it reported to match and the missing
+// volumes could not be retrieved by paging.
+var ErrPartialQueryResult = errors.New("CNS query returned partial results")
+
 // Manager provides functionality to manage volumes.
 type Manager interface {
-	// CreateVolume creates a new volume given its spec.
+	// CreateVolume creates a new volume given its spec. When the create fails
+	// with a volume ID in the CNS task result, the ID is returned along with
+	// the error.
 	CreateVolume(spec *cnstypes.CnsVolumeCreateSpec) (*cnstypes.CnsVolumeId, error)
 	// AttachVolume attaches a volume to a virtual machine given the spec.
 	AttachVolume(vm *cnsvsphere.VirtualMachine, volumeID string) (string, error)
@@ -47,6 +75,21 @@ type Manager interface {
 	QueryVolume(queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error)
 	// QueryAllVolume returns all volumes matching the given filter and selection.
 	QueryAllVolume(queryFilter cnstypes.CnsQueryFilter, querySelection cnstypes.CnsQuerySelection) (*cnstypes.CnsQueryResult, error)
+	// AttachVolumeAsync issues the attach of a volume to a virtual machine and
+	// returns once it is issued. The attach result is sent on the channel.
+	AttachVolumeAsync(vm *cnsvsphere.VirtualMachine, volumeID string) (<-chan error, error)
+	// SetOperationTimeouts sets the timeouts applied to vCenter calls per operation type.
+	SetOperationTimeouts(timeouts config.OperationTimeoutConfig)
+	// SetAttachBatchWindow sets the time attaches to the same virtual machine
+	// are batched for. 0 disables batching.
+	SetAttachBatchWindow(window time.Duration)
+	// SetStuckTaskRemediation sets the options of the cancellation of CNS
+	// tasks stuck in vCenter and the retry of their operation.
+	SetStuckTaskRemediation(cfg config.StuckTaskConfig)
+	// HealthCheck verifies that vCenter is responsive by retrieving its current time.
+	HealthCheck() error
+	// HealthCheckTimeout returns the timeout of the vCenter health checks.
+	HealthCheckTimeout() time.Duration
 }
 
 var (
@@ -62,6 +105,14 @@ func GetManager(vc *cnsvsphere.VirtualCenter) Manager {
 		klog.V(1).Infof("Initializing volume.volumeManager...")
 		managerInstance = &volumeManager{
 			virtualCenter: vc,
+			timeouts: operationTimeouts{
+				create: defaultCreateTimeout,
+				delete: defaultDeleteTimeout,
+				attach: defaultAttachTimeout,
+				query:  defaultQueryTimeout,
+				health: defaultHealthTimeout,
+			},
+			attachBatches: make(map[string]*attachBatch),
 		}
 		klog.V(1).Infof("volume.volumeManager initialized")
 	})
@@ -71,6 +122,68 @@ func GetManager(vc *cnsvsphere.VirtualCenter) Manager {
 // DefaultManager provides functionality to manage volumes.
 type volumeManager struct {
 	virtualCenter *cnsvsphere.VirtualCenter
+	timeouts      operationTimeouts
+	// attachBatchWindow is the time attaches to a virtual machine are
+	// collected for before being issued as a single CNS AttachVolume task.
+	// 0 disables batching.
+	attachBatchWindow time.Duration
+	// attachBatches holds the pending attach batch of each virtual machine.
+	attachBatches     map[string]*attachBatch
+	attachBatchesLock sync.Mutex
+	// clusterFilterUnsupported is set to 1 once the vCenter rejected a query
+	// scoped by container cluster, accessed atomically.
+	clusterFilterUnsupported int32
+	// stuckTasks holds the running CNS tasks for the remediation of the
+	// stuck ones.
+	stuckTasks stuckTasks
+}
+
+// operationTimeouts holds the timeouts applied to vCenter calls per operation type.
+type operationTimeouts struct {
+	create time.Duration
+	delete time.Duration
+	attach time.Duration
+	query  time.Duration
+	health time.Duration
+}
+
+// SetOperationTimeouts sets the timeouts applied to vCenter calls per operation type.
+// Timeouts which are not set keep their current value.
+func (m *volumeManager) SetOperationTimeouts(timeouts config.OperationTimeoutConfig) {
+	setTimeout := func(timeout *time.Duration, seconds int) {
+		if seconds > 0 {
+			*timeout = time.Duration(seconds) * time.Second
+		}
+	}
+	setTimeout(&m.timeouts.create, timeouts.Create)
+	setTimeout(&m.timeouts.delete, timeouts.Delete)
+	setTimeout(&m.timeouts.attach, timeouts.Attach)
+	setTimeout(&m.timeouts.query, timeouts.Query)
+	setTimeout(&m.timeouts.health, timeouts.Health)
+	klog.V(2).Infof("Volume manager operation timeouts set to %+v", m.timeouts)
+}
+
+// HealthCheck verifies that vCenter is responsive by retrieving its current time.
+func (m *volumeManager) HealthCheck() error {
+	err := validateManager(m)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeouts.health)
+	defer cancel()
+	if m.virtualCenter.Client == nil {
+		return errors.New("vCenter client is not connected")
+	}
+	if _, err := methods.GetCurrentTime(ctx, m.virtualCenter.Client); err != nil {
+		klog.Errorf("Health check failed for vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
+		return err
+	}
+	return nil
+}
+
+// HealthCheckTimeout returns the timeout of the vCenter health checks.
+func (m *volumeManager) HealthCheckTimeout() time.Duration {
+	return m.timeouts.health
 }
 
 // CreateVolume creates a new volume given its spec.
@@ -79,7 +192,7 @@ func (m *volumeManager) CreateVolume(spec *cnstypes.CnsVolumeCreateSpec) (*cnsty
 	if err != nil {
 		return nil, err
 	}
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeouts.create)
 	defer cancel()
 	// Set up the VC connection
 	err = m.virtualCenter.ConnectCNS(ctx)
@@ -102,13 +215,16 @@ func (m *volumeManager) CreateVolume(spec *cnstypes.CnsVolumeCreateSpec) (*cnsty
 	var cnsCreateSpecList []cnstypes.CnsVolumeCreateSpec
 	cnsCreateSpecList = append(cnsCreateSpecList, *spec)
 	// Call the CNS CreateVolume
-	task, err := m.virtualCenter.CnsClient.CreateVolume(ctx, cnsCreateSpecList)
-	if err != nil {
+	issued := false
+	taskInfo, err := m.waitForTask(ctx, "CreateVolume", spec.Name, func() (*object.Task, error) {
+		task, err := m.virtualCenter.CnsClient.CreateVolume(ctx, cnsCreateSpecList)
+		issued = err == nil
+		return task, err
+	})
+	if !issued {
 		klog.Errorf("CNS CreateVolume failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
 		return nil, err
 	}
-	// Get the taskInfo
-	taskInfo, err := cns.GetTaskInfo(ctx, task)
 	if err != nil {
 		klog.Errorf("Failed to get taskInfo for CreateVolume task from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
 		return nil, err
@@ -130,6 +246,11 @@ func (m *volumeManager) CreateVolume(spec *cnstypes.CnsVolumeCreateSpec) (*cnsty
 	volumeOperationRes := taskResult.GetCnsVolumeOperationResult()
 	if volumeOperationRes.Fault != nil {
 		klog.Errorf("failed to create cns volume. createSpec: %q, fault: %q, opId: %q", spew.Sdump(spec), spew.Sdump(volumeOperationRes.Fault), taskInfo.ActivationId)
+		if volumeOperationRes.VolumeId.Id != "" {
+			return &cnstypes.CnsVolumeId{
+				Id: volumeOperationRes.VolumeId.Id,
+			}, errors.New(volumeOperationRes.Fault.LocalizedMessage)
+		}
 		return nil, errors.New(volumeOperationRes.Fault.LocalizedMessage)
 	}
 	klog.V(2).Infof("CreateVolume: Volume created successfully. VolumeName: %q, opId: %q, volumeID: %q", spec.Name, taskInfo.ActivationId, volumeOperationRes.VolumeId.Id)
@@ -139,52 +260,146 @@ func (m *volumeManager) CreateVolume(spec *cnstypes.CnsVolumeCreateSpec) (*cnsty
 }
 
 // AttachVolume attaches a volume to a virtual machine given the spec.
+// When an attach batch window is set, the attach is batched with the other
+// attaches to the same virtual machine requested within the window.
 func (m *volumeManager) AttachVolume(vm *cnsvsphere.VirtualMachine, volumeID string) (string, error) {
 	err := validateManager(m)
 	if err != nil {
 		return "", err
 	}
-	ctx, cancel := context.WithCancel(context.Background())
+	if m.attachBatchWindow > 0 {
+		return m.batchAttachVolume(vm, volumeID)
+	}
+	request := &attachRequest{volumeID: volumeID}
+	m.attachVolumes(vm, []*attachRequest{request})
+	return request.diskUUID, request.err
+}
+
+// AttachVolumeAsync issues the CNS AttachVolume task attaching the volume to
+// the virtual machine and returns once the task is issued, without waiting for
+// its completion. The result of the attach is sent on the returned channel.
+// Attaches issued this way are not batched.
+func (m *volumeManager) AttachVolumeAsync(vm *cnsvsphere.VirtualMachine, volumeID string) (<-chan error, error) {
+	err := validateManager(m)
+	if err != nil {
+		return nil, err
+	}
+	request := &attachRequest{volumeID: volumeID, issued: make(chan error, 1)}
+	done := make(chan error, 1)
+	go func() {
+		m.attachVolumes(vm, []*attachRequest{request})
+		done <- request.err
+	}()
+	if err := <-request.issued; err != nil {
+		return nil, err
+	}
+	return done, nil
+}
+
+// attachVolumes attaches the volumes of the requests to the virtual machine
+// with a single CNS AttachVolume task, and sets the disk UUID or the error of
+// each request from the result of its volume.
+func (m *volumeManager) attachVolumes(vm *cnsvsphere.VirtualMachine, requests []*attachRequest) {
+	setError := func(err error) {
+		for _, request := range requests {
+			request.err = err
+		}
+	}
+	issued := false
+	setIssued := func(err error) {
+		issued = true
+		for _, request := range requests {
+			if request.issued != nil {
+				request.issued <- err
+			}
+		}
+	}
+	defer func() {
+		if !issued {
+			setIssued(requests[0].err)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeouts.attach)
 	defer cancel()
 
 	// Set up the VC connection
-	err = m.virtualCenter.ConnectCNS(ctx)
+	err := m.virtualCenter.ConnectCNS(ctx)
 	if err != nil {
 		klog.Errorf("ConnectCNS failed with err: %+v", err)
-		return "", err
+		setError(err)
+		return
 	}
-	// Construct the CNS AttachSpec list
+	// Construct the CNS AttachSpec list, attaching each volume once
 	var cnsAttachSpecList []cnstypes.CnsVolumeAttachDetachSpec
-	cnsAttachSpec := cnstypes.CnsVolumeAttachDetachSpec{
-		VolumeId: cnstypes.CnsVolumeId{
-			Id: volumeID,
-		},
-		Vm: vm.Reference(),
+	var volumeIDs []string
+	requested := make(map[string]bool)
+	for _, request := range requests {
+		if requested[request.volumeID] {
+			continue
+		}
+		requested[request.volumeID] = true
+		volumeIDs = append(volumeIDs, request.volumeID)
+		cnsAttachSpecList = append(cnsAttachSpecList, cnstypes.CnsVolumeAttachDetachSpec{
+			VolumeId: cnstypes.CnsVolumeId{
+				Id: request.volumeID,
+			},
+			Vm: vm.Reference(),
+		})
 	}
-	cnsAttachSpecList = append(cnsAttachSpecList, cnsAttachSpec)
 	// Call the CNS AttachVolume
-	task, err := m.virtualCenter.CnsClient.AttachVolume(ctx, cnsAttachSpecList)
-	if err != nil {
+	attached := false
+	taskInfo, err := m.waitForTask(ctx, "AttachVolume", strings.Join(volumeIDs, ","), func() (*object.Task, error) {
+		task, err := m.virtualCenter.CnsClient.AttachVolume(ctx, cnsAttachSpecList)
+		attached = err == nil
+		if attached && !issued {
+			setIssued(nil)
+		}
+		return task, err
+	})
+	if !attached {
 		klog.Errorf("CNS AttachVolume failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
-		return "", err
+		setError(err)
+		return
 	}
-	// Get the taskInfo
-	taskInfo, err := cns.GetTaskInfo(ctx, task)
 	if err != nil {
 		klog.Errorf("Failed to get taskInfo for AttachVolume task from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
-		return "", err
+		setError(err)
+		return
 	}
-	klog.V(2).Infof("AttachVolume: volumeID: %q, vm: %q, opId: %q", volumeID, vm.String(), taskInfo.ActivationId)
-	// Get the taskResult
-	taskResult, err := cns.GetTaskResult(ctx, taskInfo)
+	klog.V(2).Infof("AttachVolume: volumeIDs: %q, vm: %q, opId: %q", volumeIDs, vm.String(), taskInfo.ActivationId)
+	// Get the taskResults
+	taskResults, err := getTaskResults(taskInfo)
 	if err != nil {
-		klog.Errorf("unable to find the task result for AttachVolume task from vCenter %q with taskID %s and attachResults %v",
-			m.virtualCenter.Config.Host, taskInfo.Task.Value, taskResult)
-		return "", err
+		klog.Errorf("unable to find the task result for AttachVolume task from vCenter %q with taskID %s",
+			m.virtualCenter.Config.Host, taskInfo.Task.Value)
+		setError(err)
+		return
+	}
+	results := make(map[string]cnstypes.BaseCnsVolumeOperationResult)
+	for _, taskResult := range taskResults {
+		results[taskResult.GetCnsVolumeOperationResult().VolumeId.Id] = taskResult
 	}
+	// A single volume is attached without checking the volume ID of its
+	// result
+	if len(volumeIDs) == 1 && len(taskResults) == 1 {
+		results[volumeIDs[0]] = taskResults[0]
+	}
+	diskUUIDs := make(map[string]string)
+	errs := make(map[string]error)
+	for _, volumeID := range volumeIDs {
+		diskUUIDs[volumeID], errs[volumeID] = m.getAttachResult(ctx, vm, volumeID, taskInfo, results[volumeID])
+	}
+	for _, request := range requests {
+		request.diskUUID, request.err = diskUUIDs[request.volumeID], errs[request.volumeID]
+	}
+}
 
+// getAttachResult returns the disk UUID of the volume attached to the virtual
+// machine given its result in the AttachVolume task.
+func (m *volumeManager) getAttachResult(ctx context.Context, vm *cnsvsphere.VirtualMachine, volumeID string,
+	taskInfo *vimtypes.TaskInfo, taskResult cnstypes.BaseCnsVolumeOperationResult) (string, error) {
 	if taskResult == nil {
-		klog.Errorf("taskResult is empty for AttachVolume task: %q, opId: %q", taskInfo.Task.Value, taskInfo.ActivationId)
+		klog.Errorf("taskResult is empty for volume %q in AttachVolume task: %q, opId: %q", volumeID, taskInfo.Task.Value, taskInfo.ActivationId)
 		return "", errors.New("taskResult is empty")
 	}
 
@@ -214,7 +429,7 @@ func (m *volumeManager) DetachVolume(vm *cnsvsphere.VirtualMachine, volumeID str
 	if err != nil {
 		return err
 	}
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeouts.attach)
 	defer cancel()
 	// Set up the VC connection
 	err = m.virtualCenter.ConnectCNS(ctx)
@@ -232,13 +447,16 @@ func (m *volumeManager) DetachVolume(vm *cnsvsphere.VirtualMachine, volumeID str
 	}
 	cnsDetachSpecList = append(cnsDetachSpecList, cnsDetachSpec)
 	// Call the CNS DetachVolume
-	task, err := m.virtualCenter.CnsClient.DetachVolume(ctx, cnsDetachSpecList)
-	if err != nil {
+	issued := false
+	taskInfo, err := m.waitForTask(ctx, "DetachVolume", volumeID, func() (*object.Task, error) {
+		task, err := m.virtualCenter.CnsClient.DetachVolume(ctx, cnsDetachSpecList)
+		issued = err == nil
+		return task, err
+	})
+	if !issued {
 		klog.Errorf("CNS DetachVolume failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
 		return err
 	}
-	// Get the taskInfo
-	taskInfo, err := cns.GetTaskInfo(ctx, task)
 	if err != nil {
 		klog.Errorf("Failed to get taskInfo for DetachVolume task from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
 		return err
@@ -273,7 +491,7 @@ func (m *volumeManager) DeleteVolume(volumeID string, deleteDisk bool) error {
 	if err != nil {
 		return err
 	}
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeouts.delete)
 	defer cancel()
 	// Set up the VC connection
 	err = m.virtualCenter.ConnectCNS(ctx)
@@ -288,8 +506,13 @@ func (m *volumeManager) DeleteVolume(volumeID string, deleteDisk bool) error {
 	}
 	// Call the CNS DeleteVolume
 	cnsVolumeIDList = append(cnsVolumeIDList, cnsVolumeID)
-	task, err := m.virtualCenter.CnsClient.DeleteVolume(ctx, cnsVolumeIDList, deleteDisk)
-	if err != nil {
+	issued := false
+	taskInfo, err := m.waitForTask(ctx, "DeleteVolume", volumeID, func() (*object.Task, error) {
+		task, err := m.virtualCenter.CnsClient.DeleteVolume(ctx, cnsVolumeIDList, deleteDisk)
+		issued = err == nil
+		return task, err
+	})
+	if !issued {
 		if soap.IsSoapFault(err) {
 			soapFault := soap.ToSoapFault(err)
 			if _, ok := soapFault.VimFault().(vimtypes.NotFound); ok {
@@ -300,8 +523,6 @@ func (m *volumeManager) DeleteVolume(volumeID string, deleteDisk bool) error {
 		klog.Errorf("CNS DeleteVolume failed from the  vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
 		return err
 	}
-	// Get the taskInfo
-	taskInfo, err := cns.GetTaskInfo(ctx, task)
 	if err != nil {
 		klog.Errorf("Failed to get taskInfo for DeleteVolume task from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
 		return err
@@ -334,7 +555,7 @@ func (m *volumeManager) UpdateVolumeMetadata(spec *cnstypes.CnsVolumeMetadataUpd
 	if err != nil {
 		return err
 	}
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeouts.query)
 	defer cancel()
 	// Set up the VC connection
 	err = m.virtualCenter.ConnectCNS(ctx)
@@ -361,13 +582,16 @@ func (m *volumeManager) UpdateVolumeMetadata(spec *cnstypes.CnsVolumeMetadataUpd
 		Metadata: spec.Metadata,
 	}
 	cnsUpdateSpecList = append(cnsUpdateSpecList, cnsUpdateSpec)
-	task, err := m.virtualCenter.CnsClient.UpdateVolumeMetadata(ctx, cnsUpdateSpecList)
-	if err != nil {
+	issued := false
+	taskInfo, err := m.waitForTask(ctx, "UpdateVolumeMetadata", spec.VolumeId.Id, func() (*object.Task, error) {
+		task, err := m.virtualCenter.CnsClient.UpdateVolumeMetadata(ctx, cnsUpdateSpecList)
+		issued = err == nil
+		return task, err
+	})
+	if !issued {
 		klog.Errorf("CNS UpdateVolume failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
 		return err
 	}
-	// Get the taskInfo
-	taskInfo, err := cns.GetTaskInfo(ctx, task)
 	if err != nil {
 		klog.Errorf("Failed to get taskInfo for UpdateVolume task from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
 		return err
@@ -400,7 +624,7 @@ func (m *volumeManager) QueryVolume(queryFilter cnstypes.CnsQueryFilter) (*cnsty
 	if err != nil {
 		return nil, err
 	}
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeouts.query)
 	defer cancel()
 	// Set up the VC connection
 	err = m.virtualCenter.ConnectCNS(ctx)
@@ -409,12 +633,20 @@ func (m *volumeManager) QueryVolume(queryFilter cnstypes.CnsQueryFilter) (*cnsty
 		return nil, err
 	}
 	//Call the CNS QueryVolume
-	res, err := m.virtualCenter.CnsClient.QueryVolume(ctx, queryFilter)
-	if err != nil {
-		klog.Errorf("CNS QueryVolume failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
-		return nil, err
-	}
-	return res, err
+	return m.queryScopedToClusters(queryFilter, func(queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+		res, err := m.virtualCenter.CnsClient.QueryVolume(ctx, queryFilter)
+		if err != nil {
+			klog.Errorf("CNS QueryVolume failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
+			return nil, err
+		}
+		if queryFilter.Cursor != nil {
+			// The caller pages through the results itself
+			return res, nil
+		}
+		return completeQueryResult(queryFilter, res, func(queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+			return m.virtualCenter.CnsClient.QueryVolume(ctx, queryFilter)
+		})
+	})
 }
 
 // QueryAllVolume returns all volumes matching the given filter and selection.
@@ -423,7 +655,7 @@ func (m *volumeManager) QueryAllVolume(queryFilter cnstypes.CnsQueryFilter, quer
 	if err != nil {
 		return nil, err
 	}
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeouts.query)
 	defer cancel()
 	// Set up the VC connection
 	err = m.virtualCenter.ConnectCNS(ctx)
@@ -432,10 +664,56 @@ func (m *volumeManager) QueryAllVolume(queryFilter cnstypes.CnsQueryFilter, quer
 		return nil, err
 	}
 	//Call the CNS QueryAllVolume
-	res, err := m.virtualCenter.CnsClient.QueryAllVolume(ctx, queryFilter, querySelection)
-	if err != nil {
-		klog.Errorf("CNS QueryAllVolume failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
-		return nil, err
+	return m.queryScopedToClusters(queryFilter, func(queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+		res, err := m.virtualCenter.CnsClient.QueryAllVolume(ctx, queryFilter, querySelection)
+		if err != nil {
+			klog.Errorf("CNS QueryAllVolume failed from vCenter %q with err: %v", m.virtualCenter.Config.Host, err)
+			return nil, err
+		}
+		return completeQueryResult(queryFilter, res, func(queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+			return m.virtualCenter.CnsClient.QueryVolume(ctx, queryFilter)
+		})
+	})
+}
+
+// completeQueryResult detects query results holding fewer volumes than the
+// total reported by their cursor, and pages through the remaining volumes with
+// queryPage, a CNS QueryVolume, up to that total. ErrPartialQueryResult is
+// returned along with the volumes received so far if the result can not be
+// completed.
+func completeQueryResult(queryFilter cnstypes.CnsQueryFilter, res *cnstypes.CnsQueryResult,
+	queryPage func(cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error)) (*cnstypes.CnsQueryResult, error) {
+	if res == nil || int64(len(res.Volumes)) >= res.Cursor.TotalRecords {
+		return res, nil
+	}
+	partialQueryResults.Inc()
+	totalRecords := res.Cursor.TotalRecords
+	pageSize := res.Cursor.Limit
+	if pageSize <= 0 {
+		pageSize = defaultQueryPageSize
+	}
+	klog.Warningf("CNS query returned %d of %d volumes, querying the remaining volumes", len(res.Volumes), totalRecords)
+	// Every page adds at least one volume and pages are cut at the total, so
+	// the loop ends after at most totalRecords pages
+	for int64(len(res.Volumes)) < totalRecords {
+		queryFilter.Cursor = &cnstypes.CnsCursor{
+			Offset: int64(len(res.Volumes)),
+			Limit:  pageSize,
+		}
+		page, err := queryPage(queryFilter)
+		if err != nil {
+			klog.Errorf("CNS QueryVolume failed at offset %d with err: %v", queryFilter.Cursor.Offset, err)
+			return res, ErrPartialQueryResult
+		}
+		if len(page.Volumes) == 0 {
+			klog.Errorf("CNS QueryVolume returned no volumes at offset %d of %d", queryFilter.Cursor.Offset, totalRecords)
+			return res, ErrPartialQueryResult
+		}
+		if remaining := totalRecords - int64(len(res.Volumes)); int64(len(page.Volumes)) > remaining {
+			page.Volumes = page.Volumes[:remaining]
+		}
+		res.Volumes = append(res.Volumes, page.Volumes...)
 	}
-	return res, err
+	res.Cursor.Offset = int64(len(res.Volumes))
+	return res, nil
 }
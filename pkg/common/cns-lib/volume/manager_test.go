@@ -0,0 +1,63 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"testing"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+)
+
+func TestCompleteQueryResult(t *testing.T) {
+	var volumes []cnstypes.CnsVolume
+	for i := 0; i < 250; i++ {
+		volumes = append(volumes, cnstypes.CnsVolume{VolumeId: cnstypes.CnsVolumeId{Id: fmt.Sprintf("vol-%d", i)}})
+	}
+	var cursors []cnstypes.CnsCursor
+	// queryPage ignores the limit and returns every volume from the offset on
+	queryPage := func(queryFilter cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+		cursors = append(cursors, *queryFilter.Cursor)
+		return &cnstypes.CnsQueryResult{Volumes: append([]cnstypes.CnsVolume{}, volumes[queryFilter.Cursor.Offset:]...)}, nil
+	}
+	res := &cnstypes.CnsQueryResult{
+		Volumes: append([]cnstypes.CnsVolume{}, volumes[:50]...),
+		Cursor:  cnstypes.CnsCursor{TotalRecords: 200},
+	}
+
+	res, err := completeQueryResult(cnstypes.CnsQueryFilter{}, res, queryPage)
+	if err != nil {
+		t.Fatalf("Failed to complete query result: %v", err)
+	}
+	if len(res.Volumes) != 200 || res.Volumes[199].VolumeId.Id != "vol-199" {
+		t.Errorf("Expected the result to be completed up to its 200 volumes, got %d", len(res.Volumes))
+	}
+	if len(cursors) != 1 || cursors[0].Offset != 50 || cursors[0].Limit != defaultQueryPageSize {
+		t.Errorf("Expected a single page at offset 50 with the default page size, got %v", cursors)
+	}
+
+	res = &cnstypes.CnsQueryResult{
+		Volumes: append([]cnstypes.CnsVolume{}, volumes[:50]...),
+		Cursor:  cnstypes.CnsCursor{TotalRecords: 100, Limit: 50},
+	}
+	res, err = completeQueryResult(cnstypes.CnsQueryFilter{}, res, func(cnstypes.CnsQueryFilter) (*cnstypes.CnsQueryResult, error) {
+		return &cnstypes.CnsQueryResult{}, nil
+	})
+	if err != ErrPartialQueryResult || len(res.Volumes) != 50 {
+		t.Errorf("Expected the 50 volumes received with ErrPartialQueryResult, got %d and %v", len(res.Volumes), err)
+	}
+}
@@ -0,0 +1,32 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// partialQueryResults counts the CNS queries which returned fewer volumes
+// than they reported to match.
+var partialQueryResults = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "vsphere_csi_cns_partial_query_results_total",
+	Help: "Number of CNS queries which returned partial results",
+})
+
+func init() {
+	prometheus.MustRegister(partialQueryResults)
+}
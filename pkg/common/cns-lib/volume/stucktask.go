@@ -0,0 +1,231 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vmware/govmomi/cns"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	vimtypes "github.com/vmware/govmomi/vim25/types"
+	"k8s.io/klog"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+)
+
+const (
+	// defaultStuckTaskCheckInterval is the default interval between checks of
+	// the running CNS tasks.
+	defaultStuckTaskCheckInterval = 30 * time.Second
+	// defaultStuckTaskRetries is the default number of times an operation is
+	// issued again after its task was cancelled.
+	defaultStuckTaskRetries = 1
+)
+
+// cancelledStuckTasks counts the CNS tasks cancelled because they were stuck.
+var cancelledStuckTasks = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "vsphere_csi_cns_stuck_tasks_cancelled_total",
+	Help: "Number of CNS tasks cancelled because their progress stalled",
+}, []string{"operation"})
+
+func init() {
+	prometheus.MustRegister(cancelledStuckTasks)
+}
+
+// trackedTask is a running CNS task issued by the volume manager.
+type trackedTask struct {
+	task      *object.Task
+	operation string
+	volumeID  string
+	// canCancel is false once the operation is out of retries
+	canCancel bool
+	started   time.Time
+	// progress is the last progress of the task, and progressed the time it
+	// was first seen
+	progress   int32
+	progressed time.Time
+	cancelled  bool
+}
+
+// stuckTasks holds the running CNS tasks of the volume manager and the
+// options of their remediation.
+type stuckTasks struct {
+	lock sync.Mutex
+	// threshold is the time without progress after which a task is
+	// cancelled. 0 disables the remediation.
+	threshold time.Duration
+	retries   int
+	tasks     map[string]*trackedTask
+	once      sync.Once
+}
+
+// SetStuckTaskRemediation starts cancelling the CNS tasks whose progress did
+// not change for the threshold of the config, and issuing their operation
+// again. A threshold of 0 disables the remediation.
+func (m *volumeManager) SetStuckTaskRemediation(cfg config.StuckTaskConfig) {
+	if cfg.ThresholdInSec <= 0 {
+		return
+	}
+	interval := defaultStuckTaskCheckInterval
+	if cfg.CheckIntervalInSec > 0 {
+		interval = time.Duration(cfg.CheckIntervalInSec) * time.Second
+	}
+	retries := defaultStuckTaskRetries
+	if cfg.Retries > 0 {
+		retries = cfg.Retries
+	}
+	m.stuckTasks.lock.Lock()
+	m.stuckTasks.threshold = time.Duration(cfg.ThresholdInSec) * time.Second
+	m.stuckTasks.retries = retries
+	m.stuckTasks.lock.Unlock()
+	m.stuckTasks.once.Do(func() {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for range ticker.C {
+				m.cancelStuckTasks()
+			}
+		}()
+	})
+	klog.V(2).Infof("Volume manager cancels CNS tasks without progress for %v, retrying their operation %d times",
+		m.stuckTasks.threshold, retries)
+}
+
+// waitForTask waits for the CNS task issued by issue and returns its info.
+// When the remediation of stuck tasks is enabled and the task is cancelled
+// for being stuck, the operation is issued again, up to the configured
+// retries.
+func (m *volumeManager) waitForTask(ctx context.Context, operation string, volumeID string,
+	issue func() (*object.Task, error)) (*vimtypes.TaskInfo, error) {
+	for attempt := 0; ; attempt++ {
+		task, err := issue()
+		if err != nil {
+			return nil, err
+		}
+		tracked := m.trackTask(task, operation, volumeID, attempt)
+		taskInfo, err := cns.GetTaskInfo(ctx, task)
+		if tracked == nil {
+			return taskInfo, err
+		}
+		cancelled := m.untrackTask(tracked)
+		if err == nil || !cancelled || ctx.Err() != nil {
+			return taskInfo, err
+		}
+		klog.Warningf("%s of volume %q: task %q was cancelled for being stuck, issuing it again",
+			operation, volumeID, task.Reference().Value)
+	}
+}
+
+// trackTask records the running task for the remediation of stuck tasks, if
+// enabled. attempt is the number of times the operation was issued before.
+func (m *volumeManager) trackTask(task *object.Task, operation string, volumeID string, attempt int) *trackedTask {
+	m.stuckTasks.lock.Lock()
+	defer m.stuckTasks.lock.Unlock()
+	if m.stuckTasks.threshold == 0 {
+		return nil
+	}
+	if m.stuckTasks.tasks == nil {
+		m.stuckTasks.tasks = make(map[string]*trackedTask)
+	}
+	now := time.Now()
+	tracked := &trackedTask{
+		task:       task,
+		operation:  operation,
+		volumeID:   volumeID,
+		canCancel:  attempt < m.stuckTasks.retries,
+		started:    now,
+		progressed: now,
+	}
+	m.stuckTasks.tasks[task.Reference().Value] = tracked
+	return tracked
+}
+
+// untrackTask removes the task from the running tasks and returns true if it
+// was cancelled for being stuck.
+func (m *volumeManager) untrackTask(tracked *trackedTask) bool {
+	m.stuckTasks.lock.Lock()
+	defer m.stuckTasks.lock.Unlock()
+	delete(m.stuckTasks.tasks, tracked.task.Reference().Value)
+	return tracked.cancelled
+}
+
+// cancelStuckTasks cancels the running tasks whose progress did not change
+// for the threshold. Tasks which are still making progress, such as the
+// clone of a large disk, are left alone however long they run, as are tasks
+// vCenter does not allow to cancel and tasks of operations out of retries.
+func (m *volumeManager) cancelStuckTasks() {
+	m.stuckTasks.lock.Lock()
+	var tasks []*trackedTask
+	for _, tracked := range m.stuckTasks.tasks {
+		if tracked.canCancel && !tracked.cancelled {
+			tasks = append(tasks, tracked)
+		}
+	}
+	threshold := m.stuckTasks.threshold
+	m.stuckTasks.lock.Unlock()
+	if len(tasks) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeouts.query)
+	defer cancel()
+	for _, tracked := range tasks {
+		var task mo.Task
+		pc := property.DefaultCollector(tracked.task.Client())
+		if err := pc.RetrieveOne(ctx, tracked.task.Reference(), []string{"info"}, &task); err != nil {
+			klog.Warningf("Failed to get info of %s task %q of volume %q. Err: %v",
+				tracked.operation, tracked.task.Reference().Value, tracked.volumeID, err)
+			continue
+		}
+		if !isTaskStuck(tracked, task.Info, threshold, time.Now()) {
+			continue
+		}
+		klog.Warningf("%s task %q of volume %q running for %v made no progress for %v, cancelling it",
+			tracked.operation, tracked.task.Reference().Value, tracked.volumeID, time.Since(tracked.started), threshold)
+		m.stuckTasks.lock.Lock()
+		tracked.cancelled = true
+		m.stuckTasks.lock.Unlock()
+		if err := tracked.task.Cancel(ctx); err != nil {
+			klog.Warningf("Failed to cancel %s task %q of volume %q. Err: %v",
+				tracked.operation, tracked.task.Reference().Value, tracked.volumeID, err)
+			m.stuckTasks.lock.Lock()
+			tracked.cancelled = false
+			m.stuckTasks.lock.Unlock()
+			continue
+		}
+		cancelledStuckTasks.WithLabelValues(tracked.operation).Inc()
+	}
+}
+
+// isTaskStuck records the progress of the task from its info and returns
+// true if the task is still running, can be cancelled and did not progress
+// for the threshold at the given time.
+func isTaskStuck(tracked *trackedTask, info vimtypes.TaskInfo, threshold time.Duration, now time.Time) bool {
+	if info.State != vimtypes.TaskInfoStateRunning && info.State != vimtypes.TaskInfoStateQueued {
+		return false
+	}
+	if info.Progress != tracked.progress {
+		tracked.progress = info.Progress
+		tracked.progressed = now
+		return false
+	}
+	return info.Cancelable && now.Sub(tracked.progressed) >= threshold
+}
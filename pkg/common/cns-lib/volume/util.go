@@ -20,6 +20,7 @@ import (
 	"context"
 	"errors"
 
+	cnstypes "github.com/vmware/govmomi/cns/types"
 	vimtypes "github.com/vmware/govmomi/vim25/types"
 	"k8s.io/klog"
 
@@ -65,3 +66,22 @@ func GetDiskAttachedToVM(ctx context.Context, vm *cnsvsphere.VirtualMachine, vol
 	klog.V(3).Infof("Volume %s is not attached to VM: %s", volumeID, vm.InventoryPath)
 	return "", nil
 }
+
+// getTaskResults returns the results of all the volumes of a CNS task, in the
+// order of the specs of the task.
+func getTaskResults(taskInfo *vimtypes.TaskInfo) ([]cnstypes.BaseCnsVolumeOperationResult, error) {
+	if taskInfo == nil {
+		return nil, errors.New("TaskInfo is empty")
+	}
+	var volumeResults []cnstypes.BaseCnsVolumeOperationResult
+	switch result := taskInfo.Result.(type) {
+	case cnstypes.CnsVolumeOperationBatchResult:
+		volumeResults = result.VolumeResults
+	case *cnstypes.CnsVolumeOperationBatchResult:
+		volumeResults = result.VolumeResults
+	}
+	if len(volumeResults) == 0 {
+		return nil, errors.New("Cannot get VolumeOperationResult")
+	}
+	return volumeResults, nil
+}
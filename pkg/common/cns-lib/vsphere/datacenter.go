@@ -18,6 +18,7 @@ package vsphere
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 
@@ -32,6 +33,15 @@ import (
 // DatastoreInfoProperty refers to the property name info for the Datastore
 const DatastoreInfoProperty = "info"
 
+// ErrHostGroupNotFound is returned when a DRS host group isn't found.
+var ErrHostGroupNotFound = errors.New("host group wasn't found")
+
+// ErrResourcePoolNotFound is returned when a resource pool isn't found.
+var ErrResourcePoolNotFound = errors.New("resource pool wasn't found")
+
+// ErrVsanFaultDomainNotFound is returned when no host is in a vSAN fault domain.
+var ErrVsanFaultDomainNotFound = errors.New("vSAN fault domain wasn't found")
+
 // Datacenter holds virtual center information along with the Datacenter.
 type Datacenter struct {
 	// Datacenter represents the govmomi Datacenter.
@@ -220,7 +230,118 @@ func (dc *Datacenter) GetAllDatastores(ctx context.Context) (map[string]*Datasto
 		dsURLInfoMap[dsMo.Info.GetDatastoreInfo().Url] = &DatastoreInfo{
 			&Datastore{object.NewDatastore(dc.Client(), dsMo.Reference()),
 				dc},
-			dsMo.Info.GetDatastoreInfo()}
+			dsMo.Info.GetDatastoreInfo(),
+			GetDatastoreType(dsMo.Info),
+			GetDatastoreBlockSizeMB(dsMo.Info)}
 	}
 	return dsURLInfoMap, nil
 }
+
+// GetHostsInHostGroup returns the hosts of the DRS host group with the given
+// name, looking it up in all clusters of the datacenter.
+func (dc *Datacenter) GetHostsInHostGroup(ctx context.Context, hostGroupName string) ([]types.ManagedObjectReference, error) {
+	finder := find.NewFinder(dc.Client(), false)
+	finder.SetDatacenter(dc.Datacenter)
+	clusters, err := finder.ClusterComputeResourceList(ctx, "*")
+	if err != nil {
+		if _, ok := err.(*find.NotFoundError); ok {
+			return nil, ErrHostGroupNotFound
+		}
+		klog.Errorf("Failed to get all the clusters in the Datacenter %s with error: %v", dc.Datacenter.String(), err)
+		return nil, err
+	}
+	var clusterList []types.ManagedObjectReference
+	for _, cluster := range clusters {
+		clusterList = append(clusterList, cluster.Reference())
+	}
+	var clusterMoList []mo.ClusterComputeResource
+	pc := property.DefaultCollector(dc.Client())
+	properties := []string{"configurationEx"}
+	err = pc.Retrieve(ctx, clusterList, properties, &clusterMoList)
+	if err != nil {
+		klog.Errorf("Failed to get cluster managed objects from cluster objects %v with properties %v: %v", clusterList, properties, err)
+		return nil, err
+	}
+	for _, clusterMo := range clusterMoList {
+		clusterConfig, ok := clusterMo.ConfigurationEx.(*types.ClusterConfigInfoEx)
+		if !ok {
+			continue
+		}
+		for _, group := range clusterConfig.Group {
+			if hostGroup, ok := group.(*types.ClusterHostGroup); ok && hostGroup.Name == hostGroupName {
+				return hostGroup.Host, nil
+			}
+		}
+	}
+	return nil, ErrHostGroupNotFound
+}
+
+// GetHostsInVsanFaultDomain returns the hosts of the datacenter in the vSAN
+// fault domain with the given name.
+func (dc *Datacenter) GetHostsInVsanFaultDomain(ctx context.Context, faultDomainName string) ([]types.ManagedObjectReference, error) {
+	finder := find.NewFinder(dc.Client(), false)
+	finder.SetDatacenter(dc.Datacenter)
+	hosts, err := finder.HostSystemList(ctx, "*")
+	if err != nil {
+		if _, ok := err.(*find.NotFoundError); ok {
+			return nil, ErrVsanFaultDomainNotFound
+		}
+		klog.Errorf("Failed to get all the hosts in the Datacenter %s with error: %v", dc.Datacenter.String(), err)
+		return nil, err
+	}
+	var hostList []types.ManagedObjectReference
+	for _, host := range hosts {
+		hostList = append(hostList, host.Reference())
+	}
+	var hostMoList []mo.HostSystem
+	pc := property.DefaultCollector(dc.Client())
+	properties := []string{"config.vsanHostConfig"}
+	err = pc.Retrieve(ctx, hostList, properties, &hostMoList)
+	if err != nil {
+		klog.Errorf("Failed to get host managed objects from host objects %v with properties %v: %v", hostList, properties, err)
+		return nil, err
+	}
+	var faultDomainHosts []types.ManagedObjectReference
+	for _, hostMo := range hostMoList {
+		if hostMo.Config == nil || hostMo.Config.VsanHostConfig == nil || hostMo.Config.VsanHostConfig.FaultDomainInfo == nil {
+			continue
+		}
+		if hostMo.Config.VsanHostConfig.FaultDomainInfo.Name == faultDomainName {
+			faultDomainHosts = append(faultDomainHosts, hostMo.Reference())
+		}
+	}
+	if len(faultDomainHosts) == 0 {
+		return nil, ErrVsanFaultDomainNotFound
+	}
+	return faultDomainHosts, nil
+}
+
+// GetDatastoresOfResourcePool returns the datastores of the compute resource
+// backing the resource pool with the given name or inventory path.
+func (dc *Datacenter) GetDatastoresOfResourcePool(ctx context.Context, resourcePoolPath string) ([]types.ManagedObjectReference, error) {
+	finder := find.NewFinder(dc.Client(), false)
+	finder.SetDatacenter(dc.Datacenter)
+	resourcePool, err := finder.ResourcePool(ctx, resourcePoolPath)
+	if err != nil {
+		if _, ok := err.(*find.NotFoundError); ok {
+			return nil, ErrResourcePoolNotFound
+		}
+		klog.Errorf("Failed to find resource pool %q in the Datacenter %s with error: %v", resourcePoolPath, dc.Datacenter.String(), err)
+		return nil, err
+	}
+	owner, err := resourcePool.Owner(ctx)
+	if err != nil {
+		klog.Errorf("Failed to get the owner of resource pool %q with error: %v", resourcePoolPath, err)
+		return nil, err
+	}
+	datastores, err := object.NewComputeResource(dc.Client(), owner.Reference()).Datastores(ctx)
+	if err != nil {
+		klog.Errorf("Failed to get the datastores of the owner of resource pool %q with error: %v", resourcePoolPath, err)
+		return nil, err
+	}
+	var datastoreRefs []types.ManagedObjectReference
+	for _, datastore := range datastores {
+		datastoreRefs = append(datastoreRefs, datastore.Reference())
+	}
+	return datastoreRefs, nil
+}
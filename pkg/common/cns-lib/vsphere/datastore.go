@@ -19,14 +19,22 @@ package vsphere
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/vmware/govmomi/object"
 	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/methods"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/govmomi/vslm"
 	"k8s.io/klog"
 )
 
+// DatastoreIOPSAttribute is the name of the custom attribute of datastores
+// advertising the IOPS they are capable of.
+const DatastoreIOPSAttribute = "csi.vsphere.vmware.com/iops"
+
 // Datastore holds Datastore and Datacenter information.
 type Datastore struct {
 	// Datastore represents the govmomi Datastore instance.
@@ -39,6 +47,44 @@ type Datastore struct {
 type DatastoreInfo struct {
 	*Datastore
 	Info *types.DatastoreInfo
+	// Type is the file system type of the datastore, e.g. "VMFS", "NFS" or "vsan".
+	Type string
+	// BlockSizeMB is the block size of the file system of the datastore, or 0
+	// if the datastore does not report one.
+	BlockSizeMB int64
+}
+
+// GetDatastoreType returns the file system type of a datastore from its info.
+// An empty string is returned for unknown datastore info types.
+func GetDatastoreType(info types.BaseDatastoreInfo) string {
+	switch dsInfo := info.(type) {
+	case *types.VmfsDatastoreInfo:
+		return string(types.HostFileSystemVolumeFileSystemTypeVMFS)
+	case *types.NasDatastoreInfo:
+		if dsInfo.Nas != nil && dsInfo.Nas.Type != "" {
+			return dsInfo.Nas.Type
+		}
+		return string(types.HostFileSystemVolumeFileSystemTypeNFS)
+	case *types.VvolDatastoreInfo:
+		return string(types.HostFileSystemVolumeFileSystemTypeVVOL)
+	case *types.PMemDatastoreInfo:
+		return string(types.HostFileSystemVolumeFileSystemTypePMEM)
+	}
+	// vSAN datastores have no specific info type
+	if strings.HasPrefix(info.GetDatastoreInfo().Url, "ds:///vmfs/volumes/vsan:") {
+		return string(types.HostFileSystemVolumeFileSystemTypeVsan)
+	}
+	return ""
+}
+
+// GetDatastoreBlockSizeMB returns the block size in MB of the file system of a
+// datastore from its info. Only VMFS datastores report a block size, 0 is
+// returned for other datastores.
+func GetDatastoreBlockSizeMB(info types.BaseDatastoreInfo) int64 {
+	if dsInfo, ok := info.(*types.VmfsDatastoreInfo); ok && dsInfo.Vmfs != nil {
+		return int64(dsInfo.Vmfs.BlockSizeMb)
+	}
+	return 0
 }
 
 func (di DatastoreInfo) String() string {
@@ -56,3 +102,144 @@ func (ds *Datastore) GetDatastoreURL(ctx context.Context) (string, error) {
 	}
 	return dsMo.Summary.Url, nil
 }
+
+// GetDatastoreCapacity returns the capacity and free space in bytes of the
+// datastore
+func (ds *Datastore) GetDatastoreCapacity(ctx context.Context) (int64, int64, error) {
+	var dsMo mo.Datastore
+	pc := property.DefaultCollector(ds.Client())
+	err := pc.RetrieveOne(ctx, ds.Datastore.Reference(), []string{"summary"}, &dsMo)
+	if err != nil {
+		klog.Errorf("Failed to retrieve datastore summary property: %v", err)
+		return 0, 0, err
+	}
+	return dsMo.Summary.Capacity, dsMo.Summary.FreeSpace, nil
+}
+
+// GetDatastoreIOPS returns the IOPS the datastore advertises with its IOPS
+// custom attribute, or 0 if the attribute is not set or is not a number.
+// The last value of the attribute is used.
+func (ds *Datastore) GetDatastoreIOPS(ctx context.Context) (int64, error) {
+	var dsMo mo.Datastore
+	pc := property.DefaultCollector(ds.Client())
+	err := pc.RetrieveOne(ctx, ds.Datastore.Reference(), []string{"availableField", "customValue"}, &dsMo)
+	if err != nil {
+		klog.Errorf("Failed to retrieve datastore custom attributes: %v", err)
+		return 0, err
+	}
+	var key int32 = -1
+	for _, field := range dsMo.AvailableField {
+		if field.Name == DatastoreIOPSAttribute {
+			key = field.Key
+			break
+		}
+	}
+	var iops int64
+	for _, value := range dsMo.CustomValue {
+		if value, ok := value.(*types.CustomFieldStringValue); ok && value.Key == key {
+			iops, err = strconv.ParseInt(strings.TrimSpace(value.Value), 10, 64)
+			if err != nil {
+				klog.Warningf("Ignoring invalid IOPS %q of datastore %s", value.Value, ds.Reference())
+				iops = 0
+			}
+		}
+	}
+	return iops, nil
+}
+
+// IsVStorageObjectPresent returns whether the first class disk with the given
+// ID exists on the datastore.
+func (ds *Datastore) IsVStorageObjectPresent(ctx context.Context, id string) (bool, error) {
+	_, err := vslm.NewObjectManager(ds.Client()).Retrieve(ctx, ds.Datastore, id)
+	if err != nil {
+		if IsNotFoundError(err) {
+			return false, nil
+		}
+		klog.Errorf("Failed to retrieve first class disk %s from datastore %s: %v", id, ds.Reference(), err)
+		return false, err
+	}
+	return true, nil
+}
+
+// GetVStorageObjectDiskUUID returns the UUID of the virtual disk backing the
+// first class disk with the given ID. It is the UUID the disk is presented
+// with to the virtual machines it is attached to.
+func (ds *Datastore) GetVStorageObjectDiskUUID(ctx context.Context, id string) (string, error) {
+	vStorageObject, err := vslm.NewObjectManager(ds.Client()).Retrieve(ctx, ds.Datastore, id)
+	if err != nil {
+		klog.Errorf("Failed to retrieve first class disk %s from datastore %s: %v", id, ds.Reference(), err)
+		return "", err
+	}
+	backing, ok := vStorageObject.Config.Backing.(*types.BaseConfigInfoDiskFileBackingInfo)
+	if !ok {
+		return "", fmt.Errorf("first class disk %s is not backed by a virtual disk file", id)
+	}
+	diskUUID, err := object.NewVirtualDiskManager(ds.Client()).QueryVirtualDiskUuid(ctx, backing.FilePath, ds.Datacenter.Datacenter)
+	if err != nil {
+		klog.Errorf("Failed to query UUID of virtual disk %s of first class disk %s: %v", backing.FilePath, id, err)
+		return "", err
+	}
+	return diskUUID, nil
+}
+
+// GetVStorageObjectConsumers returns the IDs of the consumers of the first
+// class disk with the given ID, i.e. the virtual machines CNS records it as
+// attached to.
+func (ds *Datastore) GetVStorageObjectConsumers(ctx context.Context, id string) ([]string, error) {
+	vStorageObject, err := vslm.NewObjectManager(ds.Client()).Retrieve(ctx, ds.Datastore, id)
+	if err != nil {
+		klog.Errorf("Failed to retrieve first class disk %s from datastore %s: %v", id, ds.Reference(), err)
+		return nil, err
+	}
+	var consumers []string
+	for _, consumer := range vStorageObject.Config.ConsumerId {
+		consumers = append(consumers, consumer.Id)
+	}
+	return consumers, nil
+}
+
+// ReconcileVStorageObjectInventory reconciles the catalog of the first class
+// disks of the datastore with the disks present on it, so that disks whose
+// location changed, e.g. after the datastore was resignatured, are recorded on
+// the datastore again.
+func (ds *Datastore) ReconcileVStorageObjectInventory(ctx context.Context) error {
+	task, err := vslm.NewObjectManager(ds.Client()).ReconcileDatastoreInventory(ctx, ds.Datastore)
+	if err != nil {
+		klog.Errorf("Failed to reconcile first class disk inventory of datastore %s: %v", ds.Reference(), err)
+		return err
+	}
+	if err = task.Wait(ctx); err != nil {
+		klog.Errorf("Failed to reconcile first class disk inventory of datastore %s: %v", ds.Reference(), err)
+		return err
+	}
+	return nil
+}
+
+// RelocateVStorageObject moves the first class disk with the given ID from the
+// datastore to the target datastore. The disk keeps its ID.
+func (ds *Datastore) RelocateVStorageObject(ctx context.Context, id string, target types.ManagedObjectReference) error {
+	req := types.RelocateVStorageObject_Task{
+		This:      vslm.NewObjectManager(ds.Client()).Reference(),
+		Id:        types.ID{Id: id},
+		Datastore: ds.Reference(),
+		Spec: types.VslmRelocateSpec{
+			VslmMigrateSpec: types.VslmMigrateSpec{
+				BackingSpec: &types.VslmCreateSpecDiskFileBackingSpec{
+					VslmCreateSpecBackingSpec: types.VslmCreateSpecBackingSpec{
+						Datastore: target,
+					},
+				},
+			},
+		},
+	}
+	res, err := methods.RelocateVStorageObject_Task(ctx, ds.Client(), &req)
+	if err != nil {
+		klog.Errorf("Failed to relocate first class disk %s from datastore %s to %s: %v", id, ds.Reference(), target, err)
+		return err
+	}
+	if err = object.NewTask(ds.Client(), res.Returnval).Wait(ctx); err != nil {
+		klog.Errorf("Failed to relocate first class disk %s from datastore %s to %s: %v", id, ds.Reference(), target, err)
+		return err
+	}
+	return nil
+}
@@ -58,7 +58,9 @@ func (host *HostSystem) GetAllAccessibleDatastores(ctx context.Context) ([]*Data
 			&DatastoreInfo{
 				&Datastore{object.NewDatastore(host.Client(), dsMo.Reference()),
 					nil},
-				dsMo.Info.GetDatastoreInfo()})
+				dsMo.Info.GetDatastoreInfo(),
+				GetDatastoreType(dsMo.Info),
+				GetDatastoreBlockSizeMB(dsMo.Info)})
 	}
 	return dsObjList, nil
 }
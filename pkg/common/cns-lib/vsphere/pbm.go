@@ -18,11 +18,29 @@ package vsphere
 
 import (
 	"context"
+	"errors"
 
 	"github.com/vmware/govmomi/pbm"
+	pbmtypes "github.com/vmware/govmomi/pbm/types"
+	"github.com/vmware/govmomi/vim25/types"
 	"k8s.io/klog"
 )
 
+const (
+	// tagCapabilityNamespace is the namespace of the capabilities of tag based
+	// placement rules in storage policies
+	tagCapabilityNamespace = "http://www.vmware.com/storage/tag"
+)
+
+var (
+	// ErrStoragePolicyTagNotFound is returned when no storage policy has a tag
+	// based placement rule for a tag.
+	ErrStoragePolicyTagNotFound = errors.New("no storage policy found with the tag")
+	// ErrStoragePolicyTagNotUnique is returned when several storage policies
+	// have a tag based placement rule for a tag.
+	ErrStoragePolicyTagNotUnique = errors.New("multiple storage policies found with the tag")
+)
+
 // ConnectPbm creates a PBM client for the virtual center.
 func (vc *VirtualCenter) ConnectPbm(ctx context.Context) error {
 	var err = vc.Connect(ctx)
@@ -58,3 +76,116 @@ func (vc *VirtualCenter) GetStoragePolicyIDByName(ctx context.Context, storagePo
 	}
 	return storagePolicyID, nil
 }
+
+// GetStoragePolicyIDByTag gets the ID of the storage policy with a tag based
+// placement rule for the given tag. ErrStoragePolicyTagNotFound or
+// ErrStoragePolicyTagNotUnique is returned if not exactly one policy matches.
+func (vc *VirtualCenter) GetStoragePolicyIDByTag(ctx context.Context, tag string) (string, error) {
+	resourceType := pbmtypes.PbmProfileResourceType{
+		ResourceType: string(pbmtypes.PbmProfileResourceTypeEnumSTORAGE),
+	}
+	ids, err := vc.PbmClient.QueryProfile(ctx, resourceType, string(pbmtypes.PbmProfileCategoryEnumREQUIREMENT))
+	if err != nil {
+		klog.Errorf("Failed to query storage policies with err: %v", err)
+		return "", err
+	}
+	profiles, err := vc.PbmClient.RetrieveContent(ctx, ids)
+	if err != nil {
+		klog.Errorf("Failed to retrieve storage policies with err: %v", err)
+		return "", err
+	}
+	var storagePolicyIDs []string
+	for _, profile := range profiles {
+		capabilityProfile, ok := profile.(*pbmtypes.PbmCapabilityProfile)
+		if ok && hasTagRule(capabilityProfile, tag) {
+			storagePolicyIDs = append(storagePolicyIDs, capabilityProfile.ProfileId.UniqueId)
+		}
+	}
+	switch len(storagePolicyIDs) {
+	case 0:
+		return "", ErrStoragePolicyTagNotFound
+	case 1:
+		return storagePolicyIDs[0], nil
+	default:
+		klog.Errorf("Storage policies %v all have the tag %q", storagePolicyIDs, tag)
+		return "", ErrStoragePolicyTagNotUnique
+	}
+}
+
+// GetCompatibleDatastores returns the datastores on which volumes with the
+// storage policy can be placed.
+func (vc *VirtualCenter) GetCompatibleDatastores(ctx context.Context, storagePolicyID string, datastores []*DatastoreInfo) ([]*DatastoreInfo, error) {
+	hubs := make([]pbmtypes.PbmPlacementHub, 0, len(datastores))
+	for _, datastore := range datastores {
+		hubs = append(hubs, pbmtypes.PbmPlacementHub{
+			HubType: datastore.Reference().Type,
+			HubId:   datastore.Reference().Value,
+		})
+	}
+	requirements := []pbmtypes.BasePbmPlacementRequirement{
+		&pbmtypes.PbmPlacementCapabilityProfileRequirement{
+			ProfileId: pbmtypes.PbmProfileId{UniqueId: storagePolicyID},
+		},
+	}
+	result, err := vc.PbmClient.CheckRequirements(ctx, hubs, nil, requirements)
+	if err != nil {
+		klog.Errorf("Failed to check requirements of storage policy %s with err: %v", storagePolicyID, err)
+		return nil, err
+	}
+	compatibleHubs := make(map[string]bool)
+	for _, hub := range result.CompatibleDatastores() {
+		compatibleHubs[hub.HubId] = true
+	}
+	var compatible []*DatastoreInfo
+	for _, datastore := range datastores {
+		if compatibleHubs[datastore.Reference().Value] {
+			compatible = append(compatible, datastore)
+		}
+	}
+	return compatible, nil
+}
+
+// hasTagRule returns true if the storage policy has a tag based placement rule
+// for the given tag.
+func hasTagRule(profile *pbmtypes.PbmCapabilityProfile, tag string) bool {
+	constraints, ok := profile.Constraints.(*pbmtypes.PbmCapabilitySubProfileConstraints)
+	if !ok {
+		return false
+	}
+	for _, subProfile := range constraints.SubProfiles {
+		for _, capability := range subProfile.Capability {
+			if capability.Id.Namespace != tagCapabilityNamespace {
+				continue
+			}
+			for _, constraint := range capability.Constraint {
+				for _, property := range constraint.PropertyInstance {
+					switch value := property.Value.(type) {
+					case string:
+						if value == tag {
+							return true
+						}
+					case pbmtypes.PbmCapabilityDiscreteSet:
+						if containsTag(value.Values, tag) {
+							return true
+						}
+					case *pbmtypes.PbmCapabilityDiscreteSet:
+						if containsTag(value.Values, tag) {
+							return true
+						}
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// containsTag returns true if the tag is one of the values of a discrete set.
+func containsTag(values []types.AnyType, tag string) bool {
+	for _, value := range values {
+		if value == tag {
+			return true
+		}
+	}
+	return false
+}
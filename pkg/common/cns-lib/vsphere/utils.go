@@ -22,6 +22,7 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	neturl "net/url"
 	"reflect"
 	"strconv"
 	"strings"
@@ -44,6 +45,15 @@ func IsInvalidCredentialsError(err error) bool {
 	return isInvalidCredentialsError
 }
 
+// IsNotFoundError returns true if error is of type NotFound
+func IsNotFoundError(err error) bool {
+	isNotFoundError := false
+	if soap.IsSoapFault(err) {
+		_, isNotFoundError = soap.ToSoapFault(err).VimFault().(types.NotFound)
+	}
+	return isNotFoundError
+}
+
 // GetCnsKubernetesEntityMetaData creates a CnsKubernetesEntityMetadataObject object from given parameters
 func GetCnsKubernetesEntityMetaData(entityName string, labels map[string]string, deleteFlag bool, entityType string, namespace string) *cnstypes.CnsKubernetesEntityMetadata {
 	// Create new metadata spec
@@ -96,13 +106,37 @@ func GetVirtualCenterConfig(cfg *config.Config) (*VirtualCenterConfig, error) {
 		Password:        cfg.VirtualCenter[host].Password,
 		Insecure:        cfg.VirtualCenter[host].InsecureFlag,
 		DatacenterPaths: strings.Split(cfg.VirtualCenter[host].Datacenters, ","),
+		Endpoint:        cfg.VirtualCenter[host].Endpoint,
+		Proxy:           cfg.VirtualCenter[host].Proxy,
 	}
 	for idx := range vcConfig.DatacenterPaths {
 		vcConfig.DatacenterPaths[idx] = strings.TrimSpace(vcConfig.DatacenterPaths[idx])
 	}
+	if vcConfig.Endpoint != "" {
+		if _, err := soap.ParseURL(vcConfig.Endpoint); err != nil {
+			return nil, fmt.Errorf("invalid endpoint %q of vCenter %s: %v", vcConfig.Endpoint, host, err)
+		}
+	}
+	if vcConfig.Proxy != "" {
+		if _, err := parseProxyURL(vcConfig.Proxy); err != nil {
+			return nil, fmt.Errorf("invalid proxy of vCenter %s: %v", host, err)
+		}
+	}
 	return vcConfig, nil
 }
 
+// parseProxyURL parses the URL of an HTTP(S) proxy.
+func parseProxyURL(proxy string) (*neturl.URL, error) {
+	u, err := neturl.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("proxy %q is not an http or https URL", proxy)
+	}
+	return u, nil
+}
+
 // GetVcenterIPs returns list of vCenter IPs from VSphereConfig
 func GetVcenterIPs(cfg *config.Config) ([]string, error) {
 	var err error
@@ -22,9 +22,11 @@ import (
 	"encoding/pem"
 	"fmt"
 	"net"
+	"net/http"
 	neturl "net/url"
 	"strconv"
 	"sync"
+	"time"
 
 	csictx "github.com/rexray/gocsi/context"
 	"github.com/vmware/govmomi"
@@ -61,6 +63,7 @@ type VirtualCenter struct {
 	// CnsClient represents the CNS client instance.
 	CnsClient       *cns.Client
 	credentialsLock sync.Mutex
+	keepAliveOnce   sync.Once
 }
 
 func (vc *VirtualCenter) String() string {
@@ -86,31 +89,56 @@ type VirtualCenterConfig struct {
 	RoundTripperCount int
 	// DatacenterPaths represents paths of datacenters on the virtual center.
 	DatacenterPaths []string
+	// Endpoint is the URL of the virtual center API connected to instead of
+	// its host and port, if set.
+	Endpoint string
+	// Proxy is the URL of the HTTP(S) proxy the virtual center is reached
+	// through, if set.
+	Proxy string
 }
 
 func (vcc *VirtualCenterConfig) String() string {
 	return fmt.Sprintf("VirtualCenterConfig [Scheme: %v, Host: %v, Port: %v, "+
 		"Username: %v, Password: %v, Insecure: %v, RoundTripperCount: %v, "+
-		"DatacenterPaths: %v]", vcc.Scheme, vcc.Host, vcc.Port, vcc.Username,
-		vcc.Password, vcc.Insecure, vcc.RoundTripperCount, vcc.DatacenterPaths)
+		"DatacenterPaths: %v, Endpoint: %v, Proxy: %v]", vcc.Scheme, vcc.Host, vcc.Port, vcc.Username,
+		vcc.Password, vcc.Insecure, vcc.RoundTripperCount, vcc.DatacenterPaths, vcc.Endpoint, vcc.Proxy)
 }
 
 // clientMutex is used for exclusive connection creation.
 var clientMutex sync.Mutex
 
+// serviceProxies maps the endpoint hosts of the virtual centers reached through
+// a proxy to the proxy URL, for the service clients of the virtual centers.
+var serviceProxies sync.Map
+
+// serviceProxyOnce is used for installing the lookup of serviceProxies in the
+// default transport once.
+var serviceProxyOnce sync.Once
+
 // newClient creates a new govmomi Client instance.
 func (vc *VirtualCenter) newClient(ctx context.Context) (*govmomi.Client, error) {
 	if vc.Config.Scheme == "" {
 		vc.Config.Scheme = DefaultScheme
 	}
 
-	url, err := soap.ParseURL(net.JoinHostPort(vc.Config.Host, strconv.Itoa(vc.Config.Port)))
+	endpoint := net.JoinHostPort(vc.Config.Host, strconv.Itoa(vc.Config.Port))
+	if vc.Config.Endpoint != "" {
+		endpoint = vc.Config.Endpoint
+	}
+	url, err := soap.ParseURL(endpoint)
 	if err != nil {
-		klog.Errorf("Failed to parse URL %s with err: %v", url, err)
+		klog.Errorf("Failed to parse URL %s with err: %v", endpoint, err)
 		return nil, err
 	}
+	klog.V(2).Infof("Connecting to vCenter %q at %s", vc.Config.Host, url)
 
 	soapClient := soap.NewClient(url, vc.Config.Insecure)
+	if vc.Config.Proxy != "" {
+		if err = setProxy(soapClient, vc.Config.Proxy); err != nil {
+			klog.Errorf("Failed to set proxy with err: %v", err)
+			return nil, err
+		}
+	}
 	vimClient, err := vim25.NewClient(ctx, soapClient)
 	if err != nil {
 		klog.Errorf("Failed to create new client with err: %v", err)
@@ -141,6 +169,42 @@ func (vc *VirtualCenter) newClient(ctx context.Context) (*govmomi.Client, error)
 	return client, nil
 }
 
+// setProxy routes the connections of the SOAP client through the HTTP(S) proxy
+// with the given URL. The service clients created from the SOAP client, such
+// as the CNS client, take their proxy from the default transport rather than
+// from the SOAP client, and the CNS client does not expose its SOAP client, so
+// the proxy is also registered for the host of the SOAP client in the default
+// transport. Connections to other hosts are left to the proxy of the default
+// transport.
+func setProxy(soapClient *soap.Client, proxy string) error {
+	proxyURL, err := parseProxyURL(proxy)
+	if err != nil {
+		return err
+	}
+	transport, ok := soapClient.Transport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("SOAP client transport does not support proxies")
+	}
+	transport.Proxy = http.ProxyURL(proxyURL)
+	serviceProxyOnce.Do(func() {
+		if defaultTransport, ok := http.DefaultTransport.(*http.Transport); ok {
+			defaultProxy := defaultTransport.Proxy
+			defaultTransport.Proxy = func(req *http.Request) (*neturl.URL, error) {
+				if proxyURL, ok := serviceProxies.Load(req.URL.Host); ok {
+					return proxyURL.(*neturl.URL), nil
+				}
+				if defaultProxy == nil {
+					return nil, nil
+				}
+				return defaultProxy(req)
+			}
+		}
+	})
+	serviceProxies.Store(soapClient.URL().Host, proxyURL)
+	klog.V(2).Infof("Connecting to vCenter %s through proxy %s", soapClient.URL().Host, proxyURL.Host)
+	return nil
+}
+
 // login calls SessionManager.LoginByToken if certificate and private key are configured,
 // otherwise calls SessionManager.Login with user and password.
 func (vc *VirtualCenter) login(ctx context.Context, client *govmomi.Client) error {
@@ -263,6 +327,41 @@ func (vc *VirtualCenter) connect(ctx context.Context) error {
 	return nil
 }
 
+// StartKeepAlive runs the health check of the virtual center at the given
+// interval, keeping the session from timing out while the driver is idle.
+// The session is established again, within the given timeout, when the health
+// check fails. Only the first call starts the keepalive.
+func (vc *VirtualCenter) StartKeepAlive(interval time.Duration, timeout time.Duration, healthCheck func() error) {
+	vc.keepAliveOnce.Do(func() {
+		klog.V(2).Infof("Keeping the session of vCenter %q alive every %v", vc.Config.Host, interval)
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for range ticker.C {
+				vc.keepAlive(timeout, healthCheck)
+			}
+		}()
+	})
+}
+
+// keepAlive runs the health check of the virtual center, connecting again if
+// it fails. Virtual centers not connected yet are left alone.
+func (vc *VirtualCenter) keepAlive(timeout time.Duration, healthCheck func() error) {
+	if vc.Client == nil {
+		return
+	}
+	err := healthCheck()
+	if err == nil {
+		return
+	}
+	klog.Warningf("Session keepalive for vCenter %q failed, reconnecting. err: %v", vc.Config.Host, err)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := vc.Connect(ctx); err != nil {
+		klog.Errorf("Failed to reconnect to vCenter %q. err: %v", vc.Config.Host, err)
+	}
+}
+
 // listDatacenters returns all Datacenters.
 func (vc *VirtualCenter) listDatacenters(ctx context.Context) ([]*Datacenter, error) {
 	finder := find.NewFinder(vc.Client.Client, false)
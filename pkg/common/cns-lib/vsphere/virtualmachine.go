@@ -21,19 +21,33 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"sort"
 	"sync"
 
 	"github.com/vmware/govmomi/object"
 	"github.com/vmware/govmomi/vapi/rest"
 	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/methods"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/govmomi/vslm"
 	"k8s.io/klog"
 )
 
 // ErrVMNotFound is returned when a virtual machine isn't found.
 var ErrVMNotFound = errors.New("virtual machine wasn't found")
 
+// ErrNoFreeSCSIController is returned when no SCSI controller of a virtual
+// machine has a free unit.
+var ErrNoFreeSCSIController = errors.New("no SCSI controller with a free unit found")
+
+// ErrDiskNotFound is returned when a disk isn't attached to a virtual machine.
+var ErrDiskNotFound = errors.New("disk isn't attached to the virtual machine")
+
+// scsiControllerUnits is the number of unit numbers of a SCSI controller,
+// including the unit of the controller itself.
+const scsiControllerUnits = 16
+
 // VirtualMachine holds details of a virtual machine instance.
 type VirtualMachine struct {
 	// VirtualCenterHost represents the virtual machine's vCenter host.
@@ -215,6 +229,23 @@ func (vm *VirtualMachine) GetHostSystem(ctx context.Context) (*object.HostSystem
 	return vmHost, nil
 }
 
+// IsHostInMaintenanceMode returns true if the host of the virtual machine is
+// in maintenance mode.
+func (vm *VirtualMachine) IsHostInMaintenanceMode(ctx context.Context) (bool, error) {
+	vmHost, err := vm.VirtualMachine.HostSystem(ctx)
+	if err != nil {
+		klog.Errorf("Failed to get host system for vm: %v. err: %+v", vm, err)
+		return false, err
+	}
+	var oHost mo.HostSystem
+	err = vmHost.Properties(ctx, vmHost.Reference(), []string{"runtime"}, &oHost)
+	if err != nil {
+		klog.Errorf("Failed to get host system properties. err: %+v", err)
+		return false, err
+	}
+	return oHost.Runtime.InMaintenanceMode, nil
+}
+
 // GetTagManager returns tagManager using vm client
 func (vm *VirtualMachine) GetTagManager(ctx context.Context) (*tags.Manager, error) {
 	restClient := rest.NewClient(vm.Client())
@@ -351,3 +382,314 @@ func (vm *VirtualMachine) IsInZoneRegion(ctx context.Context, zoneCategoryName s
 	}
 	return false, nil
 }
+
+// IsUnreachable returns true if the virtual machine is not powered on or its
+// guest heartbeat reports the guest as unresponsive.
+func (vm *VirtualMachine) IsUnreachable(ctx context.Context) (bool, error) {
+	vmMoList, err := vm.Datacenter.GetVMMoList(ctx, []*VirtualMachine{vm}, []string{"summary"})
+	if err != nil {
+		klog.Errorf("Failed to get VM Managed object with property summary. err: +%v", err)
+		return false, err
+	}
+	summary := vmMoList[0].Summary
+	if summary.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOn {
+		return true, nil
+	}
+	return summary.QuickStats.GuestHeartbeatStatus == types.ManagedEntityStatusRed, nil
+}
+
+// GetUUIDs returns the BIOS UUID and the instance UUID of the virtual
+// machine, either of which identifies it as the consumer of the first class
+// disks CNS attached to it.
+func (vm *VirtualMachine) GetUUIDs(ctx context.Context) (map[string]bool, error) {
+	var o mo.VirtualMachine
+	if err := vm.Properties(ctx, vm.Reference(), []string{"config.uuid", "config.instanceUuid"}, &o); err != nil {
+		klog.Errorf("Failed to get UUIDs of VM %v. err: %v", vm, err)
+		return nil, err
+	}
+	uuids := map[string]bool{vm.UUID: true}
+	if o.Config != nil {
+		uuids[o.Config.Uuid] = true
+		uuids[o.Config.InstanceUuid] = true
+	}
+	delete(uuids, "")
+	return uuids, nil
+}
+
+// IsDiskAttached returns true if the first class disk with the given ID is
+// attached to the virtual machine.
+func (vm *VirtualMachine) IsDiskAttached(ctx context.Context, diskID string) (bool, error) {
+	devices, err := vm.Device(ctx)
+	if err != nil {
+		klog.Errorf("Failed to get devices of VM %v. err: %v", vm, err)
+		return false, err
+	}
+	for _, device := range devices.SelectByType((*types.VirtualDisk)(nil)) {
+		disk := device.(*types.VirtualDisk)
+		if disk.VDiskId != nil && disk.VDiskId.Id == diskID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ForceDetachDisk removes the first class disk with the given ID from the
+// virtual machine through a reconfigure of the virtual machine, bypassing CNS.
+// The backing file of the disk is kept.
+func (vm *VirtualMachine) ForceDetachDisk(ctx context.Context, diskID string) error {
+	devices, err := vm.Device(ctx)
+	if err != nil {
+		klog.Errorf("Failed to get devices of VM %v. err: %v", vm, err)
+		return err
+	}
+	for _, device := range devices.SelectByType((*types.VirtualDisk)(nil)) {
+		disk := device.(*types.VirtualDisk)
+		if disk.VDiskId == nil || disk.VDiskId.Id != diskID {
+			continue
+		}
+		if err := vm.RemoveDevice(ctx, true, disk); err != nil {
+			klog.Errorf("Failed to remove disk %s from VM %v. err: %v", diskID, vm, err)
+			return err
+		}
+		return nil
+	}
+	klog.V(2).Infof("Disk %s is not attached to VM %v", diskID, vm)
+	return nil
+}
+
+// SelectSCSIController returns the key, bus number and a free unit number of
+// the SCSI controller with the given bus number. If that controller has no
+// free unit, the controllers with the next bus numbers are tried in turn.
+// When an adapter type, such as lsilogic or pvscsi, is given, controllers of
+// other types are skipped.
+func SelectSCSIController(devices object.VirtualDeviceList, busNumber int32, adapterType string) (int32, int32, int32, error) {
+	var controllers []*types.VirtualSCSIController
+	for _, device := range devices {
+		if controller, ok := device.(types.BaseVirtualSCSIController); ok {
+			if adapterType != "" && devices.Type(device) != adapterType {
+				continue
+			}
+			controllers = append(controllers, controller.GetVirtualSCSIController())
+		}
+	}
+	sort.Slice(controllers, func(i, j int) bool {
+		return controllers[i].BusNumber < controllers[j].BusNumber
+	})
+	// Start with the requested controller, or the next one if it doesn't exist
+	start := sort.Search(len(controllers), func(i int) bool {
+		return controllers[i].BusNumber >= busNumber
+	})
+	for i := range controllers {
+		controller := controllers[(start+i)%len(controllers)]
+		usedUnits := map[int32]bool{controller.ScsiCtlrUnitNumber: true}
+		for _, device := range devices {
+			d := device.GetVirtualDevice()
+			if d.ControllerKey == controller.Key && d.UnitNumber != nil {
+				usedUnits[*d.UnitNumber] = true
+			}
+		}
+		for unit := int32(0); unit < scsiControllerUnits; unit++ {
+			if !usedUnits[unit] {
+				return controller.Key, controller.BusNumber, unit, nil
+			}
+		}
+	}
+	return 0, 0, 0, ErrNoFreeSCSIController
+}
+
+// AttachDiskToSCSIController attaches the first class disk with the given ID
+// to the SCSI controller with the given bus number, or to the next controller
+// with a free unit, of the given adapter type if set. It returns the UUID of
+// the attached disk and the bus number of the controller used. A disk which is
+// already attached is left on its controller. The disk is attached through
+// the virtual machine, bypassing CNS, as CNS does not let the controller be
+// chosen: CNS does not record the attachment, so the disk must be detached
+// with ForceDetachDisk rather than through CNS.
+func (vm *VirtualMachine) AttachDiskToSCSIController(ctx context.Context, diskID string, datastore types.ManagedObjectReference,
+	busNumber int32, adapterType string) (string, int32, error) {
+	return vm.attachDisk(ctx, diskID, busNumber, adapterType, func(controllerKey int32, unitNumber int32) error {
+		req := types.AttachDisk_Task{
+			This:          vm.Reference(),
+			DiskId:        types.ID{Id: diskID},
+			Datastore:     datastore,
+			ControllerKey: controllerKey,
+			UnitNumber:    &unitNumber,
+		}
+		res, err := methods.AttachDisk_Task(ctx, vm.Client(), &req)
+		if err != nil {
+			return err
+		}
+		return object.NewTask(vm.Client(), res.Returnval).Wait(ctx)
+	})
+}
+
+// AttachMultiWriterDisk attaches the first class disk with the given ID with
+// multi-writer sharing, like AttachDiskToSCSIController, bypassing CNS. Sharing is set in the
+// reconfigure of the virtual machine adding the disk, as a disk already
+// attached to another virtual machine can't be attached without it.
+func (vm *VirtualMachine) AttachMultiWriterDisk(ctx context.Context, diskID string, datastore types.ManagedObjectReference,
+	busNumber int32, adapterType string) (string, int32, error) {
+	vStorageObject, err := vslm.NewObjectManager(vm.Client()).Retrieve(ctx, datastore, diskID)
+	if err != nil {
+		klog.Errorf("Failed to retrieve first class disk %s from datastore %s: %v", diskID, datastore, err)
+		return "", 0, err
+	}
+	backing, ok := vStorageObject.Config.Backing.(*types.BaseConfigInfoDiskFileBackingInfo)
+	if !ok {
+		return "", 0, fmt.Errorf("first class disk %s is not backed by a virtual disk file", diskID)
+	}
+	return vm.attachDisk(ctx, diskID, busNumber, adapterType, func(controllerKey int32, unitNumber int32) error {
+		disk := &types.VirtualDisk{
+			VirtualDevice: types.VirtualDevice{
+				Key:           -1,
+				ControllerKey: controllerKey,
+				UnitNumber:    &unitNumber,
+				Backing: &types.VirtualDiskFlatVer2BackingInfo{
+					VirtualDeviceFileBackingInfo: types.VirtualDeviceFileBackingInfo{
+						FileName:  backing.FilePath,
+						Datastore: &datastore,
+					},
+					DiskMode: string(types.VirtualDiskModePersistent),
+					Sharing:  string(types.VirtualDiskSharingSharingMultiWriter),
+				},
+			},
+			VDiskId: &types.ID{Id: diskID},
+		}
+		// No capacity, so the existing disk file is attached
+		return vm.AddDevice(ctx, disk)
+	})
+}
+
+// attachDisk attaches the first class disk with the given ID with attach,
+// given the key and a free unit number of the selected SCSI controller. It
+// returns the UUID of the attached disk and the bus number of the controller
+// used. A disk which is already attached is left on its controller.
+func (vm *VirtualMachine) attachDisk(ctx context.Context, diskID string, busNumber int32, adapterType string,
+	attach func(controllerKey int32, unitNumber int32) error) (string, int32, error) {
+	devices, err := vm.Device(ctx)
+	if err != nil {
+		klog.Errorf("Failed to get devices of VM %v. err: %v", vm, err)
+		return "", 0, err
+	}
+	if diskUUID, usedBus, found := findDiskController(devices, diskID); found {
+		klog.V(2).Infof("Disk %s is already attached to SCSI controller %d of VM %v", diskID, usedBus, vm)
+		return diskUUID, usedBus, nil
+	}
+	controllerKey, usedBus, unitNumber, err := SelectSCSIController(devices, busNumber, adapterType)
+	if err != nil {
+		klog.Errorf("Failed to select SCSI controller of VM %v for disk %s. err: %v", vm, diskID, err)
+		return "", 0, err
+	}
+	if usedBus != busNumber {
+		klog.V(2).Infof("SCSI controller %d of VM %v is not available, using controller %d for disk %s", busNumber, vm, usedBus, diskID)
+	}
+	if err = attach(controllerKey, unitNumber); err != nil {
+		klog.Errorf("Failed to attach disk %s to VM %v. err: %v", diskID, vm, err)
+		return "", 0, err
+	}
+	if devices, err = vm.Device(ctx); err != nil {
+		klog.Errorf("Failed to get devices of VM %v. err: %v", vm, err)
+		return "", 0, err
+	}
+	diskUUID, usedBus, found := findDiskController(devices, diskID)
+	if !found {
+		return "", 0, fmt.Errorf("disk %s not found on VM %v after attach", diskID, vm)
+	}
+	return diskUUID, usedBus, nil
+}
+
+// SupportsSCSIController returns true if the guest OS of the virtual machine
+// supports SCSI controllers of the given adapter type, such as lsilogic or
+// pvscsi. Guest OSes vCenter has no descriptor of are assumed to support it.
+func (vm *VirtualMachine) SupportsSCSIController(ctx context.Context, adapterType string) (bool, error) {
+	var o mo.VirtualMachine
+	if err := vm.Properties(ctx, vm.Reference(), []string{"config.guestId", "environmentBrowser"}, &o); err != nil {
+		klog.Errorf("Failed to get guest OS of VM %v. err: %v", vm, err)
+		return false, err
+	}
+	if o.Config == nil {
+		return true, nil
+	}
+	req := types.QueryConfigOptionEx{
+		This: o.EnvironmentBrowser,
+		Spec: &types.EnvironmentBrowserConfigOptionQuerySpec{GuestId: []string{o.Config.GuestId}},
+	}
+	res, err := methods.QueryConfigOptionEx(ctx, vm.Client(), &req)
+	if err != nil {
+		klog.Errorf("Failed to get config options of guest OS %s of VM %v. err: %v", o.Config.GuestId, vm, err)
+		return false, err
+	}
+	if res.Returnval == nil {
+		return true, nil
+	}
+	var controllerType string
+	controllers := object.SCSIControllerTypes()
+	for _, controller := range controllers {
+		if controllers.Type(controller) == adapterType {
+			controllerType = controllers.TypeName(controller)
+		}
+	}
+	for _, guest := range res.Returnval.GuestOSDescriptor {
+		if guest.Id != o.Config.GuestId {
+			continue
+		}
+		for _, supported := range guest.SupportedDiskControllerList {
+			if supported == controllerType {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// IsDiskMultiWriter returns true if the first class disk with the given ID is
+// attached to the virtual machine with multi-writer sharing.
+func (vm *VirtualMachine) IsDiskMultiWriter(ctx context.Context, diskID string) (bool, error) {
+	disk, err := vm.getDisk(ctx, diskID)
+	if err == ErrDiskNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	backing, ok := disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+	return ok && backing.Sharing == string(types.VirtualDiskSharingSharingMultiWriter), nil
+}
+
+// getDisk returns the first class disk with the given ID attached to the
+// virtual machine, or ErrDiskNotFound.
+func (vm *VirtualMachine) getDisk(ctx context.Context, diskID string) (*types.VirtualDisk, error) {
+	devices, err := vm.Device(ctx)
+	if err != nil {
+		klog.Errorf("Failed to get devices of VM %v. err: %v", vm, err)
+		return nil, err
+	}
+	for _, device := range devices.SelectByType((*types.VirtualDisk)(nil)) {
+		disk := device.(*types.VirtualDisk)
+		if disk.VDiskId != nil && disk.VDiskId.Id == diskID {
+			return disk, nil
+		}
+	}
+	return nil, ErrDiskNotFound
+}
+
+// findDiskController returns the UUID of the first class disk with the given
+// ID and the bus number of its SCSI controller, if the disk is one of the devices.
+func findDiskController(devices object.VirtualDeviceList, diskID string) (string, int32, bool) {
+	for _, device := range devices.SelectByType((*types.VirtualDisk)(nil)) {
+		disk := device.(*types.VirtualDisk)
+		if disk.VDiskId == nil || disk.VDiskId.Id != diskID {
+			continue
+		}
+		var diskUUID string
+		if backing, ok := disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo); ok {
+			diskUUID = backing.Uuid
+		}
+		var busNumber int32
+		if controller, ok := devices.FindByKey(disk.ControllerKey).(types.BaseVirtualSCSIController); ok {
+			busNumber = controller.GetVirtualSCSIController().BusNumber
+		}
+		return diskUUID, busNumber, true
+	}
+	return "", 0, false
+}
@@ -33,6 +33,16 @@ type Config struct {
 		InsecureFlag bool `gcfg:"insecure-flag"`
 		// Datacenter in which Node VMs are located.
 		Datacenters string `gcfg:"datacenters"`
+		// True to let the syncer release volumes still attached to node VMs
+		// that were deleted from vCenter.
+		GhostVMCleanup bool `gcfg:"ghost-vm-cleanup"`
+		// Interval in seconds between vCenter health checks keeping the
+		// vCenter session alive while the driver is idle, so it does not time
+		// out. 0 disables the keepalive.
+		SessionKeepAliveIntervalInSec int `gcfg:"session-keepalive-interval-seconds"`
+		// Size of the volumes requested with no required size, as a
+		// quantity such as 10Gi. Defaults to 10Gi.
+		DefaultVolumeSize string `gcfg:"default-volume-size"`
 	}
 
 	// Virtual Center configurations
@@ -42,7 +52,259 @@ type Config struct {
 	Labels struct {
 		Zone   string `gcfg:"zone"`
 		Region string `gcfg:"region"`
+		// Topology keys reporting the zone and region of the nodes. Defaults
+		// to the failure-domain.beta.kubernetes.io labels
+		ZoneKey   string `gcfg:"zone-key"`
+		RegionKey string `gcfg:"region-key"`
 	}
+
+	// Timeouts for vCenter calls made by the CNS volume manager
+	OperationTimeout OperationTimeoutConfig `gcfg:"operation-timeout"`
+
+	// Remediation of the CNS tasks of the CNS volume manager stuck in vCenter
+	StuckTask StuckTaskConfig `gcfg:"stuck-task"`
+
+	// Metadata syncer configurations
+	Syncer SyncerConfig `gcfg:"syncer"`
+
+	// Node service configurations
+	Node NodeConfig `gcfg:"node"`
+
+	// Controller service configurations
+	Controller ControllerConfig `gcfg:"controller"`
+
+	// Cluster-wide provisioning quotas, keyed by storage policy name
+	StoragePolicyQuota map[string]*StoragePolicyQuotaConfig
+
+	// Datastores preferred for topology-aware provisioning, keyed by zone
+	PreferredDatastores map[string]*PreferredDatastoresConfig
+
+	// Storage policies holding the caching rule of each cache policy, keyed
+	// by cache policy
+	CachePolicy map[string]*CachePolicyConfig
+}
+
+// CachePolicyConfig contains the storage policy applied to volumes requesting
+// a cache policy.
+type CachePolicyConfig struct {
+	// Name of the storage policy with the caching rule of the cache policy.
+	StoragePolicyName string `gcfg:"storage-policy-name"`
+}
+
+// PreferredDatastoresConfig contains the datastores preferred for volumes
+// provisioned in a zone.
+type PreferredDatastoresConfig struct {
+	// Comma separated URLs of the datastores tried in order before the other
+	// datastores of the zone.
+	DatastoreURLs string `gcfg:"datastore-urls"`
+}
+
+// StoragePolicyQuotaConfig contains the provisioning quota of a storage policy.
+type StoragePolicyQuotaConfig struct {
+	// Total capacity in GB of the volumes which can be provisioned with the
+	// storage policy.
+	CapacityInGB int64 `gcfg:"capacity-gb"`
+}
+
+// ControllerConfig contains the options of the controller service.
+type ControllerConfig struct {
+	// Number of consecutive failed detaches of a volume from a node after
+	// which the disk is force detached by reconfiguring the node VM, if the
+	// node VM is powered off or its guest is unresponsive. 0 disables force
+	// detach.
+	ForceDetachAfterFailures int `gcfg:"force-detach-after-failures"`
+	// True to detach the volumes of a node being drained as soon as the pods
+	// using them are gone, instead of waiting for kubelet.
+	DrainDetach bool `gcfg:"drain-detach"`
+	// Comma separated keys of the node taints marking a node as being drained
+	// or shut down. Unset values fall back to the controller defaults.
+	DrainTaints string `gcfg:"drain-taints"`
+	// True to complete, on startup, the detaches of VolumeAttachments being
+	// deleted, which may have been in flight when the controller stopped.
+	ReconcileAttachmentsOnStartup bool `gcfg:"reconcile-attachments-on-startup"`
+	// True to detach the volumes of deleted nodes and remove their
+	// VolumeAttachments, so the volumes can be attached to other nodes.
+	NodeDeleteForceDetach bool `gcfg:"node-delete-force-detach"`
+	// Time in seconds waited after a node is deleted before its volumes are
+	// detached, to ignore transient node churn. Unset values fall back to the
+	// controller default.
+	NodeDeleteForceDetachDelayInSec int `gcfg:"node-delete-force-detach-delay-seconds"`
+	// True to refuse deleting volumes which are still attached to a node,
+	// unless the StorageClass of the volume allows it.
+	ProtectAttachedVolumes bool `gcfg:"protect-attached-volumes"`
+	// True to refuse attaching volumes to node VMs whose host is in
+	// maintenance mode, so the pod is rescheduled to another node.
+	RefuseAttachInMaintenanceMode bool `gcfg:"refuse-attach-in-maintenance-mode"`
+	// True to serialize the attaches and deletes of each volume and refuse
+	// attaching volumes with a pending delete.
+	RefuseAttachDuringDelete bool `gcfg:"refuse-attach-during-delete"`
+	// ConfigMap, as "namespace/name", holding the StorageClass parameters
+	// CreateVolume requests must set ("required") or must not set
+	// ("forbidden"), as comma separated parameter names.
+	ParameterPolicyConfigMap string `gcfg:"parameter-policy-configmap"`
+	// True to round the capacity of new volumes up to a multiple of the block
+	// size of the datastores they may be placed on.
+	AlignVolumeSize bool `gcfg:"align-volume-size"`
+	// Time in milliseconds during which attaches of volumes to the same node
+	// VM are collected and issued as a single CNS attach task, cutting the
+	// vCenter tasks of pods with many volumes. 0 disables batching.
+	AttachBatchWindowInMs int `gcfg:"attach-batch-window-milliseconds"`
+	// True to return from ControllerPublishVolume once the CNS attach task is
+	// issued, without waiting for its completion. NodeStageVolume waits for
+	// the device of the volume instead, and failed attaches are retried by
+	// the controller. Volumes attached to a given SCSI controller or with
+	// multi-writer sharing are always awaited.
+	DeferredAttach bool `gcfg:"deferred-attach"`
+	// True to honor the datastoreantiaffinity StorageClass parameter, which
+	// places new volumes on a datastore other than the ones of the volumes
+	// attached to the node selected for their pod. The provisioner must pass
+	// the PVC metadata with the CreateVolume parameters, which
+	// csi-provisioner does from v1.5.0 on with --extra-create-metadata.
+	DatastoreAntiAffinity bool `gcfg:"datastore-anti-affinity"`
+	// Address, e.g. ":9811", on which the capacity metrics of the shared
+	// datastores of the cluster are exposed. It must differ from the syncer
+	// metrics address, as the syncer runs in the controller pod. Empty
+	// disables the metrics.
+	MetricsAddress string `gcfg:"metrics-address"`
+	// Interval in seconds between reads of the capacity of the shared
+	// datastores. Unset values fall back to the controller service default.
+	DatastoreMetricsIntervalInSec int `gcfg:"datastore-metrics-interval-seconds"`
+	// Interval in seconds between refreshes of the storage policy quota usage
+	// from CNS, which uncharges volumes deleted outside the controller. Unset
+	// values fall back to the controller service default.
+	QuotaRefreshIntervalInSec int `gcfg:"quota-refresh-interval-seconds"`
+	// Address, e.g. ":9812", on which the effective config and capabilities
+	// of the driver are exposed for troubleshooting. It must differ from the
+	// livenessprobe port, 9808. Empty disables it.
+	DiagnosticsAddress string `gcfg:"diagnostics-address"`
+}
+
+// NodeConfig contains the options of the node service.
+type NodeConfig struct {
+	// Number of times a failed unmount in NodeUnpublishVolume is retried.
+	// Unset values fall back to the node service default.
+	UnmountRetries int `gcfg:"unmount-retries"`
+	// True to lazily unmount the target once unmount retries are exhausted.
+	LazyUnmountFallback bool `gcfg:"lazy-unmount-fallback"`
+	// Address, e.g. ":9809", on which I/O metrics of the volumes published
+	// on the node are exposed. Empty disables the metrics.
+	MetricsAddress string `gcfg:"metrics-address"`
+	// Interval in seconds between reads of the I/O stats of the published
+	// volumes. Unset values fall back to the node service default.
+	VolumeStatsIntervalInSec int `gcfg:"volume-stats-interval-seconds"`
+	// True to check, and repair when safe, the filesystem of a volume before
+	// it is mounted in NodeStageVolume.
+	FsckBeforeMount bool `gcfg:"fsck-before-mount"`
+	// Time in seconds NodeStageVolume waits for the device of volumes whose
+	// attach was deferred by the controller. Unset values fall back to the
+	// node service default.
+	DeferredAttachDeviceWaitInSec int `gcfg:"deferred-attach-device-wait-seconds"`
+	// Address, e.g. ":9813", on which the effective config and capabilities
+	// of the driver are exposed for troubleshooting. It must differ from the
+	// livenessprobe port, 9808, and the node metrics port. Empty disables it.
+	DiagnosticsAddress string `gcfg:"diagnostics-address"`
+}
+
+// SyncerConfig contains the options of the metadata syncer.
+type SyncerConfig struct {
+	// Interval in minutes between checks of the attach state of volumes
+	// against the disks of the node VMs. 0 disables the check.
+	AttachCheckIntervalInMin int `gcfg:"attach-check-interval-minutes"`
+	// True to re-attach volumes which are attached according to Kubernetes
+	// but missing from the disks of their node VM. Re-attaching is the only
+	// correction, other discrepancies such as attachments CNS records for
+	// disks the node VM no longer has are only reported.
+	AttachCheckAutoCorrect bool `gcfg:"attach-check-auto-correct"`
+	// Time in minutes the CNS volume of a deleted PV is kept before it is
+	// removed from CNS, when the backing disk is retained. 0 removes it
+	// immediately.
+	MetadataRetentionPeriodInMin int `gcfg:"metadata-retention-period"`
+	// Address, e.g. ":9810", on which the metrics of the syncer and, under
+	// /volumes, the mapping of the CNS volumes to their PV, PVC, pods and
+	// nodes are exposed. It must differ from the controller metrics address.
+	// Empty disables them.
+	MetricsAddress string `gcfg:"metrics-address"`
+	// Comma separated kinds, e.g. "StatefulSet,MyDatabase", of the owners
+	// followed from PVCs to record their owner chain as CNS metadata. The
+	// syncer needs get access to the configured kinds. Empty disables it.
+	OwnerKinds string `gcfg:"owner-kinds"`
+	// Number of times a full sync which failed to query vCenter is retried
+	// before waiting for the next full sync interval. 0 disables retries.
+	FullSyncRetries int `gcfg:"full-sync-retries"`
+	// Time in seconds waited before the first retry of a failed full sync,
+	// doubled on each further retry. Unset values default to 30 seconds.
+	FullSyncRetryBackoffInSec int `gcfg:"full-sync-retry-backoff-seconds"`
+	// Number of volumes reconciled in parallel by full sync. Unset values
+	// reconcile volumes sequentially.
+	FullSyncWorkers int `gcfg:"full-sync-workers"`
+	// Number of PV, PVC and pod events whose metadata updates are processed in
+	// parallel. Events of the same object are processed in order. Unset values
+	// process events sequentially in the informer of their kind.
+	MetadataSyncWorkers int `gcfg:"metadata-sync-workers"`
+	// Interval in minutes between inventory reports of the CNS volumes of the
+	// cluster. 0 disables the report.
+	InventoryReportIntervalInMin int `gcfg:"inventory-report-interval-minutes"`
+	// ConfigMap, as "namespace/name", the inventory report is written to.
+	InventoryReportConfigMap string `gcfg:"inventory-report-configmap"`
+	// True to remove from CNS the volumes whose backing disk no longer exists,
+	// after annotating their PV as lost so full sync does not register them
+	// again. Such volumes are otherwise only reported.
+	CleanupMissingBackingVolumes bool `gcfg:"cleanup-missing-backing-volumes"`
+	// True to periodically remove from CNS the volumes which are not referenced
+	// by any PV and whose backing disk no longer exists, e.g. left behind by a
+	// failed CreateVolume.
+	SweepFailedProvisionMetadata bool `gcfg:"sweep-failed-provision-metadata"`
+	// Interval in minutes between sweeps of failed provision metadata. Unset
+	// values default to 30 minutes.
+	FailedProvisionSweepIntervalInMin int `gcfg:"failed-provision-sweep-interval-minutes"`
+	// Interval in minutes between datastore rebalancing cycles, which relocate
+	// detached volumes from the fullest to the emptiest shared datastores of
+	// the cluster. 0 disables rebalancing.
+	RebalanceIntervalInMin int `gcfg:"rebalance-interval-minutes"`
+	// Difference in percentage points between the utilization of the fullest
+	// and the emptiest shared datastores above which volumes are relocated.
+	// Unset values default to 20.
+	RebalanceSkewThresholdPercent int `gcfg:"rebalance-skew-threshold-percent"`
+	// Maximum number of volumes relocated per rebalancing cycle. Unset values
+	// default to 1.
+	RebalanceMaxRelocations int `gcfg:"rebalance-max-relocations"`
+	// True to remove from CNS, keeping their backing disk, the volumes which
+	// share their name with a volume referenced by a PV but are not
+	// referenced by any PV themselves. Such duplicates are otherwise only
+	// reported.
+	QuarantineDuplicateVolumes bool `gcfg:"quarantine-duplicate-volumes"`
+}
+
+// OperationTimeoutConfig contains the timeouts, in seconds, applied to vCenter
+// calls per operation type. Unset values fall back to the volume manager defaults.
+type OperationTimeoutConfig struct {
+	// Timeout for CNS CreateVolume.
+	Create int `gcfg:"create"`
+	// Timeout for CNS DeleteVolume.
+	Delete int `gcfg:"delete"`
+	// Timeout for CNS AttachVolume and DetachVolume.
+	Attach int `gcfg:"attach"`
+	// Timeout for CNS QueryVolume, QueryAllVolume and UpdateVolumeMetadata.
+	Query int `gcfg:"query"`
+	// Timeout for vCenter health checks, run by the session keepalive.
+	Health int `gcfg:"health"`
+}
+
+// StuckTaskConfig contains the options of the remediation of CNS tasks issued
+// by the CNS volume manager which hang in vCenter, blocking other operations
+// on their volumes.
+type StuckTaskConfig struct {
+	// Time in seconds after which a CNS task whose progress did not change for
+	// as long is cancelled and its operation issued again. It should be lower
+	// than the operation timeouts. 0 disables the remediation.
+	ThresholdInSec int `gcfg:"threshold-seconds"`
+	// Interval in seconds between checks of the running CNS tasks. Defaults
+	// to 30.
+	CheckIntervalInSec int `gcfg:"check-interval-seconds"`
+	// Number of times an operation is issued again after its task was
+	// cancelled. Tasks of operations out of retries are not cancelled.
+	// Defaults to 1.
+	Retries int `gcfg:"retries"`
 }
 
 // VirtualCenterConfig contains information used to access a remote vCenter
@@ -58,4 +320,11 @@ type VirtualCenterConfig struct {
 	InsecureFlag bool `gcfg:"insecure-flag"`
 	// Datacenter in which VMs are located.
 	Datacenters string `gcfg:"datacenters"`
+	// URL of the vCenter API, such as https://vc-gateway.example.com:8443/sdk,
+	// to connect to instead of the vCenter host and port, e.g. through a
+	// reverse proxy.
+	Endpoint string `gcfg:"endpoint"`
+	// URL of the HTTP(S) proxy the vCenter API, CNS included, is reached
+	// through.
+	Proxy string `gcfg:"proxy"`
 }
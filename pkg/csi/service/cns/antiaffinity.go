@@ -0,0 +1,128 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"context"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+)
+
+// annSelectedNode is the PVC annotation set by the scheduler to the node
+// selected for the pod of a PVC whose StorageClass delays binding
+const annSelectedNode = "volume.kubernetes.io/selected-node"
+
+// getNodeVolumeDatastores returns the datastores, by managed object
+// reference value, of the volumes attached to the node selected for the pod
+// of the PVC. Nil is returned if no node was selected for the pod.
+func (c *controller) getNodeVolumeDatastores(ctx context.Context, k8sclient clientset.Interface, pvcName string, pvcNamespace string) (map[string]bool, error) {
+	pvc, err := k8sclient.CoreV1().PersistentVolumeClaims(pvcNamespace).Get(pvcName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	nodeName := pvc.Annotations[annSelectedNode]
+	if nodeName == "" {
+		return nil, nil
+	}
+	vm, err := c.nodeMgr.GetNodeByName(nodeName)
+	if err != nil {
+		return nil, err
+	}
+	devices, err := vm.Device(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return getVolumeDatastores(devices), nil
+}
+
+// getVolumeDatastores returns the datastores, by managed object reference
+// value, of the first class disks among the devices. Other disks, e.g. the
+// boot disk of the node VM, are not volumes.
+func getVolumeDatastores(devices object.VirtualDeviceList) map[string]bool {
+	datastores := make(map[string]bool)
+	for _, device := range devices.SelectByType((*types.VirtualDisk)(nil)) {
+		disk := device.(*types.VirtualDisk)
+		if disk.VDiskId == nil {
+			continue
+		}
+		backing, ok := disk.Backing.(types.BaseVirtualDeviceFileBackingInfo)
+		if !ok || backing.GetVirtualDeviceFileBackingInfo().Datastore == nil {
+			continue
+		}
+		datastores[backing.GetVirtualDeviceFileBackingInfo().Datastore.Value] = true
+	}
+	return datastores
+}
+
+// getAntiAffineDatastores returns the datastores which hold none of the
+// used datastores, or all datastores if every one of them is used, so
+// placement falls back to sharing a datastore.
+func getAntiAffineDatastores(datastores []*cnsvsphere.DatastoreInfo, used map[string]bool) []*cnsvsphere.DatastoreInfo {
+	var antiAffine []*cnsvsphere.DatastoreInfo
+	for _, datastore := range datastores {
+		if !used[datastore.Reference().Value] {
+			antiAffine = append(antiAffine, datastore)
+		}
+	}
+	if len(antiAffine) == 0 {
+		return datastores
+	}
+	return antiAffine
+}
+
+// preferAntiAffineDatastores narrows the datastores to those holding none of
+// the volumes attached to the node selected for the pod of the PVC, which is
+// identified by the PVC metadata passed by the provisioner. Failures to find
+// the volumes of the node leave the datastores unchanged.
+func (c *controller) preferAntiAffineDatastores(ctx context.Context, params map[string]string, datastores []*cnsvsphere.DatastoreInfo) []*cnsvsphere.DatastoreInfo {
+	if c.antiAffinityClient == nil {
+		klog.Warningf("Datastore anti-affinity is not enabled in the controller config, ignoring it")
+		return datastores
+	}
+	var pvcName, pvcNamespace string
+	for param, value := range params {
+		switch param {
+		case common.AttributePVCName:
+			pvcName = value
+		case common.AttributePVCNamespace:
+			pvcNamespace = value
+		}
+	}
+	if pvcName == "" || pvcNamespace == "" {
+		klog.Warningf("PVC metadata is not passed by the provisioner, ignoring datastore anti-affinity. " +
+			"Run csi-provisioner v1.5.0 or later with --extra-create-metadata")
+		return datastores
+	}
+	used, err := c.getNodeVolumeDatastores(ctx, c.antiAffinityClient, pvcName, pvcNamespace)
+	if err != nil {
+		klog.Warningf("Failed to get datastores of the volumes of the node selected for PVC %s/%s, ignoring datastore anti-affinity. Error: %v",
+			pvcNamespace, pvcName, err)
+		return datastores
+	}
+	antiAffine := getAntiAffineDatastores(datastores, used)
+	if len(used) > 0 && len(antiAffine) == len(datastores) {
+		klog.V(2).Infof("No datastore without volumes of the node selected for PVC %s/%s, falling back to all datastores", pvcNamespace, pvcName)
+	}
+	return antiAffine
+}
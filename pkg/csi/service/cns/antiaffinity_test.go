@@ -0,0 +1,73 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"testing"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+func TestGetVolumeDatastores(t *testing.T) {
+	newDisk := func(datastore string, fcd bool) *types.VirtualDisk {
+		disk := &types.VirtualDisk{
+			VirtualDevice: types.VirtualDevice{
+				Backing: &types.VirtualDiskFlatVer2BackingInfo{
+					VirtualDeviceFileBackingInfo: types.VirtualDeviceFileBackingInfo{
+						Datastore: &types.ManagedObjectReference{Type: "Datastore", Value: datastore},
+					},
+				},
+			},
+		}
+		if fcd {
+			disk.VDiskId = &types.ID{Id: datastore + "-volume"}
+		}
+		return disk
+	}
+	devices := object.VirtualDeviceList{newDisk("datastore-1", false), newDisk("datastore-2", true)}
+
+	datastores := getVolumeDatastores(devices)
+	if len(datastores) != 1 || !datastores["datastore-2"] {
+		t.Errorf("Expected only datastore-2 to hold volumes, got %v", datastores)
+	}
+}
+
+func TestGetAntiAffineDatastores(t *testing.T) {
+	newDatastore := func(value string) *cnsvsphere.DatastoreInfo {
+		return &cnsvsphere.DatastoreInfo{
+			Datastore: &cnsvsphere.Datastore{
+				Datastore: object.NewDatastore(nil, types.ManagedObjectReference{Type: "Datastore", Value: value}),
+			},
+			Info: &types.DatastoreInfo{Url: "ds:///vmfs/volumes/" + value + "/"},
+		}
+	}
+	ds1, ds2 := newDatastore("datastore-1"), newDatastore("datastore-2")
+	datastores := []*cnsvsphere.DatastoreInfo{ds1, ds2}
+
+	antiAffine := getAntiAffineDatastores(datastores, map[string]bool{"datastore-1": true})
+	if len(antiAffine) != 1 || antiAffine[0] != ds2 {
+		t.Errorf("Expected only datastore-2 to be anti-affine, got %v", antiAffine)
+	}
+	// Placement falls back to all datastores when each holds volumes of the node
+	antiAffine = getAntiAffineDatastores(datastores, map[string]bool{"datastore-1": true, "datastore-2": true})
+	if len(antiAffine) != 2 {
+		t.Errorf("Expected fallback to all datastores, got %v", antiAffine)
+	}
+}
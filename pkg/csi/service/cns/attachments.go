@@ -0,0 +1,100 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"context"
+	"time"
+
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
+	k8s "sigs.k8s.io/vsphere-csi-driver/pkg/kubernetes"
+)
+
+const (
+	// attachmentReconcileDelay leaves time for the node manager to discover
+	// the node VMs before attachments are reconciled on startup
+	attachmentReconcileDelay = time.Minute
+)
+
+// reconcileAttachments completes the detaches of the VolumeAttachments of the
+// driver which are being deleted, as they may have been in flight when the
+// controller stopped. Disks still attached to their node VM are detached, and
+// the attacher finalizer is removed once the disk is confirmed detached, so
+// the VolumeAttachment is deleted without waiting for the external-attacher.
+func (c *controller) reconcileAttachments(k8sclient clientset.Interface) {
+	klog.V(2).Infof("ReconcileAttachments: start")
+	vaList, err := k8sclient.StorageV1().VolumeAttachments().List(metav1.ListOptions{})
+	if err != nil {
+		klog.Warningf("ReconcileAttachments: Failed to get VolumeAttachments from kubernetes. Err: %v", err)
+		return
+	}
+	completed := 0
+	for i := range vaList.Items {
+		va := &vaList.Items[i]
+		if va.Spec.Attacher != csitypes.Name || va.DeletionTimestamp == nil || va.Spec.Source.PersistentVolumeName == nil {
+			continue
+		}
+		if c.completeDetach(k8sclient, va) {
+			completed++
+		}
+	}
+	klog.V(2).Infof("ReconcileAttachments: end, completed %d detaches", completed)
+}
+
+// completeDetach detaches the volume of the VolumeAttachment being deleted
+// from its node VM if needed, and removes the attacher finalizer. It returns
+// true if the detach was completed.
+func (c *controller) completeDetach(k8sclient clientset.Interface, va *storagev1.VolumeAttachment) bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pv, err := k8sclient.CoreV1().PersistentVolumes().Get(*va.Spec.Source.PersistentVolumeName, metav1.GetOptions{})
+	if err != nil || pv.Spec.CSI == nil {
+		klog.Warningf("ReconcileAttachments: Failed to get the CSI PV of volume attachment %q. Err: %v", va.Name, err)
+		return false
+	}
+	volumeID := pv.Spec.CSI.VolumeHandle
+	vm, err := c.nodeMgr.GetNodeByName(va.Spec.NodeName)
+	if err != nil {
+		klog.Warningf("ReconcileAttachments: Failed to find VirtualMachine for node %q. Err: %v", va.Spec.NodeName, err)
+		return false
+	}
+	attached, err := vm.IsDiskAttached(ctx, volumeID)
+	if err != nil {
+		klog.Warningf("ReconcileAttachments: Failed to check whether volume %q is attached to node %q. Err: %v", volumeID, va.Spec.NodeName, err)
+		return false
+	}
+	if attached {
+		klog.V(2).Infof("ReconcileAttachments: Detaching volume %q from node %q", volumeID, va.Spec.NodeName)
+		outsideCNS := common.IsAttachmentOutsideCNS(va.Status.AttachmentMetadata)
+		if err := common.DetachVolumeUtil(ctx, c.manager, vm, volumeID, outsideCNS); err != nil {
+			klog.Warningf("ReconcileAttachments: Failed to detach volume %q from node %q. Err: %v", volumeID, va.Spec.NodeName, err)
+			return false
+		}
+	}
+	if err := k8s.RemoveAttacherFinalizer(k8sclient, va.Name); err != nil {
+		klog.Warningf("ReconcileAttachments: Failed to remove finalizer of volume attachment %q. Err: %v", va.Name, err)
+		return false
+	}
+	klog.V(2).Infof("ReconcileAttachments: Completed detach of volume %q from node %q", volumeID, va.Spec.NodeName)
+	return true
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+
+	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
+	k8s "sigs.k8s.io/vsphere-csi-driver/pkg/kubernetes"
+)
+
+func TestReconcileAttachmentsRemovesFinalizerOfDetachedVolume(t *testing.T) {
+	ct := getControllerTest(t)
+
+	pvName := "pv-detached"
+	now := metav1.Now()
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: pvName},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:       csitypes.Name,
+					VolumeHandle: "volume-not-attached",
+				},
+			},
+		},
+	}
+	va := &storagev1.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "va-detached",
+			DeletionTimestamp: &now,
+			Finalizers:        []string{k8s.AttacherFinalizer},
+		},
+		Spec: storagev1.VolumeAttachmentSpec{
+			Attacher: csitypes.Name,
+			NodeName: "node-1",
+			Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+		},
+	}
+	k8sclient := testclient.NewSimpleClientset(pv, va)
+
+	ct.controller.reconcileAttachments(k8sclient)
+
+	va, err := k8sclient.StorageV1().VolumeAttachments().Get(va.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(va.Finalizers) != 0 {
+		t.Fatalf("expected attacher finalizer to be removed, got %v", va.Finalizers)
+	}
+}
@@ -19,7 +19,7 @@ package cns
 import (
 	"context"
 	"fmt"
-	"math/rand"
+	"strconv"
 	"strings"
 	"time"
 
@@ -28,6 +28,7 @@ import (
 	"github.com/vmware/govmomi/units"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/klog"
 
 	cnsvolume "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
@@ -35,6 +36,7 @@ import (
 	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
 	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
+	k8s "sigs.k8s.io/vsphere-csi-driver/pkg/kubernetes"
 )
 
 var (
@@ -48,13 +50,41 @@ var (
 type nodeManager interface {
 	Initialize() error
 	GetSharedDatastoresInK8SCluster(ctx context.Context) ([]*cnsvsphere.DatastoreInfo, error)
-	GetSharedDatastoresInTopology(ctx context.Context, topologyRequirement *csi.TopologyRequirement, zoneKey string, regionKey string) ([]*cnsvsphere.DatastoreInfo, map[string][]map[string]string, error)
+	GetSharedDatastoresInTopology(ctx context.Context, topologyRequirement *csi.TopologyRequirement, zoneCategoryName string, regionCategoryName string,
+		zoneKey string, regionKey string) ([]*cnsvsphere.DatastoreInfo, map[string][]map[string]string, error)
+	GetSharedDatastoresInHostGroup(ctx context.Context, hostGroupName string) ([]*cnsvsphere.DatastoreInfo, []string, error)
+	GetSharedDatastoresInVsanFaultDomain(ctx context.Context, faultDomainName string) ([]*cnsvsphere.DatastoreInfo, []string, error)
+	GetSharedDatastoresInResourcePool(ctx context.Context, resourcePool string) ([]*cnsvsphere.DatastoreInfo, error)
 	GetNodeByName(nodeName string) (*cnsvsphere.VirtualMachine, error)
 }
 
 type controller struct {
-	manager *common.Manager
-	nodeMgr nodeManager
+	manager      *common.Manager
+	nodeMgr      nodeManager
+	reservations *reservationLedger
+	// detachFailures counts failed detaches to escalate to force detach
+	detachFailures *detachFailureTracker
+	// deferredAttaches holds the attaches not awaited by ControllerPublishVolume
+	deferredAttaches *deferredAttachTracker
+	// drain detaches the volumes of draining nodes, nil unless enabled
+	drain *drainReconciler
+	// quota enforces storage policy quotas, nil unless configured
+	quota *policyQuota
+	// protectionClient checks whether volumes being deleted are attached,
+	// nil unless attached volumes are protected
+	protectionClient clientset.Interface
+	// parameterPolicy checks the parameters of CreateVolume requests, nil
+	// unless a policy ConfigMap is configured
+	parameterPolicy *parameterPolicy
+	// antiAffinityClient looks up the node selected for the pod of new
+	// volumes, nil unless datastore anti-affinity is enabled
+	antiAffinityClient clientset.Interface
+	// attachmentClient reads the attachment metadata of the
+	// VolumeAttachments of unpublished volumes
+	attachmentClient clientset.Interface
+	// volumeLocks serializes the attaches and deletes of each volume, nil
+	// unless attaches of volumes being deleted are refused
+	volumeLocks *volumeOperationLocks
 }
 
 // New creates a CNS controller
@@ -84,6 +114,19 @@ func (c *controller) Init(config *config.Config) error {
 		VolumeManager:  cnsvolume.GetManager(vcenter),
 		VcenterManager: cnsvsphere.GetVirtualCenterManager(),
 	}
+	c.manager.VolumeManager.SetOperationTimeouts(config.OperationTimeout)
+	if _, err := common.ParseDefaultVolumeSize(config.Global.DefaultVolumeSize); err != nil {
+		klog.Errorf("Invalid default volume size. err=%v", err)
+		return err
+	}
+	c.manager.VolumeManager.SetStuckTaskRemediation(config.StuckTask)
+	if config.Global.SessionKeepAliveIntervalInSec > 0 {
+		vcenter.StartKeepAlive(time.Duration(config.Global.SessionKeepAliveIntervalInSec)*time.Second,
+			c.manager.VolumeManager.HealthCheckTimeout(), c.manager.VolumeManager.HealthCheck)
+	}
+	if config.Controller.AttachBatchWindowInMs > 0 {
+		c.manager.VolumeManager.SetAttachBatchWindow(time.Duration(config.Controller.AttachBatchWindowInMs) * time.Millisecond)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -97,12 +140,74 @@ func (c *controller) Init(config *config.Config) error {
 		klog.Errorf("checkAPI failed for vcenter API version: %s, err=%v", vc.Client.ServiceContent.About.ApiVersion, err)
 		return err
 	}
+	c.reservations = newReservationLedger()
+	c.detachFailures = newDetachFailureTracker()
+	c.deferredAttaches = newDeferredAttachTracker()
+	if config.Controller.RefuseAttachDuringDelete {
+		c.volumeLocks = newVolumeOperationLocks()
+	}
 	c.nodeMgr = &Nodes{}
 	err = c.nodeMgr.Initialize()
 	if err != nil {
 		klog.Errorf("Failed to initialize nodeMgr. err=%v", err)
 		return err
 	}
+	if len(config.StoragePolicyQuota) > 0 {
+		c.quota, err = newPolicyQuotaFromConfig(ctx, c.manager)
+		if err != nil {
+			klog.Errorf("Failed to initialize storage policy quotas. err=%v", err)
+			return err
+		}
+		go c.quota.refresh(c.manager, config.Controller.QuotaRefreshIntervalInSec)
+	}
+	if config.Controller.MetricsAddress != "" {
+		startDatastoreMetricsCollector(config.Controller.MetricsAddress, config.Controller.DatastoreMetricsIntervalInSec,
+			c.nodeMgr, vcenterconfig.Host)
+	}
+	k8sclient, err := k8s.NewClient()
+	if err != nil {
+		klog.Errorf("Creating Kubernetes client failed. err=%v", err)
+		return err
+	}
+	c.attachmentClient = k8sclient
+	if config.Controller.DrainDetach {
+		c.drain = newDrainReconciler(c.manager, c.nodeMgr, k8sclient, config.Controller.DrainTaints)
+		c.drain.rebuild()
+		informMgr := k8s.NewInformer(k8sclient)
+		informMgr.AddNodeListener(nil, c.drain.nodeUpdated, nil)
+		informMgr.Listen()
+	}
+	if config.Controller.NodeDeleteForceDetach {
+		nodeDelete := newNodeDeleteReconciler(c.manager, k8sclient, config.Controller.NodeDeleteForceDetachDelayInSec)
+		informMgr := k8s.NewInformer(k8sclient)
+		informMgr.AddNodeListener(nil, nil, nodeDelete.nodeDeleted)
+		informMgr.Listen()
+	}
+	if config.Controller.ProtectAttachedVolumes {
+		c.protectionClient = k8sclient
+	}
+	if config.Controller.DatastoreAntiAffinity {
+		c.antiAffinityClient = k8sclient
+	}
+	if config.Controller.ParameterPolicyConfigMap != "" {
+		c.parameterPolicy, err = newParameterPolicy(k8sclient, config.Controller.ParameterPolicyConfigMap)
+		if err != nil {
+			klog.Errorf("Failed to initialize parameter policy. err=%v", err)
+			return err
+		}
+	}
+	if config.Controller.ReconcileAttachmentsOnStartup {
+		go func() {
+			time.Sleep(attachmentReconcileDelay)
+			c.reconcileAttachments(k8sclient)
+		}()
+	}
+	if config.Controller.DeferredAttach {
+		go func() {
+			time.Sleep(attachmentReconcileDelay)
+			c.resumeDeferredAttaches(k8sclient)
+		}()
+	}
 	return nil
 }
 
@@ -117,17 +222,44 @@ func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 		klog.Errorf("Failed to validate Create Volume Request with err: %v", err)
 		return nil, err
 	}
+	if c.parameterPolicy != nil {
+		if err = c.parameterPolicy.validate(req.GetParameters()); err != nil {
+			return nil, err
+		}
+	}
 
-	// Volume Size - Default is 10 GiB
-	volSizeBytes := int64(common.DefaultGbDiskSize * common.GbInBytes)
-	if req.GetCapacityRange() != nil && req.GetCapacityRange().RequiredBytes != 0 {
-		volSizeBytes = int64(req.GetCapacityRange().GetRequiredBytes())
+	// Volume Size - Default is 10 GiB unless configured
+	defaultSizeBytes, err := common.ParseDefaultVolumeSize(c.manager.CnsConfig.Global.DefaultVolumeSize)
+	if err != nil {
+		klog.Error(err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	volSizeBytes, err := getVolumeSizeBytes(req.GetCapacityRange(), defaultSizeBytes)
+	if err != nil {
+		klog.Errorf("Invalid capacity range %+v for volume %q. Error: %v", req.GetCapacityRange(), req.Name, err)
+		return nil, err
 	}
 	volSizeMB := int64(common.RoundUpSize(volSizeBytes, common.MbInBytes))
 
 	var datastoreURL string
 	var storagePolicyName string
+	var storagePolicyTag string
 	var fsType string
+	var mkfsOptions string
+	var hostGroup string
+	var vsanFaultDomain string
+	var resourcePool string
+	var scsiController string
+	var adapterType string
+	var mountUID string
+	var mountGID string
+	var volumeTTL string
+	var keyRotationInterval string
+	var datastoreTypePreference []string
+	var datastoreFilter common.DatastoreFilter
+	var minIOPS int64
+	var cachePolicy string
+	var datastoreAntiAffinity string
 
 	// Support case insensitive parameters
 	for paramName := range req.Parameters {
@@ -136,17 +268,66 @@ func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 			datastoreURL = req.Parameters[paramName]
 		} else if param == common.AttributeStoragePolicyName {
 			storagePolicyName = req.Parameters[paramName]
+		} else if param == common.AttributeStoragePolicyTag {
+			storagePolicyTag = req.Parameters[paramName]
 		} else if param == common.AttributeFsType {
 			fsType = req.Parameters[common.AttributeFsType]
+		} else if param == common.AttributeMkfsOptions {
+			mkfsOptions = req.Parameters[paramName]
+		} else if param == common.AttributeHostGroup {
+			hostGroup = req.Parameters[paramName]
+		} else if param == common.AttributeVsanFaultDomain {
+			vsanFaultDomain = req.Parameters[paramName]
+		} else if param == common.AttributeResourcePool {
+			resourcePool = req.Parameters[paramName]
+		} else if param == common.AttributeSCSIController {
+			scsiController = req.Parameters[paramName]
+		} else if param == common.AttributeAdapterType {
+			adapterType, _ = common.ParseAdapterType(req.Parameters[paramName])
+		} else if param == common.AttributeMountUID {
+			mountUID = req.Parameters[paramName]
+		} else if param == common.AttributeMountGID {
+			mountGID = req.Parameters[paramName]
+		} else if param == common.AttributeVolumeTTL {
+			volumeTTL = req.Parameters[paramName]
+		} else if param == common.AttributeKeyRotationInterval {
+			keyRotationInterval = req.Parameters[paramName]
+		} else if param == common.AttributeDatastoreFilter {
+			datastoreFilter, _ = common.ParseDatastoreFilter(req.Parameters[paramName])
+		} else if param == common.AttributeCachePolicy {
+			cachePolicy, _ = common.ParseCachePolicy(req.Parameters[paramName])
+		} else if param == common.AttributeMinIOPS {
+			minIOPS, _ = common.ParseMinIOPS(req.Parameters[paramName])
+		} else if param == common.AttributeDatastoreAntiAffinity {
+			datastoreAntiAffinity, _ = common.ParseDatastoreAntiAffinity(req.Parameters[paramName])
+		} else if param == common.AttributeDatastoreTypePreference {
+			datastoreTypePreference, _ = common.ParseDatastoreTypePreference(req.Parameters[paramName])
 		}
 	}
 
+	if cachePolicy != "" {
+		// The caching rule of the cache policy is held by its storage policy
+		cachePolicyConfig := c.manager.CnsConfig.CachePolicy[cachePolicy]
+		if cachePolicyConfig == nil || cachePolicyConfig.StoragePolicyName == "" {
+			msg := fmt.Sprintf("Cache policy: %s specified in the storage class has no storage policy configured.", cachePolicy)
+			klog.Error(msg)
+			return nil, status.Error(codes.InvalidArgument, msg)
+		}
+		storagePolicyName = cachePolicyConfig.StoragePolicyName
+	}
+
 	var createVolumeSpec = common.CreateVolumeSpec{
 		CapacityMB:        volSizeMB,
 		Name:              req.Name,
 		DatastoreURL:      datastoreURL,
 		StoragePolicyName: storagePolicyName,
 	}
+	if storagePolicyTag != "" {
+		createVolumeSpec.StoragePolicyID, err = getStoragePolicyIDByTag(ctx, c.manager, storagePolicyTag)
+		if err != nil {
+			return nil, err
+		}
+	}
 	var sharedDatastores []*cnsvsphere.DatastoreInfo
 	var datastoreTopologyMap = make(map[string][]map[string]string)
 
@@ -161,7 +342,9 @@ func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 			klog.Errorf(errMsg)
 			return nil, status.Error(codes.NotFound, errMsg)
 		}
-		sharedDatastores, datastoreTopologyMap, err = c.nodeMgr.GetSharedDatastoresInTopology(ctx, topologyRequirement, c.manager.CnsConfig.Labels.Zone, c.manager.CnsConfig.Labels.Region)
+		zoneKey, regionKey := common.GetTopologyKeys(c.manager.CnsConfig)
+		sharedDatastores, datastoreTopologyMap, err = c.nodeMgr.GetSharedDatastoresInTopology(ctx, topologyRequirement, c.manager.CnsConfig.Labels.Zone, c.manager.CnsConfig.Labels.Region,
+			zoneKey, regionKey)
 		if err != nil || len(sharedDatastores) == 0 {
 			msg := fmt.Sprintf("Failed to get shared datastores in topology: %+v. Error: %+v", topologyRequirement, err)
 			klog.Errorf(msg)
@@ -194,15 +377,349 @@ func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 			return nil, status.Errorf(codes.Internal, msg)
 		}
 	}
-	volumeID, err := common.CreateVolumeUtil(ctx, c.manager, &createVolumeSpec, sharedDatastores)
+	// placementNodeNames are the nodes scheduling is restricted to, when
+	// placement is confined to a host group or vSAN fault domain
+	var placementNodeNames []string
+	if hostGroup != "" {
+		// Confine placement to datastores accessible from the nodes on hosts of the host group
+		var hostGroupDatastores []*cnsvsphere.DatastoreInfo
+		hostGroupDatastores, placementNodeNames, err = c.nodeMgr.GetSharedDatastoresInHostGroup(ctx, hostGroup)
+		if err == cnsvsphere.ErrHostGroupNotFound {
+			msg := fmt.Sprintf("Host group: %s specified in the storage class is not found.", hostGroup)
+			klog.Error(msg)
+			return nil, status.Error(codes.InvalidArgument, msg)
+		} else if err != nil {
+			msg := fmt.Sprintf("Failed to get shared datastores in host group: %s. Error: %+v", hostGroup, err)
+			klog.Error(msg)
+			return nil, status.Error(codes.NotFound, msg)
+		}
+		var sharedDatastoresInHostGroup []*cnsvsphere.DatastoreInfo
+		for _, sharedDatastore := range sharedDatastores {
+			for _, hostGroupDatastore := range hostGroupDatastores {
+				if sharedDatastore.Info.Url == hostGroupDatastore.Info.Url {
+					sharedDatastoresInHostGroup = append(sharedDatastoresInHostGroup, sharedDatastore)
+					break
+				}
+			}
+		}
+		if len(sharedDatastoresInHostGroup) == 0 {
+			msg := fmt.Sprintf("No shared datastores are accessible from the nodes in host group: %s", hostGroup)
+			klog.Error(msg)
+			return nil, status.Error(codes.NotFound, msg)
+		}
+		sharedDatastores = sharedDatastoresInHostGroup
+	}
+	if vsanFaultDomain != "" {
+		// Confine placement to vSAN datastores accessible from the nodes on hosts of the fault domain
+		var faultDomainDatastores []*cnsvsphere.DatastoreInfo
+		faultDomainDatastores, placementNodeNames, err = c.nodeMgr.GetSharedDatastoresInVsanFaultDomain(ctx, vsanFaultDomain)
+		if err == cnsvsphere.ErrVsanFaultDomainNotFound {
+			msg := fmt.Sprintf("vSAN fault domain: %s specified in the storage class is not found.", vsanFaultDomain)
+			klog.Error(msg)
+			return nil, status.Error(codes.InvalidArgument, msg)
+		} else if err != nil {
+			msg := fmt.Sprintf("Failed to get shared datastores in vSAN fault domain: %s. Error: %+v", vsanFaultDomain, err)
+			klog.Error(msg)
+			return nil, status.Error(codes.NotFound, msg)
+		}
+		var sharedDatastoresInFaultDomain []*cnsvsphere.DatastoreInfo
+		for _, sharedDatastore := range sharedDatastores {
+			if !strings.EqualFold(sharedDatastore.Type, vsanDatastoreType) {
+				continue
+			}
+			for _, faultDomainDatastore := range faultDomainDatastores {
+				if sharedDatastore.Info.Url == faultDomainDatastore.Info.Url {
+					sharedDatastoresInFaultDomain = append(sharedDatastoresInFaultDomain, sharedDatastore)
+					break
+				}
+			}
+		}
+		if len(sharedDatastoresInFaultDomain) == 0 {
+			msg := fmt.Sprintf("No shared vSAN datastores are accessible from the nodes in vSAN fault domain: %s", vsanFaultDomain)
+			klog.Error(msg)
+			return nil, status.Error(codes.NotFound, msg)
+		}
+		sharedDatastores = sharedDatastoresInFaultDomain
+	}
+	if resourcePool != "" {
+		// Confine placement to datastores of the compute resource backing the resource pool
+		var resourcePoolDatastores []*cnsvsphere.DatastoreInfo
+		resourcePoolDatastores, err = c.nodeMgr.GetSharedDatastoresInResourcePool(ctx, resourcePool)
+		if err == cnsvsphere.ErrResourcePoolNotFound {
+			msg := fmt.Sprintf("Resource pool: %s specified in the storage class is not found.", resourcePool)
+			klog.Error(msg)
+			return nil, status.Error(codes.InvalidArgument, msg)
+		} else if err != nil {
+			msg := fmt.Sprintf("Failed to get shared datastores in resource pool: %s. Error: %+v", resourcePool, err)
+			klog.Error(msg)
+			return nil, status.Error(codes.Internal, msg)
+		}
+		var sharedDatastoresInResourcePool []*cnsvsphere.DatastoreInfo
+		for _, sharedDatastore := range sharedDatastores {
+			for _, resourcePoolDatastore := range resourcePoolDatastores {
+				if sharedDatastore.Info.Url == resourcePoolDatastore.Info.Url {
+					sharedDatastoresInResourcePool = append(sharedDatastoresInResourcePool, sharedDatastore)
+					break
+				}
+			}
+		}
+		if len(sharedDatastoresInResourcePool) == 0 {
+			msg := fmt.Sprintf("No shared datastores are reachable from resource pool: %s", resourcePool)
+			klog.Error(msg)
+			return nil, status.Error(codes.ResourceExhausted, msg)
+		}
+		sharedDatastores = sharedDatastoresInResourcePool
+	}
+	if len(datastoreFilter) > 0 {
+		// Confine placement to datastores matching the filter
+		var filteredDatastores []*cnsvsphere.DatastoreInfo
+		for _, sharedDatastore := range sharedDatastores {
+			if datastoreFilter.Matches(sharedDatastore) {
+				filteredDatastores = append(filteredDatastores, sharedDatastore)
+			}
+		}
+		if len(filteredDatastores) == 0 {
+			msg := "No shared datastores match the datastore filter of the storage class"
+			klog.Error(msg)
+			return nil, status.Error(codes.NotFound, msg)
+		}
+		sharedDatastores = filteredDatastores
+	}
+	if minIOPS > 0 {
+		// Confine placement to datastores capable of the minimum IOPS
+		var iopsDatastores []*cnsvsphere.DatastoreInfo
+		iopsDatastores, err = filterDatastoresByIOPS(ctx, sharedDatastores, minIOPS)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to get IOPS of shared datastores. Error: %+v", err)
+			klog.Error(msg)
+			return nil, status.Error(codes.Internal, msg)
+		}
+		if len(iopsDatastores) == 0 {
+			msg := fmt.Sprintf("No shared datastores advertise the minimum of %d IOPS of the storage class", minIOPS)
+			klog.Error(msg)
+			return nil, status.Error(codes.ResourceExhausted, msg)
+		}
+		sharedDatastores = iopsDatastores
+	}
+	if common.IsMultiWriterBlockVolume(req.GetVolumeCapabilities()) {
+		// Confine placement to datastores supporting multi-writer sharing
+		multiWriterDatastores := getMultiWriterDatastores(sharedDatastores)
+		if createVolumeSpec.DatastoreURL != "" {
+			var datastoreSupported bool
+			for _, datastore := range multiWriterDatastores {
+				datastoreSupported = datastoreSupported || datastore.Info.Url == createVolumeSpec.DatastoreURL
+			}
+			if !datastoreSupported {
+				msg := fmt.Sprintf("DatastoreURL: %s specified in the storage class does not support multi-writer volumes", createVolumeSpec.DatastoreURL)
+				klog.Error(msg)
+				return nil, status.Error(codes.InvalidArgument, msg)
+			}
+		}
+		if len(multiWriterDatastores) == 0 {
+			msg := "No shared datastores support multi-writer volumes"
+			klog.Error(msg)
+			return nil, status.Error(codes.InvalidArgument, msg)
+		}
+		sharedDatastores = multiWriterDatastores
+	}
+	if cachePolicy != "" {
+		// Fail placement rather than ignore the cache policy on datastores
+		// which can not honor it
+		var storagePolicyID string
+		storagePolicyID, err = getStoragePolicyIDByName(ctx, c.manager, storagePolicyName)
+		if err != nil {
+			return nil, err
+		}
+		var cacheDatastores []*cnsvsphere.DatastoreInfo
+		cacheDatastores, err = getStoragePolicyCompatibleDatastores(ctx, c.manager, storagePolicyID, sharedDatastores)
+		if err != nil {
+			return nil, err
+		}
+		if createVolumeSpec.DatastoreURL != "" {
+			var datastoreCompatible bool
+			for _, datastore := range cacheDatastores {
+				datastoreCompatible = datastoreCompatible || datastore.Info.Url == createVolumeSpec.DatastoreURL
+			}
+			if !datastoreCompatible {
+				msg := fmt.Sprintf("DatastoreURL: %s specified in the storage class does not support cache policy: %s", createVolumeSpec.DatastoreURL, cachePolicy)
+				klog.Error(msg)
+				return nil, status.Error(codes.ResourceExhausted, msg)
+			}
+		}
+		if len(cacheDatastores) == 0 {
+			msg := fmt.Sprintf("No shared datastores support cache policy: %s of the storage class", cachePolicy)
+			klog.Error(msg)
+			return nil, status.Error(codes.ResourceExhausted, msg)
+		}
+		sharedDatastores = cacheDatastores
+	}
+	if datastoreAntiAffinity == common.DatastoreAntiAffinityNode && createVolumeSpec.DatastoreURL == "" {
+		sharedDatastores = c.preferAntiAffineDatastores(ctx, req.Parameters, sharedDatastores)
+	}
+	if c.manager.CnsConfig.Controller.AlignVolumeSize {
+		// Align to the largest block size of the datastores the volume may be
+		// placed on, as the datastore is chosen by CNS
+		blockSizeMB := getAlignmentBlockSizeMB(sharedDatastores, createVolumeSpec.DatastoreURL)
+		alignedSizeMB := alignVolumeSizeMB(volSizeMB, blockSizeMB)
+		// The aligned capacity must stay within the limit of the capacity
+		// range, the alignment is capped at the limit otherwise
+		if limitMB := req.GetCapacityRange().GetLimitBytes() / common.MbInBytes; limitMB > 0 && alignedSizeMB > limitMB {
+			klog.V(2).Infof("Capacity of volume %q aligned to %d MB capped at the limit of %d MB", req.Name, alignedSizeMB, limitMB)
+			alignedSizeMB = limitMB
+			if alignedSizeMB < volSizeMB {
+				alignedSizeMB = volSizeMB
+			}
+		}
+		if alignedSizeMB != volSizeMB {
+			if alignedSizeMB-volSizeMB > volSizeMB/10 {
+				klog.Warningf("Capacity of volume %q aligned from %d MB to %d MB for datastore block size of %d MB",
+					req.Name, volSizeMB, alignedSizeMB, blockSizeMB)
+			} else {
+				klog.V(2).Infof("Capacity of volume %q aligned from %d MB to %d MB for datastore block size of %d MB",
+					req.Name, volSizeMB, alignedSizeMB, blockSizeMB)
+			}
+			volSizeMB = alignedSizeMB
+			volSizeBytes = volSizeMB * common.MbInBytes
+			createVolumeSpec.CapacityMB = volSizeMB
+		}
+	}
+	// The CSI volume name is stable across retries of the same request, so it
+	// is used as idempotency key for the CNS volume name. A volume created by
+	// an earlier attempt, e.g. before a controller restart, is reused instead
+	// of creating a duplicate FCD. Its capacity is compared to the aligned
+	// capacity it was created with.
+	existingVolume, err := common.GetVolumeByName(c.manager, req.Name)
 	if err != nil {
+		msg := fmt.Sprintf("Failed to query volume with name %q. Error: %+v", req.Name, err)
+		klog.Error(msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+	var volumeID string
+	// provisionedDatastoreURL is the datastore of the volume, when known
+	// without querying CNS
+	var provisionedDatastoreURL string
+	if existingVolume != nil {
+		if createVolumeSpec.StoragePolicyID == "" && storagePolicyName != "" && existingVolume.StoragePolicyId != "" {
+			createVolumeSpec.StoragePolicyID, err = getStoragePolicyIDByName(ctx, c.manager, storagePolicyName)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err = common.CheckExistingVolume(existingVolume, &createVolumeSpec); err != nil {
+			msg := fmt.Sprintf("Failed to create volume %q. Error: %v", req.Name, err)
+			klog.Error(msg)
+			return nil, status.Error(codes.AlreadyExists, msg)
+		}
+		klog.V(2).Infof("Volume with name %s already exists with ID %s", req.Name, existingVolume.VolumeId.Id)
+		volumeID = existingVolume.VolumeId.Id
+		provisionedDatastoreURL = existingVolume.DatastoreUrl
+	}
+	// Volumes created by an earlier attempt of the request are already
+	// charged to the quota
+	if c.quota != nil && existingVolume == nil {
+		policyID := createVolumeSpec.StoragePolicyID
+		if policyID == "" && storagePolicyName != "" {
+			policyID, err = getStoragePolicyIDByName(ctx, c.manager, storagePolicyName)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err = c.quota.reserve(req.Name, policyID, volSizeBytes); err != nil {
+			msg := fmt.Sprintf("Volume of %d bytes exceeds the quota of the storage policy of the storage class", volSizeBytes)
+			klog.Error(msg)
+			return nil, status.Error(codes.ResourceExhausted, msg)
+		}
+	}
+	// Account for capacity reserved by in-flight and recently created
+	// volumes. The capacity of an existing volume is already allocated.
+	candidateDatastores := sharedDatastores
+	if existingVolume == nil && createVolumeSpec.DatastoreURL == "" {
+		candidateDatastores = c.reservations.filterDatastores(sharedDatastores, volSizeBytes)
+		if len(candidateDatastores) == 0 {
+			if c.quota != nil {
+				c.quota.release(req.Name)
+			}
+			msg := fmt.Sprintf("No shared datastore has %d bytes available for volume %q after reservations", volSizeBytes, req.Name)
+			klog.Error(msg)
+			return nil, status.Error(codes.ResourceExhausted, msg)
+		}
+		c.reservations.reserve(req.Name, candidateDatastores, volSizeBytes)
+	} else if existingVolume == nil {
+		for _, datastore := range sharedDatastores {
+			if datastore.Info.Url == createVolumeSpec.DatastoreURL {
+				c.reservations.reserve(req.Name, []*cnsvsphere.DatastoreInfo{datastore}, volSizeBytes)
+				break
+			}
+		}
+	}
+	// Try the preferred datastores of the zone in order, then fall back to
+	// all candidates
+	if volumeID == "" && topologyRequirement != nil && createVolumeSpec.DatastoreURL == "" {
+		for _, datastore := range getPreferredDatastores(topologyRequirement, c.manager.CnsConfig, candidateDatastores) {
+			klog.V(3).Infof("Creating volume %q on preferred datastore %q", req.Name, datastore.Info.Url)
+			volumeID, provisionedDatastoreURL, err = common.CreateVolumeUtil(ctx, c.manager, &createVolumeSpec, []*cnsvsphere.DatastoreInfo{datastore})
+			if err == nil {
+				break
+			}
+			klog.Warningf("Failed to create volume %q on preferred datastore %q, falling back. Error: %+v", req.Name, datastore.Info.Url, err)
+		}
+	}
+	// Try the datastores of the preferred types in order, then fall back to
+	// all candidates
+	if volumeID == "" && createVolumeSpec.DatastoreURL == "" {
+		for _, datastores := range groupDatastoresByType(candidateDatastores, datastoreTypePreference) {
+			klog.V(3).Infof("Creating volume %q on %s datastores", req.Name, datastores[0].Type)
+			volumeID, provisionedDatastoreURL, err = common.CreateVolumeUtil(ctx, c.manager, &createVolumeSpec, datastores)
+			if err == nil {
+				break
+			}
+			klog.Warningf("Failed to create volume %q on %s datastores, falling back. Error: %+v", req.Name, datastores[0].Type, err)
+		}
+	}
+	if volumeID == "" {
+		volumeID, provisionedDatastoreURL, err = common.CreateVolumeUtil(ctx, c.manager, &createVolumeSpec, candidateDatastores)
+	}
+	if err != nil {
+		c.reservations.release(req.Name)
+		if c.quota != nil {
+			c.quota.release(req.Name)
+		}
 		msg := fmt.Sprintf("Failed to create volume. Error: %+v", err)
 		klog.Error(msg)
 		return nil, status.Errorf(codes.Internal, msg)
 	}
+	if c.quota != nil {
+		c.quota.commit(req.Name, volumeID)
+	}
 	attributes := make(map[string]string)
 	attributes[common.AttributeDiskType] = common.DiskTypeString
 	attributes[common.AttributeFsType] = fsType
+	if mkfsOptions != "" {
+		attributes[common.AttributeMkfsOptions] = mkfsOptions
+	}
+	if scsiController != "" {
+		attributes[common.AttributeSCSIController] = scsiController
+	}
+	if adapterType != "" {
+		attributes[common.AttributeAdapterType] = adapterType
+	}
+	if mountUID != "" {
+		attributes[common.AttributeMountUID] = mountUID
+	}
+	if mountGID != "" {
+		attributes[common.AttributeMountGID] = mountGID
+	}
+	if volumeTTL != "" {
+		attributes[common.AttributeVolumeTTL] = volumeTTL
+	}
+	if keyRotationInterval != "" {
+		attributes[common.AttributeKeyRotationInterval] = keyRotationInterval
+	}
+	// The CNS labels are recorded by the syncer along with the PV metadata
+	cnsLabels, _ := common.ParseCnsLabels(req.Parameters)
+	for key, value := range cnsLabels {
+		attributes[common.AttributeCnsLabelPrefix+key] = value
+	}
 	resp := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      volumeID,
@@ -210,34 +727,78 @@ func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 			VolumeContext: attributes,
 		},
 	}
-	// Call QueryVolume API and get the datastoreURL of the Provisioned Volume
-	var volumeAccessibleTopology = make(map[string]string)
-	if len(datastoreTopologyMap) > 0 {
-		volumeIds := []cnstypes.CnsVolumeId{{Id: volumeID}}
+	// Call QueryVolume API and get the datastoreURL of the Provisioned Volume,
+	// only known to CNS when the volume was created on several datastores
+	if provisionedDatastoreURL == "" {
 		queryFilter := cnstypes.CnsQueryFilter{
-			VolumeIds: volumeIds,
+			VolumeIds: []cnstypes.CnsVolumeId{{Id: volumeID}},
 		}
 		queryResult, err := c.manager.VolumeManager.QueryVolume(queryFilter)
 		if err != nil {
 			klog.Errorf("QueryVolume failed for volumeID: %s", volumeID)
-			return nil, status.Error(codes.Internal, err.Error())
-		}
-		if len(queryResult.Volumes) > 0 {
-			// Find datastore topology from the retrieved datastoreURL
-			datastoreAccessibleTopology := datastoreTopologyMap[queryResult.Volumes[0].DatastoreUrl]
-			klog.V(3).Infof("Volume: %s is provisioned on the datastore: %s ", volumeID, queryResult.Volumes[0].DatastoreUrl)
-			if len(datastoreAccessibleTopology) > 0 {
-				rand.Seed(time.Now().Unix())
-				volumeAccessibleTopology = datastoreAccessibleTopology[rand.Intn(len(datastoreAccessibleTopology))]
-				klog.V(3).Infof("volumeAccessibleTopology: [%+v] is selected for datastore: %s ", volumeAccessibleTopology, queryResult.Volumes[0].DatastoreUrl)
+			if len(datastoreTopologyMap) > 0 {
+				c.reservations.release(req.Name)
+				// The volume can not be returned without its topology, so it is
+				// deleted for the retry to provision it from scratch
+				if err := common.DeleteVolumeUtil(ctx, c.manager, volumeID, true); err != nil {
+					klog.Warningf("Failed to delete volume %s of failed create. Error: %+v", volumeID, err)
+				} else if c.quota != nil {
+					c.quota.remove(volumeID)
+				}
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		} else if len(queryResult.Volumes) > 0 {
+			provisionedDatastoreURL = queryResult.Volumes[0].DatastoreUrl
+		}
+	}
+	if provisionedDatastoreURL != "" {
+		klog.V(3).Infof("Volume: %s is provisioned on the datastore: %s ", volumeID, provisionedDatastoreURL)
+	}
+	c.reservations.commit(req.Name, provisionedDatastoreURL)
+
+	var volumeAccessibleTopology []*csi.Topology
+	var volumeTopologySegments map[string]string
+	if len(datastoreTopologyMap) > 0 && provisionedDatastoreURL != "" {
+		// Report every topology reaching the datastore, so pods of volumes
+		// provisioned with Immediate binding can be scheduled in any of them
+		volumeAccessibleTopology, volumeTopologySegments = getVolumeAccessibleTopology(datastoreTopologyMap[provisionedDatastoreURL])
+		klog.V(3).Infof("volumeAccessibleTopology: [%+v] reaches datastore: %s ", volumeAccessibleTopology, provisionedDatastoreURL)
+	}
+	// Pass placement details to the node through the volume context
+	if provisionedDatastoreURL != "" {
+		attributes[common.AttributeDatastoreURL] = provisionedDatastoreURL
+		for _, datastore := range candidateDatastores {
+			if datastore.Info.Url != provisionedDatastoreURL {
+				continue
+			}
+			if datastore.Type != "" {
+				attributes[common.AttributeDatastoreType] = datastore.Type
+			}
+			// The UUID of the backing disk is the one the volume is presented
+			// with on every attach, so node-side tooling can rely on its by-id path
+			diskUUID, err := datastore.GetVStorageObjectDiskUUID(ctx, volumeID)
+			if err != nil {
+				klog.Warningf("Failed to get disk UUID of volume %s. Error: %+v", volumeID, err)
+			} else {
+				attributes[common.AttributeFirstClassDiskUUID] = common.FormatDiskUUID(diskUUID)
 			}
+			break
 		}
 	}
-	if len(volumeAccessibleTopology) != 0 {
-		volumeTopology := &csi.Topology{
-			Segments: volumeAccessibleTopology,
+	for key, value := range volumeTopologySegments {
+		attributes[key] = value
+	}
+	resp.Volume.AccessibleTopology = append(resp.Volume.AccessibleTopology, volumeAccessibleTopology...)
+	if len(placementNodeNames) > 0 {
+		// Restrict scheduling to the nodes on hosts of the host group or vSAN
+		// fault domain. All of them access the volume datastore, so zone and
+		// region are not needed.
+		resp.Volume.AccessibleTopology = nil
+		for _, nodeName := range placementNodeNames {
+			resp.Volume.AccessibleTopology = append(resp.Volume.AccessibleTopology, &csi.Topology{
+				Segments: map[string]string{csitypes.LabelHostname: nodeName},
+			})
 		}
-		resp.Volume.AccessibleTopology = append(resp.Volume.AccessibleTopology, volumeTopology)
 	}
 	return resp, nil
 }
@@ -251,12 +812,29 @@ func (c *controller) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequ
 	if err != nil {
 		return nil, err
 	}
+	if c.volumeLocks != nil {
+		release, _, err := c.volumeLocks.acquire(ctx, req.VolumeId, true)
+		if err != nil {
+			msg := fmt.Sprintf("Timed out waiting for the operations on volume: %q. Error: %v", req.VolumeId, err)
+			klog.Error(msg)
+			return nil, status.Error(codes.Aborted, msg)
+		}
+		defer release()
+	}
+	if c.protectionClient != nil {
+		if err = checkAttachedVolumeDeletion(c.protectionClient, req.VolumeId); err != nil {
+			return nil, err
+		}
+	}
 	err = common.DeleteVolumeUtil(ctx, c.manager, req.VolumeId, true)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to delete volume: %q. Error: %+v", req.VolumeId, err)
 		klog.Error(msg)
 		return nil, status.Errorf(codes.Internal, msg)
 	}
+	if c.quota != nil {
+		c.quota.remove(req.VolumeId)
+	}
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
@@ -279,15 +857,112 @@ func (c *controller) ControllerPublishVolume(ctx context.Context, req *csi.Contr
 		return nil, status.Errorf(codes.Internal, msg)
 	}
 	klog.V(4).Infof("Found VirtualMachine for node:%q.", req.NodeId)
-	diskUUID, err := common.AttachVolumeUtil(ctx, c.manager, node, req.VolumeId)
-	if err != nil {
-		msg := fmt.Sprintf("Failed to attach disk: %+q with node: %q err %+v", req.VolumeId, req.NodeId, err)
-		klog.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+	if c.volumeLocks != nil {
+		release, pendingDelete, err := c.volumeLocks.acquire(ctx, req.VolumeId, false)
+		if err != nil {
+			msg := fmt.Sprintf("Timed out waiting for the operations on volume: %q. Error: %v", req.VolumeId, err)
+			klog.Error(msg)
+			return nil, status.Error(codes.Aborted, msg)
+		}
+		defer release()
+		if pendingDelete {
+			msg := fmt.Sprintf("Failed to attach disk: %+q with node: %q, volume is being deleted", req.VolumeId, req.NodeId)
+			klog.Error(msg)
+			return nil, status.Error(codes.FailedPrecondition, msg)
+		}
+	}
+	if c.manager.CnsConfig.Controller.RefuseAttachInMaintenanceMode {
+		inMaintenance, err := node.IsHostInMaintenanceMode(ctx)
+		if err != nil {
+			klog.Warningf("Failed to check whether the host of node %q is in maintenance mode, attaching anyway. Error: %v", req.NodeId, err)
+		} else if inMaintenance {
+			msg := fmt.Sprintf("Failed to attach disk: %+q with node: %q, host in maintenance mode", req.VolumeId, req.NodeId)
+			klog.Error(msg)
+			return nil, status.Error(codes.FailedPrecondition, msg)
+		}
+	}
+	if c.drain != nil {
+		c.drain.forget(req.VolumeId, req.NodeId)
 	}
 	publishInfo := make(map[string]string)
+	var diskUUID string
+	scsiController, hasSCSIController := req.GetVolumeContext()[common.AttributeSCSIController]
+	multiWriter := common.IsMultiWriterBlockVolume([]*csi.VolumeCapability{req.GetVolumeCapability()})
+	// Volumes without adapter type are attached to a controller of any type
+	adapterType := req.GetVolumeContext()[common.AttributeAdapterType]
+	if adapterType != "" {
+		adapterType, err = common.ParseAdapterType(adapterType)
+		if err != nil {
+			msg := fmt.Sprintf("Invalid adapter type for disk: %+q. Error: %v", req.VolumeId, err)
+			klog.Error(msg)
+			return nil, status.Errorf(codes.InvalidArgument, msg)
+		}
+	}
+	// CNS attaches volumes to a pvscsi controller, other adapter types
+	// require reconfiguring the node VM
+	if hasSCSIController || multiWriter || (adapterType != "" && adapterType != common.AdapterTypePVSCSI) {
+		var busNumber int32
+		if hasSCSIController {
+			busNumber, err = common.ParseSCSIController(scsiController)
+			if err != nil {
+				msg := fmt.Sprintf("Invalid SCSI controller for disk: %+q. Error: %v", req.VolumeId, err)
+				klog.Error(msg)
+				return nil, status.Errorf(codes.InvalidArgument, msg)
+			}
+		}
+		if adapterType != "" {
+			supported, err := node.SupportsSCSIController(ctx, adapterType)
+			if err != nil {
+				klog.Warningf("Failed to check whether the guest OS of node %q supports adapter type %s, attaching anyway. Error: %v",
+					req.NodeId, adapterType, err)
+			} else if !supported {
+				msg := fmt.Sprintf("Failed to attach disk: %+q with node: %q, guest OS does not support adapter type %s",
+					req.VolumeId, req.NodeId, adapterType)
+				klog.Error(msg)
+				return nil, status.Error(codes.FailedPrecondition, msg)
+			}
+		}
+		var usedBus int32
+		if multiWriter {
+			diskUUID, usedBus, err = common.AttachMultiWriterVolumeUtil(ctx, c.manager, node, req.VolumeId, busNumber, adapterType)
+		} else {
+			diskUUID, usedBus, err = common.AttachVolumeToSCSIControllerUtil(ctx, c.manager, node, req.VolumeId, busNumber, adapterType)
+		}
+		if err == cnsvsphere.ErrNoFreeSCSIController && adapterType != "" {
+			msg := fmt.Sprintf("Failed to attach disk: %+q with node: %q, no %s controller with a free unit",
+				req.VolumeId, req.NodeId, adapterType)
+			klog.Error(msg)
+			return nil, status.Error(codes.FailedPrecondition, msg)
+		}
+		if err != nil {
+			msg := fmt.Sprintf("Failed to attach disk: %+q with node: %q err %+v", req.VolumeId, req.NodeId, err)
+			klog.Error(msg)
+			return nil, status.Errorf(codes.Internal, msg)
+		}
+		publishInfo[common.AttributeSCSIController] = strconv.Itoa(int(usedBus))
+		publishInfo[common.AttributeAttachedOutsideCNS] = "true"
+	} else if c.manager.CnsConfig.Controller.DeferredAttach {
+		diskUUID, err = c.publishDeferred(ctx, node, req.VolumeId, req.NodeId)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to attach disk: %+q with node: %q err %+v", req.VolumeId, req.NodeId, err)
+			klog.Error(msg)
+			return nil, status.Errorf(codes.Internal, msg)
+		}
+		publishInfo[common.AttributeAttachDeferred] = "true"
+	} else {
+		diskUUID, err = common.AttachVolumeUtil(ctx, c.manager, node, req.VolumeId)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to attach disk: %+q with node: %q err %+v", req.VolumeId, req.NodeId, err)
+			klog.Error(msg)
+			return nil, status.Errorf(codes.Internal, msg)
+		}
+	}
 	publishInfo[common.AttributeDiskType] = common.DiskTypeString
 	publishInfo[common.AttributeFirstClassDiskUUID] = common.FormatDiskUUID(diskUUID)
+	if assigned := req.GetVolumeContext()[common.AttributeFirstClassDiskUUID]; assigned != "" && assigned != publishInfo[common.AttributeFirstClassDiskUUID] {
+		klog.Warningf("Disk: %+q attached to node: %q with UUID %s instead of UUID %s assigned at creation",
+			req.VolumeId, req.NodeId, publishInfo[common.AttributeFirstClassDiskUUID], assigned)
+	}
 	resp := &csi.ControllerPublishVolumeResponse{
 		PublishContext: publishInfo,
 	}
@@ -306,18 +981,36 @@ func (c *controller) ControllerUnpublishVolume(ctx context.Context, req *csi.Con
 		klog.Error(msg)
 		return nil, status.Errorf(codes.Internal, msg)
 	}
+	if c.drain != nil && c.drain.forget(req.VolumeId, req.NodeId) {
+		klog.V(2).Infof("Volume %q was already detached from draining node %q", req.VolumeId, req.NodeId)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
 	node, err := c.nodeMgr.GetNodeByName(req.NodeId)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to find VirtualMachine for node:%q. Error: %v", req.NodeId, err)
 		klog.Error(msg)
 		return nil, status.Errorf(codes.Internal, msg)
 	}
-	err = common.DetachVolumeUtil(ctx, c.manager, node, req.VolumeId)
+	if err := c.deferredAttaches.stop(ctx, req.VolumeId, req.NodeId); err != nil {
+		msg := fmt.Sprintf("Failed to wait for the pending attach of disk: %+q to node: %q err %+v", req.VolumeId, req.NodeId, err)
+		klog.Error(msg)
+		return nil, status.Errorf(codes.Internal, msg)
+	}
+	outsideCNS := c.isAttachedOutsideCNS(ctx, node, req.VolumeId, req.NodeId)
+	if err = common.DetachVolumeUtil(ctx, c.manager, node, req.VolumeId, outsideCNS); err != nil {
+		failures := c.detachFailures.recordFailure(req.VolumeId, req.NodeId)
+		forceDetachAfter := c.manager.CnsConfig.Controller.ForceDetachAfterFailures
+		if forceDetachAfter > 0 && failures >= forceDetachAfter {
+			klog.Warningf("Detach of disk: %q from node: %q failed %d times, last err %+v", req.VolumeId, req.NodeId, failures, err)
+			err = forceDetachVolume(ctx, node, req.VolumeId)
+		}
+	}
 	if err != nil {
 		msg := fmt.Sprintf("Failed to detach disk: %+q from node: %q err %+v", req.VolumeId, req.NodeId, err)
 		klog.Error(msg)
 		return nil, status.Errorf(codes.Internal, msg)
 	}
+	c.detachFailures.reset(req.VolumeId, req.NodeId)
 	resp := &csi.ControllerUnpublishVolumeResponse{}
 	return resp, nil
 }
@@ -328,12 +1021,14 @@ func (c *controller) ValidateVolumeCapabilities(ctx context.Context, req *csi.Va
 
 	klog.V(4).Infof("ControllerGetCapabilities: called with args %+v", *req)
 	volCaps := req.GetVolumeCapabilities()
-	var confirmed *csi.ValidateVolumeCapabilitiesResponse_Confirmed
-	if common.IsValidVolumeCapabilities(volCaps) {
-		confirmed = &csi.ValidateVolumeCapabilitiesResponse_Confirmed{VolumeCapabilities: volCaps}
+	if err := common.ValidateVolumeCapabilities(volCaps); err != nil {
+		klog.V(3).Infof("ValidateVolumeCapabilities: volume capabilities of volume %q not supported: %v", req.VolumeId, err)
+		return &csi.ValidateVolumeCapabilitiesResponse{
+			Message: err.Error(),
+		}, nil
 	}
 	return &csi.ValidateVolumeCapabilitiesResponse{
-		Confirmed: confirmed,
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{VolumeCapabilities: volCaps},
 	}, nil
 }
 
@@ -17,13 +17,19 @@ limitations under the License.
 package cns
 
 import (
+	"context"
 	"fmt"
+	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/klog"
 
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
 )
 
@@ -33,16 +39,146 @@ import (
 func validateVanillaCreateVolumeRequest(req *csi.CreateVolumeRequest) error {
 	// Get create params
 	params := req.GetParameters()
-	for paramName := range params {
+	var hasStoragePolicyName, hasStoragePolicyTag, hasCachePolicy, hasHostGroup, hasVsanFaultDomain bool
+	if _, err := common.ParseCnsLabels(params); err != nil {
+		msg := fmt.Sprintf("Volume parameters are invalid. Error: %v", err)
+		return status.Error(codes.InvalidArgument, msg)
+	}
+	for paramName, paramValue := range params {
 		paramName = strings.ToLower(paramName)
-		if paramName != common.AttributeDatastoreURL && paramName != common.AttributeStoragePolicyName && paramName != common.AttributeFsType {
+		if strings.HasPrefix(paramName, common.AttributeCnsLabelPrefix) {
+			continue
+		}
+		if paramName != common.AttributeDatastoreURL && paramName != common.AttributeStoragePolicyName && paramName != common.AttributeFsType &&
+			paramName != common.AttributeMkfsOptions && paramName != common.AttributeHostGroup && paramName != common.AttributeStoragePolicyTag &&
+			paramName != common.AttributeSCSIController && paramName != common.AttributeResourcePool &&
+			paramName != common.AttributeAllowDeleteAttached && paramName != common.AttributeMountUID &&
+			paramName != common.AttributeMountGID && paramName != common.AttributeVolumeTTL &&
+			paramName != common.AttributeDatastoreTypePreference && paramName != common.AttributeKeyRotationInterval &&
+			paramName != common.AttributeDatastoreFilter && paramName != common.AttributeMinIOPS &&
+			paramName != common.AttributeCachePolicy && paramName != common.AttributeVsanFaultDomain &&
+			paramName != common.AttributeDatastoreAntiAffinity && paramName != common.AttributePVCName &&
+			paramName != common.AttributePVCNamespace && paramName != common.AttributePVName &&
+			paramName != common.AttributeAdapterType {
 			msg := fmt.Sprintf("Volume parameter %s is not a valid Vanilla CSI parameter.", paramName)
 			return status.Error(codes.InvalidArgument, msg)
 		}
+		if paramName == common.AttributeMkfsOptions {
+			if _, err := common.ParseMkfsOptions(paramValue, getRequestFsType(req)); err != nil {
+				msg := fmt.Sprintf("Volume parameter %s is invalid. Error: %v", paramName, err)
+				return status.Error(codes.InvalidArgument, msg)
+			}
+		}
+		if paramName == common.AttributeSCSIController {
+			if _, err := common.ParseSCSIController(paramValue); err != nil {
+				msg := fmt.Sprintf("Volume parameter %s is invalid. Error: %v", paramName, err)
+				return status.Error(codes.InvalidArgument, msg)
+			}
+		}
+		if paramName == common.AttributeAdapterType {
+			if _, err := common.ParseAdapterType(paramValue); err != nil {
+				msg := fmt.Sprintf("Volume parameter %s is invalid. Error: %v", paramName, err)
+				return status.Error(codes.InvalidArgument, msg)
+			}
+		}
+		if paramName == common.AttributeMountUID || paramName == common.AttributeMountGID {
+			if _, err := common.ParseMountOwnerID(paramValue); err != nil {
+				msg := fmt.Sprintf("Volume parameter %s is invalid. Error: %v", paramName, err)
+				return status.Error(codes.InvalidArgument, msg)
+			}
+		}
+		if paramName == common.AttributeVolumeTTL {
+			if _, err := common.ParseVolumeTTL(paramValue); err != nil {
+				msg := fmt.Sprintf("Volume parameter %s is invalid. Error: %v", paramName, err)
+				return status.Error(codes.InvalidArgument, msg)
+			}
+		}
+		if paramName == common.AttributeKeyRotationInterval {
+			if _, err := common.ParseKeyRotationInterval(paramValue); err != nil {
+				msg := fmt.Sprintf("Volume parameter %s is invalid. Error: %v", paramName, err)
+				return status.Error(codes.InvalidArgument, msg)
+			}
+		}
+		if paramName == common.AttributeDatastoreFilter {
+			if _, err := common.ParseDatastoreFilter(paramValue); err != nil {
+				msg := fmt.Sprintf("Volume parameter %s is invalid. Error: %v", paramName, err)
+				return status.Error(codes.InvalidArgument, msg)
+			}
+		}
+		if paramName == common.AttributeDatastoreAntiAffinity {
+			if _, err := common.ParseDatastoreAntiAffinity(paramValue); err != nil {
+				msg := fmt.Sprintf("Volume parameter %s is invalid. Error: %v", paramName, err)
+				return status.Error(codes.InvalidArgument, msg)
+			}
+		}
+		if paramName == common.AttributeCachePolicy {
+			if _, err := common.ParseCachePolicy(paramValue); err != nil {
+				msg := fmt.Sprintf("Volume parameter %s is invalid. Error: %v", paramName, err)
+				return status.Error(codes.InvalidArgument, msg)
+			}
+		}
+		if paramName == common.AttributeMinIOPS {
+			if _, err := common.ParseMinIOPS(paramValue); err != nil {
+				msg := fmt.Sprintf("Volume parameter %s is invalid. Error: %v", paramName, err)
+				return status.Error(codes.InvalidArgument, msg)
+			}
+		}
+		if paramName == common.AttributeDatastoreTypePreference {
+			if _, err := common.ParseDatastoreTypePreference(paramValue); err != nil {
+				msg := fmt.Sprintf("Volume parameter %s is invalid. Error: %v", paramName, err)
+				return status.Error(codes.InvalidArgument, msg)
+			}
+		}
+		if paramName == common.AttributeAllowDeleteAttached {
+			if _, err := strconv.ParseBool(paramValue); err != nil {
+				msg := fmt.Sprintf("Volume parameter %s is invalid. Error: %v", paramName, err)
+				return status.Error(codes.InvalidArgument, msg)
+			}
+		}
+		hasStoragePolicyName = hasStoragePolicyName || paramName == common.AttributeStoragePolicyName
+		hasStoragePolicyTag = hasStoragePolicyTag || paramName == common.AttributeStoragePolicyTag
+		hasCachePolicy = hasCachePolicy || paramName == common.AttributeCachePolicy
+		hasHostGroup = hasHostGroup || paramName == common.AttributeHostGroup
+		hasVsanFaultDomain = hasVsanFaultDomain || paramName == common.AttributeVsanFaultDomain
+	}
+	if hasStoragePolicyName && hasStoragePolicyTag {
+		msg := fmt.Sprintf("Volume parameters %s and %s are mutually exclusive.", common.AttributeStoragePolicyName, common.AttributeStoragePolicyTag)
+		return status.Error(codes.InvalidArgument, msg)
+	}
+	if hasCachePolicy && (hasStoragePolicyName || hasStoragePolicyTag) {
+		msg := fmt.Sprintf("Volume parameter %s is mutually exclusive with %s and %s.", common.AttributeCachePolicy,
+			common.AttributeStoragePolicyName, common.AttributeStoragePolicyTag)
+		return status.Error(codes.InvalidArgument, msg)
+	}
+	if hasVsanFaultDomain && hasHostGroup {
+		msg := fmt.Sprintf("Volume parameters %s and %s are mutually exclusive.", common.AttributeVsanFaultDomain, common.AttributeHostGroup)
+		return status.Error(codes.InvalidArgument, msg)
+	}
+	if hasVsanFaultDomain && !hasStoragePolicyName && !hasStoragePolicyTag && !hasCachePolicy {
+		// The data of the volume is only kept in the fault domain by its storage policy
+		msg := fmt.Sprintf("Volume parameter %s requires a storage policy.", common.AttributeVsanFaultDomain)
+		return status.Error(codes.InvalidArgument, msg)
 	}
 	return common.ValidateCreateVolumeRequest(req)
 }
 
+// getRequestFsType returns the filesystem type the volume of the request is
+// formatted with, set by the StorageClass or in the mount capability of the
+// volume, or an empty string for the default type.
+func getRequestFsType(req *csi.CreateVolumeRequest) string {
+	for paramName, paramValue := range req.GetParameters() {
+		if strings.ToLower(paramName) == common.AttributeFsType {
+			return paramValue
+		}
+	}
+	for _, volCap := range req.GetVolumeCapabilities() {
+		if fsType := volCap.GetMount().GetFsType(); fsType != "" {
+			return fsType
+		}
+	}
+	return ""
+}
+
 // validateVanillaDeleteVolumeRequest is the helper function to validate
 // DeleteVolumeRequest for Vanilla CSI driver.
 // Function returns error if validation fails otherwise returns nil.
@@ -62,3 +198,259 @@ func validateVanillaControllerPublishVolumeRequest(req *csi.ControllerPublishVol
 func validateVanillaControllerUnpublishVolumeRequest(req *csi.ControllerUnpublishVolumeRequest) error {
 	return common.ValidateControllerUnpublishVolumeRequest(req)
 }
+
+// getStoragePolicyIDByName returns the ID of the storage policy with the given
+// name.
+func getStoragePolicyIDByName(ctx context.Context, manager *common.Manager, name string) (string, error) {
+	vc, err := common.GetVCenter(ctx, manager)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to get vCenter. Error: %+v", err)
+		klog.Error(msg)
+		return "", status.Error(codes.Internal, msg)
+	}
+	if err = vc.ConnectPbm(ctx); err != nil {
+		msg := fmt.Sprintf("Failed to connect to PBM. Error: %+v", err)
+		klog.Error(msg)
+		return "", status.Error(codes.Internal, msg)
+	}
+	storagePolicyID, err := vc.GetStoragePolicyIDByName(ctx, name)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to get storage policy with name: %s. Error: %+v", name, err)
+		klog.Error(msg)
+		return "", status.Error(codes.Internal, msg)
+	}
+	return storagePolicyID, nil
+}
+
+// getStoragePolicyIDByTag resolves the storagePolicyTag of a StorageClass to the
+// ID of the storage policy with a tag based placement rule for that tag.
+// InvalidArgument is returned if no or several storage policies match.
+func getStoragePolicyIDByTag(ctx context.Context, manager *common.Manager, tag string) (string, error) {
+	vc, err := common.GetVCenter(ctx, manager)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to get vCenter. Error: %+v", err)
+		klog.Error(msg)
+		return "", status.Error(codes.Internal, msg)
+	}
+	if err = vc.ConnectPbm(ctx); err != nil {
+		msg := fmt.Sprintf("Failed to connect to PBM. Error: %+v", err)
+		klog.Error(msg)
+		return "", status.Error(codes.Internal, msg)
+	}
+	storagePolicyID, err := vc.GetStoragePolicyIDByTag(ctx, tag)
+	if err == cnsvsphere.ErrStoragePolicyTagNotFound || err == cnsvsphere.ErrStoragePolicyTagNotUnique {
+		msg := fmt.Sprintf("Storage policy tag: %s specified in the storage class is invalid. Error: %v", tag, err)
+		klog.Error(msg)
+		return "", status.Error(codes.InvalidArgument, msg)
+	} else if err != nil {
+		msg := fmt.Sprintf("Failed to get storage policy with tag: %s. Error: %+v", tag, err)
+		klog.Error(msg)
+		return "", status.Error(codes.Internal, msg)
+	}
+	return storagePolicyID, nil
+}
+
+// getStoragePolicyCompatibleDatastores returns the datastores compatible with
+// the storage policy.
+func getStoragePolicyCompatibleDatastores(ctx context.Context, manager *common.Manager, storagePolicyID string,
+	datastores []*cnsvsphere.DatastoreInfo) ([]*cnsvsphere.DatastoreInfo, error) {
+	vc, err := common.GetVCenter(ctx, manager)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to get vCenter. Error: %+v", err)
+		klog.Error(msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+	if err = vc.ConnectPbm(ctx); err != nil {
+		msg := fmt.Sprintf("Failed to connect to PBM. Error: %+v", err)
+		klog.Error(msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+	compatible, err := vc.GetCompatibleDatastores(ctx, storagePolicyID, datastores)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to check compatibility of datastores with storage policy: %s. Error: %+v", storagePolicyID, err)
+		klog.Error(msg)
+		return nil, status.Error(codes.Internal, msg)
+	}
+	return compatible, nil
+}
+
+// getVolumeSizeBytes returns the size of the volume requested with the
+// capacity range, rounded up to a whole number of MB as volumes are created
+// in MB. Volumes without required size get the default size, capped to the
+// limit of the range. A range without required size nor limit is rejected,
+// as is a range whose limit leaves no whole MB at or above the required size,
+// while volumes requested without range get the default size.
+func getVolumeSizeBytes(capacityRange *csi.CapacityRange, defaultSizeBytes int64) (int64, error) {
+	if capacityRange == nil {
+		return common.RoundUpSize(defaultSizeBytes, common.MbInBytes) * common.MbInBytes, nil
+	}
+	requiredBytes, limitBytes := capacityRange.GetRequiredBytes(), capacityRange.GetLimitBytes()
+	if requiredBytes < 0 || limitBytes < 0 {
+		return 0, status.Error(codes.InvalidArgument, "Volume capacity range must not be negative")
+	}
+	if requiredBytes == 0 && limitBytes == 0 {
+		return 0, status.Error(codes.InvalidArgument, "Volume capacity range has neither required bytes nor limit bytes")
+	}
+	sizeBytes := requiredBytes
+	if sizeBytes == 0 {
+		sizeBytes = defaultSizeBytes
+		if sizeBytes > limitBytes {
+			sizeBytes = limitBytes / common.MbInBytes * common.MbInBytes
+		}
+	}
+	sizeBytes = common.RoundUpSize(sizeBytes, common.MbInBytes) * common.MbInBytes
+	if sizeBytes == 0 || (limitBytes != 0 && sizeBytes > limitBytes) {
+		return 0, status.Errorf(codes.OutOfRange, "Volume capacity range %+v does not allow a size in whole MB", capacityRange)
+	}
+	return sizeBytes, nil
+}
+
+// getPreferredDatastores returns, in order, the preferred datastores of the
+// zones of the topology requirement which are among the given datastores.
+// Zones of preferred topologies are considered before requisite ones.
+func getPreferredDatastores(topologyRequirement *csi.TopologyRequirement, cfg *config.Config,
+	datastores []*cnsvsphere.DatastoreInfo) []*cnsvsphere.DatastoreInfo {
+	preferences := cfg.PreferredDatastores
+	if len(preferences) == 0 {
+		return nil
+	}
+	zoneKey, _ := common.GetTopologyKeys(cfg)
+	var preferred []*cnsvsphere.DatastoreInfo
+	added := make(map[string]bool)
+	topologies := append(topologyRequirement.GetPreferred(), topologyRequirement.GetRequisite()...)
+	for _, topology := range topologies {
+		zone := topology.GetSegments()[zoneKey]
+		preference, ok := preferences[zone]
+		if !ok || added[zone] {
+			continue
+		}
+		added[zone] = true
+		for _, url := range strings.Split(preference.DatastoreURLs, ",") {
+			url = strings.TrimSpace(url)
+			for _, datastore := range datastores {
+				if datastore.Info.Url == url && !added[url] {
+					added[url] = true
+					preferred = append(preferred, datastore)
+					break
+				}
+			}
+		}
+	}
+	return preferred
+}
+
+// groupDatastoresByType returns the datastores of each type of the datastore
+// type preference, in order of preference. Types without datastores are
+// omitted.
+func groupDatastoresByType(datastores []*cnsvsphere.DatastoreInfo, preference []string) [][]*cnsvsphere.DatastoreInfo {
+	var groups [][]*cnsvsphere.DatastoreInfo
+	for _, datastoreType := range preference {
+		var group []*cnsvsphere.DatastoreInfo
+		for _, datastore := range datastores {
+			if strings.ToLower(datastore.Type) == datastoreType {
+				group = append(group, datastore)
+			}
+		}
+		if len(group) > 0 {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// filterDatastoresByIOPS returns the datastores advertising at least the given
+// IOPS.
+func filterDatastoresByIOPS(ctx context.Context, datastores []*cnsvsphere.DatastoreInfo, minIOPS int64) ([]*cnsvsphere.DatastoreInfo, error) {
+	var filtered []*cnsvsphere.DatastoreInfo
+	for _, datastore := range datastores {
+		iops, err := datastore.GetDatastoreIOPS(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if iops >= minIOPS {
+			filtered = append(filtered, datastore)
+		} else {
+			klog.V(4).Infof("Datastore %q advertises %d IOPS, less than the minimum of %d", datastore.Info.Url, iops, minIOPS)
+		}
+	}
+	return filtered, nil
+}
+
+// vsanDatastoreType is the lower cased file system type of vSAN datastores.
+const vsanDatastoreType = "vsan"
+
+// multiWriterDatastoreTypes are the lower cased file system types of the
+// datastores supporting multi-writer sharing of thin provisioned disks.
+var multiWriterDatastoreTypes = map[string]bool{
+	vsanDatastoreType: true,
+}
+
+// getMultiWriterDatastores returns the datastores on which multi-writer
+// volumes can be placed.
+func getMultiWriterDatastores(datastores []*cnsvsphere.DatastoreInfo) []*cnsvsphere.DatastoreInfo {
+	var multiWriterDatastores []*cnsvsphere.DatastoreInfo
+	for _, datastore := range datastores {
+		if multiWriterDatastoreTypes[strings.ToLower(datastore.Type)] {
+			multiWriterDatastores = append(multiWriterDatastores, datastore)
+		}
+	}
+	return multiWriterDatastores
+}
+
+// getAlignmentBlockSizeMB returns the block size in MB volumes placed on the
+// datastores are aligned to: the block size of the datastore with the given
+// URL if set, otherwise the largest block size of the datastores.
+func getAlignmentBlockSizeMB(datastores []*cnsvsphere.DatastoreInfo, datastoreURL string) int64 {
+	var blockSizeMB int64
+	for _, datastore := range datastores {
+		if datastoreURL != "" && datastore.Info.Url != datastoreURL {
+			continue
+		}
+		if datastore.BlockSizeMB > blockSizeMB {
+			blockSizeMB = datastore.BlockSizeMB
+		}
+	}
+	return blockSizeMB
+}
+
+// alignVolumeSizeMB rounds the size up to a multiple of the block size.
+func alignVolumeSizeMB(sizeMB int64, blockSizeMB int64) int64 {
+	if blockSizeMB <= 1 {
+		return sizeMB
+	}
+	return (sizeMB + blockSizeMB - 1) / blockSizeMB * blockSizeMB
+}
+
+// getVolumeAccessibleTopology returns the distinct topologies whose nodes
+// access the volume datastore, in order, along with the segments they all
+// share. Every zone reaching the datastore is reported, so pods of volumes
+// provisioned ahead of scheduling are not confined to one of them.
+func getVolumeAccessibleTopology(datastoreTopologies []map[string]string) ([]*csi.Topology, map[string]string) {
+	var topologies []*csi.Topology
+	shared := make(map[string]string)
+	for _, segments := range datastoreTopologies {
+		duplicate := false
+		for _, topology := range topologies {
+			if reflect.DeepEqual(topology.Segments, segments) {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			continue
+		}
+		if len(topologies) == 0 {
+			for key, value := range segments {
+				shared[key] = value
+			}
+		} else {
+			for key, value := range shared {
+				if segments[key] != value {
+					delete(shared, key)
+				}
+			}
+		}
+		topologies = append(topologies, &csi.Topology{Segments: segments})
+	}
+	return topologies, shared
+}
@@ -22,6 +22,7 @@ import (
 	"os"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	cnstypes "github.com/vmware/govmomi/cns/types"
@@ -33,6 +34,9 @@ import (
 	"github.com/vmware/govmomi/vim25"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/govmomi/vslm"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	clientset "k8s.io/client-go/kubernetes"
 	testclient "k8s.io/client-go/kubernetes/fake"
 	"k8s.io/klog"
@@ -41,6 +45,7 @@ import (
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
 	k8s "sigs.k8s.io/vsphere-csi-driver/pkg/kubernetes"
 )
 
@@ -59,6 +64,18 @@ func (f *FakeNodeManager) Initialize() error {
 	return nil
 }
 
+func (f *FakeNodeManager) GetSharedDatastoresInHostGroup(ctx context.Context, hostGroupName string) ([]*cnsvsphere.DatastoreInfo, []string, error) {
+	return nil, nil, cnsvsphere.ErrHostGroupNotFound
+}
+
+func (f *FakeNodeManager) GetSharedDatastoresInVsanFaultDomain(ctx context.Context, faultDomainName string) ([]*cnsvsphere.DatastoreInfo, []string, error) {
+	return nil, nil, cnsvsphere.ErrVsanFaultDomainNotFound
+}
+
+func (f *FakeNodeManager) GetSharedDatastoresInResourcePool(ctx context.Context, resourcePool string) ([]*cnsvsphere.DatastoreInfo, error) {
+	return nil, cnsvsphere.ErrResourcePoolNotFound
+}
+
 func (f *FakeNodeManager) GetSharedDatastoresInK8SCluster(ctx context.Context) ([]*cnsvsphere.DatastoreInfo, error) {
 	finder := find.NewFinder(f.client, false)
 
@@ -101,8 +118,8 @@ func (f *FakeNodeManager) GetSharedDatastoresInK8SCluster(ctx context.Context) (
 	return []*cnsvsphere.DatastoreInfo{
 		{
 			Datastore: &cnsvsphere.Datastore{
-				Datastore:  object.NewDatastore(nil, sharedDatastoreManagedObject.Reference()),
-				Datacenter: nil},
+				Datastore:  object.NewDatastore(dc.Client(), sharedDatastoreManagedObject.Reference()),
+				Datacenter: &cnsvsphere.Datacenter{Datacenter: dc}},
 			Info: sharedDatastoreManagedObject.Info.GetDatastoreInfo(),
 		},
 	}, nil
@@ -130,7 +147,8 @@ func (f *FakeNodeManager) GetNodeByName(nodeName string) (*cnsvsphere.VirtualMac
 	return vm, nil
 }
 
-func (f *FakeNodeManager) GetSharedDatastoresInTopology(ctx context.Context, topologyRequirement *csi.TopologyRequirement, zoneKey string, regionKey string) ([]*cnsvsphere.DatastoreInfo, map[string][]map[string]string, error) {
+func (f *FakeNodeManager) GetSharedDatastoresInTopology(ctx context.Context, topologyRequirement *csi.TopologyRequirement, zoneCategoryName string, regionCategoryName string,
+	zoneKey string, regionKey string) ([]*cnsvsphere.DatastoreInfo, map[string][]map[string]string, error) {
 	return nil, nil, nil
 }
 
@@ -200,6 +218,9 @@ func getControllerTest(t *testing.T) *controllerTest {
 				sharedDatastoreURL: sharedDatastoreURL,
 				k8sClient:          k8sClient,
 			},
+			reservations:     newReservationLedger(),
+			detachFailures:   newDetachFailureTracker(),
+			deferredAttaches: newDeferredAttachTracker(),
 		}
 		controllerTestInstance = &controllerTest{
 			controller: c,
@@ -319,6 +340,111 @@ func TestCreateVolumeWithStoragePolicy(t *testing.T) {
 	}
 }
 
+func TestCreateVolumeWithCachePolicy(t *testing.T) {
+	if os.Getenv("VSPHERE_DATACENTER") != "" {
+		t.Skip("Cache policies are only configured with the simulator")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+	capabilities := []*csi.VolumeCapability{
+		{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+	reqCreate := &csi.CreateVolumeRequest{
+		Name: testVolumeName + "-writeback",
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 1 * common.GbInBytes,
+		},
+		Parameters: map[string]string{
+			common.AttributeCachePolicy: "WriteBack",
+		},
+		VolumeCapabilities: capabilities,
+	}
+
+	// Cache policies without storage policy are rejected
+	if _, err := ct.controller.CreateVolume(ctx, reqCreate); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument for unconfigured cache policy, got err: %v", err)
+	}
+
+	// PBM simulator defaults
+	ct.config.CachePolicy = map[string]*config.CachePolicyConfig{
+		common.CachePolicyWriteBack: {StoragePolicyName: "vSAN Default Storage Policy"},
+	}
+	defer func() {
+		ct.config.CachePolicy = nil
+	}()
+	respCreate, err := ct.controller.CreateVolume(ctx, reqCreate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volID := respCreate.Volume.VolumeId
+	pc, err := pbm.NewClient(ctx, ct.vcenter.Client.Client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profileID, err := pc.ProfileIDByName(ctx, "vSAN Default Storage Policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queryResult, err := ct.vcenter.CnsClient.QueryVolume(ctx, cnstypes.CnsQueryFilter{
+		VolumeIds: []cnstypes.CnsVolumeId{{Id: volID}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queryResult.Volumes) != 1 || queryResult.Volumes[0].StoragePolicyId != profileID {
+		t.Fatalf("Expected volume %s to be created with storage policy %s of the cache policy", volID, profileID)
+	}
+	if _, err = ct.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volID}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache policies apply their own storage policy
+	reqCreate.Parameters[common.AttributeStoragePolicyName] = "vSAN Default Storage Policy"
+	if _, err := ct.controller.CreateVolume(ctx, reqCreate); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument for cache policy with storage policy, got err: %v", err)
+	}
+}
+
+func TestCreateVolumeWithUnknownStoragePolicyTag(t *testing.T) {
+	// Create context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+
+	// PBM simulator defaults have no tag based placement rules
+	params := map[string]string{
+		common.AttributeStoragePolicyTag: "no-such-tag",
+	}
+	capabilities := []*csi.VolumeCapability{
+		{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+
+	reqCreate := &csi.CreateVolumeRequest{
+		Name: testVolumeName + "-policy-tag",
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 1 * common.GbInBytes,
+		},
+		Parameters:         params,
+		VolumeCapabilities: capabilities,
+	}
+
+	_, err := ct.controller.CreateVolume(ctx, reqCreate)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument for unknown storage policy tag, got: %v", err)
+	}
+}
+
 func TestCompleteControllerFlow(t *testing.T) {
 	// Create context
 	ctx, cancel := context.WithCancel(context.Background())
@@ -354,6 +480,24 @@ func TestCompleteControllerFlow(t *testing.T) {
 	}
 	volID := respCreate.Volume.VolumeId
 
+	// Verify a retried request reuses the volume
+	respCreate, err = ct.controller.CreateVolume(ctx, reqCreate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if respCreate.Volume.VolumeId != volID {
+		t.Fatalf("Retried CreateVolume returned volume ID %s instead of %s", respCreate.Volume.VolumeId, volID)
+	}
+
+	// Verify a retried request with a different size is rejected
+	reqConflict := *reqCreate
+	reqConflict.CapacityRange = &csi.CapacityRange{
+		RequiredBytes: 2 * common.GbInBytes,
+	}
+	if _, err = ct.controller.CreateVolume(ctx, &reqConflict); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("Expected CreateVolume with conflicting size to fail with AlreadyExists, got err: %v", err)
+	}
+
 	// Varify the volume has been created
 	queryFilter := cnstypes.CnsQueryFilter{
 		VolumeIds: []cnstypes.CnsVolumeId{
@@ -442,3 +586,486 @@ func TestCompleteControllerFlow(t *testing.T) {
 		t.Fatalf("Volume should not exist after deletion with ID: %s", volID)
 	}
 }
+
+func TestControllerPublishVolumeInMaintenanceMode(t *testing.T) {
+	if os.Getenv("VSPHERE_DATACENTER") != "" {
+		t.Skip("Maintenance mode is only simulated")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+	ct.config.Controller.RefuseAttachInMaintenanceMode = true
+	defer func() {
+		ct.config.Controller.RefuseAttachInMaintenanceMode = false
+	}()
+	// The fake node manager resolves nodes to any VM, so all hosts enter
+	// maintenance mode
+	vm := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	for _, obj := range simulator.Map.All("HostSystem") {
+		host := obj.(*simulator.HostSystem)
+		host.Runtime.InMaintenanceMode = true
+		defer func() {
+			host.Runtime.InMaintenanceMode = false
+		}()
+	}
+
+	req := &csi.ControllerPublishVolumeRequest{
+		VolumeId: "volume-in-maintenance",
+		NodeId:   vm.Name,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+	if _, err := ct.controller.ControllerPublishVolume(ctx, req); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Expected FailedPrecondition for host in maintenance mode, got err: %v", err)
+	}
+}
+
+func TestBatchedAttachVolume(t *testing.T) {
+	if os.Getenv("VSPHERE_DATACENTER") != "" {
+		t.Skip("Attach batching is only tested with the simulator")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+	volumeManager := ct.controller.manager.VolumeManager
+	volumeManager.SetAttachBatchWindow(100 * time.Millisecond)
+	defer volumeManager.SetAttachBatchWindow(0)
+
+	capabilities := []*csi.VolumeCapability{
+		{
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+	var volumeIDs []string
+	for i := 0; i < 3; i++ {
+		respCreate, err := ct.controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: fmt.Sprintf("%s-batched-%d", testVolumeName, i),
+			CapacityRange: &csi.CapacityRange{
+				RequiredBytes: 1 * common.GbInBytes,
+			},
+			VolumeCapabilities: capabilities,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		volumeIDs = append(volumeIDs, respCreate.Volume.VolumeId)
+	}
+	obj := simulator.Map.Any("VirtualMachine").(*simulator.VirtualMachine)
+	vm := &cnsvsphere.VirtualMachine{
+		VirtualMachine: object.NewVirtualMachine(ct.vcenter.Client.Client, obj.Reference()),
+	}
+
+	// Concurrent attaches to the VM are batched and each gets its disk UUID
+	diskUUIDs := make([]string, len(volumeIDs))
+	errs := make([]error, len(volumeIDs))
+	var wg sync.WaitGroup
+	for i, volumeID := range volumeIDs {
+		wg.Add(1)
+		go func(i int, volumeID string) {
+			defer wg.Done()
+			diskUUIDs[i], errs[i] = volumeManager.AttachVolume(vm, volumeID)
+		}(i, volumeID)
+	}
+	wg.Wait()
+	for i, volumeID := range volumeIDs {
+		if errs[i] != nil {
+			t.Fatalf("Batched attach of volume %s failed: %v", volumeID, errs[i])
+		}
+		if diskUUIDs[i] == "" {
+			t.Fatalf("Batched attach of volume %s returned no disk UUID", volumeID)
+		}
+	}
+
+	// A volume attached in a batch is not attached again
+	if _, err := volumeManager.AttachVolume(vm, volumeIDs[0]); err == nil {
+		t.Fatalf("Expected attaching volume %s again to fail", volumeIDs[0])
+	}
+
+	for _, volumeID := range volumeIDs {
+		if err := volumeManager.DetachVolume(vm, volumeID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ct.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFilterDatastoresByIOPS(t *testing.T) {
+	if os.Getenv("VSPHERE_DATACENTER") != "" {
+		t.Skip("Datastore IOPS attributes are only set in the simulator")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+	client := ct.vcenter.Client.Client
+	obj := simulator.Map.Any("Datastore").(*simulator.Datastore)
+	datastore := &cnsvsphere.DatastoreInfo{
+		Datastore: &cnsvsphere.Datastore{Datastore: object.NewDatastore(client, obj.Reference())},
+		Info:      obj.Info.GetDatastoreInfo(),
+	}
+	datastores := []*cnsvsphere.DatastoreInfo{datastore}
+
+	// Datastores without the attribute advertise no IOPS
+	filtered, err := filterDatastoresByIOPS(ctx, datastores, 1)
+	if err != nil || len(filtered) != 0 {
+		t.Fatalf("expected no datastore without IOPS attribute, got %v, err: %v", filtered, err)
+	}
+
+	fields, err := object.GetCustomFieldsManager(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := fields.FindKey(ctx, cnsvsphere.DatastoreIOPSAttribute)
+	if err != nil {
+		def, err := fields.Add(ctx, cnsvsphere.DatastoreIOPSAttribute, "Datastore", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key = def.Key
+	}
+	defer fields.Set(ctx, datastore.Reference(), key, "")
+	if err := fields.Set(ctx, datastore.Reference(), key, "5000"); err != nil {
+		t.Fatal(err)
+	}
+	if filtered, err = filterDatastoresByIOPS(ctx, datastores, 5000); err != nil || len(filtered) != 1 {
+		t.Fatalf("expected the datastore to advertise 5000 IOPS, got %v, err: %v", filtered, err)
+	}
+	if filtered, err = filterDatastoresByIOPS(ctx, datastores, 6000); err != nil || len(filtered) != 0 {
+		t.Fatalf("expected no datastore to advertise 6000 IOPS, got %v, err: %v", filtered, err)
+	}
+
+	// Invalid attributes advertise no IOPS
+	if err := fields.Set(ctx, datastore.Reference(), key, "fast"); err != nil {
+		t.Fatal(err)
+	}
+	if filtered, err = filterDatastoresByIOPS(ctx, datastores, 1); err != nil || len(filtered) != 0 {
+		t.Fatalf("expected no datastore with invalid IOPS attribute, got %v, err: %v", filtered, err)
+	}
+}
+
+func TestGetPreferredDatastores(t *testing.T) {
+	fast := newTestDatastore("ds:///vmfs/volumes/fast/", 100)
+	slow := newTestDatastore("ds:///vmfs/volumes/slow/", 100)
+	other := newTestDatastore("ds:///vmfs/volumes/other/", 100)
+	datastores := []*cnsvsphere.DatastoreInfo{other, slow}
+	cfg := &config.Config{
+		PreferredDatastores: map[string]*config.PreferredDatastoresConfig{
+			"zone-a": {DatastoreURLs: fast.Info.Url + ", " + slow.Info.Url},
+		},
+	}
+	topologyRequirement := &csi.TopologyRequirement{
+		Preferred: []*csi.Topology{
+			{Segments: map[string]string{csitypes.LabelZoneFailureDomain: "zone-b"}},
+			{Segments: map[string]string{csitypes.LabelZoneFailureDomain: "zone-a"}},
+		},
+		Requisite: []*csi.Topology{
+			{Segments: map[string]string{csitypes.LabelZoneFailureDomain: "zone-a"}},
+		},
+	}
+	// The unreachable fast datastore is skipped in favour of the slow one
+	preferred := getPreferredDatastores(topologyRequirement, cfg, datastores)
+	if len(preferred) != 1 || preferred[0] != slow {
+		t.Fatalf("expected only the slow datastore to be preferred, got %v", preferred)
+	}
+	datastores = append(datastores, fast)
+	preferred = getPreferredDatastores(topologyRequirement, cfg, datastores)
+	if len(preferred) != 2 || preferred[0] != fast || preferred[1] != slow {
+		t.Fatalf("expected the fast then the slow datastore to be preferred, got %v", preferred)
+	}
+	if preferred = getPreferredDatastores(topologyRequirement, &config.Config{}, datastores); len(preferred) != 0 {
+		t.Fatalf("expected no preferred datastore without preferences, got %v", preferred)
+	}
+	// Zones are read from the configured topology key
+	cfg.Labels.ZoneKey = "example.com/zone"
+	if preferred = getPreferredDatastores(topologyRequirement, cfg, datastores); len(preferred) != 0 {
+		t.Fatalf("expected no preferred datastore for other topology key, got %v", preferred)
+	}
+	customRequirement := &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{
+			{Segments: map[string]string{"example.com/zone": "zone-a"}},
+		},
+	}
+	if preferred = getPreferredDatastores(customRequirement, cfg, datastores); len(preferred) != 2 {
+		t.Fatalf("expected the fast and the slow datastore to be preferred, got %v", preferred)
+	}
+}
+
+func TestGroupDatastoresByType(t *testing.T) {
+	vsan := newTestDatastore("ds:///vmfs/volumes/vsan:52a4/", 100)
+	vsan.Type = "vsan"
+	vmfs1 := newTestDatastore("ds:///vmfs/volumes/vmfs1/", 100)
+	vmfs1.Type = "VMFS"
+	vmfs2 := newTestDatastore("ds:///vmfs/volumes/vmfs2/", 100)
+	vmfs2.Type = "VMFS"
+	nfs := newTestDatastore("ds:///vmfs/volumes/nfs/", 100)
+	nfs.Type = "NFS"
+	datastores := []*cnsvsphere.DatastoreInfo{nfs, vmfs1, vsan, vmfs2}
+
+	groups := groupDatastoresByType(datastores, []string{"vmfs", "pmem", "vsan"})
+	if len(groups) != 2 {
+		t.Fatalf("expected the vmfs and vsan datastores to be grouped, got %v", groups)
+	}
+	if len(groups[0]) != 2 || groups[0][0] != vmfs1 || groups[0][1] != vmfs2 {
+		t.Errorf("expected the vmfs datastores first, got %v", groups[0])
+	}
+	if len(groups[1]) != 1 || groups[1][0] != vsan {
+		t.Errorf("expected the vsan datastore second, got %v", groups[1])
+	}
+	if groups = groupDatastoresByType(datastores, nil); len(groups) != 0 {
+		t.Errorf("expected no groups without preference, got %v", groups)
+	}
+}
+
+func TestGetMultiWriterDatastores(t *testing.T) {
+	vsan := newTestDatastore("ds:///vmfs/volumes/vsan:52a4/", 100)
+	vsan.Type = "vsan"
+	vmfs := newTestDatastore("ds:///vmfs/volumes/vmfs/", 100)
+	vmfs.Type = "VMFS"
+	nfs := newTestDatastore("ds:///vmfs/volumes/nfs/", 100)
+	nfs.Type = "NFS"
+	datastores := getMultiWriterDatastores([]*cnsvsphere.DatastoreInfo{vmfs, vsan, nfs})
+	if len(datastores) != 1 || datastores[0] != vsan {
+		t.Fatalf("expected only the vSAN datastore to support multi-writer volumes, got %v", datastores)
+	}
+}
+
+func TestCreateMultiWriterVolumeOnUnsupportedDatastore(t *testing.T) {
+	if os.Getenv("VSPHERE_DATACENTER") != "" {
+		t.Skip("The simulator has no vSAN datastore")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+	reqCreate := &csi.CreateVolumeRequest{
+		Name: testVolumeName + "-multi-writer",
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 1 * common.GbInBytes,
+		},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+				},
+			},
+		},
+	}
+	if _, err := ct.controller.CreateVolume(ctx, reqCreate); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument for multi-writer volume without vSAN datastore, got err: %v", err)
+	}
+}
+
+func TestAttachMultiWriterDiskToTwoVMs(t *testing.T) {
+	if os.Getenv("VSPHERE_DATACENTER") != "" {
+		t.Skip("Multi-writer attach is only tested with the simulator")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+	client := ct.vcenter.Client.Client
+	vmObjs := simulator.Map.All("VirtualMachine")
+	if len(vmObjs) < 2 {
+		t.Skip("The simulator has less than two VMs")
+	}
+	var vms []*cnsvsphere.VirtualMachine
+	for _, obj := range vmObjs[:2] {
+		vms = append(vms, &cnsvsphere.VirtualMachine{
+			VirtualMachine: object.NewVirtualMachine(client, obj.(*simulator.VirtualMachine).Reference()),
+		})
+	}
+	dsObj := simulator.Map.Any("Datastore").(*simulator.Datastore)
+	// The simulator removes the directories of its datastores once created
+	dsDir := dsObj.Info.GetDatastoreInfo().Url
+	if err := os.MkdirAll(dsDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dsDir)
+	task, err := vslm.NewObjectManager(client).CreateDisk(ctx, types.VslmCreateSpec{
+		Name:         testVolumeName + "-shared",
+		CapacityInMB: 1024,
+		BackingSpec: &types.VslmCreateSpecDiskFileBackingSpec{
+			VslmCreateSpecBackingSpec: types.VslmCreateSpecBackingSpec{Datastore: dsObj.Reference()},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := task.WaitForResult(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diskID := result.Result.(types.VStorageObject).Config.Id.Id
+
+	// The disk is attached with multi-writer sharing to both VMs at once
+	for _, vm := range vms {
+		if _, _, err := vm.AttachMultiWriterDisk(ctx, diskID, dsObj.Reference(), 0, ""); err != nil {
+			t.Fatalf("Failed to attach disk %s to VM %v: %v", diskID, vm, err)
+		}
+		multiWriter, err := vm.IsDiskMultiWriter(ctx, diskID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !multiWriter {
+			t.Fatalf("Expected disk %s to be attached to VM %v with multi-writer sharing", diskID, vm)
+		}
+	}
+	for _, vm := range vms {
+		if err := vm.ForceDetachDisk(ctx, diskID); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCreateVolumeInVsanFaultDomain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := getControllerTest(t)
+	newRequest := func(params map[string]string) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name: testVolumeName + "-fault-domain",
+			CapacityRange: &csi.CapacityRange{
+				RequiredBytes: 1 * common.GbInBytes,
+			},
+			Parameters: params,
+			VolumeCapabilities: []*csi.VolumeCapability{
+				{
+					AccessMode: &csi.VolumeCapability_AccessMode{
+						Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+					},
+				},
+			},
+		}
+	}
+	tests := []struct {
+		name   string
+		params map[string]string
+	}{
+		{
+			name:   "without storage policy",
+			params: map[string]string{common.AttributeVsanFaultDomain: "preferred"},
+		},
+		{
+			name: "with host group",
+			params: map[string]string{common.AttributeVsanFaultDomain: "preferred", common.AttributeHostGroup: "licensed-hosts",
+				common.AttributeStoragePolicyName: "vSAN Default Storage Policy"},
+		},
+		{
+			name:   "unknown fault domain",
+			params: map[string]string{common.AttributeVsanFaultDomain: "preferred", common.AttributeStoragePolicyName: "vSAN Default Storage Policy"},
+		},
+	}
+	for _, test := range tests {
+		if _, err := ct.controller.CreateVolume(ctx, newRequest(test.params)); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: expected InvalidArgument, got err: %v", test.name, err)
+		}
+	}
+}
+
+func TestAlignVolumeSize(t *testing.T) {
+	vmfs5 := newTestDatastore("ds:///vmfs/volumes/vmfs5/", 100)
+	vmfs5.BlockSizeMB = 8
+	vmfs6 := newTestDatastore("ds:///vmfs/volumes/vmfs6/", 100)
+	vmfs6.BlockSizeMB = 1
+	nfs := newTestDatastore("ds:///vmfs/volumes/nfs/", 100)
+	datastores := []*cnsvsphere.DatastoreInfo{vmfs6, vmfs5, nfs}
+
+	if blockSizeMB := getAlignmentBlockSizeMB(datastores, ""); blockSizeMB != 8 {
+		t.Errorf("expected the largest block size 8, got %d", blockSizeMB)
+	}
+	if blockSizeMB := getAlignmentBlockSizeMB(datastores, vmfs6.Info.Url); blockSizeMB != 1 {
+		t.Errorf("expected the block size 1 of the given datastore, got %d", blockSizeMB)
+	}
+	if blockSizeMB := getAlignmentBlockSizeMB(datastores, nfs.Info.Url); blockSizeMB != 0 {
+		t.Errorf("expected no block size for nfs datastore, got %d", blockSizeMB)
+	}
+
+	tests := []struct {
+		sizeMB      int64
+		blockSizeMB int64
+		expected    int64
+	}{
+		{sizeMB: 1000, blockSizeMB: 0, expected: 1000},
+		{sizeMB: 1000, blockSizeMB: 1, expected: 1000},
+		{sizeMB: 1000, blockSizeMB: 8, expected: 1000},
+		{sizeMB: 1001, blockSizeMB: 8, expected: 1008},
+		{sizeMB: 1, blockSizeMB: 8, expected: 8},
+	}
+	for _, tt := range tests {
+		if aligned := alignVolumeSizeMB(tt.sizeMB, tt.blockSizeMB); aligned != tt.expected {
+			t.Errorf("expected %d MB aligned to %d MB blocks to be %d MB, got %d", tt.sizeMB, tt.blockSizeMB, tt.expected, aligned)
+		}
+	}
+}
+
+func TestGetVolumeAccessibleTopology(t *testing.T) {
+	newSegments := func(zone string) map[string]string {
+		return map[string]string{
+			csitypes.LabelZoneFailureDomain:   zone,
+			csitypes.LabelRegionFailureDomain: "region-1",
+		}
+	}
+	// Every zone reaching the datastore is reported once
+	topologies, segments := getVolumeAccessibleTopology([]map[string]string{
+		newSegments("zone-a"), newSegments("zone-b"), newSegments("zone-a"),
+	})
+	if len(topologies) != 2 || topologies[0].Segments[csitypes.LabelZoneFailureDomain] != "zone-a" ||
+		topologies[1].Segments[csitypes.LabelZoneFailureDomain] != "zone-b" {
+		t.Fatalf("expected zone-a and zone-b to be reported, got %v", topologies)
+	}
+	if len(segments) != 1 || segments[csitypes.LabelRegionFailureDomain] != "region-1" {
+		t.Fatalf("expected only the region to be shared by the topologies, got %v", segments)
+	}
+	topologies, segments = getVolumeAccessibleTopology([]map[string]string{newSegments("zone-a")})
+	if len(topologies) != 1 || len(segments) != 2 {
+		t.Fatalf("expected the zone and region of the single topology, got %v and %v", topologies, segments)
+	}
+	if topologies, segments = getVolumeAccessibleTopology(nil); len(topologies) != 0 || len(segments) != 0 {
+		t.Fatalf("expected no topology, got %v and %v", topologies, segments)
+	}
+}
+
+func TestGetVolumeSizeBytes(t *testing.T) {
+	defaultSizeBytes := 10 * common.GbInBytes
+	tests := []struct {
+		capacityRange *csi.CapacityRange
+		expected      int64
+		expectCode    codes.Code
+	}{
+		{capacityRange: nil, expected: defaultSizeBytes},
+		{capacityRange: &csi.CapacityRange{RequiredBytes: common.GbInBytes}, expected: common.GbInBytes},
+		{capacityRange: &csi.CapacityRange{LimitBytes: 20 * common.GbInBytes}, expected: defaultSizeBytes},
+		{capacityRange: &csi.CapacityRange{LimitBytes: 5 * common.GbInBytes}, expected: 5 * common.GbInBytes},
+		{capacityRange: &csi.CapacityRange{RequiredBytes: common.MbInBytes + 1}, expected: 2 * common.MbInBytes},
+		{capacityRange: &csi.CapacityRange{LimitBytes: 5*common.MbInBytes + 1}, expected: 5 * common.MbInBytes},
+		{capacityRange: &csi.CapacityRange{RequiredBytes: 1, LimitBytes: common.MbInBytes + 1}, expected: common.MbInBytes},
+		{capacityRange: &csi.CapacityRange{RequiredBytes: common.MbInBytes + 1, LimitBytes: common.MbInBytes + 2},
+			expectCode: codes.OutOfRange},
+		{capacityRange: &csi.CapacityRange{LimitBytes: common.MbInBytes - 1}, expectCode: codes.OutOfRange},
+		{capacityRange: &csi.CapacityRange{}, expectCode: codes.InvalidArgument},
+		{capacityRange: &csi.CapacityRange{RequiredBytes: -1}, expectCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		sizeBytes, err := getVolumeSizeBytes(tt.capacityRange, defaultSizeBytes)
+		if tt.expectCode != codes.OK {
+			if status.Code(err) != tt.expectCode {
+				t.Errorf("Expected %v for capacity range %+v, got: %v", tt.expectCode, tt.capacityRange, err)
+			}
+			continue
+		}
+		if err != nil || sizeBytes != tt.expected {
+			t.Errorf("Expected size %d for capacity range %+v, got: %d, %v", tt.expected, tt.capacityRange, sizeBytes, err)
+		}
+	}
+}
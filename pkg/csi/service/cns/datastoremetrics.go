@@ -0,0 +1,138 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog"
+)
+
+const defaultDatastoreMetricsIntervalInSec = 300
+
+// datastoreCapacity is the capacity of a datastore read from vCenter
+type datastoreCapacity struct {
+	name      string
+	url       string
+	capacity  int64
+	freeSpace int64
+}
+
+// datastoreMetricsCollector is a prometheus collector exposing the capacity
+// and free space of the shared datastores of the cluster, labeled by
+// datastore and vCenter. The capacities are read periodically from vCenter
+// and served from the last read.
+type datastoreMetricsCollector struct {
+	mu      sync.Mutex
+	nodeMgr nodeManager
+	vcenter string
+	// datastores holds the capacities of the last read
+	datastores []datastoreCapacity
+
+	capacityBytes *prometheus.Desc
+	freeBytes     *prometheus.Desc
+}
+
+func newDatastoreMetricsCollector(nodeMgr nodeManager, vcenter string) *datastoreMetricsCollector {
+	labels := []string{"datastore", "datastore_url", "vcenter"}
+	return &datastoreMetricsCollector{
+		nodeMgr: nodeMgr,
+		vcenter: vcenter,
+		capacityBytes: prometheus.NewDesc("vsphere_csi_datastore_capacity_bytes",
+			"Capacity of the datastore", labels, nil),
+		freeBytes: prometheus.NewDesc("vsphere_csi_datastore_free_bytes",
+			"Free space of the datastore", labels, nil),
+	}
+}
+
+// startDatastoreMetricsCollector registers a datastore metrics collector and
+// serves its metrics on the given address
+func startDatastoreMetricsCollector(address string, intervalInSec int, nodeMgr nodeManager, vcenter string) {
+	if intervalInSec <= 0 {
+		intervalInSec = defaultDatastoreMetricsIntervalInSec
+	}
+	collector := newDatastoreMetricsCollector(nodeMgr, vcenter)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	go func() {
+		klog.V(2).Infof("Serving datastore metrics on %s", address)
+		if err := http.ListenAndServe(address, mux); err != nil {
+			klog.Errorf("Failed to serve datastore metrics on %s. Err: %v", address, err)
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(time.Duration(intervalInSec) * time.Second)
+		for ; true; <-ticker.C {
+			collector.refresh()
+		}
+	}()
+}
+
+// refresh reads the capacity of the shared datastores from vCenter. The
+// previous read is kept if the shared datastores cannot be listed.
+func (c *datastoreMetricsCollector) refresh() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sharedDatastores, err := c.nodeMgr.GetSharedDatastoresInK8SCluster(ctx)
+	if err != nil {
+		klog.Warningf("Failed to get shared datastores for datastore metrics. Err: %v", err)
+		return
+	}
+	var datastores []datastoreCapacity
+	for _, datastore := range sharedDatastores {
+		capacity, freeSpace, err := datastore.GetDatastoreCapacity(ctx)
+		if err != nil {
+			klog.Warningf("Failed to get capacity of datastore %s. Err: %v", datastore.Info.Url, err)
+			continue
+		}
+		datastores = append(datastores, datastoreCapacity{
+			name:      datastore.Info.Name,
+			url:       datastore.Info.Url,
+			capacity:  capacity,
+			freeSpace: freeSpace,
+		})
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.datastores = datastores
+}
+
+// Describe implements prometheus.Collector
+func (c *datastoreMetricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.capacityBytes
+	ch <- c.freeBytes
+}
+
+// Collect implements prometheus.Collector
+func (c *datastoreMetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, datastore := range c.datastores {
+		ch <- prometheus.MustNewConstMetric(c.capacityBytes, prometheus.GaugeValue, float64(datastore.capacity),
+			datastore.name, datastore.url, c.vcenter)
+		ch <- prometheus.MustNewConstMetric(c.freeBytes, prometheus.GaugeValue, float64(datastore.freeSpace),
+			datastore.name, datastore.url, c.vcenter)
+	}
+}
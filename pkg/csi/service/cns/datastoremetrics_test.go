@@ -0,0 +1,53 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestDatastoreMetricsCollector(t *testing.T) {
+	collector := newDatastoreMetricsCollector(nil, "vc.example.com")
+	collector.datastores = []datastoreCapacity{
+		{name: "ds-1", url: "ds:///vmfs/volumes/ds-1/", capacity: 1000, freeSpace: 400},
+	}
+
+	ch := make(chan prometheus.Metric, 2)
+	collector.Collect(ch)
+	close(ch)
+	values := make(map[string]float64)
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			t.Fatalf("Failed to write metric: %v", err)
+		}
+		labels := make(map[string]string)
+		for _, label := range m.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		if labels["datastore"] != "ds-1" || labels["datastore_url"] != "ds:///vmfs/volumes/ds-1/" || labels["vcenter"] != "vc.example.com" {
+			t.Errorf("Unexpected labels %v", labels)
+		}
+		values[metric.Desc().String()] = m.GetGauge().GetValue()
+	}
+	if values[collector.capacityBytes.String()] != 1000 || values[collector.freeBytes.String()] != 400 {
+		t.Errorf("Unexpected datastore metrics %v", values)
+	}
+}
@@ -0,0 +1,233 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
+)
+
+const (
+	// deferredAttachRetryInitialBackoff is the delay before the first retry
+	// of a failed deferred attach, doubled on each subsequent retry
+	deferredAttachRetryInitialBackoff = 5 * time.Second
+	// deferredAttachRetryMaxBackoff caps the delay between retries of a
+	// failed deferred attach
+	deferredAttachRetryMaxBackoff = 5 * time.Minute
+)
+
+// deferredAttach is an attach of a volume to a node which was reported
+// successful by ControllerPublishVolume before its completion.
+type deferredAttach struct {
+	// diskUUID is the UUID the disk of the volume is presented with
+	diskUUID string
+	// stop is closed to stop retrying the attach
+	stop     chan struct{}
+	stopOnce sync.Once
+	// done is closed once the attach completed or its retries stopped
+	done chan struct{}
+}
+
+// deferredAttachTracker holds the pending deferred attaches, so retries of
+// ControllerPublishVolume do not issue the attach again and
+// ControllerUnpublishVolume does not race with the attach. It is kept in
+// memory; deferred attaches pending when the controller stopped are issued
+// again on startup from their VolumeAttachment by resumeDeferredAttaches.
+type deferredAttachTracker struct {
+	lock sync.Mutex
+	// attaches maps volume ID and node name pairs to their pending attach.
+	attaches map[string]*deferredAttach
+}
+
+// newDeferredAttachTracker returns an empty deferredAttachTracker.
+func newDeferredAttachTracker() *deferredAttachTracker {
+	return &deferredAttachTracker{
+		attaches: make(map[string]*deferredAttach),
+	}
+}
+
+// get returns the pending attach of the volume to the node, or nil.
+func (t *deferredAttachTracker) get(volumeID string, nodeName string) *deferredAttach {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.attaches[volumeID+"/"+nodeName]
+}
+
+// add records the pending attach of the volume to the node and returns it.
+// An attach already pending is returned instead.
+func (t *deferredAttachTracker) add(volumeID string, nodeName string, diskUUID string) (*deferredAttach, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := volumeID + "/" + nodeName
+	if attach, ok := t.attaches[key]; ok {
+		return attach, false
+	}
+	attach := &deferredAttach{
+		diskUUID: diskUUID,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	t.attaches[key] = attach
+	return attach, true
+}
+
+// finish forgets the attach of the volume to the node and marks it done.
+func (t *deferredAttachTracker) finish(volumeID string, nodeName string, attach *deferredAttach) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := volumeID + "/" + nodeName
+	if t.attaches[key] == attach {
+		delete(t.attaches, key)
+	}
+	close(attach.done)
+}
+
+// stop stops retrying the pending attach of the volume to the node, if any,
+// and waits for the attach in flight to complete. The error of the context is
+// returned if it is done first.
+func (t *deferredAttachTracker) stop(ctx context.Context, volumeID string, nodeName string) error {
+	attach := t.get(volumeID, nodeName)
+	if attach == nil {
+		return nil
+	}
+	attach.stopOnce.Do(func() {
+		close(attach.stop)
+	})
+	select {
+	case <-attach.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// publishDeferred issues the attach of the volume to the node VM and returns
+// the disk UUID of the volume without waiting for the attach to complete. A
+// pending attach is reused, so retries do not issue the attach again. Failed
+// attaches are retried in the background until they succeed or the volume is
+// unpublished, as the CO does not publish the volume again once it was
+// reported attached.
+func (c *controller) publishDeferred(ctx context.Context, node *cnsvsphere.VirtualMachine, volumeID string, nodeName string) (string, error) {
+	if attach := c.deferredAttaches.get(volumeID, nodeName); attach != nil {
+		klog.V(2).Infof("Attach of volume %q to node %q is pending", volumeID, nodeName)
+		return attach.diskUUID, nil
+	}
+	diskUUID, done, err := common.StartAttachVolumeUtil(ctx, c.manager, node, volumeID)
+	if err != nil {
+		return "", err
+	}
+	attach, added := c.deferredAttaches.add(volumeID, nodeName, diskUUID)
+	if added {
+		go c.awaitDeferredAttach(node, volumeID, nodeName, attach, done)
+	}
+	return diskUUID, nil
+}
+
+// awaitDeferredAttach waits for the result of the deferred attach of the
+// volume to the node, retrying the attach with exponential backoff while it
+// fails and is not stopped.
+func (c *controller) awaitDeferredAttach(node *cnsvsphere.VirtualMachine, volumeID string, nodeName string,
+	attach *deferredAttach, done <-chan error) {
+	defer c.deferredAttaches.finish(volumeID, nodeName, attach)
+	err := <-done
+	backoff := deferredAttachRetryInitialBackoff
+	for err != nil {
+		klog.Warningf("Deferred attach of volume %q to node %q failed, retrying in %v. Err: %v", volumeID, nodeName, backoff, err)
+		select {
+		case <-attach.stop:
+			klog.V(2).Infof("Stopped retrying deferred attach of volume %q to node %q", volumeID, nodeName)
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > deferredAttachRetryMaxBackoff {
+			backoff = deferredAttachRetryMaxBackoff
+		}
+		_, err = common.AttachVolumeUtil(context.Background(), c.manager, node, volumeID)
+	}
+	klog.V(2).Infof("Deferred attach of volume %q to node %q completed", volumeID, nodeName)
+}
+
+// isDeferredAttachment returns true if the VolumeAttachment of the driver is
+// attached, not being deleted, and its attach was deferred.
+func isDeferredAttachment(va *storagev1.VolumeAttachment) bool {
+	return va.Spec.Attacher == csitypes.Name && va.DeletionTimestamp == nil && va.Status.Attached &&
+		va.Status.AttachmentMetadata[common.AttributeAttachDeferred] == "true" && va.Spec.Source.PersistentVolumeName != nil
+}
+
+// resumeDeferredAttaches issues again the deferred attaches which were pending
+// when the controller stopped, i.e. the deferred VolumeAttachments whose disk
+// is not attached to their node VM. The attaches are tracked and retried like
+// the attaches deferred by ControllerPublishVolume.
+func (c *controller) resumeDeferredAttaches(k8sclient clientset.Interface) {
+	klog.V(2).Infof("ResumeDeferredAttaches: start")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	vaList, err := k8sclient.StorageV1().VolumeAttachments().List(metav1.ListOptions{})
+	if err != nil {
+		klog.Warningf("ResumeDeferredAttaches: Failed to get VolumeAttachments from kubernetes. Err: %v", err)
+		return
+	}
+	resumed := 0
+	for i := range vaList.Items {
+		va := &vaList.Items[i]
+		if !isDeferredAttachment(va) {
+			continue
+		}
+		pv, err := k8sclient.CoreV1().PersistentVolumes().Get(*va.Spec.Source.PersistentVolumeName, metav1.GetOptions{})
+		if err != nil || pv.Spec.CSI == nil {
+			klog.Warningf("ResumeDeferredAttaches: Failed to get the CSI PV of volume attachment %q. Err: %v", va.Name, err)
+			continue
+		}
+		volumeID := pv.Spec.CSI.VolumeHandle
+		vm, err := c.nodeMgr.GetNodeByName(va.Spec.NodeName)
+		if err != nil {
+			klog.Warningf("ResumeDeferredAttaches: Failed to find VirtualMachine for node %q. Err: %v", va.Spec.NodeName, err)
+			continue
+		}
+		attached, err := vm.IsDiskAttached(ctx, volumeID)
+		if err != nil {
+			klog.Warningf("ResumeDeferredAttaches: Failed to check whether volume %q is attached to node %q. Err: %v",
+				volumeID, va.Spec.NodeName, err)
+			continue
+		}
+		if attached {
+			continue
+		}
+		// The volume may have been unpublished meanwhile
+		current, err := k8sclient.StorageV1().VolumeAttachments().Get(va.Name, metav1.GetOptions{})
+		if err != nil || !isDeferredAttachment(current) {
+			continue
+		}
+		klog.V(2).Infof("ResumeDeferredAttaches: Attaching volume %q to node %q again", volumeID, va.Spec.NodeName)
+		if _, err := c.publishDeferred(ctx, vm, volumeID, va.Spec.NodeName); err != nil {
+			klog.Warningf("ResumeDeferredAttaches: Failed to attach volume %q to node %q. Err: %v", volumeID, va.Spec.NodeName, err)
+			continue
+		}
+		resumed++
+	}
+	klog.V(2).Infof("ResumeDeferredAttaches: end, resumed %d attaches", resumed)
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
+)
+
+func TestDeferredAttachTracker(t *testing.T) {
+	tracker := newDeferredAttachTracker()
+	attach, added := tracker.add("vol-1", "node-1", "uuid-1")
+	if !added {
+		t.Fatalf("expected attach to be added")
+	}
+	// Retries reuse the pending attach
+	if pending, added := tracker.add("vol-1", "node-1", "uuid-2"); added || pending != attach {
+		t.Fatalf("expected pending attach to be returned")
+	}
+	if pending := tracker.get("vol-1", "node-1"); pending == nil || pending.diskUUID != "uuid-1" {
+		t.Fatalf("expected pending attach with disk UUID uuid-1, got %+v", pending)
+	}
+	if tracker.get("vol-1", "node-2") != nil {
+		t.Fatalf("expected no pending attach on node-2")
+	}
+
+	// stop waits for the attach in flight
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := tracker.stop(ctx, "vol-1", "node-1"); err == nil {
+		t.Fatalf("expected stop to time out while the attach is in flight")
+	}
+	select {
+	case <-attach.stop:
+	default:
+		t.Fatalf("expected retries of the attach to be stopped")
+	}
+	tracker.finish("vol-1", "node-1", attach)
+	if err := tracker.stop(context.Background(), "vol-1", "node-1"); err != nil {
+		t.Fatalf("expected stop without pending attach to succeed, got %v", err)
+	}
+	if tracker.get("vol-1", "node-1") != nil {
+		t.Fatalf("expected finished attach to be forgotten")
+	}
+}
+
+func TestIsDeferredAttachment(t *testing.T) {
+	pvName := "pv-1"
+	va := &storagev1.VolumeAttachment{
+		Spec: storagev1.VolumeAttachmentSpec{
+			Attacher: csitypes.Name,
+			Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+		},
+		Status: storagev1.VolumeAttachmentStatus{
+			Attached:           true,
+			AttachmentMetadata: map[string]string{common.AttributeAttachDeferred: "true"},
+		},
+	}
+	if !isDeferredAttachment(va) {
+		t.Fatalf("expected deferred attachment to be resumed")
+	}
+	now := metav1.Now()
+	va.DeletionTimestamp = &now
+	if isDeferredAttachment(va) {
+		t.Fatalf("expected attachment being deleted not to be resumed")
+	}
+	va.DeletionTimestamp = nil
+	delete(va.Status.AttachmentMetadata, common.AttributeAttachDeferred)
+	if isDeferredAttachment(va) {
+		t.Fatalf("expected attachment which was not deferred not to be resumed")
+	}
+}
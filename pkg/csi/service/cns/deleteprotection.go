@@ -0,0 +1,95 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
+)
+
+// checkAttachedVolumeDeletion returns a FailedPrecondition error if the volume
+// is still attached to a node according to its VolumeAttachments, unless the
+// StorageClass of its PV allows deleting attached volumes.
+func checkAttachedVolumeDeletion(k8sclient clientset.Interface, volumeID string) error {
+	pvList, err := k8sclient.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to get PVs from kubernetes to check whether volume %q is attached. Error: %+v", volumeID, err)
+		klog.Error(msg)
+		return status.Error(codes.Internal, msg)
+	}
+	var pv *v1.PersistentVolume
+	for i := range pvList.Items {
+		if csi := pvList.Items[i].Spec.CSI; csi != nil && csi.Driver == csitypes.Name && csi.VolumeHandle == volumeID {
+			pv = &pvList.Items[i]
+			break
+		}
+	}
+	if pv == nil {
+		klog.V(4).Infof("No PV found for volume %q, skipping attached volume check", volumeID)
+		return nil
+	}
+	if pv.Spec.StorageClassName != "" {
+		sc, err := k8sclient.StorageV1().StorageClasses().Get(pv.Spec.StorageClassName, metav1.GetOptions{})
+		if err == nil && allowsDeleteAttached(sc.Parameters) {
+			return nil
+		} else if err != nil {
+			klog.V(3).Infof("Failed to get storage class %q of volume %q. Err: %v", pv.Spec.StorageClassName, volumeID, err)
+		}
+	}
+	vaList, err := k8sclient.StorageV1().VolumeAttachments().List(metav1.ListOptions{})
+	if err != nil {
+		msg := fmt.Sprintf("Failed to get VolumeAttachments from kubernetes to check whether volume %q is attached. Error: %+v", volumeID, err)
+		klog.Error(msg)
+		return status.Error(codes.Internal, msg)
+	}
+	var nodes []string
+	for _, va := range vaList.Items {
+		if va.Spec.Attacher == csitypes.Name && va.Status.Attached && va.Spec.Source.PersistentVolumeName != nil &&
+			*va.Spec.Source.PersistentVolumeName == pv.Name {
+			nodes = append(nodes, va.Spec.NodeName)
+		}
+	}
+	if len(nodes) > 0 {
+		msg := fmt.Sprintf("Volume %q is still attached to nodes %v, stop the workload using it before deleting it", volumeID, nodes)
+		klog.Error(msg)
+		return status.Error(codes.FailedPrecondition, msg)
+	}
+	return nil
+}
+
+// allowsDeleteAttached returns true if the StorageClass parameters allow
+// deleting attached volumes.
+func allowsDeleteAttached(params map[string]string) bool {
+	for paramName, paramValue := range params {
+		if strings.ToLower(paramName) == common.AttributeAllowDeleteAttached {
+			allowed, _ := strconv.ParseBool(paramValue)
+			return allowed
+		}
+	}
+	return false
+}
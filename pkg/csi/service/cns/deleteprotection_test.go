@@ -0,0 +1,73 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+
+	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
+)
+
+func TestCheckAttachedVolumeDeletion(t *testing.T) {
+	pvName := "pv-attached"
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: pvName},
+		Spec: v1.PersistentVolumeSpec{
+			StorageClassName: "ephemeral",
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:       csitypes.Name,
+					VolumeHandle: "volume-attached",
+				},
+			},
+		},
+	}
+	va := &storagev1.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "va-attached"},
+		Spec: storagev1.VolumeAttachmentSpec{
+			Attacher: csitypes.Name,
+			NodeName: "node-1",
+			Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+		},
+		Status: storagev1.VolumeAttachmentStatus{Attached: true},
+	}
+
+	k8sclient := testclient.NewSimpleClientset(pv, va)
+	err := checkAttachedVolumeDeletion(k8sclient, "volume-attached")
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition for attached volume, got %v", err)
+	}
+	if err = checkAttachedVolumeDeletion(k8sclient, "volume-unknown"); err != nil {
+		t.Fatalf("expected volume without PV to be deletable, got %v", err)
+	}
+
+	sc := &storagev1.StorageClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "ephemeral"},
+		Parameters: map[string]string{"AllowDeleteAttached": "true"},
+	}
+	k8sclient = testclient.NewSimpleClientset(pv, va, sc)
+	if err = checkAttachedVolumeDeletion(k8sclient, "volume-attached"); err != nil {
+		t.Fatalf("expected storage class to allow deleting attached volume, got %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
+)
+
+// detachFailureTracker counts the consecutive failed detaches of volumes
+// from nodes, so that ControllerUnpublishVolume can escalate to a force
+// detach once the external-attacher retried enough times.
+type detachFailureTracker struct {
+	lock sync.Mutex
+	// failures maps volume ID and node name pairs to their failed detaches.
+	failures map[string]int
+}
+
+// newDetachFailureTracker returns an empty detachFailureTracker.
+func newDetachFailureTracker() *detachFailureTracker {
+	return &detachFailureTracker{
+		failures: make(map[string]int),
+	}
+}
+
+// recordFailure records a failed detach of the volume from the node and
+// returns the number of consecutive failures.
+func (t *detachFailureTracker) recordFailure(volumeID string, nodeName string) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := volumeID + "/" + nodeName
+	t.failures[key]++
+	return t.failures[key]
+}
+
+// reset forgets the failed detaches of the volume from the node.
+func (t *detachFailureTracker) reset(volumeID string, nodeName string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.failures, volumeID+"/"+nodeName)
+}
+
+// forceDetachVolume removes the disk of the volume from the node VM by
+// reconfiguring the VM. As vCenter can not tell whether the guest still has
+// I/O in flight to the disk, the force detach is only done when the node VM
+// is powered off or its guest is unresponsive.
+func forceDetachVolume(ctx context.Context, vm *cnsvsphere.VirtualMachine, volumeID string) error {
+	unreachable, err := vm.IsUnreachable(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check whether VM %v is reachable. err: %v", vm, err)
+	}
+	if !unreachable {
+		return fmt.Errorf("VM %v is running with a responsive guest, refusing to force detach volume %s", vm, volumeID)
+	}
+	klog.Warningf("Escalating to force detach of volume %s from unreachable VM %v", volumeID, vm)
+	if err := vm.ForceDetachDisk(ctx, volumeID); err != nil {
+		return err
+	}
+	klog.V(2).Infof("Force detached volume %s from VM %v", volumeID, vm)
+	return nil
+}
+
+// getAttachmentName returns the name of the VolumeAttachment of the volume to
+// the node, as named by kubernetes.
+func getAttachmentName(volumeID string, nodeName string) string {
+	return fmt.Sprintf("csi-%x", sha256.Sum256([]byte(volumeID+csitypes.Name+nodeName)))
+}
+
+// isAttachedOutsideCNS returns true if the volume was attached to the node VM
+// outside CNS, as recorded in the attachment metadata of its VolumeAttachment
+// at publish. vCenter is only queried when the VolumeAttachment can not be
+// read.
+func (c *controller) isAttachedOutsideCNS(ctx context.Context, vm *cnsvsphere.VirtualMachine, volumeID string, nodeName string) bool {
+	if c.attachmentClient != nil {
+		va, err := c.attachmentClient.StorageV1().VolumeAttachments().Get(getAttachmentName(volumeID, nodeName), metav1.GetOptions{})
+		if err == nil {
+			return common.IsAttachmentOutsideCNS(va.Status.AttachmentMetadata)
+		}
+		klog.Warningf("Failed to get volume attachment of disk %s to node %q, checking the attachment in vCenter. err: %+v",
+			volumeID, nodeName, err)
+	}
+	outsideCNS, err := common.IsAttachedOutsideCNSUtil(ctx, c.manager, vm, volumeID)
+	if err != nil {
+		klog.Warningf("Failed to check whether disk %s is attached outside CNS, detaching through CNS. err: %+v", volumeID, err)
+	}
+	return outsideCNS
+}
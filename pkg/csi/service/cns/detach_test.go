@@ -0,0 +1,75 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"context"
+	"testing"
+
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+)
+
+func TestDetachFailureTracker(t *testing.T) {
+	tracker := newDetachFailureTracker()
+	if failures := tracker.recordFailure("vol-1", "node-1"); failures != 1 {
+		t.Fatalf("expected 1 failure, got %d", failures)
+	}
+	if failures := tracker.recordFailure("vol-1", "node-1"); failures != 2 {
+		t.Fatalf("expected 2 failures, got %d", failures)
+	}
+	// Failures are counted per volume and node
+	if failures := tracker.recordFailure("vol-1", "node-2"); failures != 1 {
+		t.Fatalf("expected 1 failure on node-2, got %d", failures)
+	}
+	tracker.reset("vol-1", "node-1")
+	if failures := tracker.recordFailure("vol-1", "node-1"); failures != 1 {
+		t.Fatalf("expected failures to restart after reset, got %d", failures)
+	}
+}
+
+func TestGetAttachmentName(t *testing.T) {
+	// Name of the VolumeAttachment kubernetes creates for the volume and node
+	expected := "csi-6339f2647ceb1dcce4d0de1f8c290c2dd274832f0200ead7bf482626b4524ebd"
+	if name := getAttachmentName("vol-1", "node-1"); name != expected {
+		t.Errorf("Expected %q, got %q", expected, name)
+	}
+}
+
+func TestIsAttachedOutsideCNS(t *testing.T) {
+	newAttachment := func(volumeID string, nodeName string, metadata map[string]string) *storagev1.VolumeAttachment {
+		return &storagev1.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{Name: getAttachmentName(volumeID, nodeName)},
+			Status:     storagev1.VolumeAttachmentStatus{Attached: true, AttachmentMetadata: metadata},
+		}
+	}
+	c := &controller{
+		attachmentClient: testclient.NewSimpleClientset(
+			newAttachment("vol-1", "node-1", map[string]string{common.AttributeAttachedOutsideCNS: "true"}),
+			newAttachment("vol-2", "node-1", map[string]string{common.AttributeFirstClassDiskUUID: "uuid"}),
+		),
+	}
+	if !c.isAttachedOutsideCNS(context.Background(), nil, "vol-1", "node-1") {
+		t.Errorf("Expected vol-1 to be attached outside CNS as recorded in its attachment metadata")
+	}
+	if c.isAttachedOutsideCNS(context.Background(), nil, "vol-2", "node-1") {
+		t.Errorf("Expected vol-2 to be attached through CNS")
+	}
+}
@@ -0,0 +1,341 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
+)
+
+// defaultDrainTaints are the keys of the node taints marking a node as being
+// drained or shut down. Cordoned nodes are not drained, as pods already
+// running on them keep running.
+var defaultDrainTaints = []string{
+	"node.kubernetes.io/out-of-service",
+	"node.cloudprovider.kubernetes.io/shutdown",
+	"ToBeDeletedByClusterAutoscaler",
+}
+
+// drainReconciler detaches the volumes of nodes being drained as soon as no
+// pod on the node uses them anymore and kubelet no longer reports them in use.
+// VolumeAttachments are left untouched, so
+// the external-attacher still drives ControllerUnpublishVolume, which succeeds
+// right away for volumes already detached by the reconciler. Volumes whose
+// VolumeAttachment still exists when the drain taint is removed are attached
+// again.
+type drainReconciler struct {
+	manager   *common.Manager
+	nodeMgr   nodeManager
+	k8sclient clientset.Interface
+	// taints holds the keys of the node taints marking a node as being drained
+	taints map[string]bool
+
+	lock sync.Mutex
+	// detached maps node names to the IDs of the volumes detached from them by
+	// the reconciler
+	detached map[string]map[string]bool
+}
+
+// newDrainReconciler returns a drainReconciler for the comma separated drain
+// taint keys, or for defaultDrainTaints if none are given.
+func newDrainReconciler(manager *common.Manager, nodeMgr nodeManager, k8sclient clientset.Interface, drainTaints string) *drainReconciler {
+	r := &drainReconciler{
+		manager:   manager,
+		nodeMgr:   nodeMgr,
+		k8sclient: k8sclient,
+		taints:    make(map[string]bool),
+		detached:  make(map[string]map[string]bool),
+	}
+	taintKeys := defaultDrainTaints
+	if drainTaints != "" {
+		taintKeys = strings.Split(drainTaints, ",")
+	}
+	for _, key := range taintKeys {
+		if key = strings.TrimSpace(key); key != "" {
+			r.taints[key] = true
+		}
+	}
+	return r
+}
+
+// isDraining returns true if the node carries one of the drain taints.
+func (r *drainReconciler) isDraining(node *v1.Node) bool {
+	for _, taint := range node.Spec.Taints {
+		if r.taints[taint.Key] {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeUpdated reconciles the volumes attached to the node. Kubelet updates the
+// node status periodically, so pods leaving a drained node are picked up with
+// the next update.
+func (r *drainReconciler) nodeUpdated(oldObj interface{}, newObj interface{}) {
+	node, ok := newObj.(*v1.Node)
+	if node == nil || !ok {
+		klog.Warningf("DrainReconciler: unrecognized object %+v", newObj)
+		return
+	}
+	if r.isDraining(node) {
+		r.detachUnusedVolumes(node)
+	} else {
+		r.reattachVolumes(node.Name)
+	}
+}
+
+// forget drops the volume from the volumes detached from the node by the
+// reconciler. It returns true if the volume was detached by the reconciler.
+func (r *drainReconciler) forget(volumeID string, nodeName string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.detached[nodeName][volumeID] {
+		return false
+	}
+	delete(r.detached[nodeName], volumeID)
+	if len(r.detached[nodeName]) == 0 {
+		delete(r.detached, nodeName)
+	}
+	return true
+}
+
+// attachedVolumes returns the IDs of the volumes of the driver attached to the
+// node according to its VolumeAttachments, mapped to the PVC using them.
+func (r *drainReconciler) attachedVolumes(nodeName string) (map[string]string, error) {
+	vaList, err := r.k8sclient.StorageV1().VolumeAttachments().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	volumes := make(map[string]string)
+	for _, va := range vaList.Items {
+		if va.Spec.Attacher != csitypes.Name || va.Spec.NodeName != nodeName || !va.Status.Attached ||
+			va.DeletionTimestamp != nil || va.Spec.Source.PersistentVolumeName == nil {
+			continue
+		}
+		pv, err := r.k8sclient.CoreV1().PersistentVolumes().Get(*va.Spec.Source.PersistentVolumeName, metav1.GetOptions{})
+		if err != nil || pv.Spec.CSI == nil {
+			klog.V(3).Infof("DrainReconciler: Skipping volume attachment %q, failed to get its CSI PV. Err: %v", va.Name, err)
+			continue
+		}
+		var claim string
+		if pv.Spec.ClaimRef != nil {
+			claim = pv.Spec.ClaimRef.Namespace + "/" + pv.Spec.ClaimRef.Name
+		}
+		volumes[pv.Spec.CSI.VolumeHandle] = claim
+	}
+	return volumes, nil
+}
+
+// claimsInUse returns the PVCs used by the pods on the node which have not
+// terminated.
+func (r *drainReconciler) claimsInUse(nodeName string) (map[string]bool, error) {
+	pods, err := r.k8sclient.CoreV1().Pods(v1.NamespaceAll).List(metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", nodeName).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	claims := make(map[string]bool)
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil {
+				claims[pod.Namespace+"/"+volume.PersistentVolumeClaim.ClaimName] = true
+			}
+		}
+	}
+	return claims, nil
+}
+
+// volumesInUse returns the IDs of the volumes of the driver kubelet reports
+// in use on the node.
+func volumesInUse(node *v1.Node) map[string]bool {
+	prefix := "kubernetes.io/csi/" + csitypes.Name + "^"
+	volumes := make(map[string]bool)
+	for _, volume := range node.Status.VolumesInUse {
+		if strings.HasPrefix(string(volume), prefix) {
+			volumes[strings.TrimPrefix(string(volume), prefix)] = true
+		}
+	}
+	return volumes
+}
+
+// detachUnusedVolumes detaches the volumes attached to the node which are no
+// longer used by any of its pods and are no longer reported in use by kubelet.
+func (r *drainReconciler) detachUnusedVolumes(node *v1.Node) {
+	nodeName := node.Name
+	volumes, err := r.attachedVolumes(nodeName)
+	if err != nil {
+		klog.Warningf("DrainReconciler: Failed to get volumes attached to node %q. Err: %v", nodeName, err)
+		return
+	}
+	if len(volumes) == 0 {
+		return
+	}
+	claims, err := r.claimsInUse(nodeName)
+	if err != nil {
+		klog.Warningf("DrainReconciler: Failed to get pods on node %q. Err: %v", nodeName, err)
+		return
+	}
+	inUse := volumesInUse(node)
+	var unused []string
+	r.lock.Lock()
+	for volumeID, claim := range volumes {
+		if !claims[claim] && !inUse[volumeID] && !r.detached[nodeName][volumeID] {
+			unused = append(unused, volumeID)
+		}
+	}
+	r.lock.Unlock()
+	if len(unused) == 0 {
+		return
+	}
+	vm, err := r.nodeMgr.GetNodeByName(nodeName)
+	if err != nil {
+		klog.Warningf("DrainReconciler: Failed to find VirtualMachine for node %q. Err: %v", nodeName, err)
+		return
+	}
+	for _, volumeID := range unused {
+		// Volumes attached outside CNS could not be attached again the same
+		// way through CNS if the drain is cancelled
+		outsideCNS, err := common.IsAttachedOutsideCNSUtil(context.Background(), r.manager, vm, volumeID)
+		if err != nil || outsideCNS {
+			klog.V(3).Infof("DrainReconciler: Skipping volume %q of draining node %q attached outside CNS. Err: %v",
+				volumeID, nodeName, err)
+			continue
+		}
+		klog.V(2).Infof("DrainReconciler: Detaching volume %q from draining node %q", volumeID, nodeName)
+		// Volumes attached outside CNS were skipped above
+		if err := common.DetachVolumeUtil(context.Background(), r.manager, vm, volumeID, false); err != nil {
+			klog.Warningf("DrainReconciler: Failed to detach volume %q from node %q. Err: %v", volumeID, nodeName, err)
+			continue
+		}
+		r.markDetached(nodeName, volumeID)
+	}
+}
+
+// markDetached records the volume as detached from the node by the
+// reconciler.
+func (r *drainReconciler) markDetached(nodeName string, volumeID string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.detached[nodeName] == nil {
+		r.detached[nodeName] = make(map[string]bool)
+	}
+	r.detached[nodeName][volumeID] = true
+}
+
+// reattachVolumes attaches again the volumes detached from the node by the
+// reconciler whose VolumeAttachment still exists, as the drain was cancelled.
+func (r *drainReconciler) reattachVolumes(nodeName string) {
+	r.lock.Lock()
+	var detached []string
+	for volumeID := range r.detached[nodeName] {
+		detached = append(detached, volumeID)
+	}
+	r.lock.Unlock()
+	if len(detached) == 0 {
+		return
+	}
+	volumes, err := r.attachedVolumes(nodeName)
+	if err != nil {
+		klog.Warningf("DrainReconciler: Failed to get volumes attached to node %q. Err: %v", nodeName, err)
+		return
+	}
+	var vm *cnsvsphere.VirtualMachine
+	for _, volumeID := range detached {
+		if _, attached := volumes[volumeID]; !attached {
+			r.forget(volumeID, nodeName)
+			continue
+		}
+		if vm == nil {
+			if vm, err = r.nodeMgr.GetNodeByName(nodeName); err != nil {
+				klog.Warningf("DrainReconciler: Failed to find VirtualMachine for node %q. Err: %v", nodeName, err)
+				return
+			}
+		}
+		klog.V(2).Infof("DrainReconciler: Drain of node %q ended, attaching volume %q again", nodeName, volumeID)
+		if _, err := common.AttachVolumeUtil(context.Background(), r.manager, vm, volumeID); err != nil {
+			klog.Warningf("DrainReconciler: Failed to attach volume %q to node %q. Err: %v", volumeID, nodeName, err)
+			continue
+		}
+		if !r.forget(volumeID, nodeName) {
+			// ControllerUnpublishVolume returned while the volume was attached
+			// again, relying on it being detached.
+			klog.V(2).Infof("DrainReconciler: Volume %q was unpublished from node %q while attached again, detaching it",
+				volumeID, nodeName)
+			if err := common.DetachVolumeUtil(context.Background(), r.manager, vm, volumeID, false); err != nil {
+				klog.Warningf("DrainReconciler: Failed to detach volume %q from node %q. Err: %v", volumeID, nodeName, err)
+			}
+		}
+	}
+}
+
+// rebuild recovers the volumes detached from draining nodes by the reconciler
+// before a restart of the controller: volumes whose VolumeAttachment is
+// attached to a draining node while their disk is not attached to its
+// VirtualMachine.
+func (r *drainReconciler) rebuild() {
+	nodes, err := r.k8sclient.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		klog.Warningf("DrainReconciler: Failed to list nodes. Err: %v", err)
+		return
+	}
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		if !r.isDraining(node) {
+			continue
+		}
+		volumes, err := r.attachedVolumes(node.Name)
+		if err != nil {
+			klog.Warningf("DrainReconciler: Failed to get volumes attached to node %q. Err: %v", node.Name, err)
+			continue
+		}
+		if len(volumes) == 0 {
+			continue
+		}
+		vm, err := r.nodeMgr.GetNodeByName(node.Name)
+		if err != nil {
+			klog.Warningf("DrainReconciler: Failed to find VirtualMachine for node %q. Err: %v", node.Name, err)
+			continue
+		}
+		for volumeID := range volumes {
+			attached, err := vm.IsDiskAttached(context.Background(), volumeID)
+			if err != nil {
+				klog.Warningf("DrainReconciler: Failed to check whether volume %q is attached to node %q. Err: %v",
+					volumeID, node.Name, err)
+				break
+			}
+			if !attached {
+				klog.V(2).Infof("DrainReconciler: Volume %q was detached from draining node %q", volumeID, node.Name)
+				r.markDetached(node.Name, volumeID)
+			}
+		}
+	}
+}
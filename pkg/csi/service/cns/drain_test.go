@@ -0,0 +1,112 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+
+	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
+)
+
+func TestDrainReconcilerIsDraining(t *testing.T) {
+	r := newDrainReconciler(nil, nil, nil, "")
+	node := &v1.Node{}
+	if r.isDraining(node) {
+		t.Fatalf("expected node without taints not to be draining")
+	}
+	node.Spec.Taints = []v1.Taint{{Key: "node.kubernetes.io/unschedulable", Effect: v1.TaintEffectNoSchedule}}
+	if r.isDraining(node) {
+		t.Fatalf("expected cordoned node not to be draining")
+	}
+	node.Spec.Taints = []v1.Taint{{Key: "node.kubernetes.io/out-of-service", Effect: v1.TaintEffectNoExecute}}
+	if !r.isDraining(node) {
+		t.Fatalf("expected out of service node to be draining")
+	}
+
+	// Configured taints replace the defaults
+	r = newDrainReconciler(nil, nil, nil, "example.com/maintenance, example.com/shutdown")
+	if r.isDraining(node) {
+		t.Fatalf("expected default taint to be ignored")
+	}
+	node.Spec.Taints = []v1.Taint{{Key: "example.com/shutdown", Effect: v1.TaintEffectNoExecute}}
+	if !r.isDraining(node) {
+		t.Fatalf("expected configured taint to mark the node as draining")
+	}
+}
+
+func TestDrainReconcilerVolumesInUse(t *testing.T) {
+	node := &v1.Node{
+		Status: v1.NodeStatus{
+			VolumesInUse: []v1.UniqueVolumeName{
+				"kubernetes.io/csi/" + csitypes.Name + "^vol-1",
+				"kubernetes.io/csi/other.csi.example.com^vol-2",
+			},
+		},
+	}
+	volumes := volumesInUse(node)
+	if len(volumes) != 1 || !volumes["vol-1"] {
+		t.Fatalf("expected only vol-1 to be in use, got %v", volumes)
+	}
+}
+
+func TestDrainReconcilerClaimsInUse(t *testing.T) {
+	newPod := func(name string, nodeName string, phase v1.PodPhase, claimName string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: v1.PodSpec{
+				NodeName: nodeName,
+				Volumes: []v1.Volume{{
+					Name: "data",
+					VolumeSource: v1.VolumeSource{
+						PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: claimName},
+					},
+				}},
+			},
+			Status: v1.PodStatus{Phase: phase},
+		}
+	}
+	k8sclient := testclient.NewSimpleClientset(
+		newPod("running", "node-1", v1.PodRunning, "pvc-1"),
+		newPod("completed", "node-1", v1.PodSucceeded, "pvc-2"),
+	)
+	r := newDrainReconciler(nil, nil, k8sclient, "")
+	claims, err := r.claimsInUse("node-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claims["default/pvc-1"] || claims["default/pvc-2"] {
+		t.Fatalf("expected only default/pvc-1 to be in use, got %v", claims)
+	}
+}
+
+func TestDrainReconcilerForget(t *testing.T) {
+	r := newDrainReconciler(nil, nil, nil, "")
+	r.detached["node-1"] = map[string]bool{"vol-1": true}
+	if r.forget("vol-1", "node-2") {
+		t.Fatalf("expected vol-1 not to be detached from node-2")
+	}
+	if !r.forget("vol-1", "node-1") {
+		t.Fatalf("expected vol-1 to be detached from node-1")
+	}
+	if r.forget("vol-1", "node-1") {
+		t.Fatalf("expected vol-1 to be forgotten")
+	}
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"context"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
+	k8s "sigs.k8s.io/vsphere-csi-driver/pkg/kubernetes"
+)
+
+// defaultNodeDeleteForceDetachDelay is the time waited after a node is
+// deleted before its volumes are detached, so nodes deleted and registered
+// again, e.g. on kubelet restart, are left alone.
+const defaultNodeDeleteForceDetachDelay = 5 * time.Minute
+
+// nodeDeleteReconciler detaches the volumes of deleted nodes and removes their
+// VolumeAttachments, which otherwise block the volumes from being attached to
+// another node until they are cleaned up manually.
+type nodeDeleteReconciler struct {
+	manager   *common.Manager
+	k8sclient clientset.Interface
+	// delay is the time waited after the node deletion before acting
+	delay time.Duration
+	// findVM returns the VM with the given BIOS UUID
+	findVM func(uuid string) (*cnsvsphere.VirtualMachine, error)
+}
+
+// newNodeDeleteReconciler returns a nodeDeleteReconciler acting the given
+// delay in seconds after node deletions, or defaultNodeDeleteForceDetachDelay
+// if it is not set.
+func newNodeDeleteReconciler(manager *common.Manager, k8sclient clientset.Interface, delayInSec int) *nodeDeleteReconciler {
+	delay := defaultNodeDeleteForceDetachDelay
+	if delayInSec > 0 {
+		delay = time.Duration(delayInSec) * time.Second
+	}
+	return &nodeDeleteReconciler{
+		manager:   manager,
+		k8sclient: k8sclient,
+		delay:     delay,
+		findVM: func(uuid string) (*cnsvsphere.VirtualMachine, error) {
+			return cnsvsphere.GetVirtualMachineByUUID(uuid, false)
+		},
+	}
+}
+
+// nodeDeleted schedules the cleanup of the volumes of the deleted node.
+func (r *nodeDeleteReconciler) nodeDeleted(obj interface{}) {
+	node, ok := obj.(*v1.Node)
+	if node == nil || !ok {
+		klog.Warningf("NodeDeleteReconciler: unrecognized object %+v", obj)
+		return
+	}
+	klog.V(2).Infof("NodeDeleteReconciler: Node %q deleted, detaching its volumes in %v", node.Name, r.delay)
+	time.AfterFunc(r.delay, func() {
+		r.cleanupNode(node)
+	})
+}
+
+// cleanupNode detaches the volumes of the VolumeAttachments of the deleted
+// node from its VM and removes the VolumeAttachments, unless the node was
+// registered again.
+func (r *nodeDeleteReconciler) cleanupNode(node *v1.Node) {
+	if _, err := r.k8sclient.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{}); err == nil {
+		klog.V(2).Infof("NodeDeleteReconciler: Node %q was registered again, leaving its volumes attached", node.Name)
+		return
+	} else if !apierrors.IsNotFound(err) {
+		klog.Warningf("NodeDeleteReconciler: Failed to get node %q. Err: %v", node.Name, err)
+		return
+	}
+	vaList, err := r.k8sclient.StorageV1().VolumeAttachments().List(metav1.ListOptions{})
+	if err != nil {
+		klog.Warningf("NodeDeleteReconciler: Failed to get VolumeAttachments from kubernetes. Err: %v", err)
+		return
+	}
+	var vas []*storagev1.VolumeAttachment
+	for i := range vaList.Items {
+		va := &vaList.Items[i]
+		if va.Spec.Attacher == csitypes.Name && va.Spec.NodeName == node.Name && va.Spec.Source.PersistentVolumeName != nil {
+			vas = append(vas, va)
+		}
+	}
+	if len(vas) == 0 {
+		return
+	}
+	// The VM of a deleted node is no longer known to the node manager
+	vm, err := r.findVM(common.GetUUIDFromProviderID(node.Spec.ProviderID))
+	if err == cnsvsphere.ErrVMNotFound {
+		klog.V(2).Infof("NodeDeleteReconciler: VM of node %q no longer exists", node.Name)
+		vm = nil
+	} else if err != nil {
+		klog.Warningf("NodeDeleteReconciler: Failed to find VirtualMachine for node %q. Err: %v", node.Name, err)
+		return
+	}
+	cleaned := 0
+	for _, va := range vas {
+		if r.cleanupAttachment(vm, va) {
+			cleaned++
+		}
+	}
+	klog.V(2).Infof("NodeDeleteReconciler: Cleaned up %d of %d volume attachments of deleted node %q", cleaned, len(vas), node.Name)
+}
+
+// cleanupAttachment detaches the volume of the VolumeAttachment from the VM,
+// if the VM still exists, and deletes the VolumeAttachment along with its
+// attacher finalizer. It returns true if the VolumeAttachment was removed.
+func (r *nodeDeleteReconciler) cleanupAttachment(vm *cnsvsphere.VirtualMachine, va *storagev1.VolumeAttachment) bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pv, err := r.k8sclient.CoreV1().PersistentVolumes().Get(*va.Spec.Source.PersistentVolumeName, metav1.GetOptions{})
+	if err != nil || pv.Spec.CSI == nil {
+		klog.Warningf("NodeDeleteReconciler: Failed to get the CSI PV of volume attachment %q. Err: %v", va.Name, err)
+		return false
+	}
+	volumeID := pv.Spec.CSI.VolumeHandle
+	if vm != nil {
+		attached, err := vm.IsDiskAttached(ctx, volumeID)
+		if err != nil {
+			klog.Warningf("NodeDeleteReconciler: Failed to check whether volume %q is attached to node %q. Err: %v", volumeID, va.Spec.NodeName, err)
+			return false
+		}
+		if attached {
+			klog.V(2).Infof("NodeDeleteReconciler: Detaching volume %q from deleted node %q", volumeID, va.Spec.NodeName)
+			outsideCNS := common.IsAttachmentOutsideCNS(va.Status.AttachmentMetadata)
+			if err := common.DetachVolumeUtil(ctx, r.manager, vm, volumeID, outsideCNS); err != nil {
+				klog.Warningf("NodeDeleteReconciler: Failed to detach volume %q from node %q. Err: %v", volumeID, va.Spec.NodeName, err)
+				if err := forceDetachVolume(ctx, vm, volumeID); err != nil {
+					klog.Warningf("NodeDeleteReconciler: Failed to force detach volume %q from node %q. Err: %v", volumeID, va.Spec.NodeName, err)
+					return false
+				}
+			}
+		}
+	}
+	if va.DeletionTimestamp == nil {
+		err := r.k8sclient.StorageV1().VolumeAttachments().Delete(va.Name, &metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			klog.Warningf("NodeDeleteReconciler: Failed to delete volume attachment %q. Err: %v", va.Name, err)
+			return false
+		}
+	}
+	if err := k8s.RemoveAttacherFinalizer(r.k8sclient, va.Name); err != nil {
+		klog.Warningf("NodeDeleteReconciler: Failed to remove finalizer of volume attachment %q. Err: %v", va.Name, err)
+		return false
+	}
+	klog.V(2).Infof("NodeDeleteReconciler: Removed volume attachment %q of volume %q from deleted node %q", va.Name, volumeID, va.Spec.NodeName)
+	return true
+}
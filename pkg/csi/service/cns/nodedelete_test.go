@@ -0,0 +1,181 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	k8stesting "k8s.io/client-go/testing"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
+	k8s "sigs.k8s.io/vsphere-csi-driver/pkg/kubernetes"
+)
+
+func TestNodeDeleteReconcilerCleanupNode(t *testing.T) {
+	newVA := func(name string, attacher string, nodeName string, pvName string) *storagev1.VolumeAttachment {
+		return &storagev1.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Finalizers: []string{k8s.AttacherFinalizer}},
+			Spec: storagev1.VolumeAttachmentSpec{
+				Attacher: attacher,
+				NodeName: nodeName,
+				Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+			},
+		}
+	}
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: csitypes.Name, VolumeHandle: "volume-1"},
+			},
+		},
+	}
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1"},
+		Spec:       v1.NodeSpec{ProviderID: "vsphere://42-1"},
+	}
+	k8sclient := testclient.NewSimpleClientset(pv, node,
+		newVA("va-1", csitypes.Name, "node-1", "pv-1"),
+		newVA("va-2", csitypes.Name, "node-2", "pv-1"),
+		newVA("va-3", "other.csi.example.com", "node-1", "pv-1"),
+	)
+	r := newNodeDeleteReconciler(nil, k8sclient, 0)
+	lookups := 0
+	r.findVM = func(uuid string) (*cnsvsphere.VirtualMachine, error) {
+		lookups++
+		return nil, cnsvsphere.ErrVMNotFound
+	}
+	vaExists := func(name string) bool {
+		_, err := k8sclient.StorageV1().VolumeAttachments().Get(name, metav1.GetOptions{})
+		return err == nil
+	}
+
+	// Nodes registered again keep their volumes
+	r.cleanupNode(node)
+	if !vaExists("va-1") || lookups != 0 {
+		t.Fatalf("expected volume attachment of registered node to be kept")
+	}
+
+	if err := k8sclient.CoreV1().Nodes().Delete(node.Name, &metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	r.cleanupNode(node)
+	if vaExists("va-1") {
+		t.Fatalf("expected volume attachment of deleted node to be removed")
+	}
+	if !vaExists("va-2") || !vaExists("va-3") {
+		t.Fatalf("expected volume attachments of other nodes and drivers to be kept")
+	}
+}
+
+// newAPIServerClientset returns a fake clientset with the given objects whose
+// VolumeAttachments behave as on an API server: deleting a VolumeAttachment
+// with finalizers only sets its deletion timestamp, it is removed once its
+// finalizers are cleared, and updates of a stale resource version fail with a
+// conflict.
+func newAPIServerClientset(t *testing.T, objects ...runtime.Object) *testclient.Clientset {
+	gvr := storagev1.SchemeGroupVersion.WithResource("volumeattachments")
+	tracker := k8stesting.NewObjectTracker(scheme.Scheme, scheme.Codecs.UniversalDecoder())
+	for _, obj := range objects {
+		if err := tracker.Add(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	k8sclient := &testclient.Clientset{}
+	k8sclient.AddReactor("*", "*", k8stesting.ObjectReaction(tracker))
+	bump := func(va *storagev1.VolumeAttachment) {
+		version, _ := strconv.Atoi(va.ResourceVersion)
+		va.ResourceVersion = strconv.Itoa(version + 1)
+	}
+	k8sclient.PrependReactor("delete", "volumeattachments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		obj, err := tracker.Get(gvr, "", action.(k8stesting.DeleteAction).GetName())
+		if err != nil {
+			return true, nil, err
+		}
+		va := obj.(*storagev1.VolumeAttachment).DeepCopy()
+		if len(va.Finalizers) == 0 {
+			return true, nil, tracker.Delete(gvr, "", va.Name)
+		}
+		now := metav1.Now()
+		va.DeletionTimestamp = &now
+		bump(va)
+		return true, nil, tracker.Update(gvr, va, "")
+	})
+	k8sclient.PrependReactor("update", "volumeattachments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		va := action.(k8stesting.UpdateAction).GetObject().(*storagev1.VolumeAttachment).DeepCopy()
+		obj, err := tracker.Get(gvr, "", va.Name)
+		if err != nil {
+			return true, nil, err
+		}
+		if current := obj.(*storagev1.VolumeAttachment); current.ResourceVersion != va.ResourceVersion {
+			return true, nil, apierrors.NewConflict(gvr.GroupResource(), va.Name, errors.New("stale resource version"))
+		}
+		if va.DeletionTimestamp != nil && len(va.Finalizers) == 0 {
+			return true, va, tracker.Delete(gvr, "", va.Name)
+		}
+		bump(va)
+		return true, va, tracker.Update(gvr, va, "")
+	})
+	return k8sclient
+}
+
+func TestNodeDeleteReconcilerRemovesFinalizerOfDeletedAttachment(t *testing.T) {
+	pvName := "pv-1"
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: pvName},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: csitypes.Name, VolumeHandle: "volume-1"},
+			},
+		},
+	}
+	va := &storagev1.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "va-1",
+			ResourceVersion: "1",
+			Finalizers:      []string{k8s.AttacherFinalizer, "example.com/protection"},
+		},
+		Spec: storagev1.VolumeAttachmentSpec{
+			Attacher: csitypes.Name,
+			NodeName: "node-1",
+			Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+		},
+	}
+	k8sclient := newAPIServerClientset(t, pv, va)
+	r := newNodeDeleteReconciler(nil, k8sclient, 0)
+
+	if !r.cleanupAttachment(nil, va) {
+		t.Fatalf("expected volume attachment to be cleaned up")
+	}
+	current, err := k8sclient.StorageV1().VolumeAttachments().Get("va-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.DeletionTimestamp == nil || len(current.Finalizers) != 1 || current.Finalizers[0] != "example.com/protection" {
+		t.Fatalf("expected only the attacher finalizer to be removed from the deleted volume attachment, got %+v", current.ObjectMeta)
+	}
+}
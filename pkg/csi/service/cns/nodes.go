@@ -19,15 +19,16 @@ package cns
 import (
 	"context"
 	"fmt"
+	"sort"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/vmware/govmomi/vim25/types"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/klog"
 
 	cnsnode "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/node"
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
-	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
 	k8s "sigs.k8s.io/vsphere-csi-driver/pkg/kubernetes"
 )
 
@@ -85,6 +86,7 @@ func (nodes *Nodes) GetNodeByName(nodeName string) (*cnsvsphere.VirtualMachine,
 
 // GetSharedDatastoresInTopology returns shared accessible datastores for specified topologyRequirement along with the map of
 // datastore URL and array of accessibleTopology map for each datastore returned from this function.
+// Zone and region are read from and reported with the topology keys zoneKey and regionKey.
 // Here in this function, argument topologyRequirement can be passed in following form
 // topologyRequirement [requisite:<segments:<key:"failure-domain.beta.kubernetes.io/region" value:"k8s-region-us" >
 //                                 segments:<key:"failure-domain.beta.kubernetes.io/zone" value:"k8s-zone-us-east" > >
@@ -103,7 +105,8 @@ func (nodes *Nodes) GetNodeByName(nodeName string) (*cnsvsphere.VirtualMachine,
 //      ds:///vmfs/volumes/vsan:524fae1aaca129a5-1ee55a87f26ae626/:
 //         [map[failure-domain.beta.kubernetes.io/region:k8s-region-us failure-domain.beta.kubernetes.io/zone:k8s-zone-us-west]
 //         map[failure-domain.beta.kubernetes.io/region:k8s-region-us failure-domain.beta.kubernetes.io/zone:k8s-zone-us-east]]]]
-func (nodes *Nodes) GetSharedDatastoresInTopology(ctx context.Context, topologyRequirement *csi.TopologyRequirement, zoneCategoryName string, regionCategoryName string) ([]*cnsvsphere.DatastoreInfo, map[string][]map[string]string, error) {
+func (nodes *Nodes) GetSharedDatastoresInTopology(ctx context.Context, topologyRequirement *csi.TopologyRequirement, zoneCategoryName string, regionCategoryName string,
+	zoneKey string, regionKey string) ([]*cnsvsphere.DatastoreInfo, map[string][]map[string]string, error) {
 	klog.V(4).Infof("GetSharedDatastoresInTopology: called with topologyRequirement: %+v, zoneCategoryName: %s, regionCategoryName: %s", topologyRequirement, zoneCategoryName, regionCategoryName)
 	allNodes, err := nodes.cnsNodeManager.GetAllNodes()
 	if err != nil {
@@ -141,8 +144,8 @@ func (nodes *Nodes) GetSharedDatastoresInTopology(ctx context.Context, topologyR
 		datastoreTopologyMap := make(map[string][]map[string]string)
 		for _, topology := range topologyArr {
 			segments := topology.GetSegments()
-			zone := segments[csitypes.LabelZoneFailureDomain]
-			region := segments[csitypes.LabelRegionFailureDomain]
+			zone := segments[zoneKey]
+			region := segments[regionKey]
 			klog.V(4).Infof("Getting list of nodeVMs for zone [%s] and region [%s]", zone, region)
 			nodeVMsInZoneRegion, err := getNodesInZoneRegion(zone, region)
 			if err != nil {
@@ -159,10 +162,10 @@ func (nodes *Nodes) GetSharedDatastoresInTopology(ctx context.Context, topologyR
 			for _, datastore := range sharedDatastoresInZoneRegion {
 				accessibleTopology := make(map[string]string)
 				if zone != "" {
-					accessibleTopology[csitypes.LabelZoneFailureDomain] = zone
+					accessibleTopology[zoneKey] = zone
 				}
 				if region != "" {
-					accessibleTopology[csitypes.LabelRegionFailureDomain] = region
+					accessibleTopology[regionKey] = region
 				}
 				datastoreTopologyMap[datastore.Info.Url] = append(datastoreTopologyMap[datastore.Info.Url], accessibleTopology)
 			}
@@ -214,6 +217,132 @@ func (nodes *Nodes) GetSharedDatastoresInK8SCluster(ctx context.Context) ([]*cns
 	return sharedDatastores, nil
 }
 
+// GetSharedDatastoresInHostGroup returns shared accessible datastores for the node VMs running on hosts of the
+// DRS host group with the given name, along with the names of these nodes.
+// cnsvsphere.ErrHostGroupNotFound is returned if no cluster in the datacenters of the node VMs has such host group.
+func (nodes *Nodes) GetSharedDatastoresInHostGroup(ctx context.Context, hostGroupName string) ([]*cnsvsphere.DatastoreInfo, []string, error) {
+	klog.V(4).Infof("GetSharedDatastoresInHostGroup: called with hostGroupName: %s", hostGroupName)
+	return nodes.getSharedDatastoresOnHosts(ctx, fmt.Sprintf("host group %q", hostGroupName), cnsvsphere.ErrHostGroupNotFound,
+		func(dc *cnsvsphere.Datacenter) ([]types.ManagedObjectReference, error) {
+			return dc.GetHostsInHostGroup(ctx, hostGroupName)
+		})
+}
+
+// GetSharedDatastoresInVsanFaultDomain returns shared accessible datastores for the node VMs running on hosts of
+// the vSAN fault domain with the given name, along with the names of these nodes.
+// cnsvsphere.ErrVsanFaultDomainNotFound is returned if no host in the datacenters of the node VMs is in such fault
+// domain.
+func (nodes *Nodes) GetSharedDatastoresInVsanFaultDomain(ctx context.Context, faultDomainName string) ([]*cnsvsphere.DatastoreInfo, []string, error) {
+	klog.V(4).Infof("GetSharedDatastoresInVsanFaultDomain: called with faultDomainName: %s", faultDomainName)
+	return nodes.getSharedDatastoresOnHosts(ctx, fmt.Sprintf("vSAN fault domain %q", faultDomainName), cnsvsphere.ErrVsanFaultDomainNotFound,
+		func(dc *cnsvsphere.Datacenter) ([]types.ManagedObjectReference, error) {
+			return dc.GetHostsInVsanFaultDomain(ctx, faultDomainName)
+		})
+}
+
+// getSharedDatastoresOnHosts returns shared accessible datastores for the node VMs running on the hosts returned by
+// getHosts for their datacenter, along with the names of these nodes. errNotFound is returned if getHosts returns it
+// for all the datacenters of the node VMs.
+func (nodes *Nodes) getSharedDatastoresOnHosts(ctx context.Context, hostsName string, errNotFound error,
+	getHosts func(dc *cnsvsphere.Datacenter) ([]types.ManagedObjectReference, error)) ([]*cnsvsphere.DatastoreInfo, []string, error) {
+	hostsFound := false
+	hostSet := make(map[string]bool)
+	checkedDatacenters := make(map[string]bool)
+	var nodeVMsOnHosts []*cnsvsphere.VirtualMachine
+	var nodeNamesOnHosts []string
+	for _, nodeName := range nodes.cnsNodeManager.GetAllNodeNames() {
+		nodeVM, err := nodes.cnsNodeManager.GetNodeByName(nodeName)
+		if err != nil {
+			klog.Errorf("Failed to get node VM for node %q with err %+v", nodeName, err)
+			return nil, nil, err
+		}
+		datacenterKey := nodeVM.Datacenter.VirtualCenterHost + "/" + nodeVM.Datacenter.Reference().Value
+		if !checkedDatacenters[datacenterKey] {
+			hosts, err := getHosts(nodeVM.Datacenter)
+			if err == nil {
+				hostsFound = true
+				for _, host := range hosts {
+					hostSet[nodeVM.Datacenter.VirtualCenterHost+"/"+host.Value] = true
+				}
+			} else if err != errNotFound {
+				klog.Errorf("Failed to get hosts in %s for %v with err %+v", hostsName, nodeVM.Datacenter, err)
+				return nil, nil, err
+			}
+			checkedDatacenters[datacenterKey] = true
+		}
+		host, err := nodeVM.GetHostSystem(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if hostSet[nodeVM.VirtualCenterHost+"/"+host.Reference().Value] {
+			nodeVMsOnHosts = append(nodeVMsOnHosts, nodeVM)
+			nodeNamesOnHosts = append(nodeNamesOnHosts, nodeName)
+		}
+	}
+	if !hostsFound {
+		return nil, nil, errNotFound
+	}
+	if len(nodeVMsOnHosts) == 0 {
+		return nil, nil, fmt.Errorf("No node VMs found on hosts of %s", hostsName)
+	}
+	sharedDatastores, err := nodes.GetSharedDatastoresForVMs(ctx, nodeVMsOnHosts)
+	if err != nil {
+		klog.Errorf("Failed to get shared datastores for nodes: %+v in %s. Error: %+v", nodeNamesOnHosts, hostsName, err)
+		return nil, nil, err
+	}
+	sort.Strings(nodeNamesOnHosts)
+	klog.V(3).Infof("Nodes %v in %s share datastores: %+v", nodeNamesOnHosts, hostsName, sharedDatastores)
+	return sharedDatastores, nodeNamesOnHosts, nil
+}
+
+// GetSharedDatastoresInResourcePool returns the shared accessible datastores for the node VMs in the
+// kubernetes cluster which belong to the compute resource backing the resource pool with the given name.
+// cnsvsphere.ErrResourcePoolNotFound is returned if no datacenter of the node VMs has such resource pool.
+func (nodes *Nodes) GetSharedDatastoresInResourcePool(ctx context.Context, resourcePool string) ([]*cnsvsphere.DatastoreInfo, error) {
+	klog.V(4).Infof("GetSharedDatastoresInResourcePool: called with resourcePool: %s", resourcePool)
+	resourcePoolFound := false
+	datastoresInResourcePool := make(map[string]bool)
+	checkedDatacenters := make(map[string]bool)
+	for _, nodeName := range nodes.cnsNodeManager.GetAllNodeNames() {
+		nodeVM, err := nodes.cnsNodeManager.GetNodeByName(nodeName)
+		if err != nil {
+			klog.Errorf("Failed to get node VM for node %q with err %+v", nodeName, err)
+			return nil, err
+		}
+		datacenterKey := nodeVM.Datacenter.VirtualCenterHost + "/" + nodeVM.Datacenter.Reference().Value
+		if checkedDatacenters[datacenterKey] {
+			continue
+		}
+		checkedDatacenters[datacenterKey] = true
+		datastores, err := nodeVM.Datacenter.GetDatastoresOfResourcePool(ctx, resourcePool)
+		if err == cnsvsphere.ErrResourcePoolNotFound {
+			continue
+		} else if err != nil {
+			klog.Errorf("Failed to get datastores of resource pool %q for %v with err %+v", resourcePool, nodeVM.Datacenter, err)
+			return nil, err
+		}
+		resourcePoolFound = true
+		for _, datastore := range datastores {
+			datastoresInResourcePool[nodeVM.Datacenter.VirtualCenterHost+"/"+datastore.Value] = true
+		}
+	}
+	if !resourcePoolFound {
+		return nil, cnsvsphere.ErrResourcePoolNotFound
+	}
+	sharedDatastores, err := nodes.GetSharedDatastoresInK8SCluster(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var sharedDatastoresInResourcePool []*cnsvsphere.DatastoreInfo
+	for _, sharedDatastore := range sharedDatastores {
+		if datastoresInResourcePool[sharedDatastore.Datacenter.VirtualCenterHost+"/"+sharedDatastore.Reference().Value] {
+			sharedDatastoresInResourcePool = append(sharedDatastoresInResourcePool, sharedDatastore)
+		}
+	}
+	klog.V(3).Infof("Resource pool %q shares datastores: %+v", resourcePool, sharedDatastoresInResourcePool)
+	return sharedDatastoresInResourcePool, nil
+}
+
 // GetSharedDatastoresForVMs returns shared datastores accessible to specified nodeVMs list
 func (nodes *Nodes) GetSharedDatastoresForVMs(ctx context.Context, nodeVMs []*cnsvsphere.VirtualMachine) ([]*cnsvsphere.DatastoreInfo, error) {
 	var sharedDatastores []*cnsvsphere.DatastoreInfo
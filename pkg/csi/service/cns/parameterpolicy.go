@@ -0,0 +1,110 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	// parameterPolicyRequired is the key of the policy ConfigMap listing the
+	// parameters CreateVolume requests must set
+	parameterPolicyRequired = "required"
+	// parameterPolicyForbidden is the key of the policy ConfigMap listing the
+	// parameters CreateVolume requests must not set
+	parameterPolicyForbidden = "forbidden"
+)
+
+// parameterPolicy enforces the StorageClass parameter rules of a ConfigMap on
+// CreateVolume requests. The ConfigMap is read on every request, so policy
+// changes apply without restarting the controller.
+type parameterPolicy struct {
+	k8sclient clientset.Interface
+	namespace string
+	name      string
+}
+
+// newParameterPolicy returns a parameterPolicy for the ConfigMap given as
+// "namespace/name".
+func newParameterPolicy(k8sclient clientset.Interface, configMap string) (*parameterPolicy, error) {
+	parts := strings.Split(configMap, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("parameter policy ConfigMap %q is not of the form namespace/name", configMap)
+	}
+	return &parameterPolicy{k8sclient: k8sclient, namespace: parts[0], name: parts[1]}, nil
+}
+
+// validate returns an InvalidArgument error listing the violated rules if the
+// parameters do not comply with the policy. A missing ConfigMap enforces no
+// rules.
+func (p *parameterPolicy) validate(params map[string]string) error {
+	cm, err := p.k8sclient.CoreV1().ConfigMaps(p.namespace).Get(p.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		klog.V(3).Infof("Parameter policy ConfigMap %s/%s not found, no rules enforced", p.namespace, p.name)
+		return nil
+	} else if err != nil {
+		msg := fmt.Sprintf("Failed to get parameter policy ConfigMap %s/%s. Error: %+v", p.namespace, p.name, err)
+		klog.Error(msg)
+		return status.Error(codes.Internal, msg)
+	}
+	if violations := checkParameterPolicy(cm.Data, params); len(violations) > 0 {
+		msg := fmt.Sprintf("Volume parameters violate the policy of ConfigMap %s/%s: %s", p.namespace, p.name, strings.Join(violations, "; "))
+		klog.Error(msg)
+		return status.Error(codes.InvalidArgument, msg)
+	}
+	return nil
+}
+
+// checkParameterPolicy returns the rules of the policy the parameters violate.
+// Parameter names are compared case insensitively.
+func checkParameterPolicy(policy map[string]string, params map[string]string) []string {
+	set := make(map[string]bool)
+	for name := range params {
+		set[strings.ToLower(name)] = true
+	}
+	var violations []string
+	for _, name := range splitParameterNames(policy[parameterPolicyRequired]) {
+		if !set[name] {
+			violations = append(violations, fmt.Sprintf("parameter %s is required", name))
+		}
+	}
+	for _, name := range splitParameterNames(policy[parameterPolicyForbidden]) {
+		if set[name] {
+			violations = append(violations, fmt.Sprintf("parameter %s is forbidden", name))
+		}
+	}
+	return violations
+}
+
+// splitParameterNames returns the lower cased names of a comma separated list.
+func splitParameterNames(list string) []string {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParameterPolicy(t *testing.T) {
+	if _, err := newParameterPolicy(testclient.NewSimpleClientset(), "policy"); err == nil {
+		t.Fatalf("Expected error for ConfigMap without namespace")
+	}
+
+	// Without the ConfigMap no rules are enforced
+	k8sclient := testclient.NewSimpleClientset()
+	policy, err := newParameterPolicy(k8sclient, "kube-system/volume-policy")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := policy.validate(map[string]string{}); err != nil {
+		t.Errorf("Expected no rules without ConfigMap, got err: %v", err)
+	}
+
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "volume-policy", Namespace: "kube-system"},
+		Data: map[string]string{
+			parameterPolicyRequired:  "storagePolicyName",
+			parameterPolicyForbidden: "datastoreURL, allowDeleteAttached",
+		},
+	}
+	if _, err := k8sclient.CoreV1().ConfigMaps("kube-system").Create(cm); err != nil {
+		t.Fatalf("Failed to create ConfigMap: %v", err)
+	}
+	if err := policy.validate(map[string]string{"StoragePolicyName": "gold"}); err != nil {
+		t.Errorf("Expected compliant parameters to pass, got err: %v", err)
+	}
+	err = policy.validate(map[string]string{"datastoreurl": "ds:///vmfs/volumes/ds-1/"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument, got err: %v", err)
+	}
+	if violations := checkParameterPolicy(cm.Data, map[string]string{"datastoreurl": "ds:///vmfs/volumes/ds-1/"}); len(violations) != 2 {
+		t.Errorf("Expected both rules to be violated, got %v", violations)
+	}
+}
@@ -0,0 +1,267 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	"k8s.io/klog"
+
+	cnsvolume "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+)
+
+// defaultQuotaRefreshIntervalInSec is the default interval between refreshes
+// of the quota usage from CNS.
+const defaultQuotaRefreshIntervalInSec = 300
+
+// errQuotaExceeded is returned when provisioning a volume would exceed the
+// quota of its storage policy.
+var errQuotaExceeded = errors.New("storage policy quota exceeded")
+
+// quotaCharge is the capacity of a volume charged to a storage policy.
+type quotaCharge struct {
+	policyID  string
+	sizeBytes int64
+}
+
+// policyQuota tracks the capacity provisioned per storage policy against the
+// configured cluster-wide quotas. In-flight volumes are charged by name until
+// they are created, then by volume ID until they are deleted. The charges of
+// created volumes are refreshed from CNS periodically, so volumes deleted
+// outside the controller, e.g. by the syncer, are uncharged.
+type policyQuota struct {
+	lock sync.Mutex
+	// limits maps storage policy IDs to their quota in bytes
+	limits map[string]int64
+	// usage maps storage policy IDs to the bytes charged to them
+	usage map[string]int64
+	// pending maps the names of in-flight volumes to their charge
+	pending map[string]quotaCharge
+	// volumes maps the IDs of created volumes to their charge
+	volumes map[string]quotaCharge
+	// committed and removed hold the volumes committed and removed since the
+	// refresh in progress queried CNS, nil if no refresh is in progress
+	committed map[string]quotaCharge
+	removed   map[string]bool
+}
+
+// newPolicyQuota returns a policyQuota enforcing the quotas, in bytes, of the
+// given storage policy IDs.
+func newPolicyQuota(limits map[string]int64) *policyQuota {
+	return &policyQuota{
+		limits:  limits,
+		usage:   make(map[string]int64),
+		pending: make(map[string]quotaCharge),
+		volumes: make(map[string]quotaCharge),
+	}
+}
+
+// load charges the existing CNS volumes to their storage policy.
+func (q *policyQuota) load(volumes []cnstypes.CnsVolume) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, volume := range volumes {
+		if _, ok := q.limits[volume.StoragePolicyId]; !ok {
+			continue
+		}
+		if _, ok := q.volumes[volume.VolumeId.Id]; ok {
+			continue
+		}
+		charge := quotaCharge{
+			policyID:  volume.StoragePolicyId,
+			sizeBytes: volume.BackingObjectDetails.CapacityInMb * common.MbInBytes,
+		}
+		q.volumes[volume.VolumeId.Id] = charge
+		q.usage[charge.policyID] += charge.sizeBytes
+	}
+}
+
+// reserve charges sizeBytes for the named volume to the storage policy, and
+// returns errQuotaExceeded if this would exceed the quota of the policy.
+// Volumes of storage policies without quota are not tracked.
+func (q *policyQuota) reserve(volumeName string, policyID string, sizeBytes int64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.releaseLocked(volumeName)
+	limit, ok := q.limits[policyID]
+	if !ok {
+		return nil
+	}
+	if q.usage[policyID]+sizeBytes > limit {
+		klog.V(3).Infof("Volume %q of %d bytes exceeds quota of storage policy %q, %d of %d bytes used",
+			volumeName, sizeBytes, policyID, q.usage[policyID], limit)
+		return errQuotaExceeded
+	}
+	q.pending[volumeName] = quotaCharge{policyID: policyID, sizeBytes: sizeBytes}
+	q.usage[policyID] += sizeBytes
+	return nil
+}
+
+// release drops the charge of the named in-flight volume.
+func (q *policyQuota) release(volumeName string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.releaseLocked(volumeName)
+}
+
+// releaseLocked drops the charge of the named in-flight volume. Caller must
+// hold the lock.
+func (q *policyQuota) releaseLocked(volumeName string) {
+	if charge, ok := q.pending[volumeName]; ok {
+		q.usage[charge.policyID] -= charge.sizeBytes
+		delete(q.pending, volumeName)
+	}
+}
+
+// commit moves the charge of the named in-flight volume to the created volume.
+func (q *policyQuota) commit(volumeName string, volumeID string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	charge, ok := q.pending[volumeName]
+	if !ok {
+		return
+	}
+	delete(q.pending, volumeName)
+	if _, ok := q.volumes[volumeID]; ok {
+		// The volume is already charged, e.g. on a retried CreateVolume
+		q.usage[charge.policyID] -= charge.sizeBytes
+		return
+	}
+	q.volumes[volumeID] = charge
+	if q.committed != nil {
+		q.committed[volumeID] = charge
+	}
+}
+
+// remove drops the charge of the deleted volume.
+func (q *policyQuota) remove(volumeID string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if charge, ok := q.volumes[volumeID]; ok {
+		q.usage[charge.policyID] -= charge.sizeBytes
+		delete(q.volumes, volumeID)
+	}
+	if q.removed != nil {
+		q.removed[volumeID] = true
+	}
+}
+
+// startRefresh records the volumes committed and removed from now on, until
+// finishRefresh is called with the CNS volumes queried after this call.
+func (q *policyQuota) startRefresh() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.committed = make(map[string]quotaCharge)
+	q.removed = make(map[string]bool)
+}
+
+// finishRefresh replaces the charges of the created volumes with the charges
+// of the given CNS volumes. Volumes committed or removed since startRefresh
+// may be missing from, or still part of, the CNS volumes, so their charge is
+// kept as is.
+func (q *policyQuota) finishRefresh(volumes []cnstypes.CnsVolume) {
+	q.lock.Lock()
+	committed, removed := q.committed, q.removed
+	q.committed, q.removed = nil, nil
+	q.volumes = make(map[string]quotaCharge)
+	q.usage = make(map[string]int64)
+	for _, charge := range q.pending {
+		q.usage[charge.policyID] += charge.sizeBytes
+	}
+	for volumeID, charge := range committed {
+		q.volumes[volumeID] = charge
+		q.usage[charge.policyID] += charge.sizeBytes
+	}
+	var current []cnstypes.CnsVolume
+	for _, volume := range volumes {
+		if !removed[volume.VolumeId.Id] {
+			current = append(current, volume)
+		}
+	}
+	q.lock.Unlock()
+	q.load(current)
+}
+
+// abortRefresh stops recording the volumes committed and removed, keeping the
+// current charges.
+func (q *policyQuota) abortRefresh() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.committed, q.removed = nil, nil
+}
+
+// refresh charges the CNS volumes of the cluster in place of the created
+// volumes, every interval in seconds or the default interval if unset.
+func (q *policyQuota) refresh(manager *common.Manager, intervalInSec int) {
+	if intervalInSec <= 0 {
+		intervalInSec = defaultQuotaRefreshIntervalInSec
+	}
+	queryFilter := cnstypes.CnsQueryFilter{
+		ContainerClusterIds: []string{manager.CnsConfig.Global.ClusterID},
+	}
+	ticker := time.NewTicker(time.Duration(intervalInSec) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		q.startRefresh()
+		queryResult, err := manager.VolumeManager.QueryVolume(queryFilter)
+		if err != nil {
+			// Partial results would uncharge the volumes missing from them
+			klog.Warningf("Failed to refresh storage policy quota usage from CNS. err=%v", err)
+			q.abortRefresh()
+			continue
+		}
+		q.finishRefresh(queryResult.Volumes)
+	}
+}
+
+// newPolicyQuotaFromConfig resolves the storage policies with a configured
+// quota and charges the CNS volumes of the cluster to them.
+func newPolicyQuotaFromConfig(ctx context.Context, manager *common.Manager) (*policyQuota, error) {
+	vc, err := common.GetVCenter(ctx, manager)
+	if err != nil {
+		return nil, err
+	}
+	if err = vc.ConnectPbm(ctx); err != nil {
+		return nil, err
+	}
+	limits := make(map[string]int64)
+	for policyName, quota := range manager.CnsConfig.StoragePolicyQuota {
+		policyID, err := vc.GetStoragePolicyIDByName(ctx, policyName)
+		if err != nil {
+			return nil, err
+		}
+		limits[policyID] = quota.CapacityInGB * common.GbInBytes
+		klog.V(2).Infof("Storage policy %q is limited to %d GB", policyName, quota.CapacityInGB)
+	}
+	q := newPolicyQuota(limits)
+	queryFilter := cnstypes.CnsQueryFilter{
+		ContainerClusterIds: []string{manager.CnsConfig.Global.ClusterID},
+	}
+	queryResult, err := manager.VolumeManager.QueryVolume(queryFilter)
+	if err == cnsvolume.ErrPartialQueryResult {
+		klog.Warningf("Storage policy quota usage is derived from partial CNS query results")
+	} else if err != nil {
+		return nil, err
+	}
+	q.load(queryResult.Volumes)
+	return q, nil
+}
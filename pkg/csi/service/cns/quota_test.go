@@ -0,0 +1,112 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"testing"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+)
+
+func TestPolicyQuota(t *testing.T) {
+	quota := newPolicyQuota(map[string]int64{"gold": 10 * common.MbInBytes})
+
+	// Existing volumes of the policy are charged on load
+	quota.load([]cnstypes.CnsVolume{
+		{
+			VolumeId:             cnstypes.CnsVolumeId{Id: "vol-1"},
+			StoragePolicyId:      "gold",
+			BackingObjectDetails: cnstypes.CnsBackingObjectDetails{CapacityInMb: 4},
+		},
+		{
+			VolumeId:             cnstypes.CnsVolumeId{Id: "vol-2"},
+			StoragePolicyId:      "silver",
+			BackingObjectDetails: cnstypes.CnsBackingObjectDetails{CapacityInMb: 100},
+		},
+	})
+	if err := quota.reserve("pvc-1", "gold", 7*common.MbInBytes); err != errQuotaExceeded {
+		t.Fatalf("expected pvc-1 to exceed the quota, got %v", err)
+	}
+
+	// In-flight volumes are charged until released
+	if err := quota.reserve("pvc-1", "gold", 6*common.MbInBytes); err != nil {
+		t.Fatalf("failed to reserve pvc-1: %v", err)
+	}
+	if err := quota.reserve("pvc-2", "gold", common.MbInBytes); err != errQuotaExceeded {
+		t.Fatalf("expected pvc-2 to exceed the quota, got %v", err)
+	}
+	quota.release("pvc-1")
+	if err := quota.reserve("pvc-2", "gold", common.MbInBytes); err != nil {
+		t.Fatalf("failed to reserve pvc-2: %v", err)
+	}
+
+	// Created volumes are charged until deleted, once
+	quota.commit("pvc-2", "vol-3")
+	if err := quota.reserve("pvc-2", "gold", common.MbInBytes); err != nil {
+		t.Fatalf("failed to reserve retried pvc-2: %v", err)
+	}
+	quota.commit("pvc-2", "vol-3")
+	if err := quota.reserve("pvc-3", "gold", 6*common.MbInBytes); err != errQuotaExceeded {
+		t.Fatalf("expected pvc-3 to exceed the quota, got %v", err)
+	}
+	quota.remove("vol-1")
+	if err := quota.reserve("pvc-3", "gold", 6*common.MbInBytes); err != nil {
+		t.Fatalf("failed to reserve pvc-3: %v", err)
+	}
+
+	// Volumes of policies without quota are not limited
+	if err := quota.reserve("pvc-4", "silver", 1000*common.MbInBytes); err != nil {
+		t.Fatalf("failed to reserve pvc-4: %v", err)
+	}
+}
+
+func TestPolicyQuotaRefresh(t *testing.T) {
+	quota := newPolicyQuota(map[string]int64{"gold": 10 * common.MbInBytes})
+	newVolume := func(volumeID string, capacityMB int64) cnstypes.CnsVolume {
+		return cnstypes.CnsVolume{
+			VolumeId:             cnstypes.CnsVolumeId{Id: volumeID},
+			StoragePolicyId:      "gold",
+			BackingObjectDetails: cnstypes.CnsBackingObjectDetails{CapacityInMb: capacityMB},
+		}
+	}
+	quota.load([]cnstypes.CnsVolume{newVolume("vol-deleted", 4), newVolume("vol-removed", 2)})
+	if err := quota.reserve("pvc-1", "gold", 3*common.MbInBytes); err != nil {
+		t.Fatalf("failed to reserve pvc-1: %v", err)
+	}
+
+	// Volumes committed or removed while CNS is queried keep their charge,
+	// other volumes missing from CNS are uncharged
+	quota.startRefresh()
+	quota.commit("pvc-1", "vol-1")
+	quota.remove("vol-removed")
+	quota.finishRefresh([]cnstypes.CnsVolume{newVolume("vol-removed", 2)})
+	if quota.usage["gold"] != 3*common.MbInBytes {
+		t.Fatalf("expected 3 MB charged after refresh, got %d bytes", quota.usage["gold"])
+	}
+
+	// Failed refreshes keep the charges
+	quota.startRefresh()
+	quota.abortRefresh()
+	if err := quota.reserve("pvc-2", "gold", 8*common.MbInBytes); err != errQuotaExceeded {
+		t.Fatalf("expected pvc-2 to exceed the quota, got %v", err)
+	}
+	if err := quota.reserve("pvc-2", "gold", 7*common.MbInBytes); err != nil {
+		t.Fatalf("failed to reserve pvc-2: %v", err)
+	}
+}
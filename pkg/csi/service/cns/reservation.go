@@ -0,0 +1,193 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+const (
+	// defaultReservationMaxAge is the time after which a reservation for a
+	// created volume is dropped even if the datastore free space never
+	// reflected it, e.g. for thin provisioned disks.
+	defaultReservationMaxAge = 10 * time.Minute
+)
+
+// reservation accounts for the capacity of a single volume on a datastore.
+type reservation struct {
+	// volumeName is the name of the volume the reservation is made for.
+	volumeName string
+	// sizeBytes is the capacity reserved for the volume.
+	sizeBytes int64
+	// inFlight is true while the CNS CreateVolume call is in progress.
+	inFlight bool
+	// freeSpace is the datastore free space observed when the reservation was made.
+	freeSpace int64
+	// createdAt is the time the volume was created.
+	createdAt time.Time
+}
+
+// reservationLedger tracks capacity reserved on datastores by in-flight and
+// recently created volumes, so that concurrent CreateVolume calls don't all
+// target the same datastore based on stale free space reads.
+// As CNS decides on the placement of a volume among the candidate datastores,
+// an in-flight reservation is charged to every candidate until the datastore
+// of the created volume is known.
+type reservationLedger struct {
+	lock sync.Mutex
+	// reservations maps datastore URLs to the reservations made on them.
+	reservations map[string][]*reservation
+	// maxAge is the time after which reservations for created volumes are dropped.
+	maxAge time.Duration
+}
+
+// newReservationLedger returns an empty reservationLedger.
+func newReservationLedger() *reservationLedger {
+	return &reservationLedger{
+		reservations: make(map[string][]*reservation),
+		maxAge:       defaultReservationMaxAge,
+	}
+}
+
+// filterDatastores returns the datastores which have enough free space for a
+// volume of sizeBytes once existing reservations are accounted for.
+// Reservations for created volumes whose allocation is reflected in the
+// observed datastore free space are decayed first.
+func (l *reservationLedger) filterDatastores(datastores []*cnsvsphere.DatastoreInfo, sizeBytes int64) []*cnsvsphere.DatastoreInfo {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var filtered []*cnsvsphere.DatastoreInfo
+	for _, datastore := range datastores {
+		url := datastore.Info.Url
+		l.decay(url, datastore.Info.FreeSpace)
+		reserved := l.reservedBytes(url)
+		if datastore.Info.FreeSpace-reserved < sizeBytes {
+			klog.V(3).Infof("Skipping datastore %q with free space %d bytes and %d bytes reserved for volume of %d bytes",
+				url, datastore.Info.FreeSpace, reserved, sizeBytes)
+			continue
+		}
+		filtered = append(filtered, datastore)
+	}
+	return filtered
+}
+
+// reserve charges sizeBytes for the given volume against each of the
+// candidate datastores. Existing reservations for the volume are replaced.
+func (l *reservationLedger) reserve(volumeName string, datastores []*cnsvsphere.DatastoreInfo, sizeBytes int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.remove(volumeName)
+	for _, datastore := range datastores {
+		url := datastore.Info.Url
+		l.reservations[url] = append(l.reservations[url], &reservation{
+			volumeName: volumeName,
+			sizeBytes:  sizeBytes,
+			inFlight:   true,
+			freeSpace:  datastore.Info.FreeSpace,
+		})
+	}
+	klog.V(4).Infof("Reserved %d bytes for volume %q on %d datastores", sizeBytes, volumeName, len(datastores))
+}
+
+// commit marks the reservation of the given volume as created on datastoreURL
+// and drops it from the other candidates. If datastoreURL is empty, the
+// reservation is kept on all candidates until it decays.
+func (l *reservationLedger) commit(volumeName string, datastoreURL string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	for url, reservations := range l.reservations {
+		var kept []*reservation
+		for _, r := range reservations {
+			if r.volumeName == volumeName {
+				if datastoreURL != "" && url != datastoreURL {
+					continue
+				}
+				r.inFlight = false
+				r.createdAt = now
+			}
+			kept = append(kept, r)
+		}
+		l.setReservations(url, kept)
+	}
+}
+
+// release drops all reservations for the given volume.
+func (l *reservationLedger) release(volumeName string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.remove(volumeName)
+}
+
+// remove drops all reservations for the given volume. Caller must hold the lock.
+func (l *reservationLedger) remove(volumeName string) {
+	for url, reservations := range l.reservations {
+		var kept []*reservation
+		for _, r := range reservations {
+			if r.volumeName != volumeName {
+				kept = append(kept, r)
+			}
+		}
+		l.setReservations(url, kept)
+	}
+}
+
+// decay drops reservations for created volumes on the given datastore once the
+// observed free space reflects their allocation or they exceed maxAge.
+// Caller must hold the lock.
+func (l *reservationLedger) decay(datastoreURL string, freeSpace int64) {
+	var kept []*reservation
+	for _, r := range l.reservations[datastoreURL] {
+		if !r.inFlight {
+			if r.freeSpace-freeSpace >= r.sizeBytes {
+				klog.V(4).Infof("Datastore %q free space reflects volume %q, dropping its reservation", datastoreURL, r.volumeName)
+				continue
+			}
+			if time.Since(r.createdAt) > l.maxAge {
+				klog.V(4).Infof("Reservation for volume %q on datastore %q expired", r.volumeName, datastoreURL)
+				continue
+			}
+		}
+		kept = append(kept, r)
+	}
+	l.setReservations(datastoreURL, kept)
+}
+
+// reservedBytes returns the capacity reserved on the given datastore.
+// Caller must hold the lock.
+func (l *reservationLedger) reservedBytes(datastoreURL string) int64 {
+	var reserved int64
+	for _, r := range l.reservations[datastoreURL] {
+		reserved += r.sizeBytes
+	}
+	return reserved
+}
+
+// setReservations stores the reservations of a datastore, removing its entry
+// when there are none left. Caller must hold the lock.
+func (l *reservationLedger) setReservations(datastoreURL string, reservations []*reservation) {
+	if len(reservations) == 0 {
+		delete(l.reservations, datastoreURL)
+		return
+	}
+	l.reservations[datastoreURL] = reservations
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/types"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+func newTestDatastore(url string, freeSpace int64) *cnsvsphere.DatastoreInfo {
+	return &cnsvsphere.DatastoreInfo{
+		Info: &types.DatastoreInfo{
+			Url:       url,
+			FreeSpace: freeSpace,
+		},
+	}
+}
+
+func TestReservationLedger(t *testing.T) {
+	ledger := newReservationLedger()
+	ds1 := newTestDatastore("ds:///vmfs/volumes/ds1/", 100)
+	ds2 := newTestDatastore("ds:///vmfs/volumes/ds2/", 60)
+	datastores := []*cnsvsphere.DatastoreInfo{ds1, ds2}
+
+	// In-flight reservations are charged to every candidate
+	ledger.reserve("pvc-1", datastores, 50)
+	filtered := ledger.filterDatastores(datastores, 40)
+	if len(filtered) != 1 || filtered[0] != ds1 {
+		t.Fatalf("expected only ds1 to have room for pvc-2, got %v", filtered)
+	}
+
+	// Once placed, the reservation only applies to the chosen datastore
+	ledger.commit("pvc-1", ds1.Info.Url)
+	filtered = ledger.filterDatastores(datastores, 40)
+	if len(filtered) != 2 {
+		t.Fatalf("expected both datastores to have room for pvc-2, got %v", filtered)
+	}
+	filtered = ledger.filterDatastores(datastores, 60)
+	if len(filtered) != 1 || filtered[0] != ds2 {
+		t.Fatalf("expected only ds2 to have room for pvc-2, got %v", filtered)
+	}
+
+	// Reservation decays once the free space reflects the allocation
+	ds1.Info.FreeSpace = 50
+	filtered = ledger.filterDatastores(datastores, 50)
+	if len(filtered) != 2 {
+		t.Fatalf("expected reservation for pvc-1 to decay, got %v", filtered)
+	}
+
+	// Reservations of created volumes expire after maxAge
+	ledger.reserve("pvc-2", []*cnsvsphere.DatastoreInfo{ds2}, 60)
+	ledger.commit("pvc-2", ds2.Info.Url)
+	if filtered = ledger.filterDatastores([]*cnsvsphere.DatastoreInfo{ds2}, 10); len(filtered) != 0 {
+		t.Fatalf("expected ds2 to be fully reserved, got %v", filtered)
+	}
+	ledger.maxAge = 0
+	time.Sleep(time.Millisecond)
+	if filtered = ledger.filterDatastores([]*cnsvsphere.DatastoreInfo{ds2}, 10); len(filtered) != 1 {
+		t.Fatalf("expected reservation for pvc-2 to expire, got %v", filtered)
+	}
+
+	// Released reservations are dropped
+	ledger.reserve("pvc-3", datastores, 100)
+	ledger.release("pvc-3")
+	if len(ledger.reservations) != 0 {
+		t.Fatalf("expected no reservations left, got %v", ledger.reservations)
+	}
+}
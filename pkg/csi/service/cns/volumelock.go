@@ -0,0 +1,95 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"context"
+	"sync"
+)
+
+// volumeOperationLocks serializes the attaches and deletes of each volume,
+// and tracks the volumes with a pending delete so that attaches racing with
+// the delete of their volume are refused instead of attaching a disk about
+// to be deleted.
+type volumeOperationLocks struct {
+	lock    sync.Mutex
+	volumes map[string]*volumeOperationLock
+}
+
+// volumeOperationLock is the operation lock of a volume, held by the
+// operation holding a token of held.
+type volumeOperationLock struct {
+	held chan struct{}
+	// refs is the number of operations holding or waiting for the lock
+	refs int
+	// deletes is the number of deletes holding or waiting for the lock
+	deletes int
+}
+
+// newVolumeOperationLocks returns volumeOperationLocks with no volume locked.
+func newVolumeOperationLocks() *volumeOperationLocks {
+	return &volumeOperationLocks{
+		volumes: make(map[string]*volumeOperationLock),
+	}
+}
+
+// acquire waits for the operation lock of the volume until the context is
+// done, and returns the function releasing it. deleting is true if the
+// operation deletes the volume. It also returns true if a delete of the
+// volume other than the operation is holding or waiting for the lock.
+func (l *volumeOperationLocks) acquire(ctx context.Context, volumeID string, deleting bool) (func(), bool, error) {
+	l.lock.Lock()
+	volume, ok := l.volumes[volumeID]
+	if !ok {
+		volume = &volumeOperationLock{held: make(chan struct{}, 1)}
+		l.volumes[volumeID] = volume
+	}
+	volume.refs++
+	if deleting {
+		volume.deletes++
+	}
+	l.lock.Unlock()
+
+	done := func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		volume.refs--
+		if deleting {
+			volume.deletes--
+		}
+		if volume.refs == 0 {
+			delete(l.volumes, volumeID)
+		}
+	}
+	select {
+	case volume.held <- struct{}{}:
+	case <-ctx.Done():
+		done()
+		return nil, false, ctx.Err()
+	}
+	l.lock.Lock()
+	pendingDelete := volume.deletes > 0
+	if deleting {
+		pendingDelete = volume.deletes > 1
+	}
+	l.lock.Unlock()
+	release := func() {
+		<-volume.held
+		done()
+	}
+	return release, pendingDelete, nil
+}
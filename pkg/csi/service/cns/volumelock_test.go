@@ -0,0 +1,84 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestVolumeOperationLocks(t *testing.T) {
+	locks := newVolumeOperationLocks()
+	ctx := context.Background()
+	releaseDelete, pendingDelete, err := locks.acquire(ctx, "vol-1", true)
+	if err != nil || pendingDelete {
+		t.Fatalf("expected the delete to acquire the lock without other pending delete, got %v, %v", pendingDelete, err)
+	}
+	// Operations on other volumes are not serialized with the delete
+	releaseOther, pendingDelete, err := locks.acquire(ctx, "vol-2", false)
+	if err != nil || pendingDelete {
+		t.Fatalf("expected the attach of another volume to acquire its lock, got %v, %v", pendingDelete, err)
+	}
+	releaseOther()
+
+	// Attaches wait for the delete and see it pending
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := locks.acquire(timeoutCtx, "vol-1", false); err == nil {
+		t.Fatalf("expected the attach to wait for the delete")
+	}
+	acquired := make(chan bool)
+	go func() {
+		release, pendingDelete, err := locks.acquire(ctx, "vol-1", false)
+		if err == nil {
+			release()
+		}
+		acquired <- pendingDelete
+	}()
+	time.Sleep(10 * time.Millisecond)
+	releaseDelete()
+	if pendingDelete := <-acquired; pendingDelete {
+		t.Fatalf("expected no pending delete once the delete released the lock")
+	}
+
+	// Deletes wait for the attach holding the lock, and locks are removed once
+	// no operation holds or waits for them
+	releaseAttach, _, _ := locks.acquire(ctx, "vol-1", false)
+	deleted := make(chan struct{})
+	go func() {
+		release, _, err := locks.acquire(ctx, "vol-1", true)
+		if err == nil {
+			release()
+		}
+		close(deleted)
+	}()
+	for {
+		locks.lock.Lock()
+		deletes := locks.volumes["vol-1"].deletes
+		locks.lock.Unlock()
+		if deletes > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	releaseAttach()
+	<-deleted
+	if len(locks.volumes) != 0 {
+		t.Fatalf("expected unused locks to be removed, got %v", locks.volumes)
+	}
+}
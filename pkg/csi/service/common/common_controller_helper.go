@@ -43,8 +43,8 @@ func ValidateCreateVolumeRequest(req *csi.CreateVolumeRequest) error {
 	if len(volCaps) == 0 {
 		return status.Error(codes.InvalidArgument, "Volume capabilities not provided")
 	}
-	if !IsValidVolumeCapabilities(volCaps) {
-		return status.Error(codes.InvalidArgument, "Volume capabilities not supported")
+	if err := ValidateVolumeCapabilities(volCaps); err != nil {
+		return status.Errorf(codes.InvalidArgument, "Volume capabilities not supported: %v", err)
 	}
 	return nil
 }
@@ -81,8 +81,8 @@ func ValidateControllerPublishVolumeRequest(req *csi.ControllerPublishVolumeRequ
 		return status.Error(codes.InvalidArgument, "Volume capability not provided")
 	}
 	caps := []*csi.VolumeCapability{volCap}
-	if !IsValidVolumeCapabilities(caps) {
-		return status.Error(codes.InvalidArgument, "Volume capability not supported")
+	if err := ValidateVolumeCapabilities(caps); err != nil {
+		return status.Errorf(codes.InvalidArgument, "Volume capability not supported: %v", err)
 	}
 	return nil
 }
@@ -36,6 +36,11 @@ const (
 	// For Example: DatastoreURL: "ds:///vmfs/volumes/5c9bb20e-009c1e46-4b85-0200483b2a97/"
 	AttributeDatastoreURL = "datastoreurl"
 
+	// AttributeDatastoreType represents the file system type of the datastore
+	// hosting the volume in the volume context
+	// For Example: DatastoreType: "vsan"
+	AttributeDatastoreType = "datastoretype"
+
 	// AttributeStoragePolicyName represents name of the Storage Policy in the Storage Class
 	// For Example: StoragePolicy: "vSAN Default Storage Policy"
 	AttributeStoragePolicyName = "storagepolicyname"
@@ -44,10 +49,128 @@ const (
 	// For Example: StoragePolicyId: "251bce41-cb24-41df-b46b-7c75aed3c4ee"
 	AttributeStoragePolicyID = "storagepolicyid"
 
+	// AttributeStoragePolicyTag represents a tag of a tag based placement rule
+	// selecting the Storage Policy in the Storage Class
+	AttributeStoragePolicyTag = "storagepolicytag"
+
 	// AttributeFsType represents filesystem type in the Storage Classs
 	// For Example: FsType: "ext4"
 	AttributeFsType = "fstype"
 
+	// AttributeHostGroup represents name of the DRS host group in the Storage Class
+	// whose hosts volume placement and pod scheduling are confined to
+	// For Example: HostGroup: "licensed-hosts"
+	AttributeHostGroup = "hostgroup"
+
+	// AttributeVsanFaultDomain represents name of the vSAN fault domain in the
+	// Storage Class whose hosts volume placement and pod scheduling are confined
+	// to, along with a storage policy keeping the data in the fault domain
+	// For Example: VsanFaultDomain: "preferred"
+	AttributeVsanFaultDomain = "vsanfaultdomain"
+
+	// AttributeResourcePool represents the name or inventory path of the resource
+	// pool in the Storage Class whose datastores volume placement is confined to
+	// For Example: ResourcePool: "tenant-a"
+	AttributeResourcePool = "resourcepool"
+
+	// AttributeAllowDeleteAttached represents whether volumes of the Storage Class
+	// may be deleted while attached, when attached volumes are protected
+	// For Example: AllowDeleteAttached: "true"
+	AttributeAllowDeleteAttached = "allowdeleteattached"
+
+	// AttributeMkfsOptions represents options passed to mkfs when the volume is
+	// formatted for the first time
+	// For Example: MkfsOptions: "-O bigalloc -C 65536"
+	AttributeMkfsOptions = "mkfsoptions"
+
+	// AttributeSCSIController represents the bus number of the SCSI controller
+	// of the node VM the volume is preferably attached to. It is also set in
+	// the publish context to the bus number of the controller used
+	// For Example: SCSIController: "1"
+	AttributeSCSIController = "scsicontroller"
+
+	// MaxSCSIControllers is the maximum number of SCSI controllers of a VM
+	MaxSCSIControllers = 4
+
+	// AttributeAdapterType represents the type of the SCSI controller of the
+	// node VM the volume is attached to. Volumes without adapter type are
+	// attached by CNS to a pvscsi controller
+	// For Example: AdapterType: "lsilogic"
+	AttributeAdapterType = "adaptertype"
+
+	// AdapterTypeLsiLogic, AdapterTypeBusLogic and AdapterTypePVSCSI are the
+	// supported adapter types
+	AdapterTypeLsiLogic = "lsilogic"
+	AdapterTypeBusLogic = "buslogic"
+	AdapterTypePVSCSI   = "pvscsi"
+
+	// DefaultAdapterType is the adapter type of volumes without adapter type
+	DefaultAdapterType = AdapterTypePVSCSI
+
+	// AttributeMountUID and AttributeMountGID represent the owner the root of
+	// the filesystem is changed to after the volume is staged
+	// For Example: MountUID: "1000"
+	AttributeMountUID = "mountuid"
+	AttributeMountGID = "mountgid"
+
+	// MaxMountOwnerID is the largest UID or GID accepted as mount owner
+	MaxMountOwnerID = 2147483647
+
+	// AttributeVolumeTTL represents the time after its creation a volume whose
+	// PVC is gone is deleted by the syncer, for volumes of ephemeral clusters
+	// For Example: VolumeTTL: "72h"
+	AttributeVolumeTTL = "volumettl"
+
+	// AttributeKeyRotationInterval represents the interval at which the
+	// encryption key of the volume must be rotated, tracked by the syncer
+	// For Example: KeyRotationInterval: "2160h"
+	AttributeKeyRotationInterval = "keyrotationinterval"
+
+	// AttributeDatastoreTypePreference represents the file system types of
+	// the datastores volumes are preferably placed on, in order of preference
+	// For Example: DatastoreTypePreference: "vsan,vmfs,nfs"
+	AttributeDatastoreTypePreference = "datastoretypepreference"
+
+	// AttributeDatastoreFilter represents the comma separated property=value
+	// or property!=value comparisons the datastores volumes are placed on
+	// must all satisfy. Values may contain shell patterns
+	// For Example: DatastoreFilter: "type=vmfs,name=ssd-*"
+	AttributeDatastoreFilter = "datastorefilter"
+
+	// AttributeMinIOPS represents the minimum IOPS the datastores volumes are
+	// placed on must advertise with their IOPS custom attribute
+	// For Example: MinIops: "5000"
+	AttributeMinIOPS = "miniops"
+
+	// AttributeCachePolicy represents the cache policy of the volume, applied
+	// with the storage policy configured for it
+	// For Example: CachePolicy: "writeback"
+	AttributeCachePolicy = "cachepolicy"
+
+	// AttributeDatastoreAntiAffinity represents the volumes the datastore of
+	// the volume must differ from when possible. "node" places the volume on a
+	// datastore holding none of the volumes attached to the node selected for
+	// its pod
+	// For Example: DatastoreAntiAffinity: "node"
+	AttributeDatastoreAntiAffinity = "datastoreantiaffinity"
+
+	// DatastoreAntiAffinityNode is the datastore anti-affinity to the volumes
+	// of the node selected for the pod
+	DatastoreAntiAffinityNode = "node"
+
+	// AttributeCnsLabelPrefix is the prefix of the Storage Class parameters
+	// whose value is recorded under the rest of their name as a label of the
+	// volume in CNS, for every volume of the Storage Class
+	// For Example: cns-label-environment: "prod"
+	AttributeCnsLabelPrefix = "cns-label-"
+
+	// CachePolicyWriteBack is the cache policy acknowledging writes once cached
+	CachePolicyWriteBack = "writeback"
+
+	// CachePolicyWriteThrough is the cache policy acknowledging writes once
+	// persisted
+	CachePolicyWriteThrough = "writethrough"
+
 	// DefaultFsType represents the default filesystem type which will be used to format the volume
 	// during mount if user does not specify the filesystem type in the Storage Class
 	DefaultFsType = "ext4"
@@ -59,6 +182,34 @@ const (
 	// AttributeFirstClassDiskUUID is the SCSI Disk Identifier
 	AttributeFirstClassDiskUUID = "diskUUID"
 
+	// AttributeAttachDeferred is set to "true" in the publish context of
+	// volumes whose attach was issued but not awaited by
+	// ControllerPublishVolume, for NodeStageVolume to wait for their device
+	AttributeAttachDeferred = "attachDeferred"
+
+	// AttributeAttachedOutsideCNS is set to "true" in the publish context of
+	// volumes attached by reconfiguring the node VM instead of through CNS,
+	// which must be detached the same way
+	AttributeAttachedOutsideCNS = "attachedOutsideCNS"
+
+	// AttributePodName and AttributePodNamespace identify the pod a volume is
+	// published to. They are set in the volume context by kubelet when the
+	// CSIDriver object has podInfoOnMount enabled
+	AttributePodName      = "csi.storage.k8s.io/pod.name"
+	AttributePodNamespace = "csi.storage.k8s.io/pod.namespace"
+
+	// AttributePVCName, AttributePVCNamespace and AttributePVName identify
+	// the PVC and PV a volume is created for. They are set in the CreateVolume
+	// parameters by the provisioner when it passes extra create metadata
+	AttributePVCName      = "csi.storage.k8s.io/pvc/name"
+	AttributePVCNamespace = "csi.storage.k8s.io/pvc/namespace"
+	AttributePVName       = "csi.storage.k8s.io/pv/name"
+
+	// AnnMaxVolumesPerNode is the annotation on a Kubernetes node overriding the
+	// maximum number of volumes that can be published to that node
+	// For Example: csi.vsphere.vmware.com/max-volumes: "30"
+	AnnMaxVolumesPerNode = "csi.vsphere.vmware.com/max-volumes"
+
 	// BlockVolumeType is the VolumeType for CNS Volume
 	BlockVolumeType = "BLOCK"
 
@@ -33,6 +33,16 @@ var (
 			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
 		},
 	}
+
+	// MultiWriterBlockVolumeCaps represents how block volumes could also be
+	// accessed. Block volumes can be attached read-write to multiple nodes
+	// with multi-writer sharing of their disk, for clustered applications
+	// handling concurrent writes themselves.
+	MultiWriterBlockVolumeCaps = []csi.VolumeCapability_AccessMode{
+		{
+			Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+		},
+	}
 )
 
 // Manager type comprises VirtualCenterConfig, CnsConfig, VolumeManager and VirtualCenterManager
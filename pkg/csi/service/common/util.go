@@ -18,13 +18,21 @@ package common
 
 import (
 	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/vmware/govmomi/vim25/types"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/klog"
 
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
 )
 
 // GetVCenter returns VirtualCenter object from specified Manager object.
@@ -78,19 +86,324 @@ func GetLabelsMapFromKeyValue(labels []types.KeyValue) map[string]string {
 
 // IsValidVolumeCapabilities is the helper function to validate capabilities of volume.
 func IsValidVolumeCapabilities(volCaps []*csi.VolumeCapability) bool {
-	hasSupport := func(cap *csi.VolumeCapability) bool {
-		for _, c := range VolumeCaps {
-			if c.GetMode() == cap.AccessMode.GetMode() {
-				return true
+	return ValidateVolumeCapabilities(volCaps) == nil
+}
+
+// ValidateVolumeCapabilities returns an error describing the first volume
+// capability whose access mode and access type combination is not supported.
+func ValidateVolumeCapabilities(volCaps []*csi.VolumeCapability) error {
+	for _, volCap := range volCaps {
+		if volCap.GetAccessMode() == nil {
+			return fmt.Errorf("access mode not provided")
+		}
+		accessType := "mount"
+		if volCap.GetBlock() != nil {
+			accessType = "block"
+		}
+		mode := volCap.GetAccessMode().GetMode()
+		supported := false
+		accessModes := VolumeCaps
+		if volCap.GetBlock() != nil {
+			accessModes = append(append([]csi.VolumeCapability_AccessMode{}, VolumeCaps...), MultiWriterBlockVolumeCaps...)
+		}
+		for _, c := range accessModes {
+			if c.GetMode() == mode {
+				supported = true
+				break
 			}
 		}
-		return false
+		if !supported {
+			return fmt.Errorf("access mode %s is not supported for %s volumes, CNS volumes can only be attached to multiple nodes as multi-writer block volumes", mode, accessType)
+		}
+	}
+	return nil
+}
+
+// IsAttachmentOutsideCNS returns true if the attachment metadata of a
+// VolumeAttachment records that its volume was attached outside CNS.
+func IsAttachmentOutsideCNS(attachmentMetadata map[string]string) bool {
+	return attachmentMetadata[AttributeAttachedOutsideCNS] == "true"
+}
+
+// IsMultiWriterBlockVolume returns true if one of the volume capabilities
+// requests a block volume attached read-write to multiple nodes.
+func IsMultiWriterBlockVolume(volCaps []*csi.VolumeCapability) bool {
+	for _, volCap := range volCaps {
+		if volCap.GetBlock() != nil && volCap.GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// mkfsOptionNumber matches a plain number, such as a block or cluster size
+	mkfsOptionNumber = regexp.MustCompile(`^[0-9]+$`)
+	// mkfsOptionList matches a comma separated list of features or extended
+	// options, optionally negated with "^" or assigned a value with "="
+	mkfsOptionList = regexp.MustCompile(`^\^?[a-z0-9_]+(=[a-z0-9_]+)?(,\^?[a-z0-9_]+(=[a-z0-9_]+)?)*$`)
+	// mkfsOptionAllowlist maps the mkfs flags which may be set through the
+	// StorageClass to the pattern their value must match, nil for flags
+	// without value
+	mkfsOptionAllowlist = map[string]*regexp.Regexp{
+		"-O": mkfsOptionList,   // ext features, e.g. "^has_journal,bigalloc"
+		"-E": mkfsOptionList,   // ext extended options, e.g. "lazy_itable_init=0"
+		"-b": mkfsOptionNumber, // ext block size
+		"-C": mkfsOptionNumber, // ext cluster size with bigalloc
+		"-i": mkfsOptionNumber, // ext bytes per inode
+		"-I": mkfsOptionNumber, // ext inode size
+		"-m": mkfsOptionNumber, // ext reserved blocks percentage
+		"-N": mkfsOptionNumber, // ext number of inodes
+		"-j": nil,              // ext journal
+	}
+)
+
+// ParseMkfsOptions splits the mkfs options set in the StorageClass into
+// arguments for the mkfs command of the given filesystem type. Only the flags
+// in mkfsOptionAllowlist with a well-formed value are accepted, so that no
+// other device, file or command can be passed to mkfs. As the allowlist holds
+// ext flags, options are rejected for other filesystem types.
+func ParseMkfsOptions(options string, fsType string) ([]string, error) {
+	var args []string
+	fields := strings.Fields(options)
+	if fsType == "" {
+		fsType = DefaultFsType
+	}
+	if fsType = strings.ToLower(fsType); len(fields) > 0 && fsType != "ext2" && fsType != "ext3" && fsType != "ext4" {
+		return nil, fmt.Errorf("mkfs options are only supported for ext filesystems, not %q", fsType)
+	}
+	for i := 0; i < len(fields); i++ {
+		flag := fields[i]
+		valuePattern, ok := mkfsOptionAllowlist[flag]
+		if !ok {
+			return nil, fmt.Errorf("mkfs option %q is not allowed", flag)
+		}
+		args = append(args, flag)
+		if valuePattern == nil {
+			continue
+		}
+		i++
+		if i == len(fields) || !valuePattern.MatchString(fields[i]) {
+			return nil, fmt.Errorf("mkfs option %q requires a valid value", flag)
+		}
+		args = append(args, fields[i])
+	}
+	return args, nil
+}
+
+// ParseSCSIController parses the bus number of the SCSI controller set in the
+// StorageClass.
+func ParseSCSIController(value string) (int32, error) {
+	busNumber, err := strconv.Atoi(value)
+	if err != nil || busNumber < 0 || busNumber >= MaxSCSIControllers {
+		return 0, fmt.Errorf("SCSI controller %q is not a bus number between 0 and %d", value, MaxSCSIControllers-1)
+	}
+	return int32(busNumber), nil
+}
+
+// ParseDefaultVolumeSize parses the default volume size of the config and
+// returns it in bytes. DefaultGbDiskSize is returned if it is not set.
+func ParseDefaultVolumeSize(value string) (int64, error) {
+	if value == "" {
+		return DefaultGbDiskSize * GbInBytes, nil
+	}
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil || quantity.Sign() <= 0 {
+		return 0, fmt.Errorf("default volume size %q is not a positive quantity such as 10Gi", value)
+	}
+	return quantity.Value(), nil
+}
+
+// ParseAdapterType parses the adapter type set in the StorageClass. The
+// default adapter type is returned if it is not set.
+func ParseAdapterType(value string) (string, error) {
+	adapterType := strings.ToLower(strings.TrimSpace(value))
+	switch adapterType {
+	case "":
+		return DefaultAdapterType, nil
+	case AdapterTypeLsiLogic, AdapterTypeBusLogic, AdapterTypePVSCSI:
+		return adapterType, nil
+	}
+	return "", fmt.Errorf("adapter type %q is not one of %s, %s or %s", value,
+		AdapterTypeLsiLogic, AdapterTypeBusLogic, AdapterTypePVSCSI)
+}
+
+// GetTopologyKeys returns the topology keys of the zone and region configured
+// in the Labels section, or the failure domain labels if none are configured.
+func GetTopologyKeys(cfg *config.Config) (string, string) {
+	zoneKey, regionKey := csitypes.LabelZoneFailureDomain, csitypes.LabelRegionFailureDomain
+	if cfg.Labels.ZoneKey != "" {
+		zoneKey = cfg.Labels.ZoneKey
+	}
+	if cfg.Labels.RegionKey != "" {
+		regionKey = cfg.Labels.RegionKey
+	}
+	return zoneKey, regionKey
+}
+
+// ParseMountOwnerID parses the UID or GID of the mount owner set in the
+// StorageClass.
+func ParseMountOwnerID(value string) (int, error) {
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id < 0 || id > MaxMountOwnerID {
+		return 0, fmt.Errorf("mount owner ID %q is not a number between 0 and %d", value, MaxMountOwnerID)
+	}
+	return int(id), nil
+}
+
+// ParseVolumeTTL parses the volume TTL set in the StorageClass.
+func ParseVolumeTTL(value string) (time.Duration, error) {
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("volume TTL %q is not a positive duration", value)
+	}
+	return ttl, nil
+}
+
+// ParseKeyRotationInterval parses the key rotation interval set in the
+// StorageClass.
+func ParseKeyRotationInterval(value string) (time.Duration, error) {
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("key rotation interval %q is not a positive duration", value)
+	}
+	return interval, nil
+}
+
+// ParseMinIOPS parses the minimum IOPS set in the StorageClass.
+func ParseMinIOPS(value string) (int64, error) {
+	iops, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || iops <= 0 {
+		return 0, fmt.Errorf("minimum IOPS %q is not a positive number", value)
+	}
+	return iops, nil
+}
+
+// ParseDatastoreAntiAffinity parses the datastore anti-affinity set in the
+// StorageClass, returning it lower cased.
+func ParseDatastoreAntiAffinity(value string) (string, error) {
+	antiAffinity := strings.ToLower(strings.TrimSpace(value))
+	if antiAffinity != DatastoreAntiAffinityNode {
+		return "", fmt.Errorf("datastore anti-affinity %q is not %s", value, DatastoreAntiAffinityNode)
+	}
+	return antiAffinity, nil
+}
+
+// ParseCnsLabels returns the CNS labels set in the StorageClass parameters
+// with the AttributeCnsLabelPrefix prefix, keyed by the parameter name without
+// the prefix. The prefix is case insensitive.
+func ParseCnsLabels(params map[string]string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for paramName, value := range params {
+		if !strings.HasPrefix(strings.ToLower(paramName), AttributeCnsLabelPrefix) {
+			continue
+		}
+		key := paramName[len(AttributeCnsLabelPrefix):]
+		if key == "" {
+			return nil, fmt.Errorf("CNS label parameter %q has no label name", paramName)
+		}
+		labels[key] = value
 	}
-	foundAll := true
-	for _, c := range volCaps {
-		if !hasSupport(c) {
-			foundAll = false
+	return labels, nil
+}
+
+// ParseCachePolicy parses the cache policy set in the StorageClass, returning
+// it lower cased.
+func ParseCachePolicy(value string) (string, error) {
+	cachePolicy := strings.ToLower(strings.TrimSpace(value))
+	if cachePolicy != CachePolicyWriteBack && cachePolicy != CachePolicyWriteThrough {
+		return "", fmt.Errorf("cache policy %q is not one of %s, %s", value, CachePolicyWriteBack, CachePolicyWriteThrough)
+	}
+	return cachePolicy, nil
+}
+
+// datastoreTypes are the datastore file system types accepted in the datastore
+// type preference, lower cased.
+var datastoreTypes = map[string]bool{
+	"vsan":  true,
+	"vmfs":  true,
+	"nfs":   true,
+	"nfs41": true,
+	"vvol":  true,
+	"pmem":  true,
+}
+
+// ParseDatastoreTypePreference parses the comma separated datastore types set
+// in the StorageClass, returning them lower cased in order of preference.
+func ParseDatastoreTypePreference(value string) ([]string, error) {
+	var preference []string
+	seen := make(map[string]bool)
+	for _, datastoreType := range strings.Split(value, ",") {
+		datastoreType = strings.ToLower(strings.TrimSpace(datastoreType))
+		if !datastoreTypes[datastoreType] {
+			return nil, fmt.Errorf("datastore type %q is not one of vsan, vmfs, nfs, nfs41, vvol or pmem", datastoreType)
+		}
+		if seen[datastoreType] {
+			return nil, fmt.Errorf("datastore type %q is listed more than once", datastoreType)
+		}
+		seen[datastoreType] = true
+		preference = append(preference, datastoreType)
+	}
+	return preference, nil
+}
+
+// datastoreFilterProperties maps the datastore properties a datastore filter
+// may compare to their value.
+var datastoreFilterProperties = map[string]func(datastore *cnsvsphere.DatastoreInfo) string{
+	"name": func(datastore *cnsvsphere.DatastoreInfo) string { return datastore.Info.Name },
+	"url":  func(datastore *cnsvsphere.DatastoreInfo) string { return datastore.Info.Url },
+	"type": func(datastore *cnsvsphere.DatastoreInfo) string { return strings.ToLower(datastore.Type) },
+}
+
+// DatastoreFilter is a conjunction of comparisons of datastore properties.
+type DatastoreFilter []datastoreFilterTerm
+
+// datastoreFilterTerm compares a datastore property to a shell pattern.
+type datastoreFilterTerm struct {
+	property string
+	pattern  string
+	negate   bool
+}
+
+// ParseDatastoreFilter parses the datastore filter set in the StorageClass.
+// Property names are case insensitive, as are the values of the type
+// property.
+func ParseDatastoreFilter(value string) (DatastoreFilter, error) {
+	var filter DatastoreFilter
+	for _, expr := range strings.Split(value, ",") {
+		var term datastoreFilterTerm
+		parts := strings.SplitN(expr, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("datastore filter term %q is not of the form property=value or property!=value", strings.TrimSpace(expr))
+		}
+		if strings.HasSuffix(parts[0], "!") {
+			term.negate = true
+			parts[0] = strings.TrimSuffix(parts[0], "!")
+		}
+		term.property = strings.ToLower(strings.TrimSpace(parts[0]))
+		term.pattern = strings.TrimSpace(parts[1])
+		if _, ok := datastoreFilterProperties[term.property]; !ok {
+			return nil, fmt.Errorf("datastore property %q is not one of name, url or type", term.property)
+		}
+		if term.property == "type" {
+			term.pattern = strings.ToLower(term.pattern)
+		}
+		if _, err := path.Match(term.pattern, ""); err != nil {
+			return nil, fmt.Errorf("datastore filter value %q is not a valid pattern", term.pattern)
+		}
+		filter = append(filter, term)
+	}
+	return filter, nil
+}
+
+// Matches returns whether the datastore satisfies all comparisons of the
+// filter.
+func (f DatastoreFilter) Matches(datastore *cnsvsphere.DatastoreInfo) bool {
+	for _, term := range f {
+		matched, _ := path.Match(term.pattern, datastoreFilterProperties[term.property](datastore))
+		if matched == term.negate {
+			return false
 		}
 	}
-	return foundAll
+	return true
 }
@@ -0,0 +1,330 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/vmware/govmomi/vim25/types"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+func TestParseMkfsOptions(t *testing.T) {
+	tests := []struct {
+		options   string
+		fsType    string
+		expected  []string
+		expectErr bool
+	}{
+		{
+			options:  "",
+			expected: nil,
+		},
+		{
+			options:  "",
+			fsType:   "xfs",
+			expected: nil,
+		},
+		{
+			options:  "-b 4096",
+			fsType:   "ext3",
+			expected: []string{"-b", "4096"},
+		},
+		{
+			options:   "-b 4096",
+			fsType:    "xfs",
+			expectErr: true,
+		},
+		{
+			options:  "-O bigalloc -C 65536",
+			expected: []string{"-O", "bigalloc", "-C", "65536"},
+		},
+		{
+			options:  "-O ^has_journal,metadata_csum -E lazy_itable_init=0 -j",
+			expected: []string{"-O", "^has_journal,metadata_csum", "-E", "lazy_itable_init=0", "-j"},
+		},
+		{
+			options:   "-O",
+			expectErr: true,
+		},
+		{
+			options:   "-b 4k",
+			expectErr: true,
+		},
+		{
+			options:   "-O bigalloc /dev/sdb",
+			expectErr: true,
+		},
+		{
+			options:   "-E root_owner=0;reboot",
+			expectErr: true,
+		},
+		{
+			options:   "-d /etc",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		args, err := ParseMkfsOptions(tt.options, tt.fsType)
+		if tt.expectErr {
+			if err == nil {
+				t.Errorf("Expected error for mkfs options %q", tt.options)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for mkfs options %q: %v", tt.options, err)
+		}
+		if !reflect.DeepEqual(args, tt.expected) {
+			t.Errorf("Expected args %v got: %v", tt.expected, args)
+		}
+	}
+}
+
+func TestParseSCSIController(t *testing.T) {
+	tests := []struct {
+		value     string
+		expected  int32
+		expectErr bool
+	}{
+		{value: "0", expected: 0},
+		{value: "3", expected: 3},
+		{value: "4", expectErr: true},
+		{value: "-1", expectErr: true},
+		{value: "first", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		busNumber, err := ParseSCSIController(tt.value)
+		if tt.expectErr {
+			if err == nil {
+				t.Errorf("Expected error for SCSI controller %q", tt.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for SCSI controller %q: %v", tt.value, err)
+		}
+		if busNumber != tt.expected {
+			t.Errorf("Expected bus number %d got: %d", tt.expected, busNumber)
+		}
+	}
+}
+
+func TestParseDefaultVolumeSize(t *testing.T) {
+	tests := []struct {
+		value     string
+		expected  int64
+		expectErr bool
+	}{
+		{value: "", expected: DefaultGbDiskSize * GbInBytes},
+		{value: "1Gi", expected: GbInBytes},
+		{value: "512Mi", expected: 512 * MbInBytes},
+		{value: "0", expectErr: true},
+		{value: "ten", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		sizeBytes, err := ParseDefaultVolumeSize(tt.value)
+		if tt.expectErr {
+			if err == nil {
+				t.Errorf("Expected error for default volume size %q", tt.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for default volume size %q: %v", tt.value, err)
+		}
+		if sizeBytes != tt.expected {
+			t.Errorf("Expected size %d got: %d", tt.expected, sizeBytes)
+		}
+	}
+}
+
+func TestParseAdapterType(t *testing.T) {
+	tests := []struct {
+		value     string
+		expected  string
+		expectErr bool
+	}{
+		{value: "", expected: AdapterTypePVSCSI},
+		{value: "LsiLogic", expected: AdapterTypeLsiLogic},
+		{value: "buslogic", expected: AdapterTypeBusLogic},
+		{value: "pvscsi", expected: AdapterTypePVSCSI},
+		{value: "ide", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		adapterType, err := ParseAdapterType(tt.value)
+		if tt.expectErr {
+			if err == nil {
+				t.Errorf("Expected error for adapter type %q", tt.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for adapter type %q: %v", tt.value, err)
+		}
+		if adapterType != tt.expected {
+			t.Errorf("Expected adapter type %s got: %s", tt.expected, adapterType)
+		}
+	}
+}
+
+func TestParseMountOwnerID(t *testing.T) {
+	tests := []struct {
+		value     string
+		expected  int
+		expectErr bool
+	}{
+		{value: "0", expected: 0},
+		{value: "1000", expected: 1000},
+		{value: "2147483647", expected: 2147483647},
+		{value: "2147483648", expectErr: true},
+		{value: "-1", expectErr: true},
+		{value: "nobody", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		id, err := ParseMountOwnerID(tt.value)
+		if tt.expectErr {
+			if err == nil {
+				t.Errorf("Expected error for mount owner ID %q", tt.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for mount owner ID %q: %v", tt.value, err)
+		}
+		if id != tt.expected {
+			t.Errorf("Expected mount owner ID %d got: %d", tt.expected, id)
+		}
+	}
+}
+
+func TestParseDatastoreTypePreference(t *testing.T) {
+	preference, err := ParseDatastoreTypePreference(" vSAN, VMFS ,nfs41")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(preference, []string{"vsan", "vmfs", "nfs41"}) {
+		t.Errorf("Unexpected datastore type preference %v", preference)
+	}
+	for _, value := range []string{"", "vsan,", "vsan,ceph", "vmfs,VMFS"} {
+		if _, err := ParseDatastoreTypePreference(value); err == nil {
+			t.Errorf("Expected error for datastore type preference %q", value)
+		}
+	}
+}
+
+func TestParseCnsLabels(t *testing.T) {
+	labels, err := ParseCnsLabels(map[string]string{
+		"cns-label-environment": "prod",
+		"CNS-Label-Team":        "storage",
+		"fstype":                "ext4",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(labels, map[string]string{"environment": "prod", "Team": "storage"}) {
+		t.Errorf("Unexpected CNS labels %v", labels)
+	}
+	if _, err := ParseCnsLabels(map[string]string{"cns-label-": "prod"}); err == nil {
+		t.Errorf("Expected error for CNS label without name")
+	}
+}
+
+func TestDatastoreFilter(t *testing.T) {
+	ssd := &cnsvsphere.DatastoreInfo{Info: &types.DatastoreInfo{Name: "ssd-01", Url: "ds:///vmfs/volumes/ssd-01/"}, Type: "VMFS"}
+	hdd := &cnsvsphere.DatastoreInfo{Info: &types.DatastoreInfo{Name: "hdd-01", Url: "ds:///vmfs/volumes/hdd-01/"}, Type: "VMFS"}
+	nfs := &cnsvsphere.DatastoreInfo{Info: &types.DatastoreInfo{Name: "ssd-nfs", Url: "ds:///vmfs/volumes/ssd-nfs/"}, Type: "NFS"}
+
+	filter, err := ParseDatastoreFilter("Type=vmfs, name=ssd-*")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !filter.Matches(ssd) || filter.Matches(hdd) || filter.Matches(nfs) {
+		t.Errorf("Expected only the ssd vmfs datastore to match")
+	}
+	filter, err = ParseDatastoreFilter("type!=nfs")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !filter.Matches(ssd) || !filter.Matches(hdd) || filter.Matches(nfs) {
+		t.Errorf("Expected all but the nfs datastore to match")
+	}
+	for _, value := range []string{"", "type", "ssd=true", "name=[", "type=vmfs,cluster=a"} {
+		if _, err := ParseDatastoreFilter(value); err == nil {
+			t.Errorf("Expected error for datastore filter %q", value)
+		}
+	}
+}
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	tests := []struct {
+		block     bool
+		mode      csi.VolumeCapability_AccessMode_Mode
+		expectErr bool
+	}{
+		{mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		{block: true, mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		{block: true, mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		{mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, expectErr: true},
+		{mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, expectErr: true},
+		{mode: csi.VolumeCapability_AccessMode_UNKNOWN, expectErr: true},
+	}
+
+	for _, tt := range tests {
+		volCap := &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: tt.mode},
+		}
+		if tt.block {
+			volCap.AccessType = &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}
+		}
+		err := ValidateVolumeCapabilities([]*csi.VolumeCapability{volCap})
+		if tt.expectErr && err == nil {
+			t.Errorf("Expected error for access mode %s of block volume: %v", tt.mode, tt.block)
+		} else if !tt.expectErr && err != nil {
+			t.Errorf("Unexpected error for access mode %s of block volume: %v: %v", tt.mode, tt.block, err)
+		}
+	}
+	if err := ValidateVolumeCapabilities([]*csi.VolumeCapability{{}}); err == nil {
+		t.Errorf("Expected error for volume capability without access mode")
+	}
+}
+
+func TestIsMultiWriterBlockVolume(t *testing.T) {
+	block := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	if IsMultiWriterBlockVolume([]*csi.VolumeCapability{block}) {
+		t.Errorf("Expected single node block volume not to be multi-writer")
+	}
+	multiWriter := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+	if !IsMultiWriterBlockVolume([]*csi.VolumeCapability{block, multiWriter}) {
+		t.Errorf("Expected multi node multi writer block volume to be multi-writer")
+	}
+}
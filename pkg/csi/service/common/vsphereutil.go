@@ -28,24 +28,36 @@ import (
 	"sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 )
 
-// CreateVolumeUtil is the helper function to create CNS volume
-func CreateVolumeUtil(ctx context.Context, manager *Manager, spec *CreateVolumeSpec, sharedDatastores []*vsphere.DatastoreInfo) (string, error) {
+// ErrVolumeConflict is returned when a volume with the requested name already
+// exists with a different size or storage policy.
+var ErrVolumeConflict = errors.New("volume with the same name exists with a different size or storage policy")
+
+// ErrAmbiguousVolumeName is returned when several CNS volumes of the cluster
+// have the name a volume is looked up by.
+var ErrAmbiguousVolumeName = errors.New("several volumes with the same name exist")
+
+// CreateVolumeUtil is the helper function to create CNS volume. Callers look
+// up the volume created by an earlier attempt of the request with
+// GetVolumeByName beforehand, as it is not checked for here. As CNS does not
+// report the datastore it placed the volume on, the datastore URL is only
+// returned when the volume was created on a single datastore.
+func CreateVolumeUtil(ctx context.Context, manager *Manager, spec *CreateVolumeSpec, sharedDatastores []*vsphere.DatastoreInfo) (string, string, error) {
 	vc, err := GetVCenter(ctx, manager)
 	if err != nil {
 		klog.Errorf("Failed to get vCenter from Manager, err: %+v", err)
-		return "", err
+		return "", "", err
 	}
 	if spec.StoragePolicyName != "" {
 		// Get Storage Policy ID from Storage Policy Name
 		err = vc.ConnectPbm(ctx)
 		if err != nil {
 			klog.Errorf("Error occurred while connecting to PBM, err: %+v", err)
-			return "", err
+			return "", "", err
 		}
 		spec.StoragePolicyID, err = vc.GetStoragePolicyIDByName(ctx, spec.StoragePolicyName)
 		if err != nil {
 			klog.Errorf("Error occurred while getting Profile Id from Profile Name: %s, err: %+v", spec.StoragePolicyName, err)
-			return "", err
+			return "", "", err
 		}
 	}
 	var datastores []vim25types.ManagedObjectReference
@@ -62,7 +74,7 @@ func CreateVolumeUtil(ctx context.Context, manager *Manager, spec *CreateVolumeS
 		datacenters, err := vc.GetDatacenters(ctx)
 		if err != nil {
 			klog.Errorf("Failed to find datacenters from VC: %+v, Error: %+v", vc.Config.Host, err)
-			return "", err
+			return "", "", err
 		}
 		isSharedDatastoreURL := false
 		var datastoreObj *vsphere.Datastore
@@ -85,14 +97,14 @@ func CreateVolumeUtil(ctx context.Context, manager *Manager, spec *CreateVolumeS
 		if datastoreObj == nil {
 			errMsg := fmt.Sprintf("DatastoreURL: %s specified in the storage class is not found.", spec.DatastoreURL)
 			klog.Errorf(errMsg)
-			return "", errors.New(errMsg)
+			return "", "", errors.New(errMsg)
 		}
 		if isSharedDatastoreURL {
 			datastores = append(datastores, datastoreObj.Reference())
 		} else {
 			errMsg := fmt.Sprintf("Datastore: %s specified in the storage class is not accessible to all nodes.", spec.DatastoreURL)
 			klog.Errorf(errMsg)
-			return "", errors.New(errMsg)
+			return "", "", errors.New(errMsg)
 		}
 	}
 	createSpec := &cnstypes.CnsVolumeCreateSpec{
@@ -116,9 +128,72 @@ func CreateVolumeUtil(ctx context.Context, manager *Manager, spec *CreateVolumeS
 	volumeID, err := manager.VolumeManager.CreateVolume(createSpec)
 	if err != nil {
 		klog.Errorf("Failed to create disk %s with error %+v", spec.Name, err)
-		return "", err
+		if volumeID != nil {
+			cleanupFailedVolume(manager, spec.Name, volumeID.Id)
+		}
+		return "", "", err
+	}
+	var datastoreURL string
+	if spec.DatastoreURL != "" {
+		datastoreURL = spec.DatastoreURL
+	} else if len(sharedDatastores) == 1 {
+		datastoreURL = sharedDatastores[0].Info.Url
+	}
+	return volumeID.Id, datastoreURL, nil
+}
+
+// cleanupFailedVolume deletes the CNS volume with the given ID created by a
+// failed create, as reported by the result of its CNS task, e.g. when the
+// task failed after the FCD was created. Retries would otherwise reuse the
+// volume of the failed attempt. Volumes left behind by creates whose task
+// result has no volume ID are removed by the syncer sweep instead, as a volume
+// found by name may belong to another attempt.
+func cleanupFailedVolume(manager *Manager, volumeName string, volumeID string) {
+	klog.V(2).Infof("Deleting volume %s with name %s left behind by failed create", volumeID, volumeName)
+	if err := manager.VolumeManager.DeleteVolume(volumeID, true); err != nil {
+		klog.Warningf("Failed to delete volume %s left behind by failed create, err: %+v", volumeID, err)
+	}
+}
+
+// GetVolumeByName returns the CNS volume with the given name in this cluster,
+// or nil if there is none. ErrAmbiguousVolumeName is returned if several
+// volumes have the name, as there is no telling which one is meant.
+func GetVolumeByName(manager *Manager, volumeName string) (*cnstypes.CnsVolume, error) {
+	queryFilter := cnstypes.CnsQueryFilter{
+		Names:               []string{volumeName},
+		ContainerClusterIds: []string{manager.CnsConfig.Global.ClusterID},
+	}
+	queryResult, err := manager.VolumeManager.QueryVolume(queryFilter)
+	if err != nil {
+		return nil, err
+	}
+	var match *cnstypes.CnsVolume
+	for i := range queryResult.Volumes {
+		volume := &queryResult.Volumes[i]
+		if volume.Name != volumeName || volume.Metadata.ContainerCluster.ClusterId != manager.CnsConfig.Global.ClusterID {
+			continue
+		}
+		if match != nil {
+			klog.Errorf("Found volumes %s and %s with name %s", match.VolumeId.Id, volume.VolumeId.Id, volumeName)
+			return nil, ErrAmbiguousVolumeName
+		}
+		match = volume
 	}
-	return volumeID.Id, nil
+	return match, nil
+}
+
+// CheckExistingVolume returns ErrVolumeConflict if the existing volume with
+// the name of the create spec differs in capacity or storage policy from the
+// spec. Fields not reported by CNS are not compared.
+func CheckExistingVolume(existingVolume *cnstypes.CnsVolume, spec *CreateVolumeSpec) error {
+	capacityMB := existingVolume.BackingObjectDetails.CapacityInMb
+	if (capacityMB != 0 && capacityMB != spec.CapacityMB) ||
+		(spec.StoragePolicyID != "" && existingVolume.StoragePolicyId != "" && existingVolume.StoragePolicyId != spec.StoragePolicyID) {
+		klog.Errorf("Volume with name %s already exists with ID %s, capacity %d MB and storage policy %q, requested capacity %d MB and storage policy %q",
+			spec.Name, existingVolume.VolumeId.Id, capacityMB, existingVolume.StoragePolicyId, spec.CapacityMB, spec.StoragePolicyID)
+		return ErrVolumeConflict
+	}
+	return nil
 }
 
 // AttachVolumeUtil is the helper function to attach CNS volume to specified vm
@@ -135,11 +210,152 @@ func AttachVolumeUtil(ctx context.Context, manager *Manager,
 	return diskUUID, nil
 }
 
-// DetachVolumeUtil is the helper function to detach CNS volume from specified vm
+// StartAttachVolumeUtil is the helper function to issue the attach of the CNS
+// volume to the specified vm without waiting for its completion. It returns
+// the disk UUID the volume will be presented with, read from the backing disk
+// of the volume, and the channel receiving the attach result.
+func StartAttachVolumeUtil(ctx context.Context, manager *Manager,
+	vm *vsphere.VirtualMachine,
+	volumeID string) (string, <-chan error, error) {
+	klog.V(4).Infof("vSphere CNS driver is issuing attach of volume: %s to node vm: %s", volumeID, vm.InventoryPath)
+	datastore, err := getVolumeDatastore(ctx, manager, vm, volumeID)
+	if err != nil {
+		return "", nil, err
+	}
+	diskUUID, err := datastore.GetVStorageObjectDiskUUID(ctx, volumeID)
+	if err != nil {
+		klog.Errorf("Failed to get disk UUID of volume %s with err %+v", volumeID, err)
+		return "", nil, err
+	}
+	done, err := manager.VolumeManager.AttachVolumeAsync(vm, volumeID)
+	if err != nil {
+		klog.Errorf("Failed to issue attach of disk %s with err %+v", volumeID, err)
+		return "", nil, err
+	}
+	klog.V(4).Infof("Issued attach of disk %s to VM %v. Disk UUID is %s", volumeID, vm, diskUUID)
+	return diskUUID, done, nil
+}
+
+// AttachVolumeToSCSIControllerUtil is the helper function to attach the volume
+// to the SCSI controller with the given bus number of the specified vm, or to
+// the next controller with a free unit, of the given adapter type if set. It
+// returns the disk UUID and the bus number of the controller used.
+func AttachVolumeToSCSIControllerUtil(ctx context.Context, manager *Manager,
+	vm *vsphere.VirtualMachine,
+	volumeID string, busNumber int32, adapterType string) (string, int32, error) {
+	klog.V(4).Infof("vSphere CNS driver is attaching volume: %s to SCSI controller %d of node vm: %s", volumeID, busNumber, vm.InventoryPath)
+	datastore, err := getVolumeDatastore(ctx, manager, vm, volumeID)
+	if err != nil {
+		return "", 0, err
+	}
+	diskUUID, usedBus, err := vm.AttachDiskToSCSIController(ctx, volumeID, datastore.Reference(), busNumber, adapterType)
+	if err != nil {
+		klog.Errorf("Failed to attach disk %s with err %+v", volumeID, err)
+		return "", 0, err
+	}
+	klog.V(4).Infof("Successfully attached disk %s to SCSI controller %d of VM %v. Disk UUID is %s", volumeID, usedBus, vm, diskUUID)
+	return diskUUID, usedBus, nil
+}
+
+// AttachMultiWriterVolumeUtil is the helper function to attach the volume
+// read-write to the specified vm with multi-writer sharing, on the SCSI
+// controller with the given bus number or the next controller with a free
+// unit, of the given adapter type if set. The disk is attached by
+// reconfiguring the vm, as CNS attaches volumes to a single vm. It returns the
+// disk UUID and the bus number of the controller used.
+func AttachMultiWriterVolumeUtil(ctx context.Context, manager *Manager,
+	vm *vsphere.VirtualMachine,
+	volumeID string, busNumber int32, adapterType string) (string, int32, error) {
+	klog.V(4).Infof("vSphere CNS driver is attaching multi-writer volume: %s to SCSI controller %d of node vm: %s", volumeID, busNumber, vm.InventoryPath)
+	datastore, err := getVolumeDatastore(ctx, manager, vm, volumeID)
+	if err != nil {
+		return "", 0, err
+	}
+	diskUUID, usedBus, err := vm.AttachMultiWriterDisk(ctx, volumeID, datastore.Reference(), busNumber, adapterType)
+	if err != nil {
+		klog.Errorf("Failed to attach multi-writer disk %s with err %+v", volumeID, err)
+		return "", 0, err
+	}
+	klog.V(4).Infof("Successfully attached multi-writer disk %s to SCSI controller %d of VM %v. Disk UUID is %s", volumeID, usedBus, vm, diskUUID)
+	return diskUUID, usedBus, nil
+}
+
+// IsAttachedOutsideCNSUtil is the helper function to check whether the volume
+// is attached to the specified vm without CNS recording the attachment, as
+// volumes attached by AttachVolumeToSCSIControllerUtil and
+// AttachMultiWriterVolumeUtil are. Such volumes must be detached by
+// reconfiguring the vm rather than through CNS. As it queries vCenter, it is
+// only used when the attachment metadata recorded at publish is unavailable.
+func IsAttachedOutsideCNSUtil(ctx context.Context, manager *Manager, vm *vsphere.VirtualMachine, volumeID string) (bool, error) {
+	attached, err := vm.IsDiskAttached(ctx, volumeID)
+	if err != nil || !attached {
+		return false, err
+	}
+	multiWriter, err := vm.IsDiskMultiWriter(ctx, volumeID)
+	if err != nil || multiWriter {
+		return multiWriter, err
+	}
+	datastore, err := getVolumeDatastore(ctx, manager, vm, volumeID)
+	if err != nil {
+		return false, err
+	}
+	consumers, err := datastore.GetVStorageObjectConsumers(ctx, volumeID)
+	if err != nil {
+		return false, err
+	}
+	vmUUIDs, err := vm.GetUUIDs(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, consumer := range consumers {
+		if vmUUIDs[consumer] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// getVolumeDatastore returns the datastore of the volume in the datacenter of
+// the specified vm.
+func getVolumeDatastore(ctx context.Context, manager *Manager, vm *vsphere.VirtualMachine, volumeID string) (*vsphere.Datastore, error) {
+	queryFilter := cnstypes.CnsQueryFilter{
+		VolumeIds: []cnstypes.CnsVolumeId{
+			{
+				Id: volumeID,
+			},
+		},
+	}
+	queryResult, err := manager.VolumeManager.QueryVolume(queryFilter)
+	if err != nil {
+		klog.Errorf("Failed to query volume %s with err %+v", volumeID, err)
+		return nil, err
+	}
+	if len(queryResult.Volumes) == 0 {
+		return nil, fmt.Errorf("volume %s not found in CNS", volumeID)
+	}
+	datastore, err := vm.Datacenter.GetDatastoreByURL(ctx, queryResult.Volumes[0].DatastoreUrl)
+	if err != nil {
+		klog.Errorf("Failed to find datastore %s of volume %s with err %+v", queryResult.Volumes[0].DatastoreUrl, volumeID, err)
+		return nil, err
+	}
+	return datastore, nil
+}
+
+// DetachVolumeUtil is the helper function to detach CNS volume from specified
+// vm. Volumes attached outside CNS are detached by reconfiguring the vm.
 func DetachVolumeUtil(ctx context.Context, manager *Manager,
 	vm *vsphere.VirtualMachine,
-	volumeID string) error {
+	volumeID string, outsideCNS bool) error {
 	klog.V(4).Infof("vSphere CNS driver is detaching volume: %s from node vm: %s", volumeID, vm.InventoryPath)
+	if outsideCNS {
+		klog.V(2).Infof("Detaching disk %s attached outside CNS from VM %v", volumeID, vm)
+		if err := vm.ForceDetachDisk(ctx, volumeID); err != nil {
+			klog.Errorf("Failed to detach disk %s with err %+v", volumeID, err)
+			return err
+		}
+		klog.V(4).Infof("Successfully detached disk %s from VM %v.", volumeID, vm)
+		return nil
+	}
 	err := manager.VolumeManager.DetachVolume(vm, volumeID)
 	if err != nil {
 		klog.Errorf("Failed to detach disk %s with err %+v", volumeID, err)
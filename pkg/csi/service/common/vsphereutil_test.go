@@ -0,0 +1,52 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"testing"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+)
+
+func TestCheckExistingVolume(t *testing.T) {
+	newVolume := func(capacityMB int64, policyID string) *cnstypes.CnsVolume {
+		volume := &cnstypes.CnsVolume{
+			VolumeId:        cnstypes.CnsVolumeId{Id: "vol-1"},
+			StoragePolicyId: policyID,
+		}
+		volume.BackingObjectDetails.CapacityInMb = capacityMB
+		return volume
+	}
+	tests := []struct {
+		volume   *cnstypes.CnsVolume
+		spec     CreateVolumeSpec
+		conflict bool
+	}{
+		// Volume created with the aligned capacity of the spec
+		{newVolume(1024, "policy-1"), CreateVolumeSpec{Name: "pvc-1", CapacityMB: 1024, StoragePolicyID: "policy-1"}, false},
+		// Capacity and storage policy not reported by CNS
+		{newVolume(0, ""), CreateVolumeSpec{Name: "pvc-1", CapacityMB: 1024, StoragePolicyID: "policy-1"}, false},
+		{newVolume(1000, "policy-1"), CreateVolumeSpec{Name: "pvc-1", CapacityMB: 1024, StoragePolicyID: "policy-1"}, true},
+		{newVolume(1024, "policy-2"), CreateVolumeSpec{Name: "pvc-1", CapacityMB: 1024, StoragePolicyID: "policy-1"}, true},
+	}
+	for i, test := range tests {
+		err := CheckExistingVolume(test.volume, &test.spec)
+		if conflict := err == ErrVolumeConflict; conflict != test.conflict {
+			t.Errorf("Test %d: expected conflict %v, got error %v", i, test.conflict, err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/klog"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+)
+
+// redactedValue replaces secrets in the diagnostics.
+const redactedValue = "<redacted>"
+
+// diagnostics describes the effective configuration of the running driver.
+type diagnostics struct {
+	Name                   string
+	Version                string
+	Mode                   string
+	Config                 *cnsconfig.Config     `json:",omitempty"`
+	NodeConfig             *cnsconfig.NodeConfig `json:",omitempty"`
+	ControllerCapabilities []string              `json:",omitempty"`
+	NodeCapabilities       []string              `json:",omitempty"`
+	VirtualCenters         []virtualCenterInfo   `json:",omitempty"`
+}
+
+// virtualCenterInfo describes a vCenter the controller is registered with.
+type virtualCenterInfo struct {
+	Host       string
+	Connected  bool
+	APIVersion string `json:",omitempty"`
+	FullName   string `json:",omitempty"`
+}
+
+// startDiagnosticsServer serves the diagnostics of the driver on the address.
+func (s *service) startDiagnosticsServer(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/diagnostics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(s.getDiagnostics(r.Context())); err != nil {
+			klog.Warningf("Failed to write diagnostics. Err: %v", err)
+		}
+	})
+	go func() {
+		klog.V(2).Infof("Serving diagnostics on %s", address)
+		if err := http.ListenAndServe(address, mux); err != nil {
+			klog.Errorf("Failed to serve diagnostics on %s. Err: %v", address, err)
+		}
+	}()
+}
+
+// getDiagnostics returns the effective configuration and capabilities of the
+// services run by the driver, with secrets redacted.
+func (s *service) getDiagnostics(ctx context.Context) *diagnostics {
+	d := &diagnostics{
+		Name:    Name,
+		Version: version,
+		Mode:    s.mode,
+	}
+	if s.cfg != nil {
+		d.Config = redactConfig(s.cfg)
+		if resp, err := s.cs.ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{}); err == nil {
+			for _, capability := range resp.Capabilities {
+				d.ControllerCapabilities = append(d.ControllerCapabilities, capability.GetRpc().GetType().String())
+			}
+		}
+		for _, vc := range cnsvsphere.GetVirtualCenterManager().GetAllVirtualCenters() {
+			info := virtualCenterInfo{Host: vc.Config.Host}
+			if vc.Client != nil {
+				info.Connected = true
+				info.APIVersion = vc.Client.ServiceContent.About.ApiVersion
+				info.FullName = vc.Client.ServiceContent.About.FullName
+			}
+			d.VirtualCenters = append(d.VirtualCenters, info)
+		}
+	}
+	if s.nodeServing {
+		nodeCfg := s.nodeCfg
+		d.NodeConfig = &nodeCfg
+		if resp, err := s.NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{}); err == nil {
+			for _, capability := range resp.Capabilities {
+				d.NodeCapabilities = append(d.NodeCapabilities, capability.GetRpc().GetType().String())
+			}
+		}
+	}
+	return d
+}
+
+// redactConfig returns a copy of the config with the vCenter passwords
+// redacted.
+func redactConfig(cfg *cnsconfig.Config) *cnsconfig.Config {
+	redacted := *cfg
+	if redacted.Global.Password != "" {
+		redacted.Global.Password = redactedValue
+	}
+	redacted.VirtualCenter = make(map[string]*cnsconfig.VirtualCenterConfig, len(cfg.VirtualCenter))
+	for host, vcConfig := range cfg.VirtualCenter {
+		vcCopy := *vcConfig
+		if vcCopy.Password != "" {
+			vcCopy.Password = redactedValue
+		}
+		redacted.VirtualCenter[host] = &vcCopy
+	}
+	return &redacted
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+)
+
+func TestDiagnosticsRedactSecrets(t *testing.T) {
+	cfg := &cnsconfig.Config{}
+	cfg.Global.User = "admin"
+	cfg.Global.Password = "secret"
+	cfg.VirtualCenter = map[string]*cnsconfig.VirtualCenterConfig{
+		"vc1": {User: "admin", Password: "secret"},
+	}
+	s := &service{mode: "node", nodeServing: true}
+	d := s.getDiagnostics(context.Background())
+	if d.Config != nil || d.NodeConfig == nil || len(d.NodeCapabilities) == 0 {
+		t.Fatalf("unexpected node diagnostics %+v", d)
+	}
+
+	redacted := redactConfig(cfg)
+	out, err := json.Marshal(redacted)
+	if err != nil {
+		t.Fatalf("failed to marshal config: %v", err)
+	}
+	if strings.Contains(string(out), "secret") {
+		t.Errorf("password not redacted: %s", out)
+	}
+	if redacted.VirtualCenter["vc1"].User != "admin" {
+		t.Errorf("unexpected redacted config %s", out)
+	}
+	if cfg.Global.Password != "secret" || cfg.VirtualCenter["vc1"].Password != "secret" {
+		t.Errorf("original config was modified")
+	}
+}
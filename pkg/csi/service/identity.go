@@ -18,12 +18,19 @@ package service
 
 import (
 	"context"
+	"strconv"
+	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 )
 
 // set via ldflags
-var version string
+var (
+	version   string
+	gitCommit string
+)
 
 func (s *service) Probe(
 	ctx context.Context,
@@ -38,9 +45,24 @@ func (s *service) GetPluginInfo(
 	req *csi.GetPluginInfoRequest) (
 	*csi.GetPluginInfoResponse, error) {
 
+	manifest := map[string]string{
+		"version": version,
+		"commit":  gitCommit,
+	}
+	// The controller is registered with the vCenters once initialized
+	if s.cfg != nil {
+		connected := 0
+		for _, vc := range cnsvsphere.GetVirtualCenterManager().GetAllVirtualCenters() {
+			if vc.Client != nil {
+				connected++
+			}
+		}
+		manifest["connected-vcenters"] = strconv.Itoa(connected)
+	}
 	return &csi.GetPluginInfoResponse{
 		Name:          Name,
 		VendorVersion: version,
+		Manifest:      manifest,
 	}, nil
 }
 
@@ -54,18 +76,23 @@ func (s *service) GetPluginCapabilities(
 			{
 				Type: &csi.PluginCapability_Service_{
 					Service: &csi.PluginCapability_Service{
-						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
+						Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
 					},
 				},
 			},
+		},
+	}
+	// The controller service is not registered in node mode
+	if !strings.EqualFold(s.mode, "node") {
+		rep.Capabilities = append([]*csi.PluginCapability{
 			{
 				Type: &csi.PluginCapability_Service_{
 					Service: &csi.PluginCapability_Service{
-						Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
 					},
 				},
 			},
-		},
+		}, rep.Capabilities...)
 	}
 	return rep, nil
 }
@@ -0,0 +1,71 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestGetPluginInfoManifest(t *testing.T) {
+	version, gitCommit = "v1.0.1", "c0f4e9754e39"
+	defer func() {
+		version, gitCommit = "", ""
+	}()
+	s := &service{mode: "node", nodeServing: true}
+	resp, err := s.GetPluginInfo(context.Background(), &csi.GetPluginInfoRequest{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Manifest["version"] != "v1.0.1" || resp.Manifest["commit"] != "c0f4e9754e39" {
+		t.Errorf("unexpected manifest %v", resp.Manifest)
+	}
+	// vCenter connections are only reported by the controller
+	if _, ok := resp.Manifest["connected-vcenters"]; ok {
+		t.Errorf("unexpected vCenter connections in node manifest %v", resp.Manifest)
+	}
+}
+
+func TestGetPluginCapabilities(t *testing.T) {
+	tests := []struct {
+		mode       string
+		controller bool
+	}{
+		{mode: "", controller: true},
+		{mode: "controller", controller: true},
+		{mode: "node", controller: false},
+	}
+
+	for _, tt := range tests {
+		s := &service{mode: tt.mode}
+		resp, err := s.GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		controller := false
+		for _, capability := range resp.Capabilities {
+			if capability.GetService().GetType() == csi.PluginCapability_Service_CONTROLLER_SERVICE {
+				controller = true
+			}
+		}
+		if controller != tt.controller {
+			t.Errorf("mode %q: expected controller service capability: %v got: %v", tt.mode, tt.controller, controller)
+		}
+	}
+}
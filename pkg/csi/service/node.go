@@ -22,26 +22,48 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/akutz/gofsutil"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	csictx "github.com/rexray/gocsi/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog"
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
-	csitypes "sigs.k8s.io/vsphere-csi-driver/pkg/csi/types"
+	k8s "sigs.k8s.io/vsphere-csi-driver/pkg/kubernetes"
 )
 
 const (
 	devDiskID   = "/dev/disk/by-id"
 	blockPrefix = "wwn-0x"
 	dmiDir      = "/sys/class/dmi"
+	sysBlockDir = "/sys/block"
+	// mpathUUIDPrefix is the prefix of the device mapper UUID of multipath
+	// devices
+	mpathUUIDPrefix = "mpath-"
+
+	// defaultUnmountRetries is the number of times a failed unmount is retried
+	defaultUnmountRetries = 3
+	// unmountRetryInitialBackoff is the delay before the first unmount retry,
+	// doubled on each subsequent retry
+	unmountRetryInitialBackoff = time.Second
+
+	// defaultDeferredAttachDeviceWait is the time NodeStageVolume waits for
+	// the device of volumes whose attach was deferred by the controller
+	defaultDeferredAttachDeviceWait = 2 * time.Minute
+	// deferredAttachDevicePollInterval is the interval between checks for the
+	// device of volumes whose attach was deferred
+	deferredAttachDevicePollInterval = time.Second
 )
 
 func (s *service) NodeStageVolume(
@@ -52,11 +74,14 @@ func (s *service) NodeStageVolume(
 	volID := req.GetVolumeId()
 	pubCtx := req.GetPublishContext()
 
-	diskID, err := getDiskID(volID, pubCtx)
+	diskID, err := getDiskID(volID, pubCtx, req.GetVolumeContext())
 	if err != nil {
 		klog.Errorf("Failed to get diskID. Error: %v", err)
 		return nil, err
 	}
+	if pubCtx[common.AttributeAttachDeferred] == "true" {
+		s.waitForDeferredAttach(ctx, volID, diskID)
+	}
 	klog.V(2).Infof("Checking if volume: %s with diskID: %s is attached", volID, diskID)
 	volPath, err := verifyVolumeAttached(diskID)
 	if err != nil {
@@ -80,7 +105,7 @@ func (s *service) NodeStageVolume(
 	}
 
 	// Extract fs details
-	fs, mntFlags, err := ensureMountVol(volCap)
+	fs, mntFlags, _, err := ensureMountVol(volCap)
 	if err != nil {
 		return nil, err
 	}
@@ -107,18 +132,11 @@ func (s *service) NodeStageVolume(
 	}
 
 	attributes := req.VolumeContext
-	fsType := attributes[common.AttributeFsType]
-	klog.V(2).Infof("fsType from VolumeContext: %s", fsType)
-	if fsType == "" {
-		// no fsType is set in VolumeContext, use default "ext4"
-		fsType = common.DefaultFsType
-		klog.V(2).Infof("fsType is not set in VolumeContext, use default type")
-	}
+	klog.V(4).Infof("Volume %s is provisioned on datastore %q of type %q", volID,
+		attributes[common.AttributeDatastoreURL], attributes[common.AttributeDatastoreType])
 	if len(mnts) == 0 {
 		// Device isn't mounted anywhere, stage the volume
-		if fs == "" {
-			fs = fsType
-		}
+		fs = getFsType(fs, attributes)
 
 		// If read-only access mode, we don't allow formatting
 		if ro {
@@ -130,11 +148,30 @@ func (s *service) NodeStageVolume(
 			}
 			return &csi.NodeStageVolumeResponse{}, nil
 		}
+		if s.nodeCfg.FsckBeforeMount {
+			if err := checkFilesystem(ctx, dev.FullPath); err != nil {
+				return nil, status.Errorf(codes.Internal,
+					"error with filesystem check during staging: %s",
+					err.Error())
+			}
+		}
+		if mkfsOptions := attributes[common.AttributeMkfsOptions]; mkfsOptions != "" {
+			if err := formatWithOptions(ctx, dev.FullPath, fs, mkfsOptions); err != nil {
+				return nil, status.Errorf(codes.Internal,
+					"error with format during staging: %s",
+					err.Error())
+			}
+		}
 		if err := gofsutil.FormatAndMount(ctx, dev.FullPath, target, fs, mntFlags...); err != nil {
 			return nil, status.Errorf(codes.Internal,
 				"error with format and mount during staging: %s",
 				err.Error())
 		}
+		if err := setMountOwner(target, attributes); err != nil {
+			return nil, status.Errorf(codes.Internal,
+				"error setting owner of mount root during staging: %s",
+				err.Error())
+		}
 		return &csi.NodeStageVolumeResponse{}, nil
 
 	}
@@ -231,7 +268,7 @@ func (s *service) NodePublishVolume(
 	volID := req.GetVolumeId()
 	pubCtx := req.GetPublishContext()
 
-	diskID, err := getDiskID(volID, pubCtx)
+	diskID, err := getDiskID(volID, pubCtx, req.GetVolumeContext())
 	if err != nil {
 		return nil, err
 	}
@@ -250,15 +287,25 @@ func (s *service) NodePublishVolume(
 			"error getting block device for volume: %s, err: %s",
 			volID, err.Error())
 	}
+	// A target already mounted with the device is handled as a retry below,
+	// one mounted with another device must not be published over
+	if err := verifyTargetMount(req.GetTargetPath(), dev); err != nil {
+		return nil, err
+	}
 	// check for Block vs Mount
+	var resp *csi.NodePublishVolumeResponse
 	volCap := req.GetVolumeCapability()
 	if _, ok := volCap.GetAccessType().(*csi.VolumeCapability_Block); ok {
 		// bind mount device to target
-		return publishBlockVol(ctx, req, dev)
+		resp, err = publishBlockVol(ctx, req, dev)
+	} else {
+		// Volume must be a mount volume
+		resp, err = publishMountVol(ctx, req, dev)
 	}
-
-	// Volume must be a mount volume
-	return publishMountVol(ctx, req, dev)
+	if err == nil && s.volStats != nil {
+		s.volStats.track(req.GetTargetPath(), newPublishedVolume(volID, req.GetVolumeContext(), dev))
+	}
+	return resp, err
 }
 
 func (s *service) NodeUnpublishVolume(
@@ -269,6 +316,9 @@ func (s *service) NodeUnpublishVolume(
 	volID := req.GetVolumeId()
 
 	target := req.GetTargetPath()
+	if s.volStats != nil {
+		s.volStats.untrack(target)
+	}
 	_, err := os.Stat(target)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -308,7 +358,7 @@ func (s *service) NodeUnpublishVolume(
 	for _, m := range mnts {
 		if m.Source == dev.RealDev || m.Device == dev.RealDev {
 			if m.Path == target {
-				if err := gofsutil.Unmount(ctx, target); err != nil {
+				if err := s.unmountWithRetry(ctx, target); err != nil {
 					return nil, status.Errorf(codes.Internal,
 						"Error unmounting target: %s", err.Error())
 				}
@@ -356,6 +406,7 @@ func (s *service) NodeGetInfo(
 	if nodeID == "" {
 		return nil, status.Error(codes.Internal, "ENV NODE_NAME is not set")
 	}
+	maxVolumesPerNode := getMaxVolumesPerNode(nodeID)
 	var cfg *cnsconfig.Config
 	cfgPath = csictx.Getenv(ctx, cnsconfig.EnvCloudConfig)
 	if cfgPath == "" {
@@ -366,7 +417,8 @@ func (s *service) NodeGetInfo(
 		if os.IsNotExist(err) {
 			klog.V(2).Infof("Config file not provided to node daemonset. Assuming non-topology aware cluster.")
 			return &csi.NodeGetInfoResponse{
-				NodeId: nodeID,
+				NodeId:            nodeID,
+				MaxVolumesPerNode: maxVolumesPerNode,
 			}, nil
 		}
 		klog.Errorf("Failed to read cnsconfig. Error: %v", err)
@@ -423,9 +475,10 @@ func (s *service) NodeGetInfo(
 		}
 		klog.V(4).Infof("zone: [%s], region: [%s], Node VM: [%s]", zone, region, nodeID)
 		if zone != "" && region != "" {
+			zoneKey, regionKey := common.GetTopologyKeys(cfg)
 			accessibleTopology = make(map[string]string)
-			accessibleTopology[csitypes.LabelRegionFailureDomain] = region
-			accessibleTopology[csitypes.LabelZoneFailureDomain] = zone
+			accessibleTopology[regionKey] = region
+			accessibleTopology[zoneKey] = zone
 		}
 	}
 	if len(accessibleTopology) > 0 {
@@ -435,9 +488,53 @@ func (s *service) NodeGetInfo(
 	return &csi.NodeGetInfoResponse{
 		NodeId:             nodeID,
 		AccessibleTopology: topology,
+		MaxVolumesPerNode:  maxVolumesPerNode,
 	}, nil
 }
 
+// getMaxVolumesPerNode returns the maximum number of volumes that can be
+// published to the node, as overridden by the AnnMaxVolumesPerNode annotation
+// on the Kubernetes node. 0 is returned if the annotation is not set or can not
+// be read, leaving the limit to the container orchestrator.
+func getMaxVolumesPerNode(nodeName string) int64 {
+	k8sclient, err := k8s.NewClient()
+	if err != nil {
+		klog.Warningf("Failed to create kubernetes client to read annotations of node %q. Err: %v", nodeName, err)
+		return 0
+	}
+	node, err := k8sclient.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+	if err != nil {
+		klog.Warningf("Failed to get kubernetes node %q to read its annotations. Err: %v", nodeName, err)
+		return 0
+	}
+	maxVolumesPerNode, err := parseMaxVolumesPerNode(node.Annotations)
+	if err != nil {
+		klog.Warningf("Ignoring annotation %s on node %q. Err: %v", common.AnnMaxVolumesPerNode, nodeName, err)
+		return 0
+	}
+	if maxVolumesPerNode > 0 {
+		klog.V(2).Infof("Max volumes per node is set to %d for node %q", maxVolumesPerNode, nodeName)
+	}
+	return maxVolumesPerNode
+}
+
+// parseMaxVolumesPerNode parses the AnnMaxVolumesPerNode annotation from the
+// given node annotations. 0 is returned if the annotation is not set.
+func parseMaxVolumesPerNode(annotations map[string]string) (int64, error) {
+	value, ok := annotations[common.AnnMaxVolumesPerNode]
+	if !ok {
+		return 0, nil
+	}
+	maxVolumesPerNode, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if maxVolumesPerNode <= 0 {
+		return 0, fmt.Errorf("invalid value %q, must be a positive integer", value)
+	}
+	return maxVolumesPerNode, nil
+}
+
 func publishMountVol(
 	ctx context.Context,
 	req *csi.NodePublishVolumeRequest,
@@ -446,10 +543,11 @@ func publishMountVol(
 
 	volCap := req.GetVolumeCapability()
 	// Extract fs details
-	_, mntFlags, err := ensureMountVol(volCap)
+	fs, mntFlags, propagation, err := ensureMountVol(volCap)
 	if err != nil {
 		return nil, err
 	}
+	fs = getFsType(fs, req.GetVolumeContext())
 
 	// We are responsible for creating target dir, per spec
 	target := req.GetTargetPath()
@@ -499,6 +597,13 @@ func publishMountVol(
 		return nil, status.Errorf(codes.FailedPrecondition,
 			"Volume ID: %s does not appear staged to %s", req.GetVolumeId(), stagingTarget)
 	}
+	// Verify the volume was staged with the filesystem it was provisioned with
+	for _, m := range devMnts {
+		if m.Path == stagingTarget && m.Type != "" && m.Type != fs {
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"Volume ID: %s is staged to %s with filesystem %s instead of %s", req.GetVolumeId(), stagingTarget, m.Type, fs)
+		}
+	}
 
 	// Do the bind mount to publish the volume
 	if ro {
@@ -510,6 +615,16 @@ func publishMountVol(
 			"error publish volume to target path: %s",
 			err.Error())
 	}
+	if propagation != "" {
+		// Propagation cannot be set along with the bind mount, the target is
+		// remounted with the requested propagation instead
+		klog.V(4).Infof("Setting mount propagation %s on target path %s", propagation, target)
+		if out, err := exec.Command("mount", "--make-"+propagation, target).CombinedOutput(); err != nil {
+			return nil, status.Errorf(codes.Internal,
+				"error setting mount propagation %s on target path: %s, err: %v, output: %s",
+				propagation, target, err, string(out))
+		}
+	}
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
@@ -577,6 +692,139 @@ type Device struct {
 	RealDev  string
 }
 
+// formatWithOptions formats the device with the given mkfs options if it does
+// not contain a filesystem yet. Already formatted devices are left untouched,
+// as mkfs options only apply to the initial format.
+func formatWithOptions(ctx context.Context, device string, fsType string, mkfsOptions string) error {
+	args, err := common.ParseMkfsOptions(mkfsOptions, fsType)
+	if err != nil {
+		return err
+	}
+	existingFormat, err := gofsutil.GetDiskFormat(ctx, device)
+	if err != nil {
+		return err
+	}
+	if existingFormat != "" {
+		klog.V(4).Infof("Device %s already contains %s, ignoring mkfs options %q", device, existingFormat, mkfsOptions)
+		return nil
+	}
+	if fsType == "ext4" || fsType == "ext3" {
+		args = append(args, "-F")
+	}
+	args = append(args, device)
+	mkfsCmd := fmt.Sprintf("mkfs.%s", fsType)
+	klog.V(2).Infof("Formatting device %s with %s %v", device, mkfsCmd, args)
+	if out, err := exec.Command(mkfsCmd, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %v, output: %s", mkfsCmd, err, string(out))
+	}
+	return nil
+}
+
+// setMountOwner changes the owner of the mount root to the mount UID and GID
+// of the volume context, if any. The root is left untouched when it is already
+// owned by them, so restaging does not modify the filesystem.
+func setMountOwner(target string, volumeContext map[string]string) error {
+	uidValue, hasUID := volumeContext[common.AttributeMountUID]
+	gidValue, hasGID := volumeContext[common.AttributeMountGID]
+	if !hasUID && !hasGID {
+		return nil
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("failed to get owner of %s", target)
+	}
+	uid, gid := int(stat.Uid), int(stat.Gid)
+	if hasUID {
+		if uid, err = common.ParseMountOwnerID(uidValue); err != nil {
+			return err
+		}
+	}
+	if hasGID {
+		if gid, err = common.ParseMountOwnerID(gidValue); err != nil {
+			return err
+		}
+	}
+	if uid == int(stat.Uid) && gid == int(stat.Gid) {
+		klog.V(4).Infof("Mount root %s is already owned by %d:%d", target, uid, gid)
+		return nil
+	}
+	klog.V(2).Infof("Changing owner of mount root %s to %d:%d", target, uid, gid)
+	return os.Chown(target, uid, gid)
+}
+
+// checkFilesystem checks the filesystem on the device before it is mounted, and
+// repairs it when this is safe. Unformatted devices and filesystems without a
+// supported checker are skipped. An error is returned only if the filesystem
+// could not be repaired.
+func checkFilesystem(ctx context.Context, device string) error {
+	existingFormat, err := gofsutil.GetDiskFormat(ctx, device)
+	if err != nil {
+		return err
+	}
+	switch existingFormat {
+	case "ext2", "ext3", "ext4":
+		// Preen mode only fixes problems which can be repaired safely
+		out, code, err := runFsck("e2fsck", "-p", device)
+		if err != nil {
+			return err
+		}
+		// Exit codes 1 and 2 report errors which were corrected
+		if code&^3 != 0 {
+			return fmt.Errorf("e2fsck failed with exit code %d, output: %s", code, out)
+		}
+		if code != 0 {
+			klog.Warningf("e2fsck corrected errors on device %s, output: %s", device, out)
+			return nil
+		}
+	case "xfs":
+		out, code, err := runFsck("xfs_repair", "-n", device)
+		if err != nil {
+			return err
+		}
+		if code == 0 {
+			break
+		}
+		klog.Warningf("xfs_repair found errors on device %s, output: %s", device, out)
+		out, code, err = runFsck("xfs_repair", device)
+		if err != nil {
+			return err
+		}
+		switch code {
+		case 0:
+			klog.Warningf("xfs_repair corrected errors on device %s, output: %s", device, out)
+			return nil
+		case 2:
+			// The log is dirty, it is replayed when the filesystem is mounted
+			klog.Warningf("xfs_repair found a dirty log on device %s, leaving it to log replay on mount", device)
+			return nil
+		default:
+			return fmt.Errorf("xfs_repair failed with exit code %d, output: %s", code, out)
+		}
+	default:
+		klog.V(4).Infof("Skipping filesystem check of device %s with format %q", device, existingFormat)
+		return nil
+	}
+	klog.V(4).Infof("Filesystem %s on device %s is clean", existingFormat, device)
+	return nil
+}
+
+// runFsck runs the filesystem checker and returns its output and exit code.
+// An error is returned only if the checker could not be run.
+func runFsck(fsckCmd string, args ...string) (string, int, error) {
+	klog.V(2).Infof("Checking filesystem with %s %v", fsckCmd, args)
+	out, err := exec.Command(fsckCmd, args...).CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return string(out), exitErr.ExitCode(), nil
+	} else if err != nil {
+		return "", 0, fmt.Errorf("%s failed: %v", fsckCmd, err)
+	}
+	return string(out), 0, nil
+}
+
 // getDevice returns a Device struct with info about the given device, or
 // an error if it doesn't exist or is not a block device
 func getDevice(path string) (*Device, error) {
@@ -659,9 +907,45 @@ func verifyVolumeAttached(diskID string) (string, error) {
 	}
 
 	klog.V(2).Infof("found disk. diskID: %q, path: %q", diskID, volPath)
+
+	// Use the multipath device of the disk, if any, so the volume survives
+	// the failover between paths
+	mpathPath, err := getMultipathDevice(sysBlockDir, volPath)
+	if err != nil {
+		klog.Warningf("Failed to look up multipath device of diskID: %q, using path: %q. Error: %v", diskID, volPath, err)
+	} else if mpathPath != "" {
+		klog.V(2).Infof("found multipath device. diskID: %q, path: %q", diskID, mpathPath)
+		volPath = mpathPath
+	}
 	return volPath, nil
 }
 
+// getMultipathDevice returns the path of the multipath device holding the
+// device at the given path, or an empty string if the device is not part of a
+// multipath device, e.g. when multipath is not configured.
+func getMultipathDevice(sysBlock string, devPath string) (string, error) {
+	realDev, err := filepath.EvalSymlinks(devPath)
+	if err != nil {
+		return "", err
+	}
+	holders, err := ioutil.ReadDir(filepath.Join(sysBlock, filepath.Base(realDev), "holders"))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	for _, holder := range holders {
+		uuid, err := ioutil.ReadFile(filepath.Join(sysBlock, holder.Name(), "dm", "uuid"))
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(string(uuid), mpathUUIDPrefix) {
+			return filepath.Join("/dev", holder.Name()), nil
+		}
+	}
+	return "", nil
+}
+
 func verifyTargetDir(target string) error {
 	if target == "" {
 		return status.Error(codes.InvalidArgument,
@@ -742,16 +1026,160 @@ func rmpath(target string) error {
 	return nil
 }
 
-func ensureMountVol(volCap *csi.VolumeCapability) (string, []string, error) {
+// unmountWithRetry unmounts the target, retrying failed unmounts with
+// exponential backoff as a process may still briefly hold the mount.
+// Once retries are exhausted, the target is lazily unmounted if enabled
+// in the node options.
+func (s *service) unmountWithRetry(ctx context.Context, target string) error {
+	retries := s.nodeCfg.UnmountRetries
+	if retries <= 0 {
+		retries = defaultUnmountRetries
+	}
+	backoff := unmountRetryInitialBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = gofsutil.Unmount(ctx, target); err == nil {
+			return nil
+		}
+		if _, statErr := os.Stat(target); os.IsNotExist(statErr) {
+			// target path is already gone
+			return nil
+		}
+		if attempt == retries {
+			break
+		}
+		klog.Warningf("Failed to unmount target: %q, retrying in %v. Err: %v", target, backoff, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	if !s.nodeCfg.LazyUnmountFallback {
+		return err
+	}
+	klog.Warningf("Unmount retries exhausted for target: %q, falling back to lazy unmount. Err: %v", target, err)
+	if out, lazyErr := exec.Command("umount", "-l", target).CombinedOutput(); lazyErr != nil {
+		return fmt.Errorf("lazy unmount failed: %v, output: %s", lazyErr, string(out))
+	}
+	return nil
+}
+
+// waitForDeferredAttach waits for the device of the volume whose attach was
+// deferred by the controller to show up, until the deferred attach device
+// wait of the node options elapsed. The attach is then verified as usual, so
+// NodeStageVolume fails and is retried by the CO if the device is still
+// missing.
+func (s *service) waitForDeferredAttach(ctx context.Context, volID string, diskID string) {
+	wait := time.Duration(s.nodeCfg.DeferredAttachDeviceWaitInSec) * time.Second
+	if wait <= 0 {
+		wait = defaultDeferredAttachDeviceWait
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		if volPath, err := getDiskPath(diskID, nil); err == nil && volPath != "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			klog.Warningf("Device of volume: %s with diskID: %s did not show up within %v of its deferred attach", volID, diskID, wait)
+			return
+		}
+		klog.V(4).Infof("Waiting for device of volume: %s with diskID: %s to show up", volID, diskID)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(deferredAttachDevicePollInterval):
+		}
+	}
+}
+
+// getNodeConfig returns the node service options from the config file.
+// Defaults are used if the config file can not be read, as it is optional
+// for the node daemonset.
+func getNodeConfig(ctx context.Context) cnsconfig.NodeConfig {
+	cfgPath := csictx.Getenv(ctx, cnsconfig.EnvCloudConfig)
+	if cfgPath == "" {
+		cfgPath = cnsconfig.DefaultCloudConfigPath
+	}
+	cfg, err := cnsconfig.GetCnsconfig(cfgPath)
+	if err != nil || cfg == nil {
+		klog.V(2).Infof("Failed to read node options from config, using defaults. Err: %v", err)
+		return cnsconfig.NodeConfig{}
+	}
+	return cfg.Node
+}
+
+// getFsType returns the filesystem type of a mount volume. The type requested in
+// the volume capability takes precedence over the one set in the volume context
+// at provisioning time, which falls back to the default "ext4".
+func getFsType(volCapFsType string, volumeContext map[string]string) string {
+	if volCapFsType != "" {
+		return volCapFsType
+	}
+	fsType := volumeContext[common.AttributeFsType]
+	klog.V(2).Infof("fsType from VolumeContext: %s", fsType)
+	if fsType == "" {
+		// no fsType is set in VolumeContext, use default "ext4"
+		fsType = common.DefaultFsType
+		klog.V(2).Infof("fsType is not set in VolumeContext, use default type")
+	}
+	return fsType
+}
+
+// ensureMountVol returns the filesystem, the mount flags and the mount
+// propagation requested by the mount volume capability. Propagation flags are
+// not part of the returned mount flags, as they only apply to published mounts.
+func ensureMountVol(volCap *csi.VolumeCapability) (string, []string, string, error) {
 	mountVol := volCap.GetMount()
 	if mountVol == nil {
-		return "", nil, status.Error(codes.InvalidArgument,
+		return "", nil, "", status.Error(codes.InvalidArgument,
 			"access type missing")
 	}
 	fs := mountVol.GetFsType()
-	mntFlags := mountVol.GetMountFlags()
+	propagation, mntFlags, err := splitMountPropagation(mountVol.GetMountFlags())
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	return fs, mntFlags, propagation, nil
+}
 
-	return fs, mntFlags, nil
+// mountPropagations maps the mount flags requesting a mount propagation to
+// whether the propagation is supported for published volumes.
+var mountPropagations = map[string]bool{
+	"private":     true,
+	"rprivate":    true,
+	"shared":      true,
+	"rshared":     true,
+	"slave":       true,
+	"rslave":      true,
+	"unbindable":  false,
+	"runbindable": false,
+}
+
+// splitMountPropagation splits the mount propagation from the mount flags.
+// InvalidArgument is returned for unsupported or conflicting propagations.
+func splitMountPropagation(mntFlags []string) (string, []string, error) {
+	var propagation string
+	var flags []string
+	for _, flag := range mntFlags {
+		supported, ok := mountPropagations[flag]
+		if !ok {
+			flags = append(flags, flag)
+			continue
+		}
+		if !supported {
+			return "", nil, status.Errorf(codes.InvalidArgument,
+				"mount propagation %s is not supported", flag)
+		}
+		if propagation != "" && propagation != flag {
+			return "", nil, status.Errorf(codes.InvalidArgument,
+				"conflicting mount propagations %s and %s requested", propagation, flag)
+		}
+		propagation = flag
+	}
+	return propagation, flags, nil
 }
 
 // a wrapper around gofsutil.GetMounts that handles bind mounts
@@ -773,6 +1201,38 @@ func getDevMounts(
 	return devMnts, nil
 }
 
+// verifyTargetMount returns an AlreadyExists error if the target path is
+// mounted with a device other than the given device.
+func verifyTargetMount(target string, dev *Device) error {
+	mnts, err := gofsutil.GetMounts(context.Background())
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"could not reliably determine existing mount status: %s",
+			err.Error())
+	}
+	if m := getForeignTargetMount(mnts, target, dev); m != nil {
+		return status.Errorf(codes.AlreadyExists,
+			"target path: %s is already mounted with device: %s instead of device: %s",
+			target, m.Device, dev.RealDev)
+	}
+	return nil
+}
+
+// getForeignTargetMount returns the mount of the target path whose device is
+// not the given device, or nil if there is none.
+func getForeignTargetMount(mnts []gofsutil.Info, target string, dev *Device) *gofsutil.Info {
+	for i := range mnts {
+		m := &mnts[i]
+		if m.Path != target {
+			continue
+		}
+		if m.Device != dev.RealDev && !(m.Device == "devtmpfs" && m.Source == dev.RealDev) {
+			return m
+		}
+	}
+	return nil
+}
+
 func getSystemUUID() (string, error) {
 	idb, err := ioutil.ReadFile(path.Join(dmiDir, "id", "product_uuid"))
 	if err != nil {
@@ -800,17 +1260,27 @@ func convertUUID(uuid string) (string, error) {
 	return strings.ToLower(convertedUUID), nil
 }
 
-func getDiskID(volID string, pubCtx map[string]string) (string, error) {
+// getDiskID returns the disk UUID of the volume from the publish context, or
+// from the volume context recording the UUID assigned at creation if the
+// publish context has none. Both are the UUID of the backing disk, which is
+// stable across detach and reattach.
+func getDiskID(volID string, pubCtx map[string]string, volCtx map[string]string) (string, error) {
 	if volID == "" {
 		return "", status.Error(codes.InvalidArgument,
 			"Volume ID required")
 	}
-	if _, ok := pubCtx[common.AttributeFirstClassDiskUUID]; !ok {
-		return "", status.Errorf(codes.InvalidArgument,
-			"Attribute: %s required in publish context",
-			common.AttributeFirstClassDiskUUID)
+	diskID, ok := pubCtx[common.AttributeFirstClassDiskUUID]
+	if !ok {
+		if diskID, ok = volCtx[common.AttributeFirstClassDiskUUID]; !ok {
+			return "", status.Errorf(codes.InvalidArgument,
+				"Attribute: %s required in publish context",
+				common.AttributeFirstClassDiskUUID)
+		}
+		klog.V(3).Infof("Using diskID: %s of volume: %s from volume context", diskID, volID)
+	} else if assigned := volCtx[common.AttributeFirstClassDiskUUID]; assigned != "" && assigned != diskID {
+		klog.Warningf("diskID: %s of volume: %s in publish context differs from diskID: %s assigned at creation", diskID, volID, assigned)
 	}
-	return pubCtx[common.AttributeFirstClassDiskUUID], nil
+	return diskID, nil
 }
 
 func getDevFromMount(target string) (*Device, error) {
@@ -17,10 +17,20 @@ limitations under the License.
 package service
 
 import (
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"testing"
 	"time"
+
+	"github.com/akutz/gofsutil"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
 )
 
 func TestGetDisk(t *testing.T) {
@@ -70,6 +80,265 @@ func TestGetDisk(t *testing.T) {
 	}
 }
 
+func TestParseMaxVolumesPerNode(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		expected    int64
+		expectErr   bool
+	}{
+		{
+			annotations: nil,
+			expected:    0,
+		},
+		{
+			annotations: map[string]string{common.AnnMaxVolumesPerNode: "30"},
+			expected:    30,
+		},
+		{
+			annotations: map[string]string{common.AnnMaxVolumesPerNode: "0"},
+			expectErr:   true,
+		},
+		{
+			annotations: map[string]string{common.AnnMaxVolumesPerNode: "many"},
+			expectErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		maxVolumes, err := parseMaxVolumesPerNode(tt.annotations)
+		if tt.expectErr {
+			if err == nil {
+				t.Errorf("Expected error for annotations %v", tt.annotations)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for annotations %v: %v", tt.annotations, err)
+		}
+		if maxVolumes != tt.expected {
+			t.Errorf("Expected max volumes %d got: %d", tt.expected, maxVolumes)
+		}
+	}
+}
+
+func TestGetFsType(t *testing.T) {
+	tests := []struct {
+		volCapFsType  string
+		volumeContext map[string]string
+		expected      string
+	}{
+		{
+			volCapFsType: "",
+			expected:     common.DefaultFsType,
+		},
+		{
+			volCapFsType:  "",
+			volumeContext: map[string]string{common.AttributeFsType: "ext3"},
+			expected:      "ext3",
+		},
+		{
+			volCapFsType:  "xfs",
+			volumeContext: map[string]string{common.AttributeFsType: "ext3"},
+			expected:      "xfs",
+		},
+	}
+
+	for _, tt := range tests {
+		if fsType := getFsType(tt.volCapFsType, tt.volumeContext); fsType != tt.expected {
+			t.Errorf("Expected fsType %s got: %s", tt.expected, fsType)
+		}
+	}
+}
+
+func TestGetDiskID(t *testing.T) {
+	tests := []struct {
+		pubCtx   map[string]string
+		volCtx   map[string]string
+		expected string
+		valid    bool
+	}{
+		{
+			pubCtx:   map[string]string{common.AttributeFirstClassDiskUUID: "6000c291"},
+			expected: "6000c291",
+			valid:    true,
+		},
+		{
+			volCtx:   map[string]string{common.AttributeFirstClassDiskUUID: "6000c292"},
+			expected: "6000c292",
+			valid:    true,
+		},
+		{
+			pubCtx:   map[string]string{common.AttributeFirstClassDiskUUID: "6000c291"},
+			volCtx:   map[string]string{common.AttributeFirstClassDiskUUID: "6000c292"},
+			expected: "6000c291",
+			valid:    true,
+		},
+		{
+			valid: false,
+		},
+	}
+
+	for _, tt := range tests {
+		diskID, err := getDiskID("volume-1", tt.pubCtx, tt.volCtx)
+		if tt.valid != (err == nil) {
+			t.Errorf("Expected valid: %v got error: %v", tt.valid, err)
+		}
+		if diskID != tt.expected {
+			t.Errorf("Expected diskID %s got: %s", tt.expected, diskID)
+		}
+	}
+}
+
+func TestEnsureMountVolPropagation(t *testing.T) {
+	tests := []struct {
+		mountFlags  []string
+		propagation string
+		flags       []string
+		code        codes.Code
+	}{
+		{
+			mountFlags: []string{"noatime"},
+			flags:      []string{"noatime"},
+		},
+		{
+			mountFlags:  []string{"noatime", "rshared"},
+			propagation: "rshared",
+			flags:       []string{"noatime"},
+		},
+		{
+			mountFlags:  []string{"rprivate"},
+			propagation: "rprivate",
+		},
+		{
+			mountFlags: []string{"rshared", "rprivate"},
+			code:       codes.InvalidArgument,
+		},
+		{
+			mountFlags: []string{"runbindable"},
+			code:       codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		volCap := &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4", MountFlags: tt.mountFlags},
+			},
+		}
+		_, flags, propagation, err := ensureMountVol(volCap)
+		if tt.code != codes.OK {
+			if status.Code(err) != tt.code {
+				t.Errorf("Mount flags %v: expected code %v got err: %v", tt.mountFlags, tt.code, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Mount flags %v: unexpected err: %v", tt.mountFlags, err)
+			continue
+		}
+		if propagation != tt.propagation || !reflect.DeepEqual(flags, tt.flags) {
+			t.Errorf("Mount flags %v: expected propagation %q and flags %v got %q and %v", tt.mountFlags, tt.propagation, tt.flags, propagation, flags)
+		}
+	}
+}
+
+func TestGetForeignTargetMount(t *testing.T) {
+	dev := &Device{FullPath: "/dev/disk/by-id/wwn-0x6000c291", RealDev: "/dev/sdb"}
+	target := "/var/lib/kubelet/pods/pod-1/volumes/kubernetes.io~csi/pv-1/mount"
+	tests := []struct {
+		mnts    []gofsutil.Info
+		foreign bool
+	}{
+		{
+			mnts: []gofsutil.Info{{Device: "/dev/sdb", Path: "/staging"}},
+		},
+		{
+			mnts: []gofsutil.Info{{Device: "/dev/sdb", Path: target}},
+		},
+		{
+			mnts: []gofsutil.Info{{Device: "devtmpfs", Source: "/dev/sdb", Path: target}},
+		},
+		{
+			mnts:    []gofsutil.Info{{Device: "/dev/sdc", Path: target}},
+			foreign: true,
+		},
+	}
+
+	for _, tt := range tests {
+		if m := getForeignTargetMount(tt.mnts, target, dev); (m != nil) != tt.foreign {
+			t.Errorf("Mounts %v: expected foreign mount: %v got: %v", tt.mnts, tt.foreign, m)
+		}
+	}
+}
+
+func TestSetMountOwner(t *testing.T) {
+	target, err := ioutil.TempDir("", "mount-owner")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(target)
+
+	if err := setMountOwner(target, map[string]string{}); err != nil {
+		t.Errorf("Unexpected error without mount owner: %v", err)
+	}
+	// The root is already owned by the current user, so it is left untouched
+	owner := map[string]string{
+		common.AttributeMountUID: strconv.Itoa(os.Getuid()),
+		common.AttributeMountGID: strconv.Itoa(os.Getgid()),
+	}
+	if err := setMountOwner(target, owner); err != nil {
+		t.Errorf("Unexpected error for matching mount owner: %v", err)
+	}
+	if err := setMountOwner(target, map[string]string{common.AttributeMountUID: "nobody"}); err == nil {
+		t.Errorf("Expected error for invalid mount owner")
+	}
+}
+
+func TestGetMultipathDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multipath")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	sysBlock := filepath.Join(dir, "sys")
+	devPath := filepath.Join(dir, "wwn-0x6000c29")
+	mustMkdir := func(path string) {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatalf("Failed to create %s: %v", path, err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "sdb"), nil, 0644); err != nil {
+		t.Fatalf("Failed to create device: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "sdb"), devPath); err != nil {
+		t.Fatalf("Failed to create device link: %v", err)
+	}
+
+	// Multipath is not configured
+	if mpath, err := getMultipathDevice(sysBlock, devPath); err != nil || mpath != "" {
+		t.Errorf("Expected no multipath device, got %q, err: %v", mpath, err)
+	}
+
+	// The device is held by a device which is not a multipath device
+	mustMkdir(filepath.Join(sysBlock, "sdb", "holders", "dm-0"))
+	mustMkdir(filepath.Join(sysBlock, "dm-0", "dm"))
+	if err := ioutil.WriteFile(filepath.Join(sysBlock, "dm-0", "dm", "uuid"), []byte("CRYPT-LUKS2-0"), 0644); err != nil {
+		t.Fatalf("Failed to create dm uuid: %v", err)
+	}
+	if mpath, err := getMultipathDevice(sysBlock, devPath); err != nil || mpath != "" {
+		t.Errorf("Expected no multipath device, got %q, err: %v", mpath, err)
+	}
+
+	mustMkdir(filepath.Join(sysBlock, "sdb", "holders", "dm-1"))
+	mustMkdir(filepath.Join(sysBlock, "dm-1", "dm"))
+	if err := ioutil.WriteFile(filepath.Join(sysBlock, "dm-1", "dm", "uuid"), []byte("mpath-36000c29\n"), 0644); err != nil {
+		t.Fatalf("Failed to create dm uuid: %v", err)
+	}
+	if mpath, err := getMultipathDevice(sysBlock, devPath); err != nil || mpath != "/dev/dm-1" {
+		t.Errorf("Expected multipath device /dev/dm-1, got %q, err: %v", mpath, err)
+	}
+}
+
 type FakeFileInfo struct {
 	name string
 }
@@ -34,7 +34,7 @@ import (
 
 const (
 	// Name is the name of this CSI SP.
-	Name = "csi.vsphere.vmware.com"
+	Name = vTypes.Name
 
 	// UnixSocketPrefix is the prefix before the path on disk
 	UnixSocketPrefix = "unix://"
@@ -55,6 +55,11 @@ type Service interface {
 type service struct {
 	mode string
 	cs   vTypes.Controller
+	// cfg is the config of the controller service, nil in node mode
+	cfg         *cnsconfig.Config
+	nodeServing bool
+	nodeCfg     cnsconfig.NodeConfig
+	volStats    *volumeStatsCollector
 }
 
 // This works around a bug that if k8s node dies, this will clean up the sock file
@@ -107,6 +112,24 @@ func (s *service) BeforeServe(
 			klog.Errorf("Failed to init controller. Error: %v", err)
 			return err
 		}
+		s.cfg = cfg
+	}
+	if strings.EqualFold(s.mode, "controller") {
+		// The node service is not registered, so the node config and the VM
+		// of the node are not looked up
+		klog.V(2).Infof("Node service disabled in controller mode")
+	} else {
+		// Node service is needed
+		s.nodeServing = true
+		s.nodeCfg = getNodeConfig(ctx)
+		if s.nodeCfg.MetricsAddress != "" {
+			s.volStats = startVolumeStatsCollector(s.nodeCfg.MetricsAddress, s.nodeCfg.VolumeStatsIntervalInSec)
+		}
+	}
+	if s.cfg != nil && s.cfg.Controller.DiagnosticsAddress != "" {
+		s.startDiagnosticsServer(s.cfg.Controller.DiagnosticsAddress)
+	} else if s.nodeServing && s.nodeCfg.DiagnosticsAddress != "" {
+		s.startDiagnosticsServer(s.nodeCfg.DiagnosticsAddress)
 	}
 	return nil
 }
@@ -0,0 +1,232 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+)
+
+const (
+	procDiskstats = "/proc/diskstats"
+	// sectors in /proc/diskstats are always 512 bytes
+	diskstatsSectorSize             = 512
+	defaultVolumeStatsIntervalInSec = 60
+)
+
+// diskStats holds the I/O counters of a block device read from /proc/diskstats
+type diskStats struct {
+	readsCompleted  uint64
+	sectorsRead     uint64
+	msReading       uint64
+	writesCompleted uint64
+	sectorsWritten  uint64
+	msWriting       uint64
+}
+
+// publishedVolume is a volume published on the node
+type publishedVolume struct {
+	volumeID  string
+	pod       string
+	namespace string
+	// device is the kernel name of the block device, e.g. "sdb"
+	device string
+}
+
+// volumeStatsCollector is a prometheus collector exposing the I/O counters of
+// the volumes published on the node, labeled by volume ID and pod. The counters
+// are read periodically from /proc/diskstats and served from the last read.
+type volumeStatsCollector struct {
+	mu sync.Mutex
+	// published maps publish target paths to their volumes
+	published map[string]publishedVolume
+	// stats maps device names to their last read I/O counters
+	stats map[string]diskStats
+
+	readOps      *prometheus.Desc
+	readBytes    *prometheus.Desc
+	readSeconds  *prometheus.Desc
+	writeOps     *prometheus.Desc
+	writeBytes   *prometheus.Desc
+	writeSeconds *prometheus.Desc
+}
+
+func newVolumeStatsCollector() *volumeStatsCollector {
+	labels := []string{"volume_id", "pod", "namespace"}
+	return &volumeStatsCollector{
+		published: make(map[string]publishedVolume),
+		stats:     make(map[string]diskStats),
+		readOps: prometheus.NewDesc("vsphere_csi_volume_read_ops_total",
+			"Number of reads completed on the volume", labels, nil),
+		readBytes: prometheus.NewDesc("vsphere_csi_volume_read_bytes_total",
+			"Number of bytes read from the volume", labels, nil),
+		readSeconds: prometheus.NewDesc("vsphere_csi_volume_read_seconds_total",
+			"Time spent reading from the volume", labels, nil),
+		writeOps: prometheus.NewDesc("vsphere_csi_volume_write_ops_total",
+			"Number of writes completed on the volume", labels, nil),
+		writeBytes: prometheus.NewDesc("vsphere_csi_volume_write_bytes_total",
+			"Number of bytes written to the volume", labels, nil),
+		writeSeconds: prometheus.NewDesc("vsphere_csi_volume_write_seconds_total",
+			"Time spent writing to the volume", labels, nil),
+	}
+}
+
+// startVolumeStatsCollector registers a volume stats collector and serves its
+// metrics on the given address
+func startVolumeStatsCollector(address string, intervalInSec int) *volumeStatsCollector {
+	if intervalInSec <= 0 {
+		intervalInSec = defaultVolumeStatsIntervalInSec
+	}
+	collector := newVolumeStatsCollector()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	go func() {
+		klog.V(2).Infof("Serving volume metrics on %s", address)
+		if err := http.ListenAndServe(address, mux); err != nil {
+			klog.Errorf("Failed to serve volume metrics on %s. Err: %v", address, err)
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(time.Duration(intervalInSec) * time.Second)
+		for ; true; <-ticker.C {
+			collector.refresh()
+		}
+	}()
+	return collector
+}
+
+// track records a volume published to target
+func (c *volumeStatsCollector) track(target string, vol publishedVolume) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.published[target] = vol
+}
+
+// untrack forgets the volume published to target
+func (c *volumeStatsCollector) untrack(target string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.published, target)
+}
+
+// refresh reads the I/O counters of the block devices from /proc/diskstats
+func (c *volumeStatsCollector) refresh() {
+	f, err := os.Open(procDiskstats)
+	if err != nil {
+		klog.Warningf("Failed to open %s. Err: %v", procDiskstats, err)
+		return
+	}
+	defer f.Close()
+	stats, err := parseDiskstats(f)
+	if err != nil {
+		klog.Warningf("Failed to parse %s. Err: %v", procDiskstats, err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats = stats
+}
+
+// Describe implements prometheus.Collector
+func (c *volumeStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.readOps
+	ch <- c.readBytes
+	ch <- c.readSeconds
+	ch <- c.writeOps
+	ch <- c.writeBytes
+	ch <- c.writeSeconds
+}
+
+// Collect implements prometheus.Collector
+func (c *volumeStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// A volume published to several targets of the same pod is reported once
+	reported := make(map[publishedVolume]bool)
+	for _, vol := range c.published {
+		stats, ok := c.stats[vol.device]
+		if !ok || reported[vol] {
+			continue
+		}
+		reported[vol] = true
+		labels := []string{vol.volumeID, vol.pod, vol.namespace}
+		ch <- prometheus.MustNewConstMetric(c.readOps, prometheus.CounterValue, float64(stats.readsCompleted), labels...)
+		ch <- prometheus.MustNewConstMetric(c.readBytes, prometheus.CounterValue, float64(stats.sectorsRead*diskstatsSectorSize), labels...)
+		ch <- prometheus.MustNewConstMetric(c.readSeconds, prometheus.CounterValue, float64(stats.msReading)/1000, labels...)
+		ch <- prometheus.MustNewConstMetric(c.writeOps, prometheus.CounterValue, float64(stats.writesCompleted), labels...)
+		ch <- prometheus.MustNewConstMetric(c.writeBytes, prometheus.CounterValue, float64(stats.sectorsWritten*diskstatsSectorSize), labels...)
+		ch <- prometheus.MustNewConstMetric(c.writeSeconds, prometheus.CounterValue, float64(stats.msWriting)/1000, labels...)
+	}
+}
+
+// newPublishedVolume returns the published volume backed by the device
+func newPublishedVolume(volID string, volumeContext map[string]string, dev *Device) publishedVolume {
+	return publishedVolume{
+		volumeID:  volID,
+		pod:       volumeContext[common.AttributePodName],
+		namespace: volumeContext[common.AttributePodNamespace],
+		device:    filepath.Base(dev.RealDev),
+	}
+}
+
+// parseDiskstats parses the content of /proc/diskstats into a map of device
+// names to their I/O counters
+func parseDiskstats(r io.Reader) (map[string]diskStats, error) {
+	stats := make(map[string]diskStats)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// major minor name followed by at least 11 counters
+		if len(fields) < 14 {
+			continue
+		}
+		counters := make([]uint64, 8)
+		for i := range counters {
+			v, err := strconv.ParseUint(fields[3+i], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid counter %q for device %s: %v", fields[3+i], fields[2], err)
+			}
+			counters[i] = v
+		}
+		stats[fields[2]] = diskStats{
+			readsCompleted:  counters[0],
+			sectorsRead:     counters[2],
+			msReading:       counters[3],
+			writesCompleted: counters[4],
+			sectorsWritten:  counters[6],
+			msWriting:       counters[7],
+		}
+	}
+	return stats, scanner.Err()
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseDiskstats(t *testing.T) {
+	content := `   8       0 sda 9214 2811 667770 5283 4137 5271 215858 11378 0 8388 13148
+   8      16 sdb 120 0 4096 30 64 12 2048 90 0 110 120 0 0 0 0
+   7       0 loop0 0`
+	stats, err := parseDiskstats(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("Expected stats of 2 devices got: %d", len(stats))
+	}
+	expected := diskStats{
+		readsCompleted:  120,
+		sectorsRead:     4096,
+		msReading:       30,
+		writesCompleted: 64,
+		sectorsWritten:  2048,
+		msWriting:       90,
+	}
+	if stats["sdb"] != expected {
+		t.Errorf("Expected stats %+v got: %+v", expected, stats["sdb"])
+	}
+
+	if _, err := parseDiskstats(strings.NewReader("8 0 sda x 0 0 0 0 0 0 0 0 0 0")); err == nil {
+		t.Errorf("Expected error for invalid counter")
+	}
+}
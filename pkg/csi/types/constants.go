@@ -17,8 +17,12 @@ limitations under the License.
 package types
 
 const (
+	// Name is the name of the vSphere CSI driver
+	Name = "csi.vsphere.vmware.com"
 	// LabelRegionFailureDomain is label placed on nodes and PV containing region detail
 	LabelRegionFailureDomain = "failure-domain.beta.kubernetes.io/region"
 	// LabelZoneFailureDomain is label placed on nodes and PV containing zone detail
 	LabelZoneFailureDomain = "failure-domain.beta.kubernetes.io/zone"
+	// LabelHostname is label placed on nodes containing the node hostname
+	LabelHostname = "kubernetes.io/hostname"
 )
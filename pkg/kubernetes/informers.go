@@ -91,6 +91,19 @@ func (im *InformerManager) AddPodListener(add func(obj interface{}), update func
 	})
 }
 
+// AddNamespaceListener hooks up add, update, delete callbacks
+func (im *InformerManager) AddNamespaceListener(add func(obj interface{}), update func(oldObj, newObj interface{}), remove func(obj interface{})) {
+	if im.namespaceInformer == nil {
+		im.namespaceInformer = im.informerFactory.Core().V1().Namespaces().Informer()
+	}
+
+	im.namespaceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    add,
+		UpdateFunc: update,
+		DeleteFunc: remove,
+	})
+}
+
 // GetPVLister returns Persistent Volume Lister for the calling informer manager
 func (im *InformerManager) GetPVLister() corelisters.PersistentVolumeLister {
 	return im.informerFactory.Core().V1().PersistentVolumes().Lister()
@@ -101,6 +114,11 @@ func (im *InformerManager) GetPVCLister() corelisters.PersistentVolumeClaimListe
 	return im.informerFactory.Core().V1().PersistentVolumeClaims().Lister()
 }
 
+// GetPodLister returns Pod Lister for the calling informer manager
+func (im *InformerManager) GetPodLister() corelisters.PodLister {
+	return im.informerFactory.Core().V1().Pods().Lister()
+}
+
 // Listen starts the Informers
 func (im *InformerManager) Listen() (stopCh <-chan struct{}) {
 	go im.informerFactory.Start(im.stopCh)
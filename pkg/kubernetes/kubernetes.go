@@ -19,14 +19,29 @@ package kubernetes
 import (
 	"k8s.io/klog"
 
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
 	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
 )
 
+// AttacherFinalizer is the finalizer the external-attacher sets on the
+// VolumeAttachments of the driver until their volume is detached.
+const AttacherFinalizer = "external-attacher/csi-vsphere-vmware-com"
+
 // NewClient creates a newk8s client based on a service account
 func NewClient() (clientset.Interface, error) {
 
@@ -42,6 +57,35 @@ func NewClient() (clientset.Interface, error) {
 	return clientset.NewForConfig(config)
 }
 
+// NewDynamicClient creates a new dynamic k8s client based on a service account,
+// along with a REST mapper resolving kinds to resources through discovery
+func NewDynamicClient() (dynamic.Interface, meta.RESTMapper, error) {
+	klog.V(2).Info("k8s dynamic client using in-cluster config")
+	config, err := restclient.InClusterConfig()
+	if err != nil {
+		klog.Errorf("InClusterConfig failed %q", err)
+		return nil, nil, err
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient))
+	return dynamicClient, mapper, nil
+}
+
+// NewEventRecorder creates an event recorder posting the events of the given
+// component through the k8s client
+func NewEventRecorder(client clientset.Interface, component string) record.EventRecorder {
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: component})
+}
+
 // CreateKubernetesClientFromConfig creaates a newk8s client from given kubeConfig file
 func CreateKubernetesClientFromConfig(kubeConfigPath string) (clientset.Interface, error) {
 
@@ -69,3 +113,35 @@ func GetNodeVMUUID(k8sclient clientset.Interface, nodeName string) (string, erro
 	klog.V(2).Infof("Retrieved node UUID: %q for the node: %q", k8sNodeUUID, nodeName)
 	return k8sNodeUUID, nil
 }
+
+// RemoveAttacherFinalizer removes the attacher finalizer from the current
+// version of the VolumeAttachment with the given name, leaving its other
+// finalizers in place. The VolumeAttachment is read again before the update,
+// and on conflicts, as deleting it bumps its resource version. VolumeAttachments
+// already gone are left alone.
+func RemoveAttacherFinalizer(k8sclient clientset.Interface, name string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		va, err := k8sclient.StorageV1().VolumeAttachments().Get(name, metav1.GetOptions{})
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+		var finalizers []string
+		for _, finalizer := range va.Finalizers {
+			if finalizer != AttacherFinalizer {
+				finalizers = append(finalizers, finalizer)
+			}
+		}
+		if len(finalizers) == len(va.Finalizers) {
+			return nil
+		}
+		va.Finalizers = finalizers
+		_, err = k8sclient.StorageV1().VolumeAttachments().Update(va)
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+}
@@ -43,4 +43,7 @@ type InformerManager struct {
 
 	// Pod informer
 	podInformer cache.SharedInformer
+
+	// Namespace informer
+	namespaceInformer cache.SharedInformer
 }
@@ -0,0 +1,293 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	"github.com/vmware/govmomi/vim25/types"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	volumes "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+)
+
+// attachStateDiscrepancies reports the number of discrepancies between the
+// attach state of volumes according to Kubernetes and CNS and the disks of
+// the node VMs, as of the last attach state check
+var attachStateDiscrepancies = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "vsphere_csi_attach_state_discrepancies",
+	Help: "Number of discrepancies found by the last attach state check",
+})
+
+func init() {
+	prometheus.MustRegister(attachStateDiscrepancies)
+}
+
+// triggerAttachStateCheck compares the volumes CNS records as attached to each
+// node VM, through the consumers of their first class disk, and the volumes
+// attached to the node according to Kubernetes VolumeAttachments with the
+// disks of the node VM in vCenter. Volumes missing from their node VM are
+// re-attached through CNS when auto-correct is enabled. Other discrepancies,
+// including attachments CNS records for disks the node VM no longer has, are
+// only reported, as detaching volumes could disrupt a workload.
+func triggerAttachStateCheck(k8sclient clientset.Interface, metadataSyncer *MetadataSyncInformer) {
+	klog.V(2).Infof("AttachCheck: start")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	vaList, err := k8sclient.StorageV1().VolumeAttachments().List(metav1.ListOptions{})
+	if err != nil {
+		klog.Warningf("AttachCheck: Failed to get VolumeAttachments from kubernetes. Err: %v", err)
+		return
+	}
+	attachedVolumesByNode, attachedOutsideCNS := getAttachedVolumesByNode(vaList.Items, func(pvName string) (string, error) {
+		pv, err := metadataSyncer.pvLister.Get(pvName)
+		if err != nil {
+			return "", err
+		}
+		if pv.Spec.CSI == nil {
+			return "", fmt.Errorf("PV %s is not a CSI volume", pvName)
+		}
+		return pv.Spec.CSI.VolumeHandle, nil
+	})
+
+	queryFilter := cnstypes.CnsQueryFilter{
+		ContainerClusterIds: []string{
+			metadataSyncer.cfg.Global.ClusterID,
+		},
+	}
+	queryAllResult, err := volumes.GetManager(metadataSyncer.vcenter).QueryAllVolume(queryFilter, cnstypes.CnsQuerySelection{})
+	if err != nil {
+		klog.Warningf("AttachCheck: QueryVolume failed with err=%+v", err.Error())
+		return
+	}
+	cnsVolumes := make(map[string]bool)
+	for _, volume := range queryAllResult.Volumes {
+		cnsVolumes[volume.VolumeId.Id] = true
+	}
+	consumersByVolume, err := getCNSConsumers(ctx, metadataSyncer, queryAllResult.Volumes)
+	if err != nil {
+		klog.Warningf("AttachCheck: Failed to get datastores. Err: %v", err)
+		return
+	}
+
+	nodeList, err := k8sclient.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		klog.Warningf("AttachCheck: Failed to get nodes from kubernetes. Err: %v", err)
+		return
+	}
+	discrepancies := 0
+	for _, node := range nodeList.Items {
+		nodeUUID := common.GetUUIDFromProviderID(node.Spec.ProviderID)
+		if nodeUUID == "" {
+			continue
+		}
+		vm, err := cnsvsphere.GetVirtualMachineByUUID(nodeUUID, false)
+		if err != nil {
+			klog.Warningf("AttachCheck: Failed to get VM for node %q. Err: %v", node.Name, err)
+			continue
+		}
+		vmDisks, err := getVMDiskIDs(ctx, vm)
+		if err != nil {
+			klog.Warningf("AttachCheck: Failed to get disks of VM %v for node %q. Err: %v", vm, node.Name, err)
+			continue
+		}
+		vmIDs, err := vm.GetUUIDs(ctx)
+		if err != nil {
+			klog.Warningf("AttachCheck: Failed to get IDs of VM %v for node %q. Err: %v", vm, node.Name, err)
+			continue
+		}
+		cnsAttached := make(map[string]bool)
+		for volumeID, consumers := range consumersByVolume {
+			for _, consumer := range consumers {
+				if vmIDs[consumer] {
+					cnsAttached[volumeID] = true
+				}
+			}
+		}
+		state := compareAttachState(attachedVolumesByNode[node.Name], attachedOutsideCNS, vmDisks, cnsAttached, cnsVolumes)
+		discrepancies += state.count()
+		for _, volumeID := range state.missingDisks {
+			klog.Warningf("AttachCheck: Volume %q is attached to node %q according to kubernetes but is not a disk of VM %v",
+				volumeID, node.Name, vm)
+			// Volumes attached outside CNS can't be attached again through CNS
+			if !metadataSyncer.cfg.Syncer.AttachCheckAutoCorrect || attachedOutsideCNS[volumeID] {
+				continue
+			}
+			if _, err := volumes.GetManager(metadataSyncer.vcenter).AttachVolume(vm, volumeID); err != nil {
+				klog.Errorf("AttachCheck: Failed to re-attach volume %q to node %q. Err: %v", volumeID, node.Name, err)
+			} else {
+				klog.V(2).Infof("AttachCheck: Re-attached volume %q to node %q", volumeID, node.Name)
+			}
+		}
+		for _, volumeID := range state.untrackedDisks {
+			klog.Warningf("AttachCheck: Volume %q is a disk of VM %v but is not attached to node %q according to kubernetes",
+				volumeID, vm, node.Name)
+		}
+		for _, volumeID := range state.unrecordedDisks {
+			klog.Warningf("AttachCheck: Volume %q is a disk of VM %v of node %q but CNS does not record it as attached to the VM",
+				volumeID, vm, node.Name)
+		}
+		for _, volumeID := range state.staleAttachments {
+			klog.Warningf("AttachCheck: CNS records volume %q as attached to VM %v of node %q but it is not a disk of the VM",
+				volumeID, vm, node.Name)
+		}
+	}
+	attachStateDiscrepancies.Set(float64(discrepancies))
+	klog.V(2).Infof("AttachCheck: end, found %d discrepancies", discrepancies)
+}
+
+// getCNSConsumers maps the IDs of the given CNS volumes to the IDs of the VMs
+// CNS records them as attached to, through the consumers of their first class
+// disk. Volumes whose consumers can't be retrieved are skipped.
+func getCNSConsumers(ctx context.Context, metadataSyncer *MetadataSyncInformer,
+	cnsVolumes []cnstypes.CnsVolume) (map[string][]string, error) {
+	datastores, err := getDatastoresByURL(ctx, metadataSyncer)
+	if err != nil {
+		return nil, err
+	}
+	consumersByVolume := make(map[string][]string)
+	for _, volume := range cnsVolumes {
+		datastore := datastores[volume.DatastoreUrl]
+		if datastore == nil {
+			klog.V(3).Infof("Skipping CNS attachment of volume %q, datastore %s not found",
+				volume.VolumeId.Id, volume.DatastoreUrl)
+			continue
+		}
+		consumers, err := datastore.GetVStorageObjectConsumers(ctx, volume.VolumeId.Id)
+		if err != nil {
+			klog.Warningf("Failed to get CNS attachment of volume %q. Err: %v", volume.VolumeId.Id, err)
+			continue
+		}
+		consumersByVolume[volume.VolumeId.Id] = consumers
+	}
+	return consumersByVolume, nil
+}
+
+// getAttachedVolumesByNode maps node names to the IDs of the volumes attached
+// to them according to the VolumeAttachments of the driver. It also returns
+// the IDs of the volumes the controller attached outside CNS, as recorded by
+// the SCSI controller in their attachment metadata. getVolumeHandle returns
+// the volume handle of a PV. VolumeAttachments being deleted are skipped, as
+// their volume may already be detached.
+func getAttachedVolumesByNode(vas []storagev1.VolumeAttachment,
+	getVolumeHandle func(pvName string) (string, error)) (map[string]map[string]bool, map[string]bool) {
+	attachedVolumesByNode := make(map[string]map[string]bool)
+	attachedOutsideCNS := make(map[string]bool)
+	for _, va := range vas {
+		if va.Spec.Attacher != service.Name || !va.Status.Attached || va.DeletionTimestamp != nil ||
+			va.Spec.Source.PersistentVolumeName == nil {
+			continue
+		}
+		volumeID, err := getVolumeHandle(*va.Spec.Source.PersistentVolumeName)
+		if err != nil {
+			klog.V(3).Infof("AttachCheck: Skipping volume attachment %q, failed to get its CSI PV. Err: %v", va.Name, err)
+			continue
+		}
+		if attachedVolumesByNode[va.Spec.NodeName] == nil {
+			attachedVolumesByNode[va.Spec.NodeName] = make(map[string]bool)
+		}
+		attachedVolumesByNode[va.Spec.NodeName][volumeID] = true
+		if common.IsAttachmentOutsideCNS(va.Status.AttachmentMetadata) {
+			attachedOutsideCNS[volumeID] = true
+		}
+	}
+	return attachedVolumesByNode, attachedOutsideCNS
+}
+
+// attachState holds the discrepancies between the volumes attached to a node
+// VM according to Kubernetes and CNS, and the disks of the VM.
+type attachState struct {
+	// missingDisks are attached according to Kubernetes but not disks of the VM
+	missingDisks []string
+	// untrackedDisks are CNS volumes which are disks of the VM but not
+	// attached according to Kubernetes
+	untrackedDisks []string
+	// unrecordedDisks are CNS volumes which are disks of the VM but not
+	// recorded as attached to the VM by CNS, other than volumes attached
+	// outside CNS
+	unrecordedDisks []string
+	// staleAttachments are recorded as attached to the VM by CNS but not disks
+	// of the VM
+	staleAttachments []string
+}
+
+// count returns the number of discrepancies.
+func (s attachState) count() int {
+	return len(s.missingDisks) + len(s.untrackedDisks) + len(s.unrecordedDisks) + len(s.staleAttachments)
+}
+
+// compareAttachState compares the volumes attached to a node VM according to
+// Kubernetes and CNS with the disks of the VM. outsideCNS holds the IDs of the
+// volumes attached outside CNS and cnsVolumes the IDs of the CNS volumes of
+// the cluster.
+func compareAttachState(k8sAttached map[string]bool, outsideCNS map[string]bool, vmDisks map[string]bool,
+	cnsAttached map[string]bool, cnsVolumes map[string]bool) attachState {
+	var state attachState
+	for volumeID := range k8sAttached {
+		if !vmDisks[volumeID] {
+			state.missingDisks = append(state.missingDisks, volumeID)
+		}
+	}
+	for volumeID := range vmDisks {
+		if !cnsVolumes[volumeID] {
+			continue
+		}
+		if !k8sAttached[volumeID] {
+			state.untrackedDisks = append(state.untrackedDisks, volumeID)
+		}
+		if !cnsAttached[volumeID] && !outsideCNS[volumeID] {
+			state.unrecordedDisks = append(state.unrecordedDisks, volumeID)
+		}
+	}
+	for volumeID := range cnsAttached {
+		if !vmDisks[volumeID] {
+			state.staleAttachments = append(state.staleAttachments, volumeID)
+		}
+	}
+	sort.Strings(state.missingDisks)
+	sort.Strings(state.untrackedDisks)
+	sort.Strings(state.unrecordedDisks)
+	sort.Strings(state.staleAttachments)
+	return state
+}
+
+// getVMDiskIDs returns the IDs of the first class disks attached to the VM.
+func getVMDiskIDs(ctx context.Context, vm *cnsvsphere.VirtualMachine) (map[string]bool, error) {
+	devices, err := vm.Device(ctx)
+	if err != nil {
+		return nil, err
+	}
+	diskIDs := make(map[string]bool)
+	for _, device := range devices.SelectByType((*types.VirtualDisk)(nil)) {
+		disk := device.(*types.VirtualDisk)
+		if disk.VDiskId != nil && disk.VDiskId.Id != "" {
+			diskIDs[disk.VDiskId.Id] = true
+		}
+	}
+	return diskIDs, nil
+}
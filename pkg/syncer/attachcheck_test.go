@@ -0,0 +1,105 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+)
+
+func TestGetAttachedVolumesByNode(t *testing.T) {
+	newVA := func(name string, pvName string, attached bool) storagev1.VolumeAttachment {
+		return storagev1.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: storagev1.VolumeAttachmentSpec{
+				Attacher: service.Name,
+				NodeName: "node-1",
+				Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+			},
+			Status: storagev1.VolumeAttachmentStatus{Attached: attached},
+		}
+	}
+	outsideCNS := newVA("va-outside-cns", "pv-outside-cns", true)
+	outsideCNS.Status.AttachmentMetadata = map[string]string{common.AttributeSCSIController: "1", common.AttributeAttachedOutsideCNS: "true"}
+	deleting := newVA("va-deleting", "pv-deleting", true)
+	now := metav1.Now()
+	deleting.DeletionTimestamp = &now
+	vas := []storagev1.VolumeAttachment{
+		newVA("va-1", "pv-1", true),
+		outsideCNS,
+		newVA("va-detached", "pv-detached", false),
+		newVA("va-unknown", "pv-unknown", true),
+		deleting,
+	}
+	getVolumeHandle := func(pvName string) (string, error) {
+		if pvName == "pv-unknown" {
+			return "", fmt.Errorf("PV %s not found", pvName)
+		}
+		return "vol-" + pvName, nil
+	}
+
+	attached, attachedOutsideCNS := getAttachedVolumesByNode(vas, getVolumeHandle)
+	expected := map[string]map[string]bool{"node-1": {"vol-pv-1": true, "vol-pv-outside-cns": true}}
+	if !reflect.DeepEqual(attached, expected) {
+		t.Errorf("expected attached volumes %v, got %v", expected, attached)
+	}
+	if len(attachedOutsideCNS) != 1 || !attachedOutsideCNS["vol-pv-outside-cns"] {
+		t.Errorf("expected only vol-pv-outside-cns to be attached outside CNS, got %v", attachedOutsideCNS)
+	}
+}
+
+func TestCompareAttachState(t *testing.T) {
+	k8sAttached := map[string]bool{"vol-ok": true, "vol-missing": true, "vol-unrecorded": true}
+	vmDisks := map[string]bool{"vol-ok": true, "vol-untracked": true, "vol-unrecorded": true, "non-cns": true}
+	cnsAttached := map[string]bool{"vol-ok": true, "vol-untracked": true, "vol-stale": true}
+	cnsVolumes := map[string]bool{"vol-ok": true, "vol-missing": true, "vol-untracked": true, "vol-unrecorded": true, "vol-stale": true}
+
+	state := compareAttachState(k8sAttached, nil, vmDisks, cnsAttached, cnsVolumes)
+	expected := attachState{
+		missingDisks:     []string{"vol-missing"},
+		untrackedDisks:   []string{"vol-untracked"},
+		unrecordedDisks:  []string{"vol-unrecorded"},
+		staleAttachments: []string{"vol-stale"},
+	}
+	if !reflect.DeepEqual(state, expected) {
+		t.Errorf("expected discrepancies %+v, got %+v", expected, state)
+	}
+	if state.count() != 4 {
+		t.Errorf("expected 4 discrepancies, got %d", state.count())
+	}
+
+	// A consistent node has no discrepancy
+	state = compareAttachState(map[string]bool{"vol-ok": true}, nil, map[string]bool{"vol-ok": true},
+		map[string]bool{"vol-ok": true}, cnsVolumes)
+	if state.count() != 0 {
+		t.Errorf("expected no discrepancy, got %+v", state)
+	}
+
+	// Volumes attached outside CNS are not recorded by CNS
+	state = compareAttachState(map[string]bool{"vol-ok": true}, map[string]bool{"vol-ok": true},
+		map[string]bool{"vol-ok": true}, nil, cnsVolumes)
+	if state.count() != 0 {
+		t.Errorf("expected no discrepancy for volume attached outside CNS, got %+v", state)
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	"k8s.io/klog"
+
+	volumes "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+// unresolvableVolumes reports the number of CNS volumes whose datastore URL
+// does not resolve to a datastore of the vCenter, e.g. after the datastore was
+// resignatured. It is exposed on the syncer metrics address.
+var unresolvableVolumes = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "vsphere_csi_unresolvable_volumes",
+	Help: "Number of CNS volumes whose datastore URL does not resolve to a datastore",
+})
+
+func init() {
+	prometheus.MustRegister(unresolvableVolumes)
+}
+
+// getDatastoresByURL returns the datastores of all datacenters of the vCenter
+// keyed by URL.
+func getDatastoresByURL(ctx context.Context, metadataSyncer *MetadataSyncInformer) (map[string]*cnsvsphere.DatastoreInfo, error) {
+	datacenters, err := metadataSyncer.vcenter.GetDatacenters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	datastores := make(map[string]*cnsvsphere.DatastoreInfo)
+	for _, datacenter := range datacenters {
+		datacenterDatastores, err := datacenter.GetAllDatastores(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for url, datastore := range datacenterDatastores {
+			datastores[url] = datastore
+		}
+	}
+	return datastores, nil
+}
+
+// checkVolumeDatastores verifies the datastore URL of the CNS volumes resolves
+// to one of the given datastores. Volume handles are FCD IDs, so they remain
+// valid when the datastore URL changes. The FCDs of volumes with a stale URL
+// are looked up by ID on all the datastores, and the FCD inventory of the
+// datastore holding them is reconciled so that CNS records their current
+// datastore. Volumes which still do not resolve are reported, as they need
+// operator intervention.
+func checkVolumeDatastores(ctx context.Context, metadataSyncer *MetadataSyncInformer, cnsVolumes []cnstypes.CnsVolume,
+	datastores map[string]*cnsvsphere.DatastoreInfo) {
+	unresolved := 0
+	reconciled := make(map[string]bool)
+	for _, volume := range getUnresolvedVolumes(cnsVolumes, datastores) {
+		datastoreURL, err := findVolumeDatastore(ctx, volume.VolumeId.Id, datastores)
+		if err == nil && datastoreURL != "" {
+			if !reconciled[datastoreURL] {
+				err = datastores[datastoreURL].ReconcileVStorageObjectInventory(ctx)
+				reconciled[datastoreURL] = err == nil
+			}
+			if err == nil {
+				err = resolveVolumeDatastore(metadataSyncer, volume.VolumeId, datastoreURL)
+			}
+			if err == nil {
+				klog.V(2).Infof("DatastoreCheck: Volume %s resolved on datastore %s instead of %s", volume.VolumeId.Id,
+					datastoreURL, volume.DatastoreUrl)
+				continue
+			}
+		}
+		klog.Warningf("DatastoreCheck: Datastore %s of volume %s does not resolve to a datastore of vCenter %s. Err: %v",
+			volume.DatastoreUrl, volume.VolumeId.Id, metadataSyncer.vcenter.Config.Host, err)
+		unresolved++
+	}
+	unresolvableVolumes.Set(float64(unresolved))
+}
+
+// findVolumeDatastore returns the URL of the datastore holding the FCD of the
+// volume, or an empty string if none of the datastores holds it.
+func findVolumeDatastore(ctx context.Context, volumeID string, datastores map[string]*cnsvsphere.DatastoreInfo) (string, error) {
+	for url, datastore := range datastores {
+		present, err := datastore.IsVStorageObjectPresent(ctx, volumeID)
+		if err != nil {
+			return "", err
+		}
+		if present {
+			return url, nil
+		}
+	}
+	return "", nil
+}
+
+// resolveVolumeDatastore queries the volume by ID and returns an error unless
+// CNS records it on the datastore with the given URL.
+func resolveVolumeDatastore(metadataSyncer *MetadataSyncInformer, volumeID cnstypes.CnsVolumeId, datastoreURL string) error {
+	queryFilter := cnstypes.CnsQueryFilter{
+		VolumeIds: []cnstypes.CnsVolumeId{volumeID},
+	}
+	queryResult, err := volumes.GetManager(metadataSyncer.vcenter).QueryVolume(queryFilter)
+	if err != nil {
+		return err
+	}
+	if len(queryResult.Volumes) == 0 {
+		return fmt.Errorf("volume %s not found in CNS", volumeID.Id)
+	}
+	if queryResult.Volumes[0].DatastoreUrl != datastoreURL {
+		return fmt.Errorf("CNS records volume %s on datastore %s, its FCD is on datastore %s",
+			volumeID.Id, queryResult.Volumes[0].DatastoreUrl, datastoreURL)
+	}
+	return nil
+}
+
+// getUnresolvedVolumes returns the volumes whose datastore URL is not the URL
+// of one of the given datastores.
+func getUnresolvedVolumes(cnsVolumes []cnstypes.CnsVolume, datastores map[string]*cnsvsphere.DatastoreInfo) []cnstypes.CnsVolume {
+	var unresolved []cnstypes.CnsVolume
+	for _, volume := range cnsVolumes {
+		if datastores[volume.DatastoreUrl] == nil {
+			unresolved = append(unresolved, volume)
+		}
+	}
+	return unresolved
+}
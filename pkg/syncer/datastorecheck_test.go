@@ -0,0 +1,38 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"testing"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+func TestGetUnresolvedVolumes(t *testing.T) {
+	cnsVolumes := []cnstypes.CnsVolume{
+		{VolumeId: cnstypes.CnsVolumeId{Id: "vol-1"}, DatastoreUrl: "ds:///vmfs/volumes/ds-1/"},
+		{VolumeId: cnstypes.CnsVolumeId{Id: "vol-2"}, DatastoreUrl: "ds:///vmfs/volumes/ds-old/"},
+	}
+	datastores := map[string]*cnsvsphere.DatastoreInfo{"ds:///vmfs/volumes/ds-1/": {}}
+
+	unresolved := getUnresolvedVolumes(cnsVolumes, datastores)
+	if len(unresolved) != 1 || unresolved[0].VolumeId.Id != "vol-2" {
+		t.Errorf("Expected only vol-2 to be unresolved, got %v", unresolved)
+	}
+}
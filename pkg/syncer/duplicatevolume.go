@@ -0,0 +1,105 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+
+	volumes "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+)
+
+// duplicateVolumes reports the number of CNS volumes of the cluster sharing
+// their name with another volume of the cluster. It is exposed on the syncer
+// metrics address.
+var duplicateVolumes = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "vsphere_csi_duplicate_volumes",
+	Help: "Number of CNS volumes sharing their name with another volume of the cluster",
+})
+
+func init() {
+	prometheus.MustRegister(duplicateVolumes)
+}
+
+// checkDuplicateVolumes reports the CNS volumes of the cluster sharing their
+// name, which name based lookups cannot tell apart, with a metric and a log
+// listing their IDs. When enabled, the duplicates not referenced by any PV are
+// quarantined by removing them from CNS, keeping their backing disk, provided
+// another volume with their name is referenced by a PV. The IDs of the volumes
+// removed from CNS are returned.
+func checkDuplicateVolumes(metadataSyncer *MetadataSyncInformer, cnsVolumes []cnstypes.CnsVolume,
+	pvList []*v1.PersistentVolume) map[string]bool {
+	duplicates := getDuplicateVolumes(cnsVolumes)
+	removed := make(map[string]bool)
+	count := 0
+	for name, volumeIDs := range duplicates {
+		count += len(volumeIDs)
+		klog.Warningf("DuplicateCheck: Found %d CNS volumes with name %s: %v", len(volumeIDs), name, volumeIDs)
+	}
+	duplicateVolumes.Set(float64(count))
+	if !metadataSyncer.cfg.Syncer.QuarantineDuplicateVolumes || len(duplicates) == 0 {
+		return removed
+	}
+	pvVolumeHandles := make(map[string]bool)
+	for _, pv := range pvList {
+		pvVolumeHandles[pv.Spec.CSI.VolumeHandle] = true
+	}
+	volumeOperationsLock.Lock()
+	defer volumeOperationsLock.Unlock()
+	for name, volumeIDs := range duplicates {
+		var unreferenced []string
+		for _, volumeID := range volumeIDs {
+			if !pvVolumeHandles[volumeID] {
+				unreferenced = append(unreferenced, volumeID)
+			}
+		}
+		if len(unreferenced) == len(volumeIDs) {
+			klog.Warningf("DuplicateCheck: None of the CNS volumes with name %s is referenced by a PV, leaving them alone", name)
+			continue
+		}
+		for _, volumeID := range unreferenced {
+			klog.V(2).Infof("DuplicateCheck: Quarantining unreferenced volume %s with name %s by removing it from CNS", volumeID, name)
+			if err := volumes.GetManager(metadataSyncer.vcenter).DeleteVolume(volumeID, false); err != nil {
+				klog.Warningf("DuplicateCheck: Failed to remove volume %s from CNS with error %+v", volumeID, err)
+				continue
+			}
+			removed[volumeID] = true
+		}
+	}
+	return removed
+}
+
+// getDuplicateVolumes maps the names shared by several of the CNS volumes to
+// the sorted IDs of the volumes with the name.
+func getDuplicateVolumes(cnsVolumes []cnstypes.CnsVolume) map[string][]string {
+	volumeIDsByName := make(map[string][]string)
+	for _, volume := range cnsVolumes {
+		volumeIDsByName[volume.Name] = append(volumeIDsByName[volume.Name], volume.VolumeId.Id)
+	}
+	duplicates := make(map[string][]string)
+	for name, volumeIDs := range volumeIDsByName {
+		if len(volumeIDs) > 1 {
+			sort.Strings(volumeIDs)
+			duplicates[name] = volumeIDs
+		}
+	}
+	return duplicates
+}
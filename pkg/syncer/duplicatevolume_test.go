@@ -0,0 +1,37 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"reflect"
+	"testing"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+)
+
+func TestGetDuplicateVolumes(t *testing.T) {
+	cnsVolumes := []cnstypes.CnsVolume{
+		{Name: "pvc-1", VolumeId: cnstypes.CnsVolumeId{Id: "volume-3"}},
+		{Name: "pvc-1", VolumeId: cnstypes.CnsVolumeId{Id: "volume-1"}},
+		{Name: "pvc-2", VolumeId: cnstypes.CnsVolumeId{Id: "volume-2"}},
+	}
+
+	expected := map[string][]string{"pvc-1": {"volume-1", "volume-3"}}
+	if duplicates := getDuplicateVolumes(cnsVolumes); !reflect.DeepEqual(duplicates, expected) {
+		t.Errorf("Expected duplicates %v, got %v", expected, duplicates)
+	}
+}
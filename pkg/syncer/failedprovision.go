@@ -0,0 +1,97 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"context"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+
+	volumes "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+)
+
+// triggerFailedProvisionSweep removes from CNS the volumes of the cluster which
+// are not referenced by any PV and whose backing disk no longer exists. Such
+// entries are left behind by CreateVolume calls which failed after CNS
+// recorded the volume, and are not cleaned up by the error path, e.g. when the
+// controller restarted. Volumes being provisioned are left alone, as their
+// backing disk exists.
+func triggerFailedProvisionSweep(metadataSyncer *MetadataSyncInformer) {
+	volumeOperationsLock.Lock()
+	defer volumeOperationsLock.Unlock()
+	pvList, err := metadataSyncer.pvLister.List(labels.Everything())
+	if err != nil {
+		klog.Warningf("FailedProvisionSweep: Failed to list PVs. Err: %v", err)
+		return
+	}
+	queryFilter := cnstypes.CnsQueryFilter{
+		ContainerClusterIds: []string{metadataSyncer.cfg.Global.ClusterID},
+	}
+	// Only the volumes returned are swept, so partial results are fine
+	queryAllResult, err := volumes.GetManager(metadataSyncer.vcenter).QueryAllVolume(queryFilter, cnstypes.CnsQuerySelection{})
+	if err != nil && err != volumes.ErrPartialQueryResult {
+		klog.Warningf("FailedProvisionSweep: Failed to query CNS volumes. Err: %v", err)
+		return
+	}
+	unreferenced := getUnreferencedVolumes(queryAllResult.Volumes, pvList)
+	if len(unreferenced) == 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	datastores, err := getDatastoresByURL(ctx, metadataSyncer)
+	if err != nil {
+		klog.Warningf("FailedProvisionSweep: Failed to get datastores. Err: %v", err)
+		return
+	}
+	for _, volume := range unreferenced {
+		volumeID := volume.VolumeId.Id
+		datastore := datastores[volume.DatastoreUrl]
+		if datastore == nil {
+			continue
+		}
+		present, err := datastore.IsVStorageObjectPresent(ctx, volumeID)
+		if err != nil || present {
+			continue
+		}
+		klog.V(2).Infof("FailedProvisionSweep: Removing volume %s with name %s and no backing disk from CNS", volumeID, volume.Name)
+		if err := volumes.GetManager(metadataSyncer.vcenter).DeleteVolume(volumeID, false); err != nil {
+			klog.Warningf("FailedProvisionSweep: Failed to remove volume %s from CNS with error %+v", volumeID, err)
+		}
+	}
+}
+
+// getUnreferencedVolumes returns the CNS volumes whose ID is not the volume
+// handle of any of the PVs.
+func getUnreferencedVolumes(cnsVolumes []cnstypes.CnsVolume, pvList []*v1.PersistentVolume) []cnstypes.CnsVolume {
+	pvVolumeHandles := make(map[string]bool)
+	for _, pv := range pvList {
+		if pv.Spec.CSI != nil {
+			pvVolumeHandles[pv.Spec.CSI.VolumeHandle] = true
+		}
+	}
+	var unreferenced []cnstypes.CnsVolume
+	for _, volume := range cnsVolumes {
+		if !pvVolumeHandles[volume.VolumeId.Id] {
+			unreferenced = append(unreferenced, volume)
+		}
+	}
+	return unreferenced
+}
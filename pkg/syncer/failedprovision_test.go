@@ -0,0 +1,46 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"testing"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetUnreferencedVolumes(t *testing.T) {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{VolumeHandle: "volume-1"},
+			},
+		},
+	}
+	nonCSI := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv-2"}}
+	cnsVolumes := []cnstypes.CnsVolume{
+		{VolumeId: cnstypes.CnsVolumeId{Id: "volume-1"}},
+		{VolumeId: cnstypes.CnsVolumeId{Id: "volume-2"}},
+	}
+
+	unreferenced := getUnreferencedVolumes(cnsVolumes, []*v1.PersistentVolume{pv, nonCSI})
+	if len(unreferenced) != 1 || unreferenced[0].VolumeId.Id != "volume-2" {
+		t.Errorf("Expected only volume-2 to be unreferenced, got %v", unreferenced)
+	}
+}
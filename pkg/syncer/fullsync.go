@@ -17,7 +17,9 @@ limitations under the License.
 package syncer
 
 import (
+	"context"
 	"sync"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	cnstypes "github.com/vmware/govmomi/cns/types"
@@ -33,15 +35,96 @@ import (
 	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
 )
 
-// triggerFullSync triggers full sync
+// triggerFullSync triggers full sync. Full syncs failing to query vCenter
+// are retried with backoff, up to the configured number of retries.
 func triggerFullSync(k8sclient clientset.Interface, metadataSyncer *MetadataSyncInformer) {
-	klog.V(2).Infof("FullSync: start")
+	backoff := time.Duration(defaultFullSyncRetryBackoffInSec) * time.Second
+	if metadataSyncer.cfg.Syncer.FullSyncRetryBackoffInSec > 0 {
+		backoff = time.Duration(metadataSyncer.cfg.Syncer.FullSyncRetryBackoffInSec) * time.Second
+	}
+	err := runWithRetries(metadataSyncer.cfg.Syncer.FullSyncRetries, backoff, func() error {
+		return runFullSync(k8sclient, metadataSyncer, "")
+	})
+	if err != nil && metadataSyncer.cfg.Syncer.FullSyncRetries > 0 {
+		klog.Warningf("FullSync: giving up after %d retries, waiting for the next full sync. Err: %v",
+			metadataSyncer.cfg.Syncer.FullSyncRetries, err)
+	}
+}
+
+// runWithRetries calls fn until it succeeds or it was retried the given
+// number of times, waiting for the backoff before the first retry and twice
+// as long before each further retry. The last error is returned.
+func runWithRetries(retries int, backoff time.Duration, fn func() error) error {
+	err := fn()
+	for retry := 1; err != nil && retry <= retries; retry++ {
+		klog.Warningf("Retrying in %v (%d/%d). Err: %v", backoff, retry, retries, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		err = fn()
+	}
+	return err
+}
+
+// triggerNamespaceFullSync triggers full sync limited to the PVs bound to PVCs in
+// the given namespace. Only the CNS metadata of these volumes is reconciled,
+// volumes are neither created nor deleted in CNS. Volumes missing in CNS are
+// still recorded in cnsCreationMap and get created by the next full sync.
+func triggerNamespaceFullSync(k8sclient clientset.Interface, metadataSyncer *MetadataSyncInformer, namespace string) {
+	if err := runFullSync(k8sclient, metadataSyncer, namespace); err != nil {
+		klog.Warningf("FullSync: failed for namespace %q. Err: %v", namespace, err)
+	}
+}
+
+// namespaceFullSyncRequested triggers a namespace scoped full sync when the
+// namespace carries the annTriggerFullSync annotation. The annotation is
+// removed before the sync runs, so it can be set again to request another run.
+func namespaceFullSyncRequested(obj interface{}, k8sclient clientset.Interface, metadataSyncer *MetadataSyncInformer) {
+	ns, ok := obj.(*v1.Namespace)
+	if ns == nil || !ok {
+		return
+	}
+	if _, requested := ns.Annotations[annTriggerFullSync]; !requested {
+		return
+	}
+	klog.V(2).Infof("FullSync: requested for namespace %q", ns.Name)
+	current, err := k8sclient.CoreV1().Namespaces().Get(ns.Name, metav1.GetOptions{})
+	if err != nil {
+		klog.Errorf("FullSync: Failed to get namespace %q. Err: %v", ns.Name, err)
+		return
+	}
+	if _, requested := current.Annotations[annTriggerFullSync]; !requested {
+		// Request was already handled
+		return
+	}
+	delete(current.Annotations, annTriggerFullSync)
+	if _, err = k8sclient.CoreV1().Namespaces().Update(current); err != nil {
+		klog.Errorf("FullSync: Failed to remove annotation %q from namespace %q. Err: %v", annTriggerFullSync, ns.Name, err)
+		return
+	}
+	go triggerNamespaceFullSync(k8sclient, metadataSyncer, ns.Name)
+}
+
+// runFullSync runs full sync for all volumes, or only for volumes bound in the
+// given namespace if namespace is not empty. The error of the CNS query is
+// returned if the sync was aborted because vCenter could not be queried.
+func runFullSync(k8sclient clientset.Interface, metadataSyncer *MetadataSyncInformer, namespace string) error {
+	fullSyncLock.Lock()
+	defer fullSyncLock.Unlock()
+	klog.V(2).Infof("FullSync: start for namespace %q", namespace)
 
 	// Get K8s PVs in State "Bound", "Available" or "Released"
 	k8sPVs, err := getPVsInBoundAvailableOrReleased(k8sclient)
 	if err != nil {
 		klog.Warningf("FullSync: Failed to get PVs from kubernetes. Err: %v", err)
-		return
+		return nil
+	}
+	k8sPVs = withoutLostVolumes(k8sPVs)
+	if namespace != "" {
+		k8sPVs = getPVsBoundInNamespace(k8sPVs, namespace)
+		if len(k8sPVs) == 0 {
+			klog.V(2).Infof("FullSync: No volumes bound in namespace %q", namespace)
+			return nil
+		}
 	}
 
 	// pvToPVCMap maps pv name to corresponding PVC
@@ -56,26 +139,68 @@ func triggerFullSync(k8sclient clientset.Interface, metadataSyncer *MetadataSync
 			metadataSyncer.cfg.Global.ClusterID,
 		},
 	}
+	if namespace != "" {
+		for _, pv := range k8sPVs {
+			queryFilter.VolumeIds = append(queryFilter.VolumeIds, cnstypes.CnsVolumeId{Id: pv.Spec.CSI.VolumeHandle})
+		}
+	}
 	querySelection := cnstypes.CnsQuerySelection{}
 	queryAllResult, err := volumes.GetManager(metadataSyncer.vcenter).QueryAllVolume(queryFilter, querySelection)
-	if err != nil {
+	// On a partial view of the CNS volumes, volumes missing from the view would be
+	// taken for volumes to create or delete, so only metadata updates are performed
+	partialView := err == volumes.ErrPartialQueryResult
+	if err != nil && !partialView {
 		klog.Warningf("FullSync: failed to queryAllVolume with err %v", err)
-		return
+		return err
+	}
+	if partialView {
+		klog.Warningf("FullSync: CNS returned partial results, skipping volume creation and deletion in this cycle")
 	}
 	cnsVolumeArray := queryAllResult.Volumes
+	if namespace == "" && !partialView {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		datastores, err := getDatastoresByURL(ctx, metadataSyncer)
+		if err != nil {
+			klog.Warningf("FullSync: Failed to get datastores. Err: %v", err)
+		} else {
+			checkVolumeDatastores(ctx, metadataSyncer, cnsVolumeArray, datastores)
+			removed := checkVolumeBackings(metadataSyncer, cnsVolumeArray, k8sPVs, datastores)
+			cnsVolumeArray = withoutVolumes(cnsVolumeArray, removed)
+			k8sPVs = withoutVolumePVs(k8sPVs, removed)
+		}
+		removed := checkDuplicateVolumes(metadataSyncer, cnsVolumeArray, k8sPVs)
+		cnsVolumeArray = withoutVolumes(cnsVolumeArray, removed)
+	}
 
 	// Initialize CNS volume maps
 	cnsVolumeToPodMap = make(map[string]string)
 	cnsVolumeToPvcMap = make(map[string]string)
 	cnsVolumeToEntityNamespaceMap = make(map[string]string)
 
+	cnsCreationMapBeforeSync := make(map[string]bool)
+	for volID := range cnsCreationMap {
+		cnsCreationMapBeforeSync[volID] = true
+	}
 	// Map K8s PV's to the operation that needs to be performed on them
 	k8sPVsMap := buildVolumeMap(k8sPVs, cnsVolumeArray, pvToPVCMap, pvcToPodMap, metadataSyncer)
+	if partialView {
+		// Volumes missing from a partial view must not count towards their creation
+		cnsCreationMap = cnsCreationMapBeforeSync
+	}
 	klog.V(4).Infof("FullSync: k8sPVMap %v", k8sPVsMap)
 
 	// Identify volumes to be created, updated and deleted
 	volToBeCreated, volToBeUpdated, volWithPvcEntryToBeDeleted, volWithPodEntryToBeDeleted := identifyVolumesToBeCreatedUpdated(k8sPVs, k8sPVsMap)
-	volToBeDeleted := identifyVolumesToBeDeleted(cnsVolumeArray, k8sPVsMap)
+	var volToBeDeleted []cnstypes.CnsVolumeId
+	if partialView {
+		volToBeCreated = nil
+	} else if namespace == "" {
+		volToBeDeleted = identifyVolumesToBeDeleted(cnsVolumeArray, k8sPVsMap)
+	} else {
+		// Namespace scoped full sync only reconciles CNS metadata
+		volToBeCreated = nil
+	}
 
 	// Construct the cns spec for create and update operations
 	createSpecArray := constructCnsCreateSpec(volToBeCreated, pvToPVCMap, pvcToPodMap, metadataSyncer)
@@ -83,18 +208,58 @@ func triggerFullSync(k8sclient clientset.Interface, metadataSyncer *MetadataSync
 	updateSpecArray = append(updateSpecArray, constructCnsUpdateSpecWithPVCToBeDeleted(volWithPvcEntryToBeDeleted, metadataSyncer)...)
 	updateSpecArray = append(updateSpecArray, constructCnsUpdateSpecWithPodToBeDeleted(volWithPodEntryToBeDeleted, metadataSyncer)...)
 
+	// failedUpdates is only written by fullSyncUpdateVolumes until wg.Wait returns
+	failedUpdates := make(map[string]bool)
 	wg := sync.WaitGroup{}
 	wg.Add(3)
 	// Perform operations
 	go fullSyncCreateVolumes(createSpecArray, metadataSyncer, k8sclient, &wg)
 	go fullSyncDeleteVolumes(volToBeDeleted, metadataSyncer, k8sclient, &wg)
-	go fullSyncUpdateVolumes(updateSpecArray, metadataSyncer, &wg)
+	go fullSyncUpdateVolumes(updateSpecArray, metadataSyncer, failedUpdates, &wg)
 	wg.Wait()
 
-	cleanupCnsMaps(k8sPVsMap)
+	if !partialView {
+		// Volumes missing from a partial view cannot be told apart from volumes
+		// missing in CNS, so the sync status is only recorded on a full view
+		recordFullSyncStatus(k8sclient, k8sPVs, k8sPVsMap, failedUpdates)
+	}
+
+	if namespace == "" {
+		metadataSyncer.refreshCNSVolumeState(k8sclient, cnsVolumeArray)
+	}
+	if namespace == "" && !partialView {
+		// k8sPVsMap only holds the volumes of the namespace in a scoped run
+		cleanupCnsMaps(k8sPVsMap)
+	}
 	klog.V(4).Infof("FullSync: cnsDeletionMap at end of cycle: %v", cnsDeletionMap)
 	klog.V(4).Infof("FullSync: cnsCreationMap at end of cycle: %v", cnsCreationMap)
-	klog.V(2).Infof("FullSync: end")
+	klog.V(2).Infof("FullSync: end for namespace %q", namespace)
+	return nil
+}
+
+// withoutVolumes returns the CNS volumes whose ID is not in the removed set.
+func withoutVolumes(cnsVolumes []cnstypes.CnsVolume, removed map[string]bool) []cnstypes.CnsVolume {
+	if len(removed) == 0 {
+		return cnsVolumes
+	}
+	var remaining []cnstypes.CnsVolume
+	for _, volume := range cnsVolumes {
+		if !removed[volume.VolumeId.Id] {
+			remaining = append(remaining, volume)
+		}
+	}
+	return remaining
+}
+
+// getPVsBoundInNamespace returns the PVs from the given list that are bound to PVCs in the given namespace
+func getPVsBoundInNamespace(pvList []*v1.PersistentVolume, namespace string) []*v1.PersistentVolume {
+	var pvsInNamespace []*v1.PersistentVolume
+	for _, pv := range pvList {
+		if pv.Spec.ClaimRef != nil && pv.Spec.ClaimRef.Namespace == namespace {
+			pvsInNamespace = append(pvsInNamespace, pv)
+		}
+	}
+	return pvsInNamespace
 }
 
 // getPVsInBoundAvailableOrReleased return PVs in Bound, Available or Released state
@@ -171,6 +336,12 @@ func fullSyncDeleteVolumes(volumeIDDeleteArray []cnstypes.CnsVolumeId, metadataS
 		currentK8sPVMap[pv.Spec.CSI.VolumeHandle] = true
 	}
 	for _, volID := range volumeIDDeleteArray {
+		// Volumes within their metadata retention period are removed by the retention sweep
+		if _, retained := retainedVolumeMap[volID.Id]; retained {
+			klog.V(4).Infof("FullSync: Skipping deletion of retained volume %v", volID)
+			delete(cnsDeletionMap, volID.Id)
+			continue
+		}
 		// Delete volume if not present in currentK8sPVMap
 		if _, existsInK8s := currentK8sPVMap[volID.Id]; !existsInK8s {
 			klog.V(4).Infof("FullSync: Calling DeleteVolume for volume %v with delete disk %v", volID, deleteDisk)
@@ -185,13 +356,60 @@ func fullSyncDeleteVolumes(volumeIDDeleteArray []cnstypes.CnsVolumeId, metadataS
 }
 
 // fullSyncUpdateVolumes update metadata for volumes with given array of createSpec
-func fullSyncUpdateVolumes(updateSpecArray []cnstypes.CnsVolumeMetadataUpdateSpec, metadataSyncer *MetadataSyncInformer, wg *sync.WaitGroup) {
+// The IDs of the volumes whose update failed are added to failedUpdates
+func fullSyncUpdateVolumes(updateSpecArray []cnstypes.CnsVolumeMetadataUpdateSpec, metadataSyncer *MetadataSyncInformer, failedUpdates map[string]bool, wg *sync.WaitGroup) {
 	defer wg.Done()
-	for _, updateSpec := range updateSpecArray {
+	var failedUpdatesLock sync.Mutex
+	runWithWorkers(len(updateSpecArray), getFullSyncWorkers(metadataSyncer), func(i int) {
+		updateSpec := &updateSpecArray[i]
 		klog.V(4).Infof("FullSync: Calling UpdateVolumeMetadata for volume %s with updateSpec: %+v", updateSpec.VolumeId.Id, spew.Sdump(updateSpec))
-		if err := volumes.GetManager(metadataSyncer.vcenter).UpdateVolumeMetadata(&updateSpec); err != nil {
+		if err := volumes.GetManager(metadataSyncer.vcenter).UpdateVolumeMetadata(updateSpec); err != nil {
 			klog.Warningf("FullSync:UpdateVolumeMetadata failed with err %v", err)
+			failedUpdatesLock.Lock()
+			failedUpdates[updateSpec.VolumeId.Id] = true
+			failedUpdatesLock.Unlock()
 		}
+	})
+}
+
+// getFullSyncWorkers returns the number of volumes reconciled in parallel by
+// full sync.
+func getFullSyncWorkers(metadataSyncer *MetadataSyncInformer) int {
+	if workers := metadataSyncer.cfg.Syncer.FullSyncWorkers; workers > 1 {
+		return workers
+	}
+	return 1
+}
+
+// runWithWorkers calls fn for the indexes 0 to n-1 from the given number of
+// concurrent workers, and returns once all calls returned.
+func runWithWorkers(n int, workers int, fn func(i int)) {
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// recordFullSyncStatus records the metadata sync status of the PVs at the end
+// of a full sync cycle. Volumes not registered in CNS yet and volumes whose
+// metadata update failed are out of sync.
+func recordFullSyncStatus(k8sclient clientset.Interface, pvList []*v1.PersistentVolume, k8sPVsMap map[string]string, failedUpdates map[string]bool) {
+	for _, pv := range pvList {
+		volumeID := pv.Spec.CSI.VolumeHandle
+		synced := !failedUpdates[volumeID] && !cnsCreationMap[volumeID] && k8sPVsMap[volumeID] != createVolumeOperation
+		setMetadataSyncStatus(k8sclient, pv, synced, true)
 	}
 }
 
@@ -201,11 +419,11 @@ func buildCnsUpdateMetadataList(pv *v1.PersistentVolume, pvToPVCMap pvcMap, pvcT
 	var metadataList []cnstypes.BaseCnsEntityMetadata
 
 	// get pv metadata
-	pvMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(pv.Name, pv.GetLabels(), false, string(cnstypes.CnsKubernetesEntityTypePV), pv.Namespace)
+	pvMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(pv.Name, pvLabels(pv), false, string(cnstypes.CnsKubernetesEntityTypePV), pv.Namespace)
 	metadataList = append(metadataList, cnstypes.BaseCnsEntityMetadata(pvMetadata))
 	if pvc, ok := pvToPVCMap[pv.Name]; ok {
 		// get pvc metadata
-		pvcMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(pvc.Name, pvc.GetLabels(), false, string(cnstypes.CnsKubernetesEntityTypePVC), pvc.Namespace)
+		pvcMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(pvc.Name, pvcLabels(pvc), false, string(cnstypes.CnsKubernetesEntityTypePVC), pvc.Namespace)
 		metadataList = append(metadataList, cnstypes.BaseCnsEntityMetadata(pvcMetadata))
 
 		key := pvc.Namespace + "/" + pvc.Name
@@ -230,19 +448,28 @@ func buildVolumeMap(pvList []*v1.PersistentVolume, cnsVolumeList []cnstypes.CnsV
 	for _, vol := range cnsVolumeList {
 		cnsVolumeMap[vol.VolumeId.Id] = true
 	}
-	for _, pv := range pvList {
+	// The CNS volumes of the PVs are queried in parallel, the results are
+	// processed sequentially as they update the global CNS volume maps
+	queryResults := make([]*cnstypes.CnsQueryResult, len(pvList))
+	queryErrors := make([]error, len(pvList))
+	runWithWorkers(len(pvList), getFullSyncWorkers(metadataSyncer), func(i int) {
+		if !cnsVolumeMap[pvList[i].Spec.CSI.VolumeHandle] {
+			return
+		}
+		queryFilter := cnstypes.CnsQueryFilter{
+			VolumeIds: []cnstypes.CnsVolumeId{
+				{
+					Id: pvList[i].Spec.CSI.VolumeHandle,
+				},
+			},
+		}
+		queryResults[i], queryErrors[i] = volumes.GetManager(metadataSyncer.vcenter).QueryVolume(queryFilter)
+	})
+	for i, pv := range pvList {
 		k8sPVMap[pv.Spec.CSI.VolumeHandle] = ""
 		if cnsVolumeMap[pv.Spec.CSI.VolumeHandle] {
 			// PV exist in both K8S and CNS cache, check metadata has been changed or not
-			queryFilter := cnstypes.CnsQueryFilter{
-				VolumeIds: []cnstypes.CnsVolumeId{
-					{
-						Id: pv.Spec.CSI.VolumeHandle,
-					},
-				},
-			}
-
-			queryResult, err := volumes.GetManager(metadataSyncer.vcenter).QueryVolume(queryFilter)
+			queryResult, err := queryResults[i], queryErrors[i]
 			if err == nil && queryResult != nil && len(queryResult.Volumes) > 0 {
 				if &queryResult.Volumes[0].Metadata != nil {
 					cnsMetadata := queryResult.Volumes[0].Metadata.EntityMetadata
@@ -0,0 +1,77 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunWithWorkers(t *testing.T) {
+	for _, workers := range []int{1, 4, 20} {
+		var lock sync.Mutex
+		var running, maxRunning int32
+		seen := make(map[int]bool)
+		runWithWorkers(10, workers, func(i int) {
+			current := atomic.AddInt32(&running, 1)
+			lock.Lock()
+			if current > maxRunning {
+				maxRunning = current
+			}
+			seen[i] = true
+			lock.Unlock()
+			atomic.AddInt32(&running, -1)
+		})
+		if len(seen) != 10 {
+			t.Errorf("Expected all 10 indexes to be processed with %d workers, got %v", workers, seen)
+		}
+		if int(maxRunning) > workers {
+			t.Errorf("Expected at most %d concurrent calls, got %d", workers, maxRunning)
+		}
+	}
+	// No work does not block
+	runWithWorkers(0, 4, func(i int) {
+		t.Errorf("Unexpected call for index %d", i)
+	})
+}
+
+func TestRunWithRetries(t *testing.T) {
+	errVCenter := errors.New("vCenter unavailable")
+	calls := 0
+	err := runWithRetries(3, time.Millisecond, func() error {
+		calls++
+		if calls < 3 {
+			return errVCenter
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("Expected success on the third call, got %d calls and err: %v", calls, err)
+	}
+
+	calls = 0
+	err = runWithRetries(2, time.Millisecond, func() error {
+		calls++
+		return errVCenter
+	})
+	if err != errVCenter || calls != 3 {
+		t.Errorf("Expected failure after 2 retries, got %d calls and err: %v", calls, err)
+	}
+}
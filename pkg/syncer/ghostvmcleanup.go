@@ -0,0 +1,232 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	volumes "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+	k8s "sigs.k8s.io/vsphere-csi-driver/pkg/kubernetes"
+)
+
+// triggerGhostVMCleanup releases volumes which are still attached to node VMs
+// that no longer exist in vCenter.
+// The volumes are detached in CNS with the reference of the VM recorded while
+// it existed, and the stale VolumeAttachments are removed, which allows the
+// volumes to be attached to a healthy node.
+// To guard against transient vCenter inventory glitches, an attachment is only
+// released if its VM is reported missing across two cleanup cycles, the cycle
+// is aborted on any inventory error, and nothing is released when the VMs of
+// all nodes with attached volumes appear to be missing at once.
+func triggerGhostVMCleanup(k8sclient clientset.Interface, metadataSyncer *MetadataSyncInformer) {
+	klog.V(2).Infof("GhostVMCleanup: start")
+	cleanupGhostVMAttachments(k8sclient,
+		func(nodeName string) (bool, error) {
+			return isGhostNode(k8sclient, nodeName)
+		},
+		func(va *storagev1.VolumeAttachment) error {
+			return detachGhostVolume(k8sclient, metadataSyncer, va)
+		})
+	klog.V(4).Infof("GhostVMCleanup: ghostVMAttachmentMap at end of cycle: %v", ghostVMAttachmentMap)
+	klog.V(2).Infof("GhostVMCleanup: end")
+}
+
+// cleanupGhostVMAttachments detaches and releases the VolumeAttachments of
+// the nodes whose VM isGhost reports missing in two consecutive cycles,
+// recording the ones seen missing for the first time in ghostVMAttachmentMap.
+func cleanupGhostVMAttachments(k8sclient clientset.Interface, isGhost func(nodeName string) (bool, error),
+	detach func(va *storagev1.VolumeAttachment) error) {
+	vaList, err := k8sclient.StorageV1().VolumeAttachments().List(metav1.ListOptions{})
+	if err != nil {
+		klog.Warningf("GhostVMCleanup: Failed to get VolumeAttachments from kubernetes. Err: %v", err)
+		return
+	}
+	attachmentsByNode := make(map[string][]*storagev1.VolumeAttachment)
+	for index, va := range vaList.Items {
+		if va.Spec.Attacher != service.Name || !va.Status.Attached {
+			continue
+		}
+		attachmentsByNode[va.Spec.NodeName] = append(attachmentsByNode[va.Spec.NodeName], &vaList.Items[index])
+	}
+
+	ghostAttachments := make(map[string]*storagev1.VolumeAttachment)
+	ghostNodeCount := 0
+	for nodeName, attachments := range attachmentsByNode {
+		ghost, err := isGhost(nodeName)
+		if err != nil {
+			klog.Warningf("GhostVMCleanup: Failed to verify VM for node %q, skipping this cycle. Err: %v", nodeName, err)
+			return
+		}
+		if !ghost {
+			continue
+		}
+		ghostNodeCount++
+		for _, va := range attachments {
+			ghostAttachments[va.Name] = va
+		}
+	}
+	if ghostNodeCount > 1 && ghostNodeCount == len(attachmentsByNode) {
+		klog.Warningf("GhostVMCleanup: VMs of all %d nodes with attached volumes appear to be missing, "+
+			"assuming an inventory glitch and skipping this cycle", ghostNodeCount)
+		ghostVMAttachmentMap = make(map[string]bool)
+		return
+	}
+
+	nextGhostVMAttachmentMap := make(map[string]bool)
+	for vaName, va := range ghostAttachments {
+		if !ghostVMAttachmentMap[vaName] {
+			klog.V(2).Infof("GhostVMCleanup: VM of node %q is missing, volume attachment %q will be released in the next cycle",
+				va.Spec.NodeName, vaName)
+			nextGhostVMAttachmentMap[vaName] = true
+			continue
+		}
+		if err := detach(va); err != nil {
+			klog.Errorf("GhostVMCleanup: Failed to detach volume of volume attachment %q in CNS. Err: %v", vaName, err)
+			nextGhostVMAttachmentMap[vaName] = true
+			continue
+		}
+		if err := releaseVolumeAttachment(k8sclient, va); err != nil {
+			klog.Errorf("GhostVMCleanup: Failed to release volume attachment %q. Err: %v", vaName, err)
+			nextGhostVMAttachmentMap[vaName] = true
+		}
+	}
+	ghostVMAttachmentMap = nextGhostVMAttachmentMap
+}
+
+// isGhostNode returns true if the VM backing the given node can not be found
+// in vCenter. An error is returned if the VM lookup fails for any other reason.
+func isGhostNode(k8sclient clientset.Interface, nodeName string) (bool, error) {
+	var nodeUUID string
+	node, err := k8sclient.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+	if err == nil {
+		if isNodeReady(node) {
+			// kubelet is still reporting status, so its VM exists.
+			return false, nil
+		}
+		nodeUUID = common.GetUUIDFromProviderID(node.Spec.ProviderID)
+	} else if apierrors.IsNotFound(err) {
+		// Node object may already be removed once its VM is deleted,
+		// fall back to the UUID observed by the node informer.
+		if uuid, ok := nodeNameToVMUUIDMap.Load(nodeName); ok {
+			nodeUUID = uuid.(string)
+		}
+	} else {
+		return false, err
+	}
+	if nodeUUID == "" {
+		klog.V(3).Infof("GhostVMCleanup: VM UUID for node %q is unknown", nodeName)
+		return false, nil
+	}
+
+	vm, err := cnsvsphere.GetVirtualMachineByUUID(nodeUUID, false)
+	if err == cnsvsphere.ErrVMNotFound {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	nodeNameToVMMap.Store(nodeName, vm)
+	return false, nil
+}
+
+// isNodeReady returns true if the node has the Ready condition set to True.
+func isNodeReady(node *v1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// detachGhostVolume detaches the volume of the VolumeAttachment in CNS from
+// the missing VM of its node, using the VM reference recorded while the VM
+// existed. Volumes of VMs whose reference was never recorded are left
+// attached in CNS, with a warning, as CNS detaches volumes by VM reference.
+func detachGhostVolume(k8sclient clientset.Interface, metadataSyncer *MetadataSyncInformer, va *storagev1.VolumeAttachment) error {
+	if va.Spec.Source.PersistentVolumeName == nil {
+		return nil
+	}
+	pv, err := k8sclient.CoreV1().PersistentVolumes().Get(*va.Spec.Source.PersistentVolumeName, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if pv.Spec.CSI == nil {
+		return nil
+	}
+	vm, ok := nodeNameToVMMap.Load(va.Spec.NodeName)
+	if !ok {
+		klog.Warningf("GhostVMCleanup: VM of node %q is unknown, volume %s can not be detached in CNS",
+			va.Spec.NodeName, pv.Spec.CSI.VolumeHandle)
+		return nil
+	}
+	klog.V(2).Infof("GhostVMCleanup: Detaching volume %s from missing VM %v of node %q in CNS",
+		pv.Spec.CSI.VolumeHandle, vm.(*cnsvsphere.VirtualMachine).Reference(), va.Spec.NodeName)
+	return volumes.GetManager(metadataSyncer.vcenter).DetachVolume(vm.(*cnsvsphere.VirtualMachine), pv.Spec.CSI.VolumeHandle)
+}
+
+// releaseVolumeAttachment deletes the given VolumeAttachment and removes its
+// attacher finalizer, as the attacher can never complete the detach for a
+// missing VM.
+func releaseVolumeAttachment(k8sclient clientset.Interface, va *storagev1.VolumeAttachment) error {
+	klog.Warningf("GhostVMCleanup: Releasing volume attachment %q of PV %v from missing VM of node %q",
+		va.Name, va.Spec.Source.PersistentVolumeName, va.Spec.NodeName)
+	err := k8sclient.StorageV1().VolumeAttachments().Delete(va.Name, &metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return k8s.RemoveAttacherFinalizer(k8sclient, va.Name)
+}
+
+// nodeAdded and nodeUpdated record the VM UUID of a node so that it is still
+// known after the node object is deleted.
+func nodeAdded(obj interface{}) {
+	node, ok := obj.(*v1.Node)
+	if node == nil || !ok {
+		klog.Warningf("NodeAdded: unrecognized object %+v", obj)
+		return
+	}
+	uuid := common.GetUUIDFromProviderID(node.Spec.ProviderID)
+	if uuid == "" {
+		return
+	}
+	nodeNameToVMUUIDMap.Store(node.Name, uuid)
+	if _, ok := nodeNameToVMMap.Load(node.Name); ok {
+		return
+	}
+	vm, err := cnsvsphere.GetVirtualMachineByUUID(uuid, false)
+	if err != nil {
+		klog.V(4).Infof("NodeAdded: Failed to find VM of node %q. Err: %v", node.Name, err)
+		return
+	}
+	nodeNameToVMMap.Store(node.Name, vm)
+}
+
+func nodeUpdated(oldObj, newObj interface{}) {
+	nodeAdded(newObj)
+}
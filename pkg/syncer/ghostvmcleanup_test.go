@@ -0,0 +1,145 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"errors"
+	"testing"
+
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	testclient "k8s.io/client-go/kubernetes/fake"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
+)
+
+func newAttachedVolumeAttachment(name string, nodeName string) *storagev1.VolumeAttachment {
+	return &storagev1.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Finalizers: []string{"external-attacher/csi-vsphere-vmware-com"}},
+		Spec:       storagev1.VolumeAttachmentSpec{Attacher: service.Name, NodeName: nodeName},
+		Status:     storagev1.VolumeAttachmentStatus{Attached: true},
+	}
+}
+
+func volumeAttachmentExists(t *testing.T, k8sclient kubernetes.Interface, name string) bool {
+	vaList, err := k8sclient.StorageV1().VolumeAttachments().List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("Failed to list VolumeAttachments: %v", err)
+	}
+	for _, va := range vaList.Items {
+		if va.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCleanupGhostVMAttachmentsAfterTwoCycles(t *testing.T) {
+	ghostVMAttachmentMap = make(map[string]bool)
+	k8sclient := testclient.NewSimpleClientset(
+		newAttachedVolumeAttachment("va-1", "node-1"),
+		newAttachedVolumeAttachment("va-2", "node-2"),
+	)
+	missing := map[string]bool{"node-1": true}
+	isGhost := func(nodeName string) (bool, error) {
+		return missing[nodeName], nil
+	}
+	var detached []string
+	detach := func(va *storagev1.VolumeAttachment) error {
+		detached = append(detached, va.Name)
+		return nil
+	}
+
+	cleanupGhostVMAttachments(k8sclient, isGhost, detach)
+	if !volumeAttachmentExists(t, k8sclient, "va-1") || !ghostVMAttachmentMap["va-1"] || len(detached) != 0 {
+		t.Fatalf("Expected va-1 to be kept and recorded in the first cycle, recorded %v, detached %v",
+			ghostVMAttachmentMap, detached)
+	}
+	cleanupGhostVMAttachments(k8sclient, isGhost, detach)
+	if volumeAttachmentExists(t, k8sclient, "va-1") {
+		t.Errorf("Expected va-1 to be released in the second cycle")
+	}
+	if len(detached) != 1 || detached[0] != "va-1" {
+		t.Errorf("Expected the volume of va-1 to be detached in CNS, detached %v", detached)
+	}
+	if !volumeAttachmentExists(t, k8sclient, "va-2") {
+		t.Errorf("Expected va-2 of a node with its VM to be kept")
+	}
+
+	// A VM seen again between cycles restarts the count
+	ghostVMAttachmentMap = make(map[string]bool)
+	k8sclient = testclient.NewSimpleClientset(
+		newAttachedVolumeAttachment("va-1", "node-1"),
+		newAttachedVolumeAttachment("va-2", "node-2"),
+	)
+	cleanupGhostVMAttachments(k8sclient, isGhost, detach)
+	missing["node-1"] = false
+	cleanupGhostVMAttachments(k8sclient, isGhost, detach)
+	missing["node-1"] = true
+	cleanupGhostVMAttachments(k8sclient, isGhost, detach)
+	if !volumeAttachmentExists(t, k8sclient, "va-1") {
+		t.Errorf("Expected va-1 to be kept when its VM was not missing in consecutive cycles")
+	}
+
+	// A failed detach in CNS keeps the VolumeAttachment for the next cycle
+	ghostVMAttachmentMap = map[string]bool{"va-1": true}
+	failingDetach := func(va *storagev1.VolumeAttachment) error {
+		return errors.New("detach error")
+	}
+	cleanupGhostVMAttachments(k8sclient, isGhost, failingDetach)
+	if !volumeAttachmentExists(t, k8sclient, "va-1") || !ghostVMAttachmentMap["va-1"] {
+		t.Errorf("Expected va-1 to be kept and recorded when its volume failed to detach, recorded %v",
+			ghostVMAttachmentMap)
+	}
+}
+
+func TestCleanupGhostVMAttachmentsSafeguards(t *testing.T) {
+	ghostVMAttachmentMap = make(map[string]bool)
+	k8sclient := testclient.NewSimpleClientset(
+		newAttachedVolumeAttachment("va-1", "node-1"),
+		newAttachedVolumeAttachment("va-2", "node-2"),
+	)
+	allMissing := func(nodeName string) (bool, error) {
+		return true, nil
+	}
+	detach := func(va *storagev1.VolumeAttachment) error {
+		return nil
+	}
+	for i := 0; i < 3; i++ {
+		cleanupGhostVMAttachments(k8sclient, allMissing, detach)
+	}
+	if !volumeAttachmentExists(t, k8sclient, "va-1") || !volumeAttachmentExists(t, k8sclient, "va-2") {
+		t.Errorf("Expected no VolumeAttachment to be released when the VMs of all nodes are missing")
+	}
+	if len(ghostVMAttachmentMap) != 0 {
+		t.Errorf("Expected no VolumeAttachment to be recorded when the VMs of all nodes are missing, got %v",
+			ghostVMAttachmentMap)
+	}
+
+	ghostVMAttachmentMap = map[string]bool{"va-1": true}
+	failing := func(nodeName string) (bool, error) {
+		if nodeName == "node-2" {
+			return false, errors.New("inventory error")
+		}
+		return nodeName == "node-1", nil
+	}
+	cleanupGhostVMAttachments(k8sclient, failing, detach)
+	if !volumeAttachmentExists(t, k8sclient, "va-1") {
+		t.Errorf("Expected no VolumeAttachment to be released in a cycle with an inventory error")
+	}
+}
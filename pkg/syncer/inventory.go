@@ -0,0 +1,121 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	volumes "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+)
+
+const (
+	// inventoryReportKey is the key of the inventory ConfigMap holding the report
+	inventoryReportKey = "inventory.csv"
+	// inventoryReportHeader is the first line of the inventory report
+	inventoryReportHeader = "volume-id,capacity-mb,datastore-url,storage-policy-id,pvc"
+)
+
+// splitConfigMapName returns the namespace and name of a ConfigMap given as
+// "namespace/name".
+func splitConfigMapName(configMap string) (string, string, error) {
+	parts := strings.Split(configMap, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("ConfigMap %q is not of the form namespace/name", configMap)
+	}
+	return parts[0], parts[1], nil
+}
+
+// triggerInventoryReport writes the report of the CNS volumes of the cluster
+// to the inventory ConfigMap.
+func triggerInventoryReport(metadataSyncer *MetadataSyncInformer, namespace string, name string) {
+	queryFilter := cnstypes.CnsQueryFilter{
+		ContainerClusterIds: []string{
+			metadataSyncer.cfg.Global.ClusterID,
+		},
+	}
+	queryResult, err := volumes.GetManager(metadataSyncer.vcenter).QueryVolume(queryFilter)
+	if err != nil {
+		klog.Warningf("InventoryReport: QueryVolume failed with err=%+v", err)
+		return
+	}
+	pvList, err := metadataSyncer.pvLister.List(labels.Everything())
+	if err != nil {
+		klog.Warningf("InventoryReport: Failed to list PVs. Err: %v", err)
+		return
+	}
+	report := buildInventoryReport(queryResult.Volumes, pvList)
+	if err := writeInventoryReport(metadataSyncer.k8sclient, namespace, name, report); err != nil {
+		klog.Warningf("InventoryReport: Failed to write report to ConfigMap %s/%s. Err: %v", namespace, name, err)
+		return
+	}
+	klog.V(3).Infof("InventoryReport: Reported %d volumes to ConfigMap %s/%s", len(queryResult.Volumes), namespace, name)
+}
+
+// buildInventoryReport returns the CSV report of the CNS volumes, listing the
+// ID, capacity, datastore, storage policy and owning PVC of each volume. Lines
+// are sorted by volume ID, so reports of an unchanged inventory are identical.
+func buildInventoryReport(cnsVolumes []cnstypes.CnsVolume, pvList []*v1.PersistentVolume) string {
+	pvcByVolumeID := make(map[string]string)
+	for _, pv := range pvList {
+		if pv.Spec.CSI != nil && pv.Spec.ClaimRef != nil {
+			pvcByVolumeID[pv.Spec.CSI.VolumeHandle] = pv.Spec.ClaimRef.Namespace + "/" + pv.Spec.ClaimRef.Name
+		}
+	}
+	lines := make([]string, 0, len(cnsVolumes))
+	for _, volume := range cnsVolumes {
+		lines = append(lines, fmt.Sprintf("%s,%d,%s,%s,%s", volume.VolumeId.Id, volume.BackingObjectDetails.CapacityInMb,
+			volume.DatastoreUrl, volume.StoragePolicyId, pvcByVolumeID[volume.VolumeId.Id]))
+	}
+	sort.Strings(lines)
+	return inventoryReportHeader + "\n" + strings.Join(append(lines, ""), "\n")
+}
+
+// writeInventoryReport creates or updates the inventory ConfigMap with the
+// report. The ConfigMap is not updated when the report is unchanged.
+func writeInventoryReport(k8sclient clientset.Interface, namespace string, name string, report string) error {
+	cm, err := k8sclient.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Data:       map[string]string{inventoryReportKey: report},
+		}
+		_, err = k8sclient.CoreV1().ConfigMaps(namespace).Create(cm)
+		return err
+	} else if err != nil {
+		return err
+	}
+	if cm.Data[inventoryReportKey] == report {
+		return nil
+	}
+	cm = cm.DeepCopy()
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+	cm.Data[inventoryReportKey] = report
+	_, err = k8sclient.CoreV1().ConfigMaps(namespace).Update(cm)
+	return err
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"testing"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestBuildInventoryReport(t *testing.T) {
+	cnsVolumes := []cnstypes.CnsVolume{
+		{
+			VolumeId:             cnstypes.CnsVolumeId{Id: "vol-2"},
+			DatastoreUrl:         "ds:///vmfs/volumes/ds-1/",
+			StoragePolicyId:      "policy-1",
+			BackingObjectDetails: cnstypes.CnsBackingObjectDetails{CapacityInMb: 2048},
+		},
+		{
+			VolumeId:             cnstypes.CnsVolumeId{Id: "vol-1"},
+			DatastoreUrl:         "ds:///vmfs/volumes/ds-2/",
+			BackingObjectDetails: cnstypes.CnsBackingObjectDetails{CapacityInMb: 1024},
+		},
+	}
+	pvList := []*v1.PersistentVolume{
+		{
+			Spec: v1.PersistentVolumeSpec{
+				ClaimRef: &v1.ObjectReference{Namespace: "default", Name: "data"},
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{VolumeHandle: "vol-2"},
+				},
+			},
+		},
+	}
+	expected := inventoryReportHeader + "\n" +
+		"vol-1,1024,ds:///vmfs/volumes/ds-2/,,\n" +
+		"vol-2,2048,ds:///vmfs/volumes/ds-1/,policy-1,default/data\n"
+	if report := buildInventoryReport(cnsVolumes, pvList); report != expected {
+		t.Errorf("Expected report:\n%s\ngot:\n%s", expected, report)
+	}
+	if report := buildInventoryReport(nil, nil); report != inventoryReportHeader+"\n" {
+		t.Errorf("Unexpected report of empty inventory: %q", report)
+	}
+}
+
+func TestWriteInventoryReport(t *testing.T) {
+	k8sclient := testclient.NewSimpleClientset()
+	if err := writeInventoryReport(k8sclient, "kube-system", "inventory", "report-1"); err != nil {
+		t.Fatalf("Failed to create report: %v", err)
+	}
+	if err := writeInventoryReport(k8sclient, "kube-system", "inventory", "report-2"); err != nil {
+		t.Fatalf("Failed to update report: %v", err)
+	}
+	cm, err := k8sclient.CoreV1().ConfigMaps("kube-system").Get("inventory", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get ConfigMap: %v", err)
+	}
+	if cm.Data[inventoryReportKey] != "report-2" {
+		t.Errorf("Expected updated report, got %q", cm.Data[inventoryReportKey])
+	}
+
+	// An unchanged report is not written again
+	actions := len(k8sclient.Actions())
+	if err := writeInventoryReport(k8sclient, "kube-system", "inventory", "report-2"); err != nil {
+		t.Fatalf("Failed to write report: %v", err)
+	}
+	if len(k8sclient.Actions()) != actions+1 {
+		t.Errorf("Expected unchanged report not to be updated")
+	}
+}
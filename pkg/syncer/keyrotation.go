@@ -0,0 +1,109 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+)
+
+const (
+	// keyRotationIntervalLabel is the label of the PV metadata in CNS
+	// recording the key rotation interval of volumes provisioned with one
+	keyRotationIntervalLabel = "csi.vsphere.vmware.com/key-rotation-interval"
+	// lastKeyRotationAnnotation is the PV annotation holding the time the
+	// encryption key of the volume was last rotated, in RFC3339 format. The
+	// creation time of the PV is used until it is set.
+	lastKeyRotationAnnotation = "cns.vmware.com/last-key-rotation"
+	// reasonKeyRotationOverdue is the reason of the events posted on PVs
+	// whose key rotation is overdue
+	reasonKeyRotationOverdue = "KeyRotationOverdue"
+)
+
+// keyRotationOverdueVolumes reports the number of volumes whose encryption
+// key was not rotated within their key rotation interval. It is exposed on
+// the syncer metrics address.
+var keyRotationOverdueVolumes = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "vsphere_csi_key_rotation_overdue_volumes",
+	Help: "Number of volumes whose encryption key rotation is overdue",
+})
+
+func init() {
+	prometheus.MustRegister(keyRotationOverdueVolumes)
+}
+
+// triggerKeyRotationCheck reports the volumes provisioned with a key rotation
+// interval whose key was not rotated within the interval, with a metric and
+// an event on their PV.
+func triggerKeyRotationCheck(metadataSyncer *MetadataSyncInformer) {
+	pvList, err := metadataSyncer.pvLister.List(labels.Everything())
+	if err != nil {
+		klog.Warningf("KeyRotationCheck: Failed to list PVs. Err: %v", err)
+		return
+	}
+	overdue := getKeyRotationOverdueVolumes(pvList, time.Now())
+	for _, pv := range overdue {
+		klog.Warningf("KeyRotationCheck: Key rotation of volume %s of PV %s is overdue", pv.Spec.CSI.VolumeHandle, pv.Name)
+		if metadataSyncer.recorder != nil {
+			metadataSyncer.recorder.Eventf(pv, v1.EventTypeWarning, reasonKeyRotationOverdue,
+				"Encryption key of volume %s was not rotated within %s", pv.Spec.CSI.VolumeHandle,
+				pv.Spec.CSI.VolumeAttributes[common.AttributeKeyRotationInterval])
+		}
+	}
+	keyRotationOverdueVolumes.Set(float64(len(overdue)))
+}
+
+// getKeyRotationOverdueVolumes returns the PVs of vSphere CSI volumes whose
+// key rotation interval elapsed at the given time since their last key
+// rotation.
+func getKeyRotationOverdueVolumes(pvList []*v1.PersistentVolume, now time.Time) []*v1.PersistentVolume {
+	var overdue []*v1.PersistentVolume
+	for _, pv := range pvList {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != service.Name || pv.DeletionTimestamp != nil {
+			continue
+		}
+		value := pv.Spec.CSI.VolumeAttributes[common.AttributeKeyRotationInterval]
+		if value == "" {
+			continue
+		}
+		interval, err := common.ParseKeyRotationInterval(value)
+		if err != nil {
+			klog.Warningf("KeyRotationCheck: Ignoring invalid key rotation interval of PV %s. Err: %v", pv.Name, err)
+			continue
+		}
+		lastRotation := pv.CreationTimestamp.Time
+		if annotation := pv.GetAnnotations()[lastKeyRotationAnnotation]; annotation != "" {
+			rotatedAt, err := time.Parse(time.RFC3339, annotation)
+			if err != nil {
+				klog.Warningf("KeyRotationCheck: Ignoring invalid last key rotation %q of PV %s. Err: %v", annotation, pv.Name, err)
+			} else {
+				lastRotation = rotatedAt
+			}
+		}
+		if now.Sub(lastRotation) >= interval {
+			overdue = append(overdue, pv)
+		}
+	}
+	return overdue
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+)
+
+func newKeyRotationPV(name string, interval string, lastRotation string, created time.Time) *v1.PersistentVolume {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			CreationTimestamp: metav1.NewTime(created),
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:           service.Name,
+					VolumeHandle:     name + "-handle",
+					VolumeAttributes: map[string]string{common.AttributeKeyRotationInterval: interval},
+				},
+			},
+		},
+	}
+	if lastRotation != "" {
+		pv.Annotations = map[string]string{lastKeyRotationAnnotation: lastRotation}
+	}
+	return pv
+}
+
+func TestGetKeyRotationOverdueVolumes(t *testing.T) {
+	now := time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC)
+	created := now.Add(-100 * 24 * time.Hour)
+	pvList := []*v1.PersistentVolume{
+		newKeyRotationPV("never-rotated", "2160h", "", created),
+		newKeyRotationPV("rotated", "2160h", "2019-09-01T00:00:00Z", created),
+		newKeyRotationPV("rotated-long-ago", "720h", "2019-08-01T00:00:00Z", created),
+		newKeyRotationPV("invalid-rotation", "2160h", "yesterday", created),
+		newKeyRotationPV("no-interval", "", "", created),
+	}
+
+	overdue := getKeyRotationOverdueVolumes(pvList, now)
+	names := make(map[string]bool)
+	for _, pv := range overdue {
+		names[pv.Name] = true
+	}
+	if len(overdue) != 3 || !names["never-rotated"] || !names["rotated-long-ago"] || !names["invalid-rotation"] {
+		t.Errorf("Unexpected overdue volumes %v", names)
+	}
+}
+
+func TestPVLabelsKeyRotationInterval(t *testing.T) {
+	pv := newKeyRotationPV("pv-1", "2160h", "", time.Now())
+	pv.Spec.CSI.VolumeAttributes[common.AttributeVolumeTTL] = "24h"
+	labels := pvLabels(pv)
+	if len(labels) != 2 || labels[keyRotationIntervalLabel] != "2160h" || labels[volumeTTLLabel] != "24h" {
+		t.Errorf("Unexpected labels %v", labels)
+	}
+}
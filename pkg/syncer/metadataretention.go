@@ -0,0 +1,144 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"time"
+
+	"github.com/davecgh/go-spew/spew"
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+
+	volumes "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+// pvDeletedAtLabel is the label of the PV metadata in CNS recording the time
+// the PV of a retained volume was deleted, so that the retention period
+// survives restarts of the syncer
+const pvDeletedAtLabel = "csi.vsphere.vmware.com/pv-deleted-at"
+
+// retainVolume records the CNS volume of the deleted PV as retained since
+// the given time, in retainedVolumeMap and as a label of the PV metadata in
+// CNS. The volume is retained in memory even if the label can not be set, in
+// which case a restart of the syncer restarts its retention period.
+func retainVolume(metadataSyncer *MetadataSyncInformer, pv *v1.PersistentVolume, deletedAt time.Time) {
+	volumeID := pv.Spec.CSI.VolumeHandle
+	retainedVolumeMap[volumeID] = deletedAt
+	recorded := map[string]string{pvDeletedAtLabel: deletedAt.UTC().Format(time.RFC3339)}
+	for key, value := range pvLabels(pv) {
+		recorded[key] = value
+	}
+	pvMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(pv.Name, recorded, false, string(cnstypes.CnsKubernetesEntityTypePV), pv.Namespace)
+	updateSpec := &cnstypes.CnsVolumeMetadataUpdateSpec{
+		VolumeId: cnstypes.CnsVolumeId{
+			Id: volumeID,
+		},
+		Metadata: cnstypes.CnsVolumeMetadata{
+			ContainerCluster: cnsvsphere.GetContainerCluster(metadataSyncer.cfg.Global.ClusterID, metadataSyncer.cfg.VirtualCenter[metadataSyncer.vcenter.Config.Host].User),
+			EntityMetadata:   []cnstypes.BaseCnsEntityMetadata{cnstypes.BaseCnsEntityMetadata(pvMetadata)},
+		},
+	}
+	klog.V(4).Infof("MetadataRetention: Calling UpdateVolumeMetadata for volume %s with updateSpec: %+v", volumeID, spew.Sdump(updateSpec))
+	if err := volumes.GetManager(metadataSyncer.vcenter).UpdateVolumeMetadata(updateSpec); err != nil {
+		klog.Warningf("MetadataRetention: Failed to record deletion time of PV %s of volume %s in CNS. Err: %v", pv.Name, volumeID, err)
+	}
+}
+
+// loadRetainedVolumes fills retainedVolumeMap with the CNS volumes of the
+// cluster whose PV metadata records the deletion time of their PV, i.e. the
+// volumes retained before the syncer restarted.
+func loadRetainedVolumes(metadataSyncer *MetadataSyncInformer) error {
+	queryFilter := cnstypes.CnsQueryFilter{
+		ContainerClusterIds: []string{metadataSyncer.cfg.Global.ClusterID},
+	}
+	queryAllResult, err := volumes.GetManager(metadataSyncer.vcenter).QueryAllVolume(queryFilter, cnstypes.CnsQuerySelection{})
+	if err != nil && err != volumes.ErrPartialQueryResult {
+		return err
+	}
+	for volumeID, deletedAt := range getRetainedVolumes(queryAllResult.Volumes) {
+		retainedVolumeMap[volumeID] = deletedAt
+	}
+	return err
+}
+
+// getRetainedVolumes returns the volumes whose PV metadata records the
+// deletion time of their PV, mapped to that time.
+func getRetainedVolumes(cnsVolumes []cnstypes.CnsVolume) map[string]time.Time {
+	retained := make(map[string]time.Time)
+	for _, volume := range cnsVolumes {
+		for _, metadata := range volume.Metadata.EntityMetadata {
+			kubernetesMetadata, ok := metadata.(*cnstypes.CnsKubernetesEntityMetadata)
+			if !ok || kubernetesMetadata.EntityType != string(cnstypes.CnsKubernetesEntityTypePV) {
+				continue
+			}
+			for _, label := range kubernetesMetadata.Labels {
+				if label.Key != pvDeletedAtLabel {
+					continue
+				}
+				deletedAt, err := time.Parse(time.RFC3339, label.Value)
+				if err != nil {
+					klog.Warningf("MetadataRetention: Ignoring invalid deletion time %q of volume %s", label.Value, volume.VolumeId.Id)
+					continue
+				}
+				retained[volume.VolumeId.Id] = deletedAt
+			}
+		}
+	}
+	return retained
+}
+
+// triggerMetadataRetentionSweep removes from CNS the volumes of deleted PVs
+// whose metadata retention period elapsed. Volumes which are referenced by a
+// PV again, e.g. after static re-provisioning, are no longer retained.
+func triggerMetadataRetentionSweep(metadataSyncer *MetadataSyncInformer) {
+	volumeOperationsLock.Lock()
+	defer volumeOperationsLock.Unlock()
+	if len(retainedVolumeMap) == 0 {
+		return
+	}
+	pvList, err := metadataSyncer.pvLister.List(labels.Everything())
+	if err != nil {
+		klog.Warningf("MetadataRetention: Failed to list PVs. Err: %v", err)
+		return
+	}
+	pvVolumeHandles := make(map[string]bool)
+	for _, pv := range pvList {
+		if pv.Spec.CSI != nil {
+			pvVolumeHandles[pv.Spec.CSI.VolumeHandle] = true
+		}
+	}
+	retentionPeriod := time.Duration(metadataSyncer.cfg.Syncer.MetadataRetentionPeriodInMin) * time.Minute
+	for volumeID, deletedAt := range retainedVolumeMap {
+		if pvVolumeHandles[volumeID] {
+			klog.V(3).Infof("MetadataRetention: Volume %s is referenced by a PV again", volumeID)
+			delete(retainedVolumeMap, volumeID)
+			continue
+		}
+		if time.Since(deletedAt) < retentionPeriod {
+			continue
+		}
+		klog.V(2).Infof("MetadataRetention: Retention period of volume %s elapsed, removing it from CNS", volumeID)
+		if err := volumes.GetManager(metadataSyncer.vcenter).DeleteVolume(volumeID, false); err != nil {
+			klog.Warningf("MetadataRetention: Failed to delete volume %s with error %+v", volumeID, err)
+			continue
+		}
+		delete(retainedVolumeMap, volumeID)
+	}
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"testing"
+	"time"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+func TestGetRetainedVolumes(t *testing.T) {
+	deletedAt := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	newVolume := func(volumeID string, entityType string, labels map[string]string) cnstypes.CnsVolume {
+		metadata := cnsvsphere.GetCnsKubernetesEntityMetaData("entity-"+volumeID, labels, false, entityType, "")
+		volume := cnstypes.CnsVolume{VolumeId: cnstypes.CnsVolumeId{Id: volumeID}}
+		volume.Metadata.EntityMetadata = []cnstypes.BaseCnsEntityMetadata{metadata}
+		return volume
+	}
+	cnsVolumes := []cnstypes.CnsVolume{
+		newVolume("vol-1", string(cnstypes.CnsKubernetesEntityTypePV),
+			map[string]string{pvDeletedAtLabel: deletedAt.Format(time.RFC3339), "app": "db"}),
+		newVolume("vol-2", string(cnstypes.CnsKubernetesEntityTypePV), map[string]string{"app": "db"}),
+		newVolume("vol-3", string(cnstypes.CnsKubernetesEntityTypePVC),
+			map[string]string{pvDeletedAtLabel: deletedAt.Format(time.RFC3339)}),
+		newVolume("vol-4", string(cnstypes.CnsKubernetesEntityTypePV), map[string]string{pvDeletedAtLabel: "yesterday"}),
+	}
+
+	retained := getRetainedVolumes(cnsVolumes)
+	if len(retained) != 1 || !retained["vol-1"].Equal(deletedAt) {
+		t.Errorf("Expected only vol-1 retained since %v, got %v", deletedAt, retained)
+	}
+}
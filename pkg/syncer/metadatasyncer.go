@@ -20,12 +20,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"reflect"
 	"strconv"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	csictx "github.com/rexray/gocsi/context"
 	cnstypes "github.com/vmware/govmomi/cns/types"
 	v1 "k8s.io/api/core/v1"
@@ -105,12 +107,22 @@ func (metadataSyncer *MetadataSyncInformer) Init() error {
 		klog.Errorf("Failed to connect to VirtualCenter host: %q. err=%v", metadataSyncer.vcconfig.Host, err)
 		return err
 	}
+	volumes.GetManager(metadataSyncer.vcenter).SetOperationTimeouts(metadataSyncer.cfg.OperationTimeout)
+	volumes.GetManager(metadataSyncer.vcenter).SetStuckTaskRemediation(metadataSyncer.cfg.StuckTask)
+	if metadataSyncer.cfg.Global.SessionKeepAliveIntervalInSec > 0 {
+		volumeManager := volumes.GetManager(metadataSyncer.vcenter)
+		metadataSyncer.vcenter.StartKeepAlive(time.Duration(metadataSyncer.cfg.Global.SessionKeepAliveIntervalInSec)*time.Second,
+			volumeManager.HealthCheckTimeout(), volumeManager.HealthCheck)
+	}
+
 	// Create the kubernetes client from config
 	k8sclient, err := k8s.NewClient()
 	if err != nil {
 		klog.Errorf("Creating Kubernetes client failed. Err: %v", err)
 		return err
 	}
+	metadataSyncer.k8sclient = k8sclient
+	metadataSyncer.recorder = k8s.NewEventRecorder(k8sclient, "vsphere-csi-syncer")
 
 	// Initialize cnsDeletionMap used by Full Sync
 	cnsDeletionMap = make(map[string]bool)
@@ -130,32 +142,155 @@ func (metadataSyncer *MetadataSyncInformer) Init() error {
 
 	// Set up kubernetes resource listeners for metadata syncer
 	metadataSyncer.k8sInformerManager = k8s.NewInformer(k8sclient)
+
+	if metadataSyncer.cfg.Global.GhostVMCleanup {
+		// Initialize ghostVMAttachmentMap used by ghost VM cleanup
+		ghostVMAttachmentMap = make(map[string]bool)
+		metadataSyncer.k8sInformerManager.AddNodeListener(
+			nodeAdded,   // Add
+			nodeUpdated, // Update
+			nil)         // Delete
+		ghostVMCleanupTicker := time.NewTicker(time.Duration(ghostVMCleanupIntervalInMin) * time.Minute)
+		// Trigger ghost VM cleanup
+		go func() {
+			for range ghostVMCleanupTicker.C {
+				klog.V(2).Infof("ghostVMCleanup is triggered")
+				triggerGhostVMCleanup(k8sclient, metadataSyncer)
+			}
+		}()
+	}
+	if metadataSyncer.cfg.Syncer.AttachCheckIntervalInMin > 0 {
+		attachCheckTicker := time.NewTicker(time.Duration(metadataSyncer.cfg.Syncer.AttachCheckIntervalInMin) * time.Minute)
+		// Trigger attach state check
+		go func() {
+			for range attachCheckTicker.C {
+				klog.V(2).Infof("attachCheck is triggered")
+				triggerAttachStateCheck(k8sclient, metadataSyncer)
+			}
+		}()
+	}
+	if metadataSyncer.cfg.Syncer.MetadataRetentionPeriodInMin > 0 {
+		// Initialize retainedVolumeMap used by the metadata retention sweep
+		retainedVolumeMap = make(map[string]time.Time)
+		if err := loadRetainedVolumes(metadataSyncer); err != nil {
+			klog.Warningf("Failed to load the volumes retained before the restart. Err: %v", err)
+		}
+		retentionSweepTicker := time.NewTicker(time.Duration(metadataRetentionSweepIntervalInMin) * time.Minute)
+		// Trigger metadata retention sweep
+		go func() {
+			for range retentionSweepTicker.C {
+				klog.V(2).Infof("metadataRetentionSweep is triggered")
+				triggerMetadataRetentionSweep(metadataSyncer)
+			}
+		}()
+	}
+	if metadataSyncer.cfg.Syncer.InventoryReportIntervalInMin > 0 {
+		namespace, name, err := splitConfigMapName(metadataSyncer.cfg.Syncer.InventoryReportConfigMap)
+		if err != nil {
+			klog.Errorf("Invalid inventory report ConfigMap. Err: %v", err)
+			return err
+		}
+		inventoryReportTicker := time.NewTicker(time.Duration(metadataSyncer.cfg.Syncer.InventoryReportIntervalInMin) * time.Minute)
+		// Trigger inventory report
+		go func() {
+			for range inventoryReportTicker.C {
+				klog.V(2).Infof("inventoryReport is triggered")
+				triggerInventoryReport(metadataSyncer, namespace, name)
+			}
+		}()
+	}
+	if metadataSyncer.cfg.Syncer.SweepFailedProvisionMetadata {
+		sweepIntervalInMin := defaultFailedProvisionSweepIntervalInMin
+		if metadataSyncer.cfg.Syncer.FailedProvisionSweepIntervalInMin > 0 {
+			sweepIntervalInMin = metadataSyncer.cfg.Syncer.FailedProvisionSweepIntervalInMin
+		}
+		failedProvisionSweepTicker := time.NewTicker(time.Duration(sweepIntervalInMin) * time.Minute)
+		// Trigger failed provision sweep
+		go func() {
+			for range failedProvisionSweepTicker.C {
+				klog.V(2).Infof("failedProvisionSweep is triggered")
+				triggerFailedProvisionSweep(metadataSyncer)
+			}
+		}()
+	}
+	if metadataSyncer.cfg.Syncer.RebalanceIntervalInMin > 0 {
+		rebalanceTicker := time.NewTicker(time.Duration(metadataSyncer.cfg.Syncer.RebalanceIntervalInMin) * time.Minute)
+		// Trigger datastore rebalancing
+		go func() {
+			for range rebalanceTicker.C {
+				klog.V(2).Infof("rebalance is triggered")
+				triggerRebalance(k8sclient, metadataSyncer)
+			}
+		}()
+	}
+	// Initialize ttlDeletedVolumeMap used by the volume TTL sweep
+	ttlDeletedVolumeMap = make(map[string]bool)
+	volumeTTLSweepTicker := time.NewTicker(time.Duration(volumeTTLSweepIntervalInMin) * time.Minute)
+	// Trigger volume TTL sweep
+	go func() {
+		for range volumeTTLSweepTicker.C {
+			klog.V(4).Infof("volumeTTLSweep is triggered")
+			triggerVolumeTTLSweep(metadataSyncer)
+		}
+	}()
+	keyRotationCheckTicker := time.NewTicker(time.Duration(keyRotationCheckIntervalInMin) * time.Minute)
+	// Trigger key rotation check
+	go func() {
+		for range keyRotationCheckTicker.C {
+			klog.V(4).Infof("keyRotationCheck is triggered")
+			triggerKeyRotationCheck(metadataSyncer)
+		}
+	}()
+	if metadataSyncer.cfg.Syncer.OwnerKinds != "" {
+		dynamicClient, mapper, err := k8s.NewDynamicClient()
+		if err != nil {
+			klog.Errorf("Creating Kubernetes dynamic client failed. Err: %v", err)
+			return err
+		}
+		ownerResolver = newOwnerChainResolver(metadataSyncer.cfg.Syncer.OwnerKinds, dynamicOwnerGetter(dynamicClient, mapper))
+	}
+	var events *eventQueue
+	if metadataSyncer.cfg.Syncer.MetadataSyncWorkers > 0 {
+		events = newEventQueue(metadataSyncer.cfg.Syncer.MetadataSyncWorkers)
+	}
 	metadataSyncer.k8sInformerManager.AddPVCListener(
 		nil, // Add
 		func(oldObj interface{}, newObj interface{}) { // Update
-			pvcUpdated(oldObj, newObj, metadataSyncer)
+			events.dispatch(newObj, func() { pvcUpdated(oldObj, newObj, metadataSyncer) })
 		},
 		func(obj interface{}) { // Delete
-			pvcDeleted(obj, metadataSyncer)
+			events.dispatch(obj, func() { pvcDeleted(obj, metadataSyncer) })
 		})
 	metadataSyncer.k8sInformerManager.AddPVListener(
 		nil, // Add
 		func(oldObj interface{}, newObj interface{}) { // Update
-			pvUpdated(oldObj, newObj, metadataSyncer)
+			events.dispatch(newObj, func() { pvUpdated(oldObj, newObj, metadataSyncer) })
 		},
 		func(obj interface{}) { // Delete
-			pvDeleted(obj, metadataSyncer)
+			events.dispatch(obj, func() { pvDeleted(obj, metadataSyncer) })
 		})
 	metadataSyncer.k8sInformerManager.AddPodListener(
 		nil, // Add
 		func(oldObj interface{}, newObj interface{}) { // Update
-			podUpdated(oldObj, newObj, metadataSyncer)
+			events.dispatch(newObj, func() { podUpdated(oldObj, newObj, metadataSyncer) })
 		},
 		func(obj interface{}) { // Delete
-			podDeleted(obj, metadataSyncer)
+			events.dispatch(obj, func() { podDeleted(obj, metadataSyncer) })
 		})
+	metadataSyncer.k8sInformerManager.AddNamespaceListener(
+		func(obj interface{}) { // Add
+			namespaceFullSyncRequested(obj, k8sclient, metadataSyncer)
+		},
+		func(oldObj interface{}, newObj interface{}) { // Update
+			namespaceFullSyncRequested(newObj, k8sclient, metadataSyncer)
+		},
+		nil) // Delete
 	metadataSyncer.pvLister = metadataSyncer.k8sInformerManager.GetPVLister()
 	metadataSyncer.pvcLister = metadataSyncer.k8sInformerManager.GetPVCLister()
+	metadataSyncer.podLister = metadataSyncer.k8sInformerManager.GetPodLister()
+	if metadataSyncer.cfg.Syncer.MetricsAddress != "" {
+		go serveMetrics(metadataSyncer.cfg.Syncer.MetricsAddress, metadataSyncer)
+	}
 	klog.V(2).Infof("Initialized metadata syncer")
 	stopCh := metadataSyncer.k8sInformerManager.Listen()
 	<-(stopCh)
@@ -201,7 +336,7 @@ func pvcUpdated(oldObj, newObj interface{}, metadataSyncer *MetadataSyncInformer
 
 	// Create updateSpec
 	var metadataList []cnstypes.BaseCnsEntityMetadata
-	pvcMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(newPvc.Name, newPvc.Labels, false, string(cnstypes.CnsKubernetesEntityTypePVC), newPvc.Namespace)
+	pvcMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(newPvc.Name, pvcLabels(newPvc), false, string(cnstypes.CnsKubernetesEntityTypePVC), newPvc.Namespace)
 	metadataList = append(metadataList, cnstypes.BaseCnsEntityMetadata(pvcMetadata))
 
 	updateSpec := &cnstypes.CnsVolumeMetadataUpdateSpec{
@@ -217,7 +352,10 @@ func pvcUpdated(oldObj, newObj interface{}, metadataSyncer *MetadataSyncInformer
 	klog.V(4).Infof("PVCUpdated: Calling UpdateVolumeMetadata with updateSpec: %+v", spew.Sdump(updateSpec))
 	if err := volumes.GetManager(metadataSyncer.vcenter).UpdateVolumeMetadata(updateSpec); err != nil {
 		klog.Errorf("PVCUpdated: UpdateVolumeMetadata failed with err %v", err)
+		setMetadataSyncStatus(metadataSyncer.k8sclient, pv, false, false)
+		return
 	}
+	setMetadataSyncStatus(metadataSyncer.k8sclient, pv, true, false)
 }
 
 // pvDeleted deletes pvc metadata on VC when pvc has been deleted on K8s cluster
@@ -268,7 +406,10 @@ func pvcDeleted(obj interface{}, metadataSyncer *MetadataSyncInformer) {
 	klog.V(4).Infof("PVCDeleted: Calling UpdateVolumeMetadata for volume %s with updateSpec: %+v", updateSpec.VolumeId.Id, spew.Sdump(updateSpec))
 	if err := volumes.GetManager(metadataSyncer.vcenter).UpdateVolumeMetadata(updateSpec); err != nil {
 		klog.Errorf("PVCDeleted: UpdateVolumeMetadata failed with err %v", err)
+		setMetadataSyncStatus(metadataSyncer.k8sclient, pv, false, false)
+		return
 	}
+	setMetadataSyncStatus(metadataSyncer.k8sclient, pv, true, false)
 }
 
 // pvUpdated updates volume metadata on VC when volume labels on K8S cluster have been updated
@@ -297,6 +438,16 @@ func pvUpdated(oldObj, newObj interface{}, metadataSyncer *MetadataSyncInformer)
 		klog.V(3).Infof("PVUpdated: PV %s metadata is not updated since updated PV is in phase %s", newPv.Name, newPv.Status.Phase)
 		return
 	}
+	// Return if only the metadata sync status recorded by the syncer changed
+	if isMetadataSyncStatusUpdate(oldPv, newPv) {
+		klog.V(4).Infof("PVUpdated: Only metadata sync status of PV %s changed", newPv.Name)
+		return
+	}
+	// Return if the volume was removed from CNS as its backing disk is gone
+	if isVolumeLost(newPv) {
+		klog.V(3).Infof("PVUpdated: PV %s is lost", newPv.Name)
+		return
+	}
 	// Return if labels are unchanged
 	if oldPv.Status.Phase == v1.VolumeAvailable && reflect.DeepEqual(newPv.GetLabels(), oldPv.GetLabels()) {
 		klog.V(3).Infof("PVUpdated: PV labels have not changed")
@@ -312,7 +463,7 @@ func pvUpdated(oldObj, newObj interface{}, metadataSyncer *MetadataSyncInformer)
 	}
 
 	var metadataList []cnstypes.BaseCnsEntityMetadata
-	pvMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(newPv.Name, newPv.GetLabels(), false, string(cnstypes.CnsKubernetesEntityTypePV), newPv.Namespace)
+	pvMetadata := cnsvsphere.GetCnsKubernetesEntityMetaData(newPv.Name, pvLabels(newPv), false, string(cnstypes.CnsKubernetesEntityTypePV), newPv.Namespace)
 	metadataList = append(metadataList, cnstypes.BaseCnsEntityMetadata(pvMetadata))
 
 	if oldPv.Status.Phase == v1.VolumeAvailable || newPv.Spec.StorageClassName != "" {
@@ -329,7 +480,10 @@ func pvUpdated(oldObj, newObj interface{}, metadataSyncer *MetadataSyncInformer)
 		klog.V(4).Infof("PVUpdated: Calling UpdateVolumeMetadata for volume %s with updateSpec: %+v", updateSpec.VolumeId.Id, spew.Sdump(updateSpec))
 		if err := volumes.GetManager(metadataSyncer.vcenter).UpdateVolumeMetadata(updateSpec); err != nil {
 			klog.Errorf("PVUpdated: UpdateVolumeMetadata failed with err %v", err)
+			setMetadataSyncStatus(metadataSyncer.k8sclient, newPv, false, false)
+			return
 		}
+		setMetadataSyncStatus(metadataSyncer.k8sclient, newPv, true, false)
 	} else {
 		createSpec := &cnstypes.CnsVolumeCreateSpec{
 			Name:       oldPv.Name,
@@ -385,6 +539,16 @@ func pvDeleted(obj interface{}, metadataSyncer *MetadataSyncInformer) {
 	}
 	volumeOperationsLock.Lock()
 	defer volumeOperationsLock.Unlock()
+	if ttlDeletedVolumeMap[pv.Spec.CSI.VolumeHandle] {
+		klog.V(2).Infof("PVDeleted: CNS volume %s was already deleted by the volume TTL sweep", pv.Spec.CSI.VolumeHandle)
+		delete(ttlDeletedVolumeMap, pv.Spec.CSI.VolumeHandle)
+		return
+	}
+	if !deleteDisk && metadataSyncer.cfg.Syncer.MetadataRetentionPeriodInMin > 0 {
+		klog.V(2).Infof("PVDeleted: Retaining CNS volume %s for %d minutes", pv.Spec.CSI.VolumeHandle, metadataSyncer.cfg.Syncer.MetadataRetentionPeriodInMin)
+		retainVolume(metadataSyncer, pv, time.Now())
+		return
+	}
 	klog.V(4).Infof("PVDeleted: vSphere provisioner deleting volume %v with delete disk %v", pv, deleteDisk)
 	if err := volumes.GetManager(metadataSyncer.vcenter).DeleteVolume(pv.Spec.CSI.VolumeHandle, deleteDisk); err != nil {
 		klog.Errorf("PVDeleted: Failed to delete disk %s with error %+v", pv.Spec.CSI.VolumeHandle, err)
@@ -489,8 +653,23 @@ func updatePodMetadata(pod *v1.Pod, metadataSyncer *MetadataSyncInformer, delete
 			if err := volumes.GetManager(metadataSyncer.vcenter).UpdateVolumeMetadata(updateSpec); err != nil {
 				msg := fmt.Sprintf("UpdateVolumeMetadata failed for volume %s with err: %v", volume.Name, err)
 				errorList = append(errorList, errors.New(msg))
+				setMetadataSyncStatus(metadataSyncer.k8sclient, pv, false, false)
+				continue
 			}
+			setMetadataSyncStatus(metadataSyncer.k8sclient, pv, true, false)
 		}
 	}
 	return errorList
 }
+
+// serveMetrics exposes the metrics of the default prometheus registry and the
+// volume mappings of the cluster on the given address
+func serveMetrics(address string, metadataSyncer *MetadataSyncInformer) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/volumes", metadataSyncer.serveVolumeMappings)
+	klog.V(2).Infof("Serving metrics on %s", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		klog.Errorf("Failed to serve metrics on %s. Err: %v", address, err)
+	}
+}
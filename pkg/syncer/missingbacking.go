@@ -0,0 +1,154 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/prometheus/client_golang/prometheus"
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	volumes "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+)
+
+const (
+	// volumeLostAnnotation is the PV annotation marking volumes removed from
+	// CNS because their backing disk no longer exists
+	volumeLostAnnotation = "cns.vmware.com/volume-lost"
+	// reasonBackingDiskMissing is the reason of the events posted on PVs
+	// whose backing disk no longer exists
+	reasonBackingDiskMissing = "BackingDiskMissing"
+)
+
+// missingBackingVolumes reports the number of CNS volumes whose backing disk
+// no longer exists, e.g. after the FCD was deleted out of band. It is exposed
+// on the syncer metrics address.
+var missingBackingVolumes = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "vsphere_csi_missing_backing_volumes",
+	Help: "Number of CNS volumes whose backing disk no longer exists",
+})
+
+func init() {
+	prometheus.MustRegister(missingBackingVolumes)
+}
+
+// checkVolumeBackings verifies the backing disk of the CNS volumes exists on
+// their datastore. Volumes whose disk is gone are reported with a metric and
+// an event on their PV. When enabled, their PV is annotated as lost, so full
+// sync does not register them again, and they are removed from CNS. The IDs
+// of the volumes removed from CNS are returned.
+func checkVolumeBackings(metadataSyncer *MetadataSyncInformer, cnsVolumes []cnstypes.CnsVolume, pvList []*v1.PersistentVolume,
+	datastores map[string]*cnsvsphere.DatastoreInfo) map[string]bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pvs := make(map[string]*v1.PersistentVolume)
+	for _, pv := range pvList {
+		pvs[pv.Spec.CSI.VolumeHandle] = pv
+	}
+	removed := make(map[string]bool)
+	missing := 0
+	for _, volume := range cnsVolumes {
+		volumeID := volume.VolumeId.Id
+		datastore := datastores[volume.DatastoreUrl]
+		if datastore == nil {
+			// Reported by the datastore check
+			continue
+		}
+		present, err := datastore.IsVStorageObjectPresent(ctx, volumeID)
+		if err != nil || present {
+			continue
+		}
+		missing++
+		klog.Warningf("BackingCheck: Backing disk of volume %s no longer exists on datastore %s", volumeID, volume.DatastoreUrl)
+		pv := pvs[volumeID]
+		if pv != nil && metadataSyncer.recorder != nil {
+			metadataSyncer.recorder.Eventf(pv, v1.EventTypeWarning, reasonBackingDiskMissing,
+				"Backing disk of volume %s no longer exists on datastore %s", volumeID, volume.DatastoreUrl)
+		}
+		if !metadataSyncer.cfg.Syncer.CleanupMissingBackingVolumes {
+			continue
+		}
+		if pv != nil {
+			if err := setVolumeLost(metadataSyncer.k8sclient, pv); err != nil {
+				klog.Warningf("BackingCheck: Failed to annotate PV %q as lost, keeping volume %s in CNS. Err: %v", pv.Name, volumeID, err)
+				continue
+			}
+		}
+		klog.V(2).Infof("BackingCheck: Removing volume %s from CNS", volumeID)
+		if err := volumes.GetManager(metadataSyncer.vcenter).DeleteVolume(volumeID, false); err != nil {
+			klog.Warningf("BackingCheck: Failed to remove volume %s from CNS with error %+v", volumeID, err)
+			continue
+		}
+		removed[volumeID] = true
+	}
+	missingBackingVolumes.Set(float64(missing))
+	return removed
+}
+
+// setVolumeLost annotates the PV as lost.
+func setVolumeLost(k8sclient clientset.Interface, pv *v1.PersistentVolume) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				volumeLostAnnotation: "true",
+			},
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = k8sclient.CoreV1().PersistentVolumes().Patch(pv.Name, types.MergePatchType, data)
+	return err
+}
+
+// isVolumeLost returns true if the PV is annotated as lost.
+func isVolumeLost(pv *v1.PersistentVolume) bool {
+	return pv.GetAnnotations()[volumeLostAnnotation] == "true"
+}
+
+// withoutLostVolumes returns the PVs which are not annotated as lost. The
+// volumes of lost PVs are not registered in CNS again, as their backing disk
+// is gone.
+func withoutLostVolumes(pvList []*v1.PersistentVolume) []*v1.PersistentVolume {
+	var pvs []*v1.PersistentVolume
+	for _, pv := range pvList {
+		if !isVolumeLost(pv) {
+			pvs = append(pvs, pv)
+		}
+	}
+	return pvs
+}
+
+// withoutVolumePVs returns the PVs whose volume ID is not in the removed set.
+// The PVs of volumes removed in a full sync cycle are listed before they were
+// annotated as lost.
+func withoutVolumePVs(pvList []*v1.PersistentVolume, removed map[string]bool) []*v1.PersistentVolume {
+	var pvs []*v1.PersistentVolume
+	for _, pv := range pvList {
+		if !removed[pv.Spec.CSI.VolumeHandle] {
+			pvs = append(pvs, pv)
+		}
+	}
+	return pvs
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSetVolumeLost(t *testing.T) {
+	pv := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv-1"}}
+	k8sclient := testclient.NewSimpleClientset(pv)
+
+	if err := setVolumeLost(k8sclient, pv); err != nil {
+		t.Fatalf("Failed to annotate PV as lost: %v", err)
+	}
+	updated, err := k8sclient.CoreV1().PersistentVolumes().Get("pv-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get PV: %v", err)
+	}
+	if !isVolumeLost(updated) {
+		t.Errorf("Expected PV to be annotated as lost, got annotations %v", updated.Annotations)
+	}
+	if isVolumeLost(pv) {
+		t.Errorf("Expected PV without annotation not to be lost")
+	}
+}
+
+func TestWithoutLostVolumes(t *testing.T) {
+	lost := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{
+		Name:        "pv-lost",
+		Annotations: map[string]string{volumeLostAnnotation: "true"},
+	}}
+	healthy := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv-healthy"}}
+
+	pvs := withoutLostVolumes([]*v1.PersistentVolume{lost, healthy})
+	if len(pvs) != 1 || pvs[0] != healthy {
+		t.Errorf("Expected only the healthy PV, got %v", pvs)
+	}
+}
+
+func TestWithoutVolumePVs(t *testing.T) {
+	newPV := func(name string, volumeID string) *v1.PersistentVolume {
+		return &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{VolumeHandle: volumeID},
+			}},
+		}
+	}
+	removed := newPV("pv-removed", "vol-removed")
+	kept := newPV("pv-kept", "vol-kept")
+
+	pvs := withoutVolumePVs([]*v1.PersistentVolume{removed, kept}, map[string]bool{"vol-removed": true})
+	if len(pvs) != 1 || pvs[0] != kept {
+		t.Errorf("Expected only the PV of the kept volume, got %v", pvs)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog"
+)
+
+const (
+	// ownerLabel is the CNS metadata label holding the top-level owner of a
+	// PVC, as "Kind/name"
+	ownerLabel = "csi.vsphere.vmware.com/owner"
+	// ownerChainLabel is the CNS metadata label holding the owners of a PVC,
+	// from its direct owner up to its top-level owner, as comma separated
+	// "Kind/name"
+	ownerChainLabel = "csi.vsphere.vmware.com/owner-chain"
+	// maxOwnerChainDepth bounds the owner references followed from a PVC
+	maxOwnerChainDepth = 10
+)
+
+// ownerGetter fetches the object referenced by an owner reference in the
+// namespace.
+type ownerGetter func(namespace string, ref metav1.OwnerReference) (metav1.Object, error)
+
+// ownerChainResolver resolves the owner chain of PVCs through the owner
+// references of the configured kinds.
+type ownerChainResolver struct {
+	kinds    map[string]bool
+	getOwner ownerGetter
+}
+
+// ownerResolver is set when owner kinds are configured for the syncer.
+var ownerResolver *ownerChainResolver
+
+// newOwnerChainResolver returns an ownerChainResolver following the owner
+// references of the comma separated kinds, or nil if none are given.
+func newOwnerChainResolver(ownerKinds string, getOwner ownerGetter) *ownerChainResolver {
+	kinds := make(map[string]bool)
+	for _, kind := range strings.Split(ownerKinds, ",") {
+		if kind = strings.TrimSpace(kind); kind != "" {
+			kinds[kind] = true
+		}
+	}
+	if len(kinds) == 0 {
+		return nil
+	}
+	return &ownerChainResolver{kinds: kinds, getOwner: getOwner}
+}
+
+// dynamicOwnerGetter returns an ownerGetter fetching owners of any kind
+// through the dynamic client.
+func dynamicOwnerGetter(dynamicClient dynamic.Interface, mapper meta.RESTMapper) ownerGetter {
+	return func(namespace string, ref metav1.OwnerReference) (metav1.Object, error) {
+		gv, err := schema.ParseGroupVersion(ref.APIVersion)
+		if err != nil {
+			return nil, err
+		}
+		mapping, err := mapper.RESTMapping(gv.WithKind(ref.Kind).GroupKind(), gv.Version)
+		if err != nil {
+			return nil, err
+		}
+		if mapping.Scope.Name() == meta.RESTScopeNameRoot {
+			return dynamicClient.Resource(mapping.Resource).Get(ref.Name, metav1.GetOptions{})
+		}
+		return dynamicClient.Resource(mapping.Resource).Namespace(namespace).Get(ref.Name, metav1.GetOptions{})
+	}
+}
+
+// ownerChain returns the owners of the object as "Kind/name", from its direct
+// owner up to its top-level owner. Only the controller owner references of the
+// configured kinds are followed.
+func (r *ownerChainResolver) ownerChain(obj metav1.Object) []string {
+	var chain []string
+	for len(chain) < maxOwnerChainDepth {
+		ref := metav1.GetControllerOf(obj)
+		if ref == nil || !r.kinds[ref.Kind] {
+			break
+		}
+		chain = append(chain, ref.Kind+"/"+ref.Name)
+		owner, err := r.getOwner(obj.GetNamespace(), *ref)
+		if err != nil {
+			klog.V(3).Infof("OwnerChain: Failed to get owner %s/%s of %s/%s. Err: %v", ref.Kind, ref.Name, obj.GetNamespace(), obj.GetName(), err)
+			break
+		}
+		obj = owner
+	}
+	return chain
+}
+
+// pvcLabels returns the labels of the PVC recorded as CNS metadata, including
+// its owner chain when owner kinds are configured for the syncer.
+func pvcLabels(pvc *v1.PersistentVolumeClaim) map[string]string {
+	if ownerResolver == nil {
+		return pvc.GetLabels()
+	}
+	chain := ownerResolver.ownerChain(pvc)
+	if len(chain) == 0 {
+		return pvc.GetLabels()
+	}
+	labels := make(map[string]string, len(pvc.Labels)+2)
+	for key, value := range pvc.Labels {
+		labels[key] = value
+	}
+	labels[ownerLabel] = chain[len(chain)-1]
+	labels[ownerChainLabel] = strings.Join(chain, ",")
+	return labels
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"fmt"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func controllerRef(kind string, name string) []metav1.OwnerReference {
+	isController := true
+	return []metav1.OwnerReference{{APIVersion: "example.com/v1", Kind: kind, Name: name, Controller: &isController}}
+}
+
+func TestPVCLabelsWithOwnerChain(t *testing.T) {
+	owners := map[string]*metav1.ObjectMeta{
+		"StatefulSet/db-0": {Name: "db-0", Namespace: "ns", OwnerReferences: controllerRef("Database", "db")},
+		"Database/db":      {Name: "db", Namespace: "ns", OwnerReferences: controllerRef("Tenant", "t1")},
+	}
+	getOwner := func(namespace string, ref metav1.OwnerReference) (metav1.Object, error) {
+		if owner, ok := owners[ref.Kind+"/"+ref.Name]; ok {
+			return owner, nil
+		}
+		return nil, fmt.Errorf("owner %s/%s not found", ref.Kind, ref.Name)
+	}
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "data-db-0",
+			Namespace:       "ns",
+			Labels:          map[string]string{"app": "db"},
+			OwnerReferences: controllerRef("StatefulSet", "db-0"),
+		},
+	}
+	defer func() { ownerResolver = nil }()
+
+	// Tenant is not configured, so the chain stops at the Database
+	ownerResolver = newOwnerChainResolver("StatefulSet, Database", getOwner)
+	labels := pvcLabels(pvc)
+	if labels[ownerLabel] != "Database/db" || labels[ownerChainLabel] != "StatefulSet/db-0,Database/db" || labels["app"] != "db" {
+		t.Errorf("unexpected labels %v", labels)
+	}
+	if _, ok := pvc.Labels[ownerLabel]; ok {
+		t.Errorf("labels of the PVC were modified")
+	}
+
+	// Unresolvable owners end the chain
+	ownerResolver = newOwnerChainResolver("StatefulSet,Database,Tenant", getOwner)
+	if labels := pvcLabels(pvc); labels[ownerLabel] != "Tenant/t1" {
+		t.Errorf("unexpected labels %v", labels)
+	}
+
+	// PVCs whose owner is not configured keep their labels
+	ownerResolver = newOwnerChainResolver("Database", getOwner)
+	if labels := pvcLabels(pvc); len(labels) != 1 {
+		t.Errorf("unexpected labels %v", labels)
+	}
+
+	if newOwnerChainResolver(" , ", getOwner) != nil {
+		t.Errorf("expected no resolver without owner kinds")
+	}
+}
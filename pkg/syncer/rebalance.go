@@ -0,0 +1,361 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"context"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	volumes "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+)
+
+const (
+	// defaultRebalanceSkewThresholdPercent is the utilization skew in
+	// percentage points between shared datastores above which volumes are
+	// relocated, unless configured
+	defaultRebalanceSkewThresholdPercent = 20
+	// defaultRebalanceMaxRelocations is the number of volumes relocated per
+	// rebalancing cycle, unless configured
+	defaultRebalanceMaxRelocations = 1
+)
+
+var (
+	// datastoreUtilizationSkew reports the difference in percentage points
+	// between the utilization of the fullest and the emptiest shared
+	// datastores, as of the last rebalancing cycle
+	datastoreUtilizationSkew = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "vsphere_csi_datastore_utilization_skew_percent",
+		Help: "Utilization difference between the fullest and emptiest shared datastores",
+	})
+	// rebalanceRelocations counts the volumes relocated by rebalancing
+	rebalanceRelocations = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "vsphere_csi_rebalance_relocations_total",
+		Help: "Number of volumes relocated to rebalance shared datastores",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(datastoreUtilizationSkew)
+	prometheus.MustRegister(rebalanceRelocations)
+}
+
+// datastoreUsage is the capacity and used space in bytes of a shared datastore.
+type datastoreUsage struct {
+	datastore *cnsvsphere.DatastoreInfo
+	capacity  int64
+	used      int64
+}
+
+// utilization returns the used space of the datastore in percent.
+func (u *datastoreUsage) utilization() float64 {
+	return 100 * float64(u.used) / float64(u.capacity)
+}
+
+// rebalanceVolume is a detached volume which may be relocated.
+type rebalanceVolume struct {
+	volumeID  string
+	policyID  string
+	sizeBytes int64
+}
+
+// triggerRebalance relocates detached volumes from the fullest to the emptiest
+// shared datastores of the cluster while the difference of their utilization
+// exceeds the skew threshold, up to the maximum relocations per cycle. Volumes
+// are only relocated to datastores compatible with their storage policy.
+// Volumes with a VolumeAttachment or attached to a node VM are never moved.
+// The volume operations lock is only held while the candidates are selected,
+// not across the attachment checks and relocations, so they do not hold up
+// the other syncer operations.
+func triggerRebalance(k8sclient clientset.Interface, metadataSyncer *MetadataSyncInformer) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sharedDatastores, attachedVolumes, err := getSharedDatastoresAndDisks(ctx, k8sclient)
+	if err != nil {
+		klog.Warningf("Rebalance: Failed to get the shared datastores of the nodes. Err: %v", err)
+		return
+	}
+	candidates, pvNames, err := getRebalanceCandidates(k8sclient, metadataSyncer, attachedVolumes)
+	if err != nil {
+		klog.Warningf("Rebalance: Failed to get the detached volumes. Err: %v", err)
+		return
+	}
+	var usages []*datastoreUsage
+	for _, datastore := range sharedDatastores {
+		capacity, free, err := datastore.GetDatastoreCapacity(ctx)
+		if err != nil {
+			klog.Warningf("Rebalance: Failed to get capacity of datastore %s. Err: %v", datastore.Info.Url, err)
+			return
+		}
+		if capacity > 0 {
+			usages = append(usages, &datastoreUsage{datastore: datastore, capacity: capacity, used: capacity - free})
+		}
+	}
+	compatible := func(volume rebalanceVolume, target *datastoreUsage) bool {
+		if volume.policyID == "" {
+			return true
+		}
+		if err := metadataSyncer.vcenter.ConnectPbm(ctx); err != nil {
+			klog.Warningf("Rebalance: Failed to connect to PBM. Err: %v", err)
+			return false
+		}
+		datastores, err := metadataSyncer.vcenter.GetCompatibleDatastores(ctx, volume.policyID, []*cnsvsphere.DatastoreInfo{target.datastore})
+		if err != nil {
+			klog.Warningf("Rebalance: Failed to check storage policy %s of volume %s. Err: %v", volume.policyID, volume.volumeID, err)
+			return false
+		}
+		return len(datastores) > 0
+	}
+	thresholdPercent := metadataSyncer.cfg.Syncer.RebalanceSkewThresholdPercent
+	if thresholdPercent <= 0 {
+		thresholdPercent = defaultRebalanceSkewThresholdPercent
+	}
+	maxRelocations := metadataSyncer.cfg.Syncer.RebalanceMaxRelocations
+	if maxRelocations <= 0 {
+		maxRelocations = defaultRebalanceMaxRelocations
+	}
+	datastoreUtilizationSkew.Set(getUtilizationSkew(usages))
+	for relocations := 0; relocations < maxRelocations; relocations++ {
+		volume, source, target := selectRebalanceMove(usages, candidates, float64(thresholdPercent), compatible)
+		if volume == nil {
+			break
+		}
+		if attached, err := isVolumeAttached(ctx, k8sclient, source.datastore, volume.volumeID, pvNames[volume.volumeID]); err != nil || attached {
+			if err != nil {
+				klog.Warningf("Rebalance: Failed to check the attachment of volume %s. Err: %v", volume.volumeID, err)
+			} else {
+				klog.V(2).Infof("Rebalance: Skipping volume %s attached since the start of the cycle", volume.volumeID)
+			}
+			relocations--
+			continue
+		}
+		klog.V(2).Infof("Rebalance: Relocating volume %s of %d bytes from datastore %s at %.1f%% to datastore %s at %.1f%%",
+			volume.volumeID, volume.sizeBytes, source.datastore.Info.Url, source.utilization(), target.datastore.Info.Url, target.utilization())
+		if err := source.datastore.RelocateVStorageObject(ctx, volume.volumeID, target.datastore.Reference()); err != nil {
+			klog.Warningf("Rebalance: Failed to relocate volume %s. Err: %v", volume.volumeID, err)
+			break
+		}
+		rebalanceRelocations.Inc()
+		source.used -= volume.sizeBytes
+		target.used += volume.sizeBytes
+		datastoreUtilizationSkew.Set(getUtilizationSkew(usages))
+	}
+}
+
+// getRebalanceCandidates returns the detached volumes of the driver by the URL
+// of their datastore, along with the PV names by volume ID. It holds the
+// volume operations lock while the volumes are selected.
+func getRebalanceCandidates(k8sclient clientset.Interface, metadataSyncer *MetadataSyncInformer,
+	attachedVolumes map[string]bool) (map[string][]rebalanceVolume, map[string]string, error) {
+	volumeOperationsLock.Lock()
+	defer volumeOperationsLock.Unlock()
+	vaList, err := k8sclient.StorageV1().VolumeAttachments().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	attachedPVs := getAttachedPVs(vaList.Items)
+	pvList, err := metadataSyncer.pvLister.List(labels.Everything())
+	if err != nil {
+		return nil, nil, err
+	}
+	detachedVolumes := make(map[string]bool)
+	pvNames := make(map[string]string)
+	for _, pv := range pvList {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != service.Name || pv.DeletionTimestamp != nil {
+			continue
+		}
+		volumeID := pv.Spec.CSI.VolumeHandle
+		pvNames[volumeID] = pv.Name
+		if !attachedPVs[pv.Name] && !attachedVolumes[volumeID] {
+			detachedVolumes[volumeID] = true
+		}
+	}
+	queryFilter := cnstypes.CnsQueryFilter{
+		ContainerClusterIds: []string{metadataSyncer.cfg.Global.ClusterID},
+	}
+	queryAllResult, err := volumes.GetManager(metadataSyncer.vcenter).QueryAllVolume(queryFilter, cnstypes.CnsQuerySelection{})
+	if err != nil && err != volumes.ErrPartialQueryResult {
+		return nil, nil, err
+	}
+	candidates := make(map[string][]rebalanceVolume)
+	for _, volume := range queryAllResult.Volumes {
+		if !detachedVolumes[volume.VolumeId.Id] {
+			continue
+		}
+		candidates[volume.DatastoreUrl] = append(candidates[volume.DatastoreUrl], rebalanceVolume{
+			volumeID:  volume.VolumeId.Id,
+			policyID:  volume.StoragePolicyId,
+			sizeBytes: volume.BackingObjectDetails.CapacityInMb * common.MbInBytes,
+		})
+	}
+	return candidates, pvNames, nil
+}
+
+// getAttachedPVs returns the names of the PVs with a VolumeAttachment of the
+// driver.
+func getAttachedPVs(vas []storagev1.VolumeAttachment) map[string]bool {
+	attachedPVs := make(map[string]bool)
+	for _, va := range vas {
+		if va.Spec.Attacher == service.Name && va.Spec.Source.PersistentVolumeName != nil {
+			attachedPVs[*va.Spec.Source.PersistentVolumeName] = true
+		}
+	}
+	return attachedPVs
+}
+
+// isVolumeAttached returns true if the PV of the volume has a VolumeAttachment,
+// or if the first class disk of the volume has a consumer or is attached to a
+// node VM, including attachments made outside CNS. It checks the attachment
+// right before a relocation, since the volume may have been attached after
+// the candidates of the rebalancing cycle were selected.
+func isVolumeAttached(ctx context.Context, k8sclient clientset.Interface, datastore *cnsvsphere.DatastoreInfo,
+	volumeID string, pvName string) (bool, error) {
+	vaList, err := k8sclient.StorageV1().VolumeAttachments().List(metav1.ListOptions{})
+	if err != nil {
+		return false, err
+	}
+	if getAttachedPVs(vaList.Items)[pvName] {
+		return true, nil
+	}
+	consumers, err := datastore.GetVStorageObjectConsumers(ctx, volumeID)
+	if err != nil {
+		return false, err
+	}
+	if len(consumers) > 0 {
+		return true, nil
+	}
+	_, attachedDisks, err := getSharedDatastoresAndDisks(ctx, k8sclient)
+	if err != nil {
+		return false, err
+	}
+	return attachedDisks[volumeID], nil
+}
+
+// getSharedDatastoresAndDisks returns the datastores accessible from all the
+// node VMs of the cluster, and the IDs of the first class disks attached to
+// them.
+func getSharedDatastoresAndDisks(ctx context.Context, k8sclient clientset.Interface) ([]*cnsvsphere.DatastoreInfo, map[string]bool, error) {
+	nodeList, err := k8sclient.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	var sharedDatastores []*cnsvsphere.DatastoreInfo
+	attachedDisks := make(map[string]bool)
+	for i, node := range nodeList.Items {
+		vm, err := cnsvsphere.GetVirtualMachineByUUID(common.GetUUIDFromProviderID(node.Spec.ProviderID), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		vmDisks, err := getVMDiskIDs(ctx, vm)
+		if err != nil {
+			return nil, nil, err
+		}
+		for diskID := range vmDisks {
+			attachedDisks[diskID] = true
+		}
+		accessibleDatastores, err := vm.GetAllAccessibleDatastores(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if i == 0 {
+			sharedDatastores = accessibleDatastores
+			continue
+		}
+		accessible := make(map[string]bool)
+		for _, datastore := range accessibleDatastores {
+			accessible[datastore.Info.Url] = true
+		}
+		var stillShared []*cnsvsphere.DatastoreInfo
+		for _, datastore := range sharedDatastores {
+			if accessible[datastore.Info.Url] {
+				stillShared = append(stillShared, datastore)
+			}
+		}
+		sharedDatastores = stillShared
+	}
+	return sharedDatastores, attachedDisks, nil
+}
+
+// getUtilizationSkew returns the difference in percentage points between the
+// utilization of the fullest and the emptiest datastores.
+func getUtilizationSkew(usages []*datastoreUsage) float64 {
+	if len(usages) < 2 {
+		return 0
+	}
+	min, max := usages[0].utilization(), usages[0].utilization()
+	for _, usage := range usages[1:] {
+		if utilization := usage.utilization(); utilization < min {
+			min = utilization
+		} else if utilization > max {
+			max = utilization
+		}
+	}
+	return max - min
+}
+
+// selectRebalanceMove returns the volume to relocate from the fullest
+// datastore, along with the datastore it is relocated to, or nil if the
+// utilization skew does not exceed the threshold. The largest volume which
+// leaves the target less utilized than the source is moved to the emptiest
+// datastore compatible with it.
+func selectRebalanceMove(usages []*datastoreUsage, candidates map[string][]rebalanceVolume, thresholdPercent float64,
+	compatible func(rebalanceVolume, *datastoreUsage) bool) (*rebalanceVolume, *datastoreUsage, *datastoreUsage) {
+	if len(usages) < 2 {
+		return nil, nil, nil
+	}
+	sorted := make([]*datastoreUsage, len(usages))
+	copy(sorted, usages)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].utilization() > sorted[j].utilization()
+	})
+	source := sorted[0]
+	if source.utilization()-sorted[len(sorted)-1].utilization() <= thresholdPercent {
+		return nil, nil, nil
+	}
+	sourceURL := source.datastore.Info.Url
+	volumesBySize := candidates[sourceURL]
+	sort.Slice(volumesBySize, func(i, j int) bool {
+		return volumesBySize[i].sizeBytes > volumesBySize[j].sizeBytes
+	})
+	for i := len(sorted) - 1; i > 0; i-- {
+		target := sorted[i]
+		if source.utilization()-target.utilization() <= thresholdPercent {
+			break
+		}
+		for j, volume := range volumesBySize {
+			sourceAfter := 100 * float64(source.used-volume.sizeBytes) / float64(source.capacity)
+			targetAfter := 100 * float64(target.used+volume.sizeBytes) / float64(target.capacity)
+			if targetAfter >= sourceAfter || !compatible(volume, target) {
+				continue
+			}
+			candidates[sourceURL] = append(volumesBySize[:j:j], volumesBySize[j+1:]...)
+			return &volume, source, target
+		}
+	}
+	return nil, nil, nil
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/types"
+	storagev1 "k8s.io/api/storage/v1"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
+)
+
+func TestSelectRebalanceMove(t *testing.T) {
+	newUsage := func(url string, capacity int64, used int64) *datastoreUsage {
+		return &datastoreUsage{
+			datastore: &cnsvsphere.DatastoreInfo{Info: &types.DatastoreInfo{Url: url}},
+			capacity:  capacity,
+			used:      used,
+		}
+	}
+	full := newUsage("ds:///full/", 100, 90)
+	empty := newUsage("ds:///empty/", 100, 10)
+	middle := newUsage("ds:///middle/", 100, 50)
+	usages := []*datastoreUsage{middle, full, empty}
+	candidates := map[string][]rebalanceVolume{
+		"ds:///full/": {
+			{volumeID: "small", sizeBytes: 5},
+			{volumeID: "huge", sizeBytes: 60},
+			{volumeID: "large", sizeBytes: 30},
+			{volumeID: "restricted", sizeBytes: 40, policyID: "policy"},
+		},
+	}
+	compatible := func(volume rebalanceVolume, target *datastoreUsage) bool {
+		return volume.policyID == "" || target == middle
+	}
+
+	// The largest compatible volume leaving the target less utilized than
+	// the source is moved to the emptiest datastore
+	volume, source, target := selectRebalanceMove(usages, candidates, 20, compatible)
+	if volume == nil || volume.volumeID != "large" || source != full || target != empty {
+		t.Fatalf("expected large volume to move from full to empty datastore, got %+v", volume)
+	}
+	if len(candidates["ds:///full/"]) != 3 {
+		t.Fatalf("expected moved volume to be removed from candidates, got %v", candidates["ds:///full/"])
+	}
+
+	// No volume is moved once the skew is under the threshold
+	if volume, _, _ := selectRebalanceMove(usages, candidates, 80, compatible); volume != nil {
+		t.Fatalf("expected no move under the threshold, got %+v", volume)
+	}
+	if skew := getUtilizationSkew(usages); skew != 80 {
+		t.Errorf("expected skew of 80, got %v", skew)
+	}
+}
+
+func TestGetAttachedPVs(t *testing.T) {
+	newVA := func(attacher string, pvName string) storagev1.VolumeAttachment {
+		va := storagev1.VolumeAttachment{Spec: storagev1.VolumeAttachmentSpec{Attacher: attacher}}
+		if pvName != "" {
+			va.Spec.Source.PersistentVolumeName = &pvName
+		}
+		return va
+	}
+	attachedPVs := getAttachedPVs([]storagev1.VolumeAttachment{
+		newVA(service.Name, "pv-1"),
+		newVA("other.csi.driver", "pv-2"),
+		newVA(service.Name, ""),
+	})
+	if len(attachedPVs) != 1 || !attachedPVs["pv-1"] {
+		t.Errorf("Expected only pv-1 to be attached, got %v", attachedPVs)
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	// metadataSyncedAnnotation is the PV annotation telling whether the CNS
+	// metadata of the volume is in sync with kubernetes
+	metadataSyncedAnnotation = "cns.vmware.com/metadata-synced"
+	// metadataSyncTimeAnnotation is the PV annotation holding the time the
+	// sync status of the volume was last recorded, in RFC3339 format
+	metadataSyncTimeAnnotation = "cns.vmware.com/metadata-sync-time"
+)
+
+// setMetadataSyncStatus records on the PV whether its CNS metadata is in sync.
+// Unless force is set, the PV is only patched when the status changes, so the
+// metadata syncer does not write a PV on every event.
+func setMetadataSyncStatus(k8sclient clientset.Interface, pv *v1.PersistentVolume, synced bool, force bool) {
+	if k8sclient == nil {
+		return
+	}
+	value := strconv.FormatBool(synced)
+	if !force && pv.GetAnnotations()[metadataSyncedAnnotation] == value {
+		return
+	}
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				metadataSyncedAnnotation:   value,
+				metadataSyncTimeAnnotation: time.Now().UTC().Format(time.RFC3339),
+			},
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		klog.Warningf("Failed to build metadata sync status patch for PV %q. Err: %v", pv.Name, err)
+		return
+	}
+	if _, err := k8sclient.CoreV1().PersistentVolumes().Patch(pv.Name, types.MergePatchType, data); err != nil {
+		klog.Warningf("Failed to record metadata sync status %s on PV %q. Err: %v", value, pv.Name, err)
+	}
+}
+
+// isMetadataSyncStatusUpdate returns true if the only change between the PVs
+// is their metadata sync status, which must not trigger a metadata update.
+func isMetadataSyncStatusUpdate(oldPv *v1.PersistentVolume, newPv *v1.PersistentVolume) bool {
+	if !reflect.DeepEqual(oldPv.GetLabels(), newPv.GetLabels()) || !reflect.DeepEqual(oldPv.Spec, newPv.Spec) ||
+		!reflect.DeepEqual(oldPv.Status, newPv.Status) {
+		return false
+	}
+	if reflect.DeepEqual(oldPv.GetAnnotations(), newPv.GetAnnotations()) {
+		return false
+	}
+	return reflect.DeepEqual(withoutSyncStatus(oldPv.GetAnnotations()), withoutSyncStatus(newPv.GetAnnotations()))
+}
+
+// withoutSyncStatus returns a copy of the annotations without the metadata
+// sync status annotations.
+func withoutSyncStatus(annotations map[string]string) map[string]string {
+	result := make(map[string]string)
+	for key, value := range annotations {
+		if key != metadataSyncedAnnotation && key != metadataSyncTimeAnnotation {
+			result[key] = value
+		}
+	}
+	return result
+}
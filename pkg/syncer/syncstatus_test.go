@@ -0,0 +1,78 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSetMetadataSyncStatus(t *testing.T) {
+	pv := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv-1"}}
+	k8sclient := testclient.NewSimpleClientset(pv)
+
+	setMetadataSyncStatus(k8sclient, pv, false, false)
+	updated, err := k8sclient.CoreV1().PersistentVolumes().Get("pv-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get PV: %v", err)
+	}
+	if updated.Annotations[metadataSyncedAnnotation] != "false" || updated.Annotations[metadataSyncTimeAnnotation] == "" {
+		t.Errorf("Unexpected sync status annotations %v", updated.Annotations)
+	}
+
+	// An unchanged status is not written again unless forced
+	actions := len(k8sclient.Actions())
+	setMetadataSyncStatus(k8sclient, updated, false, false)
+	if len(k8sclient.Actions()) != actions {
+		t.Errorf("Expected unchanged sync status not to be patched")
+	}
+	setMetadataSyncStatus(k8sclient, updated, false, true)
+	if len(k8sclient.Actions()) != actions+1 {
+		t.Errorf("Expected forced sync status to be patched")
+	}
+
+	// A nil client is ignored
+	setMetadataSyncStatus(nil, pv, true, true)
+}
+
+func TestIsMetadataSyncStatusUpdate(t *testing.T) {
+	oldPv := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{
+		Name:        "pv-1",
+		Labels:      map[string]string{"app": "db"},
+		Annotations: map[string]string{"pv.kubernetes.io/provisioned-by": "csi.vsphere.vmware.com"},
+	}}
+
+	statusUpdate := oldPv.DeepCopy()
+	statusUpdate.Annotations[metadataSyncedAnnotation] = "true"
+	statusUpdate.Annotations[metadataSyncTimeAnnotation] = "2019-10-01T00:00:00Z"
+	if !isMetadataSyncStatusUpdate(oldPv, statusUpdate) {
+		t.Errorf("Expected sync status only change to be detected")
+	}
+
+	labelUpdate := statusUpdate.DeepCopy()
+	labelUpdate.Labels["app"] = "web"
+	if isMetadataSyncStatusUpdate(oldPv, labelUpdate) {
+		t.Errorf("Expected label change not to be a sync status update")
+	}
+
+	if isMetadataSyncStatusUpdate(oldPv, oldPv.DeepCopy()) {
+		t.Errorf("Expected unchanged PV not to be a sync status update")
+	}
+}
@@ -18,9 +18,12 @@ package syncer
 
 import (
 	"sync"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
+	clientset "k8s.io/client-go/kubernetes"
 	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/record"
 
 	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
 	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
@@ -31,6 +34,25 @@ const (
 	// default interval for csi full sync, used unless overridden by user in csi-controller YAML
 	defaultFullSyncIntervalInMin = 30
 
+	// interval for releasing volumes attached to deleted node VMs
+	ghostVMCleanupIntervalInMin = 5
+
+	// interval for removing CNS volumes whose metadata retention period elapsed
+	metadataRetentionSweepIntervalInMin = 5
+
+	// interval for deleting released volumes whose TTL elapsed
+	volumeTTLSweepIntervalInMin = 5
+
+	// interval for reporting volumes whose key rotation is overdue
+	keyRotationCheckIntervalInMin = 60
+
+	// default interval for removing CNS volumes of failed provisions
+	defaultFailedProvisionSweepIntervalInMin = 30
+
+	// default backoff before the first retry of a full sync failed on a
+	// vCenter error, doubled on each further retry
+	defaultFullSyncRetryBackoffInSec = 30
+
 	// Constants for specifying operation that needs to be performed on CNS volume
 	// Create the volume on CNS
 	createVolumeOperation = "createVolume"
@@ -43,6 +65,9 @@ const (
 
 	// Env variable for FullSync interval
 	envFullSyncIntervalMinutes = "FULL_SYNC_INTERVAL_MINUTES"
+
+	// Annotation on a namespace requesting a full sync scoped to that namespace
+	annTriggerFullSync = "csi.vsphere.vmware.com/trigger-full-sync"
 )
 
 var (
@@ -69,6 +94,33 @@ var (
 	// the volume is created in CNS
 	cnsCreationMap map[string]bool
 
+	// ghostVMAttachmentMap tracks VolumeAttachments whose node VM is missing
+	// in vCenter. If an attachment exists in this map across two cleanup
+	// cycles, it is released
+	ghostVMAttachmentMap map[string]bool
+
+	// retainedVolumeMap maps the CNS volumes of deleted PVs to the time the
+	// PV was deleted. The volumes are removed from CNS once the metadata
+	// retention period elapsed. Guarded by volumeOperationsLock
+	retainedVolumeMap map[string]time.Time
+
+	// ttlDeletedVolumeMap holds the volumes deleted by the volume TTL sweep
+	// until the deletion of their PV is observed, so the PV deletion does not
+	// retain or delete them again. Guarded by volumeOperationsLock
+	ttlDeletedVolumeMap map[string]bool
+
+	// nodeNameToVMUUIDMap maps K8s node names to their VM UUIDs. Entries are
+	// kept after node deletion so ghost VMs can still be looked up
+	nodeNameToVMUUIDMap sync.Map
+
+	// nodeNameToVMMap maps K8s node names to their VMs, whose reference is
+	// needed to detach the volumes of ghost VMs in CNS. Entries are kept after
+	// node deletion
+	nodeNameToVMMap sync.Map
+
+	// fullSyncLock serializes periodic and namespace scoped full sync runs
+	fullSyncLock sync.Mutex
+
 	// Metadata syncer and full sync share a global lock
 	// to mitigate race conditions related to
 	// static provisioning of volumes
@@ -91,4 +143,13 @@ type MetadataSyncInformer struct {
 	vcenter              *cnsvsphere.VirtualCenter
 	pvLister             corelisters.PersistentVolumeLister
 	pvcLister            corelisters.PersistentVolumeClaimLister
+	podLister            corelisters.PodLister
+	// k8sclient records the metadata sync status on the PVs
+	k8sclient clientset.Interface
+	// recorder posts events on the PVs
+	recorder record.EventRecorder
+	// cnsVolumeState is the CNS state of the volume mappings served on the
+	// metrics address, refreshed by full sync
+	cnsVolumeState     *cnsVolumeState
+	cnsVolumeStateLock sync.RWMutex
 }
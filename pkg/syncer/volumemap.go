@@ -0,0 +1,222 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+
+	cnsvsphere "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/vsphere"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+)
+
+// volumeMapping maps a CNS volume to the Kubernetes objects using it, for
+// troubleshooting.
+type volumeMapping struct {
+	VolumeID     string
+	DatastoreURL string   `json:",omitempty"`
+	PV           string   `json:",omitempty"`
+	PVC          string   `json:",omitempty"`
+	Pods         []string `json:",omitempty"`
+	Nodes        []string `json:",omitempty"`
+}
+
+// volumeMappings is the response of the volume mappings endpoint.
+type volumeMappings struct {
+	// CNSStateTime is the time of the full sync the datastores and attached
+	// nodes of the volumes were read at. PVs, PVCs and pods are read from the
+	// informer caches on each request.
+	CNSStateTime time.Time
+	Volumes      []*volumeMapping
+}
+
+// cnsVolumeState is the snapshot of the CNS volumes of the cluster and of the
+// nodes CNS records them as attached to.
+type cnsVolumeState struct {
+	volumes []cnstypes.CnsVolume
+	// attachedNodes maps volume IDs to the names of the nodes CNS records
+	// them as attached to
+	attachedNodes map[string][]string
+	time          time.Time
+}
+
+// serveVolumeMappings writes the mappings of the CNS volumes of the cluster
+// and of the vSphere CSI PVs to their PV, PVC, pods and the nodes CNS records
+// them as attached to. CNS is not queried on requests, its state is the one
+// of the last full sync.
+func (metadataSyncer *MetadataSyncInformer) serveVolumeMappings(w http.ResponseWriter, r *http.Request) {
+	metadataSyncer.cnsVolumeStateLock.RLock()
+	state := metadataSyncer.cnsVolumeState
+	metadataSyncer.cnsVolumeStateLock.RUnlock()
+	if state == nil {
+		http.Error(w, "volume mappings are not available until the first full sync", http.StatusServiceUnavailable)
+		return
+	}
+	pvList, err := metadataSyncer.pvLister.List(labels.Everything())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list PVs: %v", err), http.StatusInternalServerError)
+		return
+	}
+	podList, err := metadataSyncer.podLister.List(labels.Everything())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to list pods: %v", err), http.StatusInternalServerError)
+		return
+	}
+	mappings := volumeMappings{
+		CNSStateTime: state.time,
+		Volumes:      buildVolumeMappings(state.volumes, pvList, podList, state.attachedNodes),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(mappings); err != nil {
+		klog.Warningf("Failed to write volume mappings. Err: %v", err)
+	}
+}
+
+// refreshCNSVolumeState records the CNS volumes of the full sync and the nodes
+// CNS records them as attached to for the volume mappings. The previous state
+// is kept on failure.
+func (metadataSyncer *MetadataSyncInformer) refreshCNSVolumeState(k8sclient clientset.Interface,
+	cnsVolumes []cnstypes.CnsVolume) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	consumersByVolume, err := getCNSConsumers(ctx, metadataSyncer, cnsVolumes)
+	if err != nil {
+		klog.Warningf("FullSync: Failed to get CNS attachments for the volume mappings. Err: %v", err)
+		return
+	}
+	nodesByVMID, err := getNodesByVMID(ctx, k8sclient)
+	if err != nil {
+		klog.Warningf("FullSync: Failed to get node VMs for the volume mappings. Err: %v", err)
+		return
+	}
+	state := &cnsVolumeState{
+		volumes:       cnsVolumes,
+		attachedNodes: make(map[string][]string),
+		time:          time.Now(),
+	}
+	for volumeID, consumers := range consumersByVolume {
+		for _, consumer := range consumers {
+			if nodeName, ok := nodesByVMID[consumer]; ok {
+				state.attachedNodes[volumeID] = append(state.attachedNodes[volumeID], nodeName)
+			}
+		}
+	}
+	metadataSyncer.cnsVolumeStateLock.Lock()
+	metadataSyncer.cnsVolumeState = state
+	metadataSyncer.cnsVolumeStateLock.Unlock()
+}
+
+// getNodesByVMID maps the IDs of the node VMs to the names of their nodes.
+// Nodes whose VM can't be found are skipped.
+func getNodesByVMID(ctx context.Context, k8sclient clientset.Interface) (map[string]string, error) {
+	nodeList, err := k8sclient.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	nodesByVMID := make(map[string]string)
+	for _, node := range nodeList.Items {
+		nodeUUID := common.GetUUIDFromProviderID(node.Spec.ProviderID)
+		if nodeUUID == "" {
+			continue
+		}
+		vm, err := cnsvsphere.GetVirtualMachineByUUID(nodeUUID, false)
+		if err != nil {
+			klog.Warningf("Failed to get VM for node %q. Err: %v", node.Name, err)
+			continue
+		}
+		vmIDs, err := vm.GetUUIDs(ctx)
+		if err != nil {
+			klog.Warningf("Failed to get IDs of VM %v for node %q. Err: %v", vm, node.Name, err)
+			continue
+		}
+		for vmID := range vmIDs {
+			nodesByVMID[vmID] = node.Name
+		}
+	}
+	return nodesByVMID, nil
+}
+
+// buildVolumeMappings maps the CNS volumes and the volumes of the vSphere CSI
+// PVs to their PV, the PVC bound to it, the pods using the PVC and the nodes
+// the volume is attached to according to attachedNodes, keyed by volume ID.
+// Mappings are sorted by volume ID.
+func buildVolumeMappings(cnsVolumes []cnstypes.CnsVolume, pvList []*v1.PersistentVolume, podList []*v1.Pod,
+	attachedNodes map[string][]string) []*volumeMapping {
+	mappings := make(map[string]*volumeMapping)
+	getMapping := func(volumeID string) *volumeMapping {
+		mapping := mappings[volumeID]
+		if mapping == nil {
+			mapping = &volumeMapping{VolumeID: volumeID}
+			mappings[volumeID] = mapping
+		}
+		return mapping
+	}
+	for _, volume := range cnsVolumes {
+		getMapping(volume.VolumeId.Id).DatastoreURL = volume.DatastoreUrl
+	}
+	pvcVolumes := make(map[string]*volumeMapping)
+	for _, pv := range pvList {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != service.Name {
+			continue
+		}
+		mapping := getMapping(pv.Spec.CSI.VolumeHandle)
+		mapping.PV = pv.Name
+		if pv.Spec.ClaimRef != nil {
+			mapping.PVC = pv.Spec.ClaimRef.Namespace + "/" + pv.Spec.ClaimRef.Name
+			pvcVolumes[mapping.PVC] = mapping
+		}
+	}
+	for _, pod := range podList {
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim == nil {
+				continue
+			}
+			if mapping := pvcVolumes[pod.Namespace+"/"+volume.PersistentVolumeClaim.ClaimName]; mapping != nil {
+				mapping.Pods = append(mapping.Pods, pod.Namespace+"/"+pod.Name)
+			}
+		}
+	}
+	for volumeID, nodes := range attachedNodes {
+		if mapping := mappings[volumeID]; mapping != nil {
+			mapping.Nodes = append(mapping.Nodes, nodes...)
+		}
+	}
+	result := make([]*volumeMapping, 0, len(mappings))
+	for _, mapping := range mappings {
+		sort.Strings(mapping.Pods)
+		sort.Strings(mapping.Nodes)
+		result = append(result, mapping)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].VolumeID < result[j].VolumeID
+	})
+	return result
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	cnstypes "github.com/vmware/govmomi/cns/types"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
+)
+
+func TestBuildVolumeMappings(t *testing.T) {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: service.Name, VolumeHandle: "volume-1"},
+			},
+			ClaimRef: &v1.ObjectReference{Namespace: "default", Name: "pvc-1"},
+		},
+	}
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod-1"},
+		Spec: v1.PodSpec{
+			Volumes: []v1.Volume{{
+				Name: "data",
+				VolumeSource: v1.VolumeSource{
+					PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "pvc-1"},
+				},
+			}},
+		},
+	}
+	cnsVolumes := []cnstypes.CnsVolume{
+		{VolumeId: cnstypes.CnsVolumeId{Id: "volume-2"}, DatastoreUrl: "ds:///vmfs/volumes/ds2/"},
+		{VolumeId: cnstypes.CnsVolumeId{Id: "volume-1"}, DatastoreUrl: "ds:///vmfs/volumes/ds1/"},
+	}
+
+	mappings := buildVolumeMappings(cnsVolumes, []*v1.PersistentVolume{pv}, []*v1.Pod{pod},
+		map[string][]string{"volume-1": {"node-1"}, "volume-3": {"node-2"}})
+	expected := []*volumeMapping{
+		{
+			VolumeID:     "volume-1",
+			DatastoreURL: "ds:///vmfs/volumes/ds1/",
+			PV:           "pv-1",
+			PVC:          "default/pvc-1",
+			Pods:         []string{"default/pod-1"},
+			Nodes:        []string{"node-1"},
+		},
+		{VolumeID: "volume-2", DatastoreURL: "ds:///vmfs/volumes/ds2/"},
+	}
+	if !reflect.DeepEqual(mappings, expected) {
+		t.Errorf("Expected mappings %+v, got %+v", expected, mappings)
+	}
+}
+
+func TestServeVolumeMappings(t *testing.T) {
+	metadataSyncer := &MetadataSyncInformer{}
+	recorder := httptest.NewRecorder()
+	metadataSyncer.serveVolumeMappings(recorder, httptest.NewRequest("GET", "/volumes", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d before the first full sync, got %d", http.StatusServiceUnavailable, recorder.Code)
+	}
+
+	// PVs are read from the informer cache on each request
+	pvIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	metadataSyncer.pvLister = corelisters.NewPersistentVolumeLister(pvIndexer)
+	metadataSyncer.podLister = corelisters.NewPodLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}))
+	stateTime := time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC)
+	metadataSyncer.cnsVolumeState = &cnsVolumeState{
+		volumes:       []cnstypes.CnsVolume{{VolumeId: cnstypes.CnsVolumeId{Id: "volume-1"}}},
+		attachedNodes: map[string][]string{"volume-1": {"node-1"}},
+		time:          stateTime,
+	}
+	pvIndexer.Add(&v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: service.Name, VolumeHandle: "volume-1"},
+			},
+		},
+	})
+	recorder = httptest.NewRecorder()
+	metadataSyncer.serveVolumeMappings(recorder, httptest.NewRequest("GET", "/volumes", nil))
+	var mappings volumeMappings
+	if err := json.NewDecoder(recorder.Body).Decode(&mappings); err != nil {
+		t.Fatalf("Failed to decode volume mappings: %v", err)
+	}
+	expected := volumeMappings{
+		CNSStateTime: stateTime,
+		Volumes:      []*volumeMapping{{VolumeID: "volume-1", PV: "pv-1", Nodes: []string{"node-1"}}},
+	}
+	if recorder.Code != http.StatusOK || !reflect.DeepEqual(mappings, expected) {
+		t.Errorf("Expected mappings %+v, got status %d and %+v", expected, recorder.Code, mappings)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+
+	volumes "sigs.k8s.io/vsphere-csi-driver/pkg/common/cns-lib/volume"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+)
+
+// volumeTTLLabel is the label of the PV metadata in CNS recording the TTL of
+// volumes provisioned with one
+const volumeTTLLabel = "csi.vsphere.vmware.com/volume-ttl"
+
+// recordedVolumeAttributes maps the volume attributes recorded as labels of
+// the PV metadata in CNS to their label.
+var recordedVolumeAttributes = map[string]string{
+	common.AttributeVolumeTTL:           volumeTTLLabel,
+	common.AttributeKeyRotationInterval: keyRotationIntervalLabel,
+}
+
+// pvLabels returns the labels of the PV recorded as CNS metadata, including
+// the TTL and key rotation interval of the volume when its StorageClass set
+// them, and the CNS labels set by its StorageClass. The labels set by the
+// StorageClass take precedence over the labels of the PV.
+func pvLabels(pv *v1.PersistentVolume) map[string]string {
+	if pv.Spec.CSI == nil {
+		return pv.GetLabels()
+	}
+	storageClassLabels := make(map[string]string)
+	for attribute, label := range recordedVolumeAttributes {
+		if value := pv.Spec.CSI.VolumeAttributes[attribute]; value != "" {
+			storageClassLabels[label] = value
+		}
+	}
+	for attribute, value := range pv.Spec.CSI.VolumeAttributes {
+		if strings.HasPrefix(attribute, common.AttributeCnsLabelPrefix) {
+			storageClassLabels[strings.TrimPrefix(attribute, common.AttributeCnsLabelPrefix)] = value
+		}
+	}
+	if len(storageClassLabels) == 0 {
+		return pv.GetLabels()
+	}
+	recorded := make(map[string]string, len(pv.Labels)+len(storageClassLabels))
+	for key, value := range pv.Labels {
+		recorded[key] = value
+	}
+	for key, value := range storageClassLabels {
+		recorded[key] = value
+	}
+	return recorded
+}
+
+// triggerVolumeTTLSweep deletes the volumes provisioned with a TTL whose PVC
+// is gone once the TTL elapsed since their creation. The PV is deleted along
+// with the volume, and the volume is recorded in ttlDeletedVolumeMap so the
+// PV deletion does not retain it. Volumes reclaimed by the provisioner are
+// left alone.
+func triggerVolumeTTLSweep(metadataSyncer *MetadataSyncInformer) {
+	pvList, err := metadataSyncer.pvLister.List(labels.Everything())
+	if err != nil {
+		klog.Warningf("VolumeTTL: Failed to list PVs. Err: %v", err)
+		return
+	}
+	expired := getExpiredOrphanedVolumes(pvList, time.Now())
+	if len(expired) == 0 {
+		return
+	}
+	volumeOperationsLock.Lock()
+	defer volumeOperationsLock.Unlock()
+	for _, pv := range expired {
+		volumeID := pv.Spec.CSI.VolumeHandle
+		klog.V(2).Infof("VolumeTTL: TTL %s of released volume %s elapsed, deleting PV %s",
+			pv.Spec.CSI.VolumeAttributes[common.AttributeVolumeTTL], volumeID, pv.Name)
+		if err := volumes.GetManager(metadataSyncer.vcenter).DeleteVolume(volumeID, true); err != nil {
+			klog.Warningf("VolumeTTL: Failed to delete volume %s with error %+v", volumeID, err)
+			continue
+		}
+		ttlDeletedVolumeMap[volumeID] = true
+		err := metadataSyncer.k8sclient.CoreV1().PersistentVolumes().Delete(pv.Name, &metav1.DeleteOptions{})
+		if apierrors.IsNotFound(err) {
+			delete(ttlDeletedVolumeMap, volumeID)
+		} else if err != nil {
+			klog.Warningf("VolumeTTL: Failed to delete PV %s of deleted volume %s. Err: %v", pv.Name, volumeID, err)
+		}
+	}
+}
+
+// getExpiredOrphanedVolumes returns the released PVs of vSphere CSI volumes
+// with a retained reclaim policy whose TTL elapsed at the given time.
+func getExpiredOrphanedVolumes(pvList []*v1.PersistentVolume, now time.Time) []*v1.PersistentVolume {
+	var expired []*v1.PersistentVolume
+	for _, pv := range pvList {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != service.Name || pv.DeletionTimestamp != nil {
+			continue
+		}
+		value := pv.Spec.CSI.VolumeAttributes[common.AttributeVolumeTTL]
+		if value == "" || pv.Status.Phase != v1.VolumeReleased ||
+			pv.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimDelete {
+			continue
+		}
+		ttl, err := common.ParseVolumeTTL(value)
+		if err != nil {
+			klog.Warningf("VolumeTTL: Ignoring invalid TTL of PV %s. Err: %v", pv.Name, err)
+			continue
+		}
+		if now.Sub(pv.CreationTimestamp.Time) >= ttl {
+			expired = append(expired, pv)
+		}
+	}
+	return expired
+}
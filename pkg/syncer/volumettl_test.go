@@ -0,0 +1,118 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cnsconfig "sigs.k8s.io/vsphere-csi-driver/pkg/common/config"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service"
+	"sigs.k8s.io/vsphere-csi-driver/pkg/csi/service/common"
+)
+
+func newTTLPV(name string, ttl string, phase v1.PersistentVolumePhase, reclaimPolicy v1.PersistentVolumeReclaimPolicy, created time.Time) *v1.PersistentVolume {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Labels:            map[string]string{"app": "ci"},
+			CreationTimestamp: metav1.NewTime(created),
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeReclaimPolicy: reclaimPolicy,
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:           service.Name,
+					VolumeHandle:     name + "-handle",
+					VolumeAttributes: map[string]string{},
+				},
+			},
+		},
+		Status: v1.PersistentVolumeStatus{Phase: phase},
+	}
+	if ttl != "" {
+		pv.Spec.CSI.VolumeAttributes[common.AttributeVolumeTTL] = ttl
+	}
+	return pv
+}
+
+func TestPVLabels(t *testing.T) {
+	now := time.Now()
+	pv := newTTLPV("pv-1", "", v1.VolumeBound, v1.PersistentVolumeReclaimRetain, now)
+	if labels := pvLabels(pv); len(labels) != 1 || labels["app"] != "ci" {
+		t.Errorf("Unexpected labels %v for PV without TTL", labels)
+	}
+	pv = newTTLPV("pv-2", "24h", v1.VolumeBound, v1.PersistentVolumeReclaimRetain, now)
+	labels := pvLabels(pv)
+	if labels[volumeTTLLabel] != "24h" || labels["app"] != "ci" {
+		t.Errorf("Unexpected labels %v for PV with TTL", labels)
+	}
+	if _, ok := pv.Labels[volumeTTLLabel]; ok {
+		t.Errorf("Expected labels of the PV not to be modified")
+	}
+}
+
+func TestPVLabelsCnsLabels(t *testing.T) {
+	pv := newTTLPV("pv-1", "", v1.VolumeBound, v1.PersistentVolumeReclaimRetain, time.Now())
+	pv.Labels["environment"] = "dev"
+	pv.Spec.CSI.VolumeAttributes[common.AttributeCnsLabelPrefix+"environment"] = "prod"
+	labels := pvLabels(pv)
+	if len(labels) != 2 || labels["environment"] != "prod" || labels["app"] != "ci" {
+		t.Errorf("Unexpected labels %v", labels)
+	}
+}
+
+func TestGetExpiredOrphanedVolumes(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+	pvList := []*v1.PersistentVolume{
+		newTTLPV("expired", "24h", v1.VolumeReleased, v1.PersistentVolumeReclaimRetain, old),
+		newTTLPV("not-expired", "72h", v1.VolumeReleased, v1.PersistentVolumeReclaimRetain, old),
+		newTTLPV("bound", "24h", v1.VolumeBound, v1.PersistentVolumeReclaimRetain, old),
+		newTTLPV("reclaimed", "24h", v1.VolumeReleased, v1.PersistentVolumeReclaimDelete, old),
+		newTTLPV("no-ttl", "", v1.VolumeReleased, v1.PersistentVolumeReclaimRetain, old),
+		newTTLPV("invalid-ttl", "soon", v1.VolumeReleased, v1.PersistentVolumeReclaimRetain, old),
+	}
+	other := newTTLPV("other-driver", "24h", v1.VolumeReleased, v1.PersistentVolumeReclaimRetain, old)
+	other.Spec.CSI.Driver = "other.csi.driver"
+	pvList = append(pvList, other)
+
+	expired := getExpiredOrphanedVolumes(pvList, now)
+	if len(expired) != 1 || expired[0].Name != "expired" {
+		t.Errorf("Expected only PV expired to be expired, got %v", expired)
+	}
+}
+
+func TestPVDeletedSkipsVolumeDeletedByTTLSweep(t *testing.T) {
+	cfg := &cnsconfig.Config{}
+	cfg.Syncer.MetadataRetentionPeriodInMin = 60
+	metadataSyncer := &MetadataSyncInformer{cfg: cfg}
+	retainedVolumeMap = make(map[string]time.Time)
+	pv := newTTLPV("pv-1", "1h", v1.VolumeReleased, v1.PersistentVolumeReclaimRetain, time.Now().Add(-2*time.Hour))
+	ttlDeletedVolumeMap = map[string]bool{pv.Spec.CSI.VolumeHandle: true}
+
+	pvDeleted(pv, metadataSyncer)
+	if _, retained := retainedVolumeMap[pv.Spec.CSI.VolumeHandle]; retained {
+		t.Errorf("Expected volume deleted by the TTL sweep not to be retained")
+	}
+	if ttlDeletedVolumeMap[pv.Spec.CSI.VolumeHandle] {
+		t.Errorf("Expected volume to be forgotten once the deletion of its PV is observed")
+	}
+}
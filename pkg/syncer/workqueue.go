@@ -0,0 +1,82 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"hash/fnv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// eventQueueShardSize is the number of events buffered per worker before
+// the informers are blocked
+const eventQueueShardSize = 1024
+
+// eventQueueDepth reports the number of informer events waiting for their
+// metadata update. It is exposed on the syncer metrics address.
+var eventQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "vsphere_csi_syncer_queue_depth",
+	Help: "Number of informer events waiting for their metadata update",
+})
+
+func init() {
+	prometheus.MustRegister(eventQueueDepth)
+}
+
+// eventQueue processes informer events on a fixed number of workers. Events
+// are sharded by object key, so the events of an object are processed in
+// order by the same worker.
+type eventQueue struct {
+	shards []chan func()
+}
+
+// newEventQueue returns an eventQueue processing events on the given number
+// of workers.
+func newEventQueue(workers int) *eventQueue {
+	q := &eventQueue{shards: make([]chan func(), workers)}
+	for i := range q.shards {
+		q.shards[i] = make(chan func(), eventQueueShardSize)
+		go func(shard chan func()) {
+			for process := range shard {
+				process()
+				eventQueueDepth.Dec()
+			}
+		}(q.shards[i])
+	}
+	return q
+}
+
+// dispatch queues the processing of an event of the object. Events are
+// processed inline when no queue is configured.
+func (q *eventQueue) dispatch(obj interface{}, process func()) {
+	if q == nil {
+		process()
+		return
+	}
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		klog.Warningf("Failed to get key of object %+v, processing event inline. Err: %v", obj, err)
+		process()
+		return
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	eventQueueDepth.Inc()
+	q.shards[hash.Sum32()%uint32(len(q.shards))] <- process
+}
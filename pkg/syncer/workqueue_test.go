@@ -0,0 +1,58 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"sync"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestEventQueue(t *testing.T) {
+	// Events are processed inline without a queue
+	var events *eventQueue
+	processed := false
+	events.dispatch(&v1.PersistentVolume{}, func() { processed = true })
+	if !processed {
+		t.Errorf("Expected event to be processed inline")
+	}
+
+	// Events of an object are processed in order
+	events = newEventQueue(4)
+	pv := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv-1"}}
+	var mutex sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		i := i
+		events.dispatch(pv, func() {
+			defer wg.Done()
+			mutex.Lock()
+			order = append(order, i)
+			mutex.Unlock()
+		})
+	}
+	wg.Wait()
+	for i, event := range order {
+		if event != i {
+			t.Fatalf("Expected events to be processed in order, got %v", order)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package e2e
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/kubernetes/test/e2e/framework"
+	"k8s.io/kubernetes/test/e2e/storage/utils"
+)
+
+/*
+	Test to verify a controller failover during a CreateVolume storm neither
+	orphans nor duplicates volumes.
+
+	Steps
+		1. Create storage class for dynamic volume provisioning using CSI driver.
+		2. Create PVCs using above storage class. (CreateVolume storm)
+		3. Wait until the first PVC is bound, then delete the vsphere-csi-controller pod.
+		4. Wait until all PVs and PVCs get bound.
+		5. Verify each PV is backed by exactly one CNS volume named after it.
+		6. Delete all PVCs.
+		7. Verify no CNS volume named after the PVs and no FCD of the PVs is left behind.
+		8. Delete storage class.
+*/
+
+var _ = utils.SIGDescribe("[csi-block-e2e] Controller Failover During Volume Operations Storm", func() {
+	f := framework.NewDefaultFramework("controller-failover-storm")
+	const defaultVolumeOpsScale = 30
+	var (
+		client            clientset.Interface
+		namespace         string
+		storageclass      *storage.StorageClass
+		pvclaims          []*v1.PersistentVolumeClaim
+		persistentvolumes []*v1.PersistentVolume
+		err               error
+		volumeOpsScale    int
+	)
+	ginkgo.BeforeEach(func() {
+		client = f.ClientSet
+		namespace = f.Namespace.Name
+		nodeList := framework.GetReadySchedulableNodesOrDie(f.ClientSet)
+		if !(len(nodeList.Items) > 0) {
+			framework.Failf("Unable to find ready and schedulable Node")
+		}
+		bootstrap()
+		if os.Getenv(envVolumeOperationsScale) != "" {
+			volumeOpsScale, err = strconv.Atoi(os.Getenv(envVolumeOperationsScale))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		} else {
+			volumeOpsScale = defaultVolumeOpsScale
+		}
+		pvclaims = make([]*v1.PersistentVolumeClaim, volumeOpsScale)
+	})
+
+	ginkgo.It("Verify all PVCs bind to exactly one CNS volume when the controller fails over mid-storm", func() {
+		ginkgo.By(fmt.Sprintf("Running test with VOLUME_OPS_SCALE: %v", volumeOpsScale))
+		ginkgo.By("Creating Storage Class")
+		storageclass, err = client.StorageV1().StorageClasses().Create(getVSphereStorageClassSpec("", nil, nil, "", ""))
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		defer client.StorageV1().StorageClasses().Delete(storageclass.Name, nil)
+
+		ginkgo.By("Creating PVCs using the Storage Class")
+		for count := 0; count < volumeOpsScale; count++ {
+			pvclaims[count], err = framework.CreatePVC(client, namespace, getPersistentVolumeClaimSpecWithStorageClass(namespace, diskSize, storageclass, nil))
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		}
+
+		// The controller is deleted as soon as the first claim is bound, while
+		// the remaining claims are still being provisioned.
+		ginkgo.By("Waiting for the first claim to be in bound state")
+		err = wait.Poll(poll, framework.ClaimProvisionTimeout, func() (bool, error) {
+			claims, err := client.CoreV1().PersistentVolumeClaims(namespace).List(metav1.ListOptions{})
+			if err != nil {
+				return false, err
+			}
+			for _, claim := range claims.Items {
+				if claim.Status.Phase == v1.ClaimBound {
+					return true, nil
+				}
+			}
+			return false, nil
+		})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+		ginkgo.By("Deleting the vsphere-csi-controller pod while the storm is in progress")
+		pods, err := client.CoreV1().Pods(kubeSystemNamespace).List(metav1.ListOptions{})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		for _, pod := range pods.Items {
+			if strings.HasPrefix(pod.Name, vSphereCSIControllerPodNamePrefix) {
+				err = client.CoreV1().Pods(kubeSystemNamespace).Delete(pod.Name, metav1.NewDeleteOptions(0))
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			}
+		}
+
+		ginkgo.By("Waiting for all claims to be in bound state")
+		persistentvolumes, err = framework.WaitForPVClaimBoundPhase(client, pvclaims, framework.ClaimProvisionTimeout+k8sPodTerminationTimeOut)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+		ginkgo.By("Verifying each PV is backed by exactly one CNS volume")
+		volumeDatastoreURLs := make(map[string]string)
+		for _, pv := range persistentvolumes {
+			volumes, err := e2eVSphere.getCNSVolumesByName(pv.Name)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(volumes).To(gomega.HaveLen(1),
+				fmt.Sprintf("Expected one CNS volume named %q, found %d", pv.Name, len(volumes)))
+			gomega.Expect(volumes[0].VolumeId.Id).To(gomega.Equal(pv.Spec.CSI.VolumeHandle))
+			volumeDatastoreURLs[pv.Spec.CSI.VolumeHandle] = volumes[0].DatastoreUrl
+		}
+
+		ginkgo.By("Deleting PVCs")
+		for _, claim := range pvclaims {
+			err = framework.DeletePersistentVolumeClaim(client, claim.Name, namespace)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		}
+		ginkgo.By("Verifying no CNS volume is left behind")
+		for _, pv := range persistentvolumes {
+			framework.ExpectNoError(framework.WaitForPersistentVolumeDeleted(client, pv.Name, framework.Poll, framework.PodDeleteTimeout))
+			err = e2eVSphere.waitForCNSVolumeToBeDeleted(pv.Spec.CSI.VolumeHandle)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			volumes, err := e2eVSphere.getCNSVolumesByName(pv.Name)
+			gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			gomega.Expect(volumes).To(gomega.BeEmpty(),
+				fmt.Sprintf("Found %d leaked CNS volumes named %q", len(volumes), pv.Name))
+		}
+		ginkgo.By("Verifying no FCD of the deleted volumes is left behind on the datastores")
+		fcdIDsByDatastoreURL := make(map[string]map[string]bool)
+		for volumeHandle, datastoreURL := range volumeDatastoreURLs {
+			if _, ok := fcdIDsByDatastoreURL[datastoreURL]; !ok {
+				fcdIDs, err := e2eVSphere.listFCDsOnDatastore(datastoreURL)
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+				fcdIDsByDatastoreURL[datastoreURL] = make(map[string]bool)
+				for _, fcdID := range fcdIDs {
+					fcdIDsByDatastoreURL[datastoreURL][fcdID] = true
+				}
+			}
+			gomega.Expect(fcdIDsByDatastoreURL[datastoreURL][volumeHandle]).To(gomega.BeFalse(),
+				fmt.Sprintf("Found leaked FCD %q on datastore %q", volumeHandle, datastoreURL))
+		}
+	})
+})
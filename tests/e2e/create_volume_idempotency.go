@@ -0,0 +1,87 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package e2e
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/kubernetes/test/e2e/framework"
+)
+
+/*
+	Test to verify CreateVolume retried after a controller crash does not create duplicate volumes
+
+	Steps
+	1. Create StorageClass.
+	2. Create PVC which uses the StorageClass created in step 1.
+	3. Delete the vsphere-csi-controller pod while the volume is being provisioned.
+	4. Wait for PVC to be in Bound phase.
+	5. Query CNS for volumes named after the PV and verify exactly one volume exists.
+	6. Delete PVC and StorageClass.
+*/
+
+var _ = ginkgo.Describe("[csi-block-e2e] CreateVolume Idempotency", func() {
+	f := framework.NewDefaultFramework("e2e-vsphere-create-volume-idempotency")
+	var (
+		client    clientset.Interface
+		namespace string
+	)
+	ginkgo.BeforeEach(func() {
+		client = f.ClientSet
+		namespace = f.Namespace.Name
+		bootstrap()
+		nodeList := framework.GetReadySchedulableNodesOrDie(f.ClientSet)
+		if !(len(nodeList.Items) > 0) {
+			framework.Failf("Unable to find ready and schedulable Node")
+		}
+	})
+
+	ginkgo.It("Verify no duplicate volume is created when the controller restarts during provisioning", func() {
+		storageclass, pvclaim, err := createPVCAndStorageClass(client, namespace, nil, nil, "", nil, "")
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		defer client.StorageV1().StorageClasses().Delete(storageclass.Name, nil)
+		defer framework.DeletePersistentVolumeClaim(client, pvclaim.Name, namespace)
+
+		ginkgo.By("Deleting the vsphere-csi-controller pod while the volume is being provisioned")
+		pods, err := client.CoreV1().Pods(kubeSystemNamespace).List(metav1.ListOptions{})
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		for _, pod := range pods.Items {
+			if strings.HasPrefix(pod.Name, vSphereCSIControllerPodNamePrefix) {
+				err = client.CoreV1().Pods(kubeSystemNamespace).Delete(pod.Name, metav1.NewDeleteOptions(0))
+				gomega.Expect(err).NotTo(gomega.HaveOccurred())
+			}
+		}
+
+		ginkgo.By("Waiting for claim to be in bound phase")
+		err = framework.WaitForPersistentVolumeClaimPhase(v1.ClaimBound, client, pvclaim.Namespace, pvclaim.Name, framework.Poll, k8sPodTerminationTimeOut)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+		ginkgo.By("Verifying exactly one volume was created in CNS")
+		pv := getPvFromClaim(client, pvclaim.Namespace, pvclaim.Name)
+		volumes, err := e2eVSphere.getCNSVolumesByName(pv.Name)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(volumes).To(gomega.HaveLen(1),
+			fmt.Sprintf("Expected one CNS volume named %q, found %d", pv.Name, len(volumes)))
+		gomega.Expect(volumes[0].VolumeId.Id).To(gomega.Equal(pv.Spec.CSI.VolumeHandle))
+	})
+})
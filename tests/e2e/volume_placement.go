@@ -0,0 +1,80 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package e2e
+
+import (
+	"fmt"
+
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/kubernetes/test/e2e/framework"
+)
+
+/*
+	Test to verify volumes are placed on the datastore selected through the StorageClass
+
+	Steps
+	1. Create StorageClass with shared datastore URL.
+	2. Create PVC which uses the StorageClass created in step 1.
+	3. Wait for PVC to be in Bound phase.
+	4. Query CNS for the datastore hosting the volume and verify it is the datastore
+	   specified in the StorageClass.
+	5. Delete PVC and StorageClass.
+
+	This test reads env
+	1. SHARED_VSPHERE_DATASTORE_URL (set to shared datastore URL)
+*/
+
+var _ = ginkgo.Describe("[csi-block-e2e] Volume Placement", func() {
+	f := framework.NewDefaultFramework("e2e-vsphere-volume-placement")
+	var (
+		client    clientset.Interface
+		namespace string
+	)
+	ginkgo.BeforeEach(func() {
+		client = f.ClientSet
+		namespace = f.Namespace.Name
+		bootstrap()
+		nodeList := framework.GetReadySchedulableNodesOrDie(f.ClientSet)
+		if !(len(nodeList.Items) > 0) {
+			framework.Failf("Unable to find ready and schedulable Node")
+		}
+	})
+
+	ginkgo.It("Verify volume is placed on the datastore specified in the storage class", func() {
+		sharedDatastoreURL := GetAndExpectStringEnvVar(envSharedDatastoreURL)
+		scParameters := make(map[string]string)
+		scParameters[scParamDatastoreURL] = sharedDatastoreURL
+		storageclass, pvclaim, err := createPVCAndStorageClass(client, namespace, nil, scParameters, "", nil, "")
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		defer client.StorageV1().StorageClasses().Delete(storageclass.Name, nil)
+		defer framework.DeletePersistentVolumeClaim(client, pvclaim.Name, namespace)
+
+		ginkgo.By("Waiting for claim to be in bound phase")
+		err = framework.WaitForPersistentVolumeClaimPhase(v1.ClaimBound, client, pvclaim.Namespace, pvclaim.Name, framework.Poll, framework.ClaimProvisionTimeout)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+
+		ginkgo.By("Verifying volume is placed on the datastore specified in the storage class")
+		pv := getPvFromClaim(client, pvclaim.Namespace, pvclaim.Name)
+		datastoreURL, err := e2eVSphere.getDatastoreForVolume(pv.Spec.CSI.VolumeHandle)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		gomega.Expect(datastoreURL).To(gomega.Equal(sharedDatastoreURL),
+			fmt.Sprintf("Volume %q is placed on datastore %q instead of %q", pv.Spec.CSI.VolumeHandle, datastoreURL, sharedDatastoreURL))
+	})
+})
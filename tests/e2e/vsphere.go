@@ -363,3 +363,78 @@ func (vs *vSphere) deleteFCD(ctx context.Context, fcdID string, dsRef types.Mana
 	}
 	return nil
 }
+
+// getDatastoreForVolume executes QueryVolume API on vCenter for requested volumeHandle
+// and returns the URL of the datastore hosting the volume
+func (vs *vSphere) getDatastoreForVolume(volumeHandle string) (string, error) {
+	queryResult, err := vs.queryCNSVolumeWithResult(volumeHandle)
+	if err != nil {
+		return "", err
+	}
+	if len(queryResult.Volumes) != 1 || queryResult.Volumes[0].VolumeId.Id != volumeHandle {
+		return "", fmt.Errorf("Failed to query cns volume %s", volumeHandle)
+	}
+	e2elog.Logf("Volume: %s is placed on datastore: %s", volumeHandle, queryResult.Volumes[0].DatastoreUrl)
+	return queryResult.Volumes[0].DatastoreUrl, nil
+}
+
+// getCNSVolumesByName executes QueryVolume API on vCenter for the requested
+// volume name and returns the volumes carrying that name
+func (vs *vSphere) getCNSVolumesByName(volumeName string) ([]cnstypes.CnsVolume, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Connect to VC
+	connect(ctx, vs)
+	err := connectCns(ctx, vs)
+	if err != nil {
+		return nil, err
+	}
+	req := cnstypes.CnsQueryVolume{
+		This: cnsVolumeManagerInstance,
+		Filter: cnstypes.CnsQueryFilter{
+			Names: []string{volumeName},
+		},
+	}
+	res, err := cnsmethods.CnsQueryVolume(ctx, vs.CnsClient.Client, &req)
+	if err != nil {
+		return nil, err
+	}
+	var volumes []cnstypes.CnsVolume
+	for _, volume := range res.Returnval.Volumes {
+		if volume.Name == volumeName {
+			volumes = append(volumes, volume)
+		}
+	}
+	return volumes, nil
+}
+
+// listFCDsOnDatastore executes ListVStorageObject API on vCenter for the
+// datastore with the requested URL and returns the IDs of the FCDs it hosts
+func (vs *vSphere) listFCDsOnDatastore(datastoreURL string) ([]string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	datacenters, err := vs.getAllDatacenters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, dc := range datacenters {
+		datastore, err := getDatastoreByURL(ctx, datastoreURL, dc)
+		if err != nil {
+			continue
+		}
+		req := types.ListVStorageObject{
+			This:      *vs.Client.Client.ServiceContent.VStorageObjectManager,
+			Datastore: datastore.Reference(),
+		}
+		res, err := methods.ListVStorageObject(ctx, vs.Client.Client, &req)
+		if err != nil {
+			return nil, err
+		}
+		var fcdIDs []string
+		for _, id := range res.Returnval {
+			fcdIDs = append(fcdIDs, id.Id)
+		}
+		return fcdIDs, nil
+	}
+	return nil, fmt.Errorf("Couldn't find Datastore given URL %q", datastoreURL)
+}